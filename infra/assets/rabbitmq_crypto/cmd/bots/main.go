@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/config"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/metrics"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/usecase"
+)
+
+func main() {
+	seed := flag.Int64("seed", 0, "random seed for a reproducible run (0 picks one at random)")
+	cfg := config.FromCommandLine("bots")
+	stopTracing, err := cfg.SetupTracing(context.Background(), "bots")
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer stopTracing()
+
+	broker, err := cfg.Open()
+	if err != nil {
+		log.Fatalf("Failed to setup broker: %v", err)
+	}
+	defer broker.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if addr := cfg.MetricsAddr("bots"); addr != "" {
+		go func() {
+			log.Printf("Metrics listening on %s: /metrics, /healthz, /readyz", addr)
+			if err := metrics.New(broker).Serve(ctx, addr); err != nil {
+				log.Printf("Metrics error, shutting down: %v", err)
+				stop()
+			}
+		}()
+	}
+
+	opts := []usecase.BotsOption{usecase.WithBotCount(cfg.Bots.Count)}
+	if *seed != 0 {
+		opts = append(opts, usecase.WithBotSeed(*seed))
+	}
+	bots := usecase.NewTradingBots(broker.OrderPublisher(), opts...)
+
+	log.Printf("%d bots trading (orders.<symbol>.<target>)... (Ctrl+C to stop)", cfg.Bots.Count)
+	if err := bots.Run(ctx, cfg.Bots.Interval.Duration); err != nil && err != context.Canceled {
+		log.Printf("Bots error: %v", err)
+		return
+	}
+	log.Println("Bots stopped.")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/config"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/codec"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/metrics"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/usecase"
+)
+
+// shutdownTimeout bounds how long in-flight trades may take to drain and
+// open candles may take to publish after SIGTERM.
+const shutdownTimeout = 10 * time.Second
+
+func main() {
+	cfg := config.FromCommandLine("candles")
+	stopTracing, err := cfg.SetupTracing(context.Background(), "candles")
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer stopTracing()
+	broker, err := cfg.Open()
+	if err != nil {
+		log.Fatalf("Failed to setup broker: %v", err)
+	}
+	defer broker.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	exporter := metrics.New(broker)
+	if addr := cfg.MetricsAddr("candles"); addr != "" {
+		go func() {
+			log.Printf("Metrics listening on %s: /metrics, /healthz, /readyz", addr)
+			if err := exporter.Serve(ctx, addr); err != nil {
+				log.Printf("Metrics error, shutting down: %v", err)
+				stop()
+			}
+		}()
+	}
+
+	agg := usecase.NewCandleAggregator(broker.CandlePublisher(),
+		usecase.WithIntervals(cfg.CandleIntervals()...),
+		usecase.WithAllowedLateness(cfg.Candles.Lateness.Duration))
+	obs := usecase.NewTradeObserver(broker.Subscriber(), usecase.WithObserverMetrics(exporter))
+
+	binding := cfg.Binding("candles")
+	log.Printf("Candles starting (%s -> candles.<symbol>.<target>.<interval>)...", binding)
+	subscription, err := obs.Start(ctx, binding, agg.Observe, domain.WithWorkers(4))
+	if err != nil {
+		log.Fatalf("Observer error: %v", err)
+	}
+	if cfg.Broker.Type == config.BrokerMemory {
+		// Nothing outside this process reaches an in-process broker, so
+		// simulate the market here.
+		go usecase.NewMarketSimulator(broker.Publisher(codec.JSON)).Run(ctx, cfg.Ticker.Interval.Duration)
+	}
+
+	if err := agg.Run(ctx); err != nil && err != context.Canceled {
+		log.Printf("Candle publishing failed: %v", err)
+		stop()
+	}
+
+	log.Println("Candles stopping, publishing open candles...")
+	shutdown, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := subscription.Stop(shutdown); err != nil {
+		log.Printf("Shutdown incomplete: %v", err)
+	}
+	if err := agg.Flush(shutdown); err != nil {
+		log.Printf("Failed to publish open candles: %v", err)
+	}
+	log.Println("Candles stopped.")
+}
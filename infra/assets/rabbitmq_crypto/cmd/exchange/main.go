@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/config"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/codec"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/metrics"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/usecase"
+)
+
+// shutdownTimeout bounds how long in-flight orders may take to match and
+// publish their trades after SIGTERM.
+const shutdownTimeout = 10 * time.Second
+
+func main() {
+	format := flag.String("codec", "json", "wire format of the published trades: json, protobuf or msgpack")
+	cfg := config.FromCommandLine("exchange")
+	stopTracing, err := cfg.SetupTracing(context.Background(), "exchange")
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer stopTracing()
+
+	c, err := codec.ByName(*format)
+	if err != nil {
+		log.Fatalf("Invalid codec: %v", err)
+	}
+
+	broker, err := cfg.Open()
+	if err != nil {
+		log.Fatalf("Failed to setup broker: %v", err)
+	}
+	defer broker.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	exporter := metrics.New(broker)
+	if addr := cfg.MetricsAddr("exchange"); addr != "" {
+		go func() {
+			log.Printf("Metrics listening on %s: /metrics, /healthz, /readyz", addr)
+			if err := exporter.Serve(ctx, addr); err != nil {
+				log.Printf("Metrics error, shutting down: %v", err)
+				stop()
+			}
+		}()
+	}
+
+	engine := usecase.NewMatchingEngine(broker.Publisher(c),
+		usecase.WithEngineMetrics(exporter),
+		usecase.WithEngineDeliveryReport(func(trade domain.Trade, err error) {
+			switch {
+			case errors.Is(err, domain.ErrTradeUnroutable):
+				log.Printf("No consumer for %s/%s, trade %s dropped", trade.Symbol, trade.TargetCurrency, trade.ID)
+			case err != nil:
+				log.Printf("Trade %s not delivered: %v", trade.ID, err)
+			}
+		}))
+
+	binding := cfg.Binding("exchange")
+	log.Printf("Exchange starting (%s -> market.<symbol>.<target>)...", binding)
+	// Orders are not retried: a redelivered order would match again.
+	subscription, err := engine.Start(ctx, broker.OrderSubscriber(), binding, domain.WithWorkers(4))
+	if err != nil {
+		log.Fatalf("Order entry error: %v", err)
+	}
+	if cfg.Broker.Type == config.BrokerMemory {
+		// Nothing outside this process reaches an in-process broker, so
+		// let the bots trade here.
+		go usecase.NewTradingBots(broker.OrderPublisher(), usecase.WithBotCount(cfg.Bots.Count)).Run(ctx, cfg.Bots.Interval.Duration)
+	}
+
+	<-ctx.Done()
+	log.Println("Exchange stopping, matching in-flight orders...")
+	shutdown, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := subscription.Stop(shutdown); err != nil {
+		log.Printf("Shutdown incomplete: %v", err)
+	}
+	log.Println("Exchange stopped.")
+}
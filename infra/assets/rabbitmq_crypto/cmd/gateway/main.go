@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/config"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/codec"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/gateway"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/metrics"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/usecase"
+)
+
+// shutdownTimeout bounds how long open streams may take to close.
+const shutdownTimeout = 5 * time.Second
+
+func main() {
+	cfg := config.FromCommandLine("gateway")
+	stopTracing, err := cfg.SetupTracing(context.Background(), "gateway")
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer stopTracing()
+	broker, err := cfg.Open()
+	if err != nil {
+		log.Fatalf("Failed to setup broker: %v", err)
+	}
+	defer broker.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	exporter := metrics.New(broker)
+	if addr := cfg.MetricsAddr("gateway"); addr != "" {
+		go func() {
+			log.Printf("Metrics listening on %s: /metrics, /healthz, /readyz", addr)
+			if err := exporter.Serve(ctx, addr); err != nil {
+				log.Printf("Metrics error, shutting down: %v", err)
+				stop()
+			}
+		}()
+	}
+
+	// One subscription feeds every client; each client filters it with its
+	// own topic pattern.
+	hub := usecase.NewTradeBroadcaster(usecase.WithClientBuffer(cfg.Gateway.ClientBuffer))
+	obs := usecase.NewTradeObserver(broker.Subscriber(), usecase.WithObserverMetrics(exporter))
+	binding := cfg.Binding("gateway")
+	subscription, err := obs.Start(ctx, binding, func(trade domain.Trade) error {
+		return hub.Publish(ctx, trade)
+	})
+	if err != nil {
+		log.Fatalf("Observer error: %v", err)
+	}
+	if cfg.Broker.Type == config.BrokerMemory {
+		// Nothing outside this process reaches an in-process broker, so
+		// simulate the market here.
+		go usecase.NewMarketSimulator(broker.Publisher(codec.JSON)).Run(ctx, cfg.Ticker.Interval.Duration)
+	}
+
+	srv := &http.Server{
+		Addr: cfg.ListenAddr("gateway"),
+		Handler: gateway.New(hub,
+			gateway.WithWriteTimeout(cfg.Gateway.WriteTimeout.Duration),
+			gateway.WithAllowedOrigins(cfg.Gateway.AllowedOrigins...)),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		log.Printf("Gateway listening on %s (%s): /ws and /sse?topic=<pattern>", srv.Addr, binding)
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Gateway error: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Gateway stopping...")
+	// Ending the streams lets their handlers return, so Shutdown does not
+	// wait for clients that would otherwise stay connected.
+	hub.Close()
+	shutdown, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdown); err != nil {
+		log.Printf("Shutdown incomplete: %v", err)
+	}
+	if err := subscription.Stop(shutdown); err != nil {
+		log.Printf("Subscription error: %v", err)
+	}
+	log.Println("Gateway stopped.")
+}
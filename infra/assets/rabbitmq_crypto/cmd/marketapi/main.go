@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/config"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/codec"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/marketapi"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/metrics"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/usecase"
+)
+
+// shutdownTimeout bounds how long in-flight requests may take to finish.
+const shutdownTimeout = 5 * time.Second
+
+func main() {
+	cfg := config.FromCommandLine("marketapi")
+	stopTracing, err := cfg.SetupTracing(context.Background(), "marketapi")
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer stopTracing()
+	broker, err := cfg.Open()
+	if err != nil {
+		log.Fatalf("Failed to setup broker: %v", err)
+	}
+	defer broker.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	exporter := metrics.New(broker)
+	if addr := cfg.MetricsAddr("marketapi"); addr != "" {
+		go func() {
+			log.Printf("Metrics listening on %s: /metrics, /healthz, /readyz", addr)
+			if err := exporter.Serve(ctx, addr); err != nil {
+				log.Printf("Metrics error, shutting down: %v", err)
+				stop()
+			}
+		}()
+	}
+
+	// The book starts empty and fills as trades arrive; a restart forgets
+	// prices until each pair trades again.
+	book := usecase.NewPriceBook(usecase.WithRecentTrades(cfg.MarketAPI.RecentTrades))
+	obs := usecase.NewTradeObserver(broker.Subscriber(), usecase.WithObserverMetrics(exporter))
+	binding := cfg.Binding("marketapi")
+	subscription, err := obs.Start(ctx, binding, book.Observe)
+	if err != nil {
+		log.Fatalf("Observer error: %v", err)
+	}
+	if cfg.Broker.Type == config.BrokerMemory {
+		// Nothing outside this process reaches an in-process broker, so
+		// simulate the market here.
+		go usecase.NewMarketSimulator(broker.Publisher(codec.JSON)).Run(ctx, cfg.Ticker.Interval.Duration)
+	}
+
+	srv := &http.Server{
+		Addr:              cfg.ListenAddr("marketapi"),
+		Handler:           marketapi.New(book),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		log.Printf("Market API listening on %s (%s): /prices, /prices/{symbol}/{target}, /trades", srv.Addr, binding)
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Market API error: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Market API stopping...")
+	shutdown, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdown); err != nil {
+		log.Printf("Shutdown incomplete: %v", err)
+	}
+	if err := subscription.Stop(shutdown); err != nil {
+		log.Printf("Subscription error: %v", err)
+	}
+	log.Println("Market API stopped.")
+}
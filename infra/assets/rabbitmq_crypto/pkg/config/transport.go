@@ -0,0 +1,207 @@
+package config
+
+import (
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/broker"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/codec"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/kafkabroker"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/memory"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/natsbroker"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/rabbitmq"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/redisbroker"
+)
+
+// Transport is the broker the commands publish to and subscribe from.
+type Transport interface {
+	// Publisher publishes trades encoded with c, where the broker encodes
+	// them at all, and reports trades no queue receives where the broker
+	// can tell.
+	Publisher(c codec.Codec) domain.AsyncTradePublisher
+	CandlePublisher() domain.CandlePublisher
+	AlertPublisher() domain.AlertNotifier
+	Subscriber() domain.TradeSubscriber
+	// OrderPublisher and OrderSubscriber carry orders on the trade
+	// exchange, under orders.<symbol>.<target>.
+	OrderPublisher() domain.OrderPublisher
+	OrderSubscriber() domain.OrderSubscriber
+	// Exchange names the trade exchange; durable queues are named after it.
+	Exchange() string
+	DeadLetterExchange() string
+	// Connected reports whether the broker can be reached right now.
+	Connected() bool
+	Close() error
+}
+
+// Open sets up the broker selected by Broker.Type. An in-process broker
+// only connects the publishers and subscribers of this process.
+func (c Config) Open() (Transport, error) {
+	switch c.Broker.Type {
+	case BrokerMemory:
+		return memoryTransport{memory.NewBroker(memory.WithExchange(c.Broker.Exchange))}, nil
+	case BrokerNATS:
+		conn, err := natsbroker.Connect(c.Broker.URL, natsbroker.WithExchange(c.Broker.Exchange))
+		if err != nil {
+			return nil, err
+		}
+		return natsTransport{conn}, nil
+	case BrokerRedis:
+		conn, err := redisbroker.Connect(c.Broker.URL, redisbroker.WithExchange(c.Broker.Exchange))
+		if err != nil {
+			return nil, err
+		}
+		return redisTransport{conn}, nil
+	case BrokerKafka:
+		conn, err := kafkabroker.Connect(c.Broker.URL, kafkabroker.WithExchange(c.Broker.Exchange))
+		if err != nil {
+			return nil, err
+		}
+		return kafkaTransport{conn}, nil
+	}
+	conn, err := c.Connect()
+	if err != nil {
+		return nil, err
+	}
+	return rabbitTransport{conn}, nil
+}
+
+type rabbitTransport struct {
+	*rabbitmq.Connection
+}
+
+func (t rabbitTransport) Publisher(c codec.Codec) domain.AsyncTradePublisher {
+	return rabbitmq.NewConfirmingPublisher(t.Connection, broker.WithCodec(c))
+}
+
+func (t rabbitTransport) CandlePublisher() domain.CandlePublisher {
+	return rabbitmq.NewCandlePublisher(t.Connection)
+}
+
+func (t rabbitTransport) AlertPublisher() domain.AlertNotifier {
+	return rabbitmq.NewAlertPublisher(t.Connection)
+}
+
+func (t rabbitTransport) Subscriber() domain.TradeSubscriber {
+	return rabbitmq.NewSubscriber(t.Connection)
+}
+
+func (t rabbitTransport) OrderPublisher() domain.OrderPublisher {
+	return rabbitmq.NewOrderPublisher(t.Connection)
+}
+
+func (t rabbitTransport) OrderSubscriber() domain.OrderSubscriber {
+	return rabbitmq.NewOrderSubscriber(t.Connection)
+}
+
+type memoryTransport struct {
+	*memory.Broker
+}
+
+// Publisher ignores c: trades never leave the process, so they are passed
+// as they are.
+func (t memoryTransport) Publisher(c codec.Codec) domain.AsyncTradePublisher {
+	return memory.NewPublisher(t.Broker)
+}
+
+func (t memoryTransport) CandlePublisher() domain.CandlePublisher {
+	return memory.NewCandlePublisher(t.Broker)
+}
+
+func (t memoryTransport) AlertPublisher() domain.AlertNotifier {
+	return memory.NewAlertPublisher(t.Broker)
+}
+
+func (t memoryTransport) Subscriber() domain.TradeSubscriber {
+	return memory.NewSubscriber(t.Broker)
+}
+
+func (t memoryTransport) OrderPublisher() domain.OrderPublisher {
+	return memory.NewOrderPublisher(t.Broker)
+}
+
+func (t memoryTransport) OrderSubscriber() domain.OrderSubscriber {
+	return memory.NewOrderSubscriber(t.Broker)
+}
+
+type natsTransport struct {
+	*natsbroker.Conn
+}
+
+func (t natsTransport) Publisher(c codec.Codec) domain.AsyncTradePublisher {
+	return natsbroker.NewPublisher(t.Conn, broker.WithCodec(c))
+}
+
+func (t natsTransport) CandlePublisher() domain.CandlePublisher {
+	return natsbroker.NewCandlePublisher(t.Conn)
+}
+
+func (t natsTransport) AlertPublisher() domain.AlertNotifier {
+	return natsbroker.NewAlertPublisher(t.Conn)
+}
+
+func (t natsTransport) Subscriber() domain.TradeSubscriber {
+	return natsbroker.NewSubscriber(t.Conn)
+}
+
+func (t natsTransport) OrderPublisher() domain.OrderPublisher {
+	return natsbroker.NewOrderPublisher(t.Conn)
+}
+
+func (t natsTransport) OrderSubscriber() domain.OrderSubscriber {
+	return natsbroker.NewOrderSubscriber(t.Conn)
+}
+
+type redisTransport struct {
+	*redisbroker.Conn
+}
+
+func (t redisTransport) Publisher(c codec.Codec) domain.AsyncTradePublisher {
+	return redisbroker.NewPublisher(t.Conn, broker.WithCodec(c))
+}
+
+func (t redisTransport) CandlePublisher() domain.CandlePublisher {
+	return redisbroker.NewCandlePublisher(t.Conn)
+}
+
+func (t redisTransport) AlertPublisher() domain.AlertNotifier {
+	return redisbroker.NewAlertPublisher(t.Conn)
+}
+
+func (t redisTransport) Subscriber() domain.TradeSubscriber {
+	return redisbroker.NewSubscriber(t.Conn)
+}
+
+func (t redisTransport) OrderPublisher() domain.OrderPublisher {
+	return redisbroker.NewOrderPublisher(t.Conn)
+}
+
+func (t redisTransport) OrderSubscriber() domain.OrderSubscriber {
+	return redisbroker.NewOrderSubscriber(t.Conn)
+}
+
+type kafkaTransport struct {
+	*kafkabroker.Conn
+}
+
+func (t kafkaTransport) Publisher(c codec.Codec) domain.AsyncTradePublisher {
+	return kafkabroker.NewPublisher(t.Conn, broker.WithCodec(c))
+}
+
+func (t kafkaTransport) CandlePublisher() domain.CandlePublisher {
+	return kafkabroker.NewCandlePublisher(t.Conn)
+}
+
+func (t kafkaTransport) AlertPublisher() domain.AlertNotifier {
+	return kafkabroker.NewAlertPublisher(t.Conn)
+}
+
+func (t kafkaTransport) Subscriber() domain.TradeSubscriber {
+	return kafkabroker.NewSubscriber(t.Conn)
+}
+
+func (t kafkaTransport) OrderPublisher() domain.OrderPublisher {
+	return kafkabroker.NewOrderPublisher(t.Conn)
+}
+
+func (t kafkaTransport) OrderSubscriber() domain.OrderSubscriber {
+	return kafkabroker.NewOrderSubscriber(t.Conn)
+}
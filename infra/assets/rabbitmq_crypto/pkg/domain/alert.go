@@ -0,0 +1,109 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RuleKind selects the value an AlertRule watches.
+type RuleKind string
+
+const (
+	// RuleAmount watches the amount of each trade.
+	RuleAmount RuleKind = "amount"
+	// RulePrice watches the trade price.
+	RulePrice RuleKind = "price"
+	// RuleNotional watches the value of each trade, price times amount.
+	RuleNotional RuleKind = "notional"
+	// RuleMove watches the percent price change over Window.
+	RuleMove RuleKind = "move"
+	// RuleVelocity watches the number of trades within Window.
+	RuleVelocity RuleKind = "velocity"
+)
+
+// AlertRule raises an alert when the watched value of a symbol and currency
+// reaches Above or falls to Below.
+//
+// Amount and notional rules judge each trade on its own and fire for every
+// matching trade. Price, move and velocity rules describe a state and fire
+// once when it is entered; they fire again only after it was left.
+type AlertRule struct {
+	Name string
+	Kind RuleKind
+	// Symbol and Currency restrict the rule to matching trades; empty or
+	// "*" matches any. The comparison ignores case.
+	Symbol   string
+	Currency string
+	// Above and Below are the thresholds; nil means unbounded. Move rules
+	// are in percent, e.g. -5 for a 5% drop.
+	Above *float64
+	Below *float64
+	// Window is the time span of move and velocity rules.
+	Window time.Duration
+	// Cooldown is the minimum time between two alerts of the rule for the
+	// same symbol and currency.
+	Cooldown time.Duration
+}
+
+// Validate reports whether the rule is complete and consistent.
+func (r AlertRule) Validate() error {
+	var errs []error
+	if r.Name == "" {
+		errs = append(errs, errors.New("name must not be empty"))
+	}
+	switch r.Kind {
+	case RuleAmount, RulePrice, RuleNotional:
+	case RuleMove, RuleVelocity:
+		if r.Window <= 0 {
+			errs = append(errs, fmt.Errorf("%s rule needs a positive window", r.Kind))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown kind %q", r.Kind))
+	}
+	if r.Above == nil && r.Below == nil {
+		errs = append(errs, errors.New("needs above or below"))
+	}
+	if r.Cooldown < 0 {
+		errs = append(errs, errors.New("cooldown must not be negative"))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("rule %q: %w", r.Name, err)
+	}
+	return nil
+}
+
+// Matches reports whether the rule applies to the trade's symbol and currency.
+func (r AlertRule) Matches(trade Trade) bool {
+	return matchesField(r.Symbol, trade.Symbol) && matchesField(r.Currency, trade.TargetCurrency)
+}
+
+func matchesField(pattern, value string) bool {
+	return pattern == "" || pattern == "*" || strings.EqualFold(pattern, value)
+}
+
+// Breached returns the threshold that value reached, if any.
+func (r AlertRule) Breached(value float64) (float64, bool) {
+	if r.Above != nil && value >= *r.Above {
+		return *r.Above, true
+	}
+	if r.Below != nil && value <= *r.Below {
+		return *r.Below, true
+	}
+	return 0, false
+}
+
+// Alert is raised when a trade makes an AlertRule fire.
+type Alert struct {
+	Rule           string   `json:"rule"`
+	Kind           RuleKind `json:"kind"`
+	Symbol         string   `json:"symbol"`
+	TargetCurrency string   `json:"target_currency"`
+	// Value is the watched value and Threshold the bound it reached.
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	TradeID   string    `json:"trade_id"`
+	Time      time.Time `json:"time"`
+	Message   string    `json:"message"`
+}
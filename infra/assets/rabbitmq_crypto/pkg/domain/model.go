@@ -4,6 +4,14 @@ import (
 	"time"
 )
 
+// Trade sides. Trades from producers older than schema version 2 carry
+// SideUnknown.
+const (
+	SideBuy     = "buy"
+	SideSell    = "sell"
+	SideUnknown = "unknown"
+)
+
 // Trade represents a crypto transaction event.
 type Trade struct {
 	ID             string    `json:"id"`
@@ -12,4 +20,33 @@ type Trade struct {
 	Price          float64   `json:"price"`
 	Amount         float64   `json:"amount"`
 	Timestamp      time.Time `json:"timestamp"`
+	Side           string    `json:"side,omitempty"`
+}
+
+// Candle is an OHLCV bar summarizing the trades of one symbol and target
+// currency over an interval starting at Start.
+type Candle struct {
+	Symbol         string    `json:"symbol"`
+	TargetCurrency string    `json:"target_currency"`
+	Interval       string    `json:"interval"`
+	Start          time.Time `json:"start"`
+	End            time.Time `json:"end"`
+	Open           float64   `json:"open"`
+	High           float64   `json:"high"`
+	Low            float64   `json:"low"`
+	Close          float64   `json:"close"`
+	Volume         float64   `json:"volume"`
+	Trades         int       `json:"trades"`
+}
+
+// LastPrice is the price of the most recent trade of one symbol and target
+// currency.
+type LastPrice struct {
+	Symbol         string    `json:"symbol"`
+	TargetCurrency string    `json:"target_currency"`
+	Price          float64   `json:"price"`
+	Amount         float64   `json:"amount"`
+	Side           string    `json:"side,omitempty"`
+	TradeID        string    `json:"trade_id"`
+	Timestamp      time.Time `json:"timestamp"`
 }
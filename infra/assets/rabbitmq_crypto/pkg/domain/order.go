@@ -0,0 +1,83 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// OrderType selects how an order book treats an order.
+type OrderType string
+
+const (
+	// OrderLimit rests in the book at Price until it is filled or
+	// cancelled. It fills at Price or better.
+	OrderLimit OrderType = "limit"
+	// OrderMarket fills what it can at the best prices in the book right
+	// away; whatever is left is dropped.
+	OrderMarket OrderType = "market"
+	// OrderCancel removes the resting order with the same ID from the book,
+	// if it has not filled yet.
+	OrderCancel OrderType = "cancel"
+)
+
+var (
+	// ErrInvalidOrder is returned for orders an order book cannot accept.
+	ErrInvalidOrder = errors.New("invalid order")
+	// ErrDuplicateOrder is returned for a limit order whose ID is already
+	// resting in the book.
+	ErrDuplicateOrder = errors.New("duplicate order")
+)
+
+// Order is an instruction to buy or sell Amount of Symbol, priced in
+// TargetCurrency, sent to the order book of that pair.
+type Order struct {
+	ID string `json:"id"`
+	// Trader identifies who placed the order.
+	Trader         string    `json:"trader,omitempty"`
+	Symbol         string    `json:"symbol"`
+	TargetCurrency string    `json:"target_currency"`
+	Type           OrderType `json:"type"`
+	Side           string    `json:"side,omitempty"`
+	// Price is the limit price; market and cancel orders have none.
+	Price     float64   `json:"price,omitempty"`
+	Amount    float64   `json:"amount,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Validate reports whether o is complete for its type.
+func (o Order) Validate() error {
+	var errs []error
+	if o.ID == "" {
+		errs = append(errs, errors.New("id must not be empty"))
+	}
+	if o.Symbol == "" || o.TargetCurrency == "" {
+		errs = append(errs, errors.New("symbol and target currency must not be empty"))
+	}
+	switch o.Type {
+	case OrderCancel:
+	case OrderLimit, OrderMarket:
+		if o.Side != SideBuy && o.Side != SideSell {
+			errs = append(errs, fmt.Errorf("side must be %s or %s, got %q", SideBuy, SideSell, o.Side))
+		}
+		if o.Amount <= 0 {
+			errs = append(errs, errors.New("amount must be positive"))
+		}
+		if o.Type == OrderLimit && o.Price <= 0 {
+			errs = append(errs, errors.New("limit price must be positive"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown type %q", o.Type))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("%w %q: %w", ErrInvalidOrder, o.ID, err)
+	}
+	return nil
+}
+
+// PriceLevel is the amount resting in an order book at one price.
+type PriceLevel struct {
+	Price  float64 `json:"price"`
+	Amount float64 `json:"amount"`
+	Orders int     `json:"orders"`
+}
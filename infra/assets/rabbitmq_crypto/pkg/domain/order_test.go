@@ -0,0 +1,33 @@
+package domain
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOrder_Validate(t *testing.T) {
+	valid := []Order{
+		{ID: "o1", Symbol: "BTC", TargetCurrency: "USD", Type: OrderLimit, Side: SideBuy, Price: 60000, Amount: 0.5},
+		{ID: "o2", Symbol: "BTC", TargetCurrency: "USD", Type: OrderMarket, Side: SideSell, Amount: 1},
+		{ID: "o1", Symbol: "BTC", TargetCurrency: "USD", Type: OrderCancel},
+	}
+	for _, o := range valid {
+		if err := o.Validate(); err != nil {
+			t.Errorf("expected %+v to be valid, got %v", o, err)
+		}
+	}
+
+	invalid := []Order{
+		{Symbol: "BTC", TargetCurrency: "USD", Type: OrderCancel},
+		{ID: "o1", Type: OrderCancel},
+		{ID: "o1", Symbol: "BTC", TargetCurrency: "USD", Type: OrderLimit, Side: SideBuy, Amount: 1},
+		{ID: "o1", Symbol: "BTC", TargetCurrency: "USD", Type: OrderMarket, Side: SideUnknown, Amount: 1},
+		{ID: "o1", Symbol: "BTC", TargetCurrency: "USD", Type: OrderMarket, Side: SideBuy},
+		{ID: "o1", Symbol: "BTC", TargetCurrency: "USD", Type: "stop", Side: SideBuy, Amount: 1},
+	}
+	for _, o := range invalid {
+		if err := o.Validate(); !errors.Is(err, ErrInvalidOrder) {
+			t.Errorf("expected %+v to be rejected, got %v", o, err)
+		}
+	}
+}
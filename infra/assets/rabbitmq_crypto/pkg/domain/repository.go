@@ -1,13 +1,139 @@
 package domain
 
-import "context"
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrTradeUnroutable means the broker accepted a trade but no queue was
+	// bound to receive it.
+	ErrTradeUnroutable = errors.New("trade unroutable")
+	// ErrTradeNotConfirmed means the broker rejected a trade or the
+	// connection was lost before it confirmed receipt.
+	ErrTradeNotConfirmed = errors.New("trade not confirmed")
+)
 
 // TradePublisher defines the interface for publishing trade events.
 type TradePublisher interface {
 	Publish(ctx context.Context, trade Trade) error
 }
 
+// CandlePublisher defines the interface for publishing closed candles.
+type CandlePublisher interface {
+	PublishCandle(ctx context.Context, candle Candle) error
+}
+
+// AlertNotifier delivers alerts, e.g. to a chat channel or by email.
+type AlertNotifier interface {
+	Notify(ctx context.Context, alert Alert) error
+}
+
+// PublishReceipt tracks the delivery outcome of a trade published asynchronously.
+type PublishReceipt interface {
+	// Wait blocks until the broker settled the trade and returns nil,
+	// ErrTradeUnroutable or ErrTradeNotConfirmed (possibly wrapped).
+	Wait(ctx context.Context) error
+}
+
+// AsyncTradePublisher is a TradePublisher that can publish without waiting
+// for the broker to confirm each trade.
+type AsyncTradePublisher interface {
+	TradePublisher
+	PublishAsync(ctx context.Context, trade Trade) (PublishReceipt, error)
+}
+
+// Subscription is a running trade subscription. It ends when the context
+// passed to Subscribe is cancelled or Stop is called.
+type Subscription interface {
+	// Stop stops consuming, waits for in-flight trades to be handled and
+	// settled, and returns the final error. If ctx is done first, the
+	// remaining trades are left to the broker to redeliver and ctx.Err()
+	// is returned.
+	Stop(ctx context.Context) error
+	// Wait blocks until the subscription has ended and returns its final
+	// error, which is nil after a requested stop.
+	Wait() error
+}
+
+// TradeStream is a live feed of trades that ends if its reader falls too
+// far behind.
+type TradeStream interface {
+	// Trades delivers the trades; it is closed when the stream ends.
+	Trades() <-chan Trade
+	// Err tells why the stream ended, or nil if it was closed by its reader.
+	Err() error
+	// Close ends the stream.
+	Close()
+}
+
+// TradeFeed hands out live streams of the trades matching a topic pattern.
+type TradeFeed interface {
+	Listen(pattern TopicPattern) TradeStream
+}
+
+// MarketView answers queries about the current state of the market.
+type MarketView interface {
+	// Prices returns the last price of every pair.
+	Prices() []LastPrice
+	// Price returns the last price of symbol in target.
+	Price(symbol, target string) (LastPrice, bool)
+	// Trades returns recent trades of symbol (any if empty) after since
+	// (any if zero).
+	Trades(symbol string, since time.Time) []Trade
+}
+
+// TradeReader reads previously recorded trades in order. Read returns
+// io.EOF once all trades have been read.
+type TradeReader interface {
+	Read() (Trade, error)
+}
+
+// TradeQuery selects stored trades. Zero fields match every trade.
+type TradeQuery struct {
+	Symbol         string
+	TargetCurrency string
+	// From is inclusive and To exclusive.
+	From time.Time
+	To   time.Time
+	// Limit caps the number of trades returned.
+	Limit int
+}
+
+// TradeRepository stores trades durably.
+type TradeRepository interface {
+	// Save stores trades in one batch. Trades whose ID is already stored
+	// are skipped, so saving a redelivered trade is harmless.
+	Save(ctx context.Context, trades ...Trade) error
+	// Find returns the matching trades, oldest first and ties ordered by ID.
+	Find(ctx context.Context, q TradeQuery) ([]Trade, error)
+}
+
 // TradeSubscriber defines the interface for subscribing to trade events.
 type TradeSubscriber interface {
-	Subscribe(ctx context.Context, routingKey string, handler func(Trade) error) error
+	Subscribe(ctx context.Context, routingKey string, handler func(Trade) error, opts ...SubscribeOption) (Subscription, error)
+}
+
+// TradeMetrics observes trades as they are published and consumed, e.g. to
+// export them to a monitoring system.
+type TradeMetrics interface {
+	// Published records the outcome of publishing a trade; err is nil once
+	// the broker confirmed it.
+	Published(trade Trade, err error)
+	// Consumed records a trade handled by a subscriber: lag is how long
+	// after its timestamp the handler started, took how long the handler
+	// ran and err what it returned.
+	Consumed(trade Trade, lag, took time.Duration, err error)
+}
+
+// OrderPublisher sends orders to the order book of their pair.
+type OrderPublisher interface {
+	PublishOrder(ctx context.Context, order Order) error
+}
+
+// OrderSubscriber delivers the orders sent to an order book. Options apply
+// as for trades; orders of the same symbol always go to the same worker.
+type OrderSubscriber interface {
+	SubscribeOrders(ctx context.Context, routingKey string, handler func(Order) error, opts ...SubscribeOption) (Subscription, error)
 }
@@ -0,0 +1,206 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// MarketTopic is the first segment of every trade routing key.
+	MarketTopic = "market"
+	// CandleTopic is the first segment of every candle routing key.
+	CandleTopic = "candles"
+	// AlertTopic is the first segment of every alert routing key.
+	AlertTopic = "alerts"
+	// OrderTopic is the first segment of every order routing key.
+	OrderTopic = "orders"
+)
+
+// maxRoutingKeyLen is the AMQP short string limit.
+const maxRoutingKeyLen = 255
+
+var (
+	// ErrInvalidRoutingKey is returned for routing keys with illegal segments.
+	ErrInvalidRoutingKey = errors.New("invalid routing key")
+	// ErrInvalidTopicPattern is returned for binding patterns with illegal segments.
+	ErrInvalidTopicPattern = errors.New("invalid topic pattern")
+)
+
+// RoutingKey is a canonical, lowercase, dot-separated topic such as
+// market.btc.usd. Build one with NewRoutingKey or ParseRoutingKey.
+type RoutingKey string
+
+// TopicPattern is a canonical binding pattern in which "*" matches exactly
+// one segment and "#" matches zero or more, e.g. market.*.jpy.
+type TopicPattern string
+
+// NewRoutingKey builds a routing key from its segments, lowercasing them.
+func NewRoutingKey(segments ...string) (RoutingKey, error) {
+	if len(segments) == 0 {
+		return "", fmt.Errorf("%w: no segments", ErrInvalidRoutingKey)
+	}
+	canon := make([]string, len(segments))
+	for i, s := range segments {
+		s = strings.ToLower(s)
+		if !validSegment(s) {
+			return "", fmt.Errorf("%w: illegal segment %q", ErrInvalidRoutingKey, s)
+		}
+		canon[i] = s
+	}
+	key := strings.Join(canon, ".")
+	if len(key) > maxRoutingKeyLen {
+		return "", fmt.Errorf("%w: longer than %d bytes", ErrInvalidRoutingKey, maxRoutingKeyLen)
+	}
+	return RoutingKey(key), nil
+}
+
+// ParseRoutingKey validates and canonicalizes a dot-separated routing key.
+func ParseRoutingKey(s string) (RoutingKey, error) {
+	return NewRoutingKey(strings.Split(s, ".")...)
+}
+
+// TradeRoutingKey returns the routing key a trade is published with:
+// market.<symbol>.<target>.
+func TradeRoutingKey(trade Trade) (RoutingKey, error) {
+	return NewRoutingKey(MarketTopic, trade.Symbol, trade.TargetCurrency)
+}
+
+// ParseTradeRoutingKey extracts the symbol and target currency from a
+// market.<symbol>.<target> routing key.
+func ParseTradeRoutingKey(s string) (symbol, target string, err error) {
+	key, err := ParseRoutingKey(s)
+	if err != nil {
+		return "", "", err
+	}
+	seg := key.Segments()
+	if len(seg) != 3 || seg[0] != MarketTopic {
+		return "", "", fmt.Errorf("%w: %q is not a trade routing key", ErrInvalidRoutingKey, s)
+	}
+	return seg[1], seg[2], nil
+}
+
+// CandleRoutingKey returns the routing key a candle is published with:
+// candles.<symbol>.<target>.<interval>.
+func CandleRoutingKey(c Candle) (RoutingKey, error) {
+	return NewRoutingKey(CandleTopic, c.Symbol, c.TargetCurrency, c.Interval)
+}
+
+// AlertRoutingKey returns the routing key an alert is published with:
+// alerts.<symbol>.<target>.
+func AlertRoutingKey(a Alert) (RoutingKey, error) {
+	return NewRoutingKey(AlertTopic, a.Symbol, a.TargetCurrency)
+}
+
+// OrderRoutingKey returns the routing key an order is sent with:
+// orders.<symbol>.<target>.
+func OrderRoutingKey(o Order) (RoutingKey, error) {
+	return NewRoutingKey(OrderTopic, o.Symbol, o.TargetCurrency)
+}
+
+// IntervalName returns the short name of a candle interval used in routing
+// keys, e.g. "1s", "1m", "5m" or "1h".
+func IntervalName(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	case d%time.Second == 0:
+		return fmt.Sprintf("%ds", d/time.Second)
+	default:
+		return fmt.Sprintf("%dms", d/time.Millisecond)
+	}
+}
+
+// Segments returns the dot-separated parts of the key.
+func (k RoutingKey) Segments() []string {
+	return strings.Split(string(k), ".")
+}
+
+func (k RoutingKey) String() string {
+	return string(k)
+}
+
+// NewTopicPattern builds a binding pattern from its segments, lowercasing
+// them. Segments may be "*" or "#".
+func NewTopicPattern(segments ...string) (TopicPattern, error) {
+	if len(segments) == 0 {
+		return "", fmt.Errorf("%w: no segments", ErrInvalidTopicPattern)
+	}
+	canon := make([]string, len(segments))
+	for i, s := range segments {
+		s = strings.ToLower(s)
+		if s != "*" && s != "#" && !validSegment(s) {
+			return "", fmt.Errorf("%w: illegal segment %q", ErrInvalidTopicPattern, s)
+		}
+		canon[i] = s
+	}
+	p := strings.Join(canon, ".")
+	if len(p) > maxRoutingKeyLen {
+		return "", fmt.Errorf("%w: longer than %d bytes", ErrInvalidTopicPattern, maxRoutingKeyLen)
+	}
+	return TopicPattern(p), nil
+}
+
+// ParseTopicPattern validates and canonicalizes a dot-separated binding pattern.
+func ParseTopicPattern(s string) (TopicPattern, error) {
+	return NewTopicPattern(strings.Split(s, ".")...)
+}
+
+// Matches reports whether key would be routed to a queue bound with p.
+func (p TopicPattern) Matches(key RoutingKey) bool {
+	return matchSegments(strings.Split(string(p), "."), key.Segments())
+}
+
+func (p TopicPattern) String() string {
+	return string(p)
+}
+
+func matchSegments(pattern, key []string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case "#":
+			// Collapse consecutive hashes, then try every possible split.
+			for len(pattern) > 0 && pattern[0] == "#" {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if matchSegments(pattern, key[i:]) {
+					return true
+				}
+			}
+			return false
+		case "*":
+			if len(key) == 0 {
+				return false
+			}
+		default:
+			if len(key) == 0 || key[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, key = pattern[1:], key[1:]
+	}
+	return len(key) == 0
+}
+
+// validSegment reports whether s is a non-empty run of lowercase letters,
+// digits, '-' or '_'.
+func validSegment(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+package domain
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTradeRoutingKey(t *testing.T) {
+	key, err := TradeRoutingKey(Trade{Symbol: "BTC", TargetCurrency: "Usd"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if key != "market.btc.usd" {
+		t.Errorf("expected market.btc.usd, got %s", key)
+	}
+}
+
+func TestCandleRoutingKey(t *testing.T) {
+	key, err := CandleRoutingKey(Candle{Symbol: "ETH", TargetCurrency: "JPY", Interval: IntervalName(5 * time.Minute)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if key != "candles.eth.jpy.5m" {
+		t.Errorf("expected candles.eth.jpy.5m, got %s", key)
+	}
+}
+
+func TestOrderRoutingKey(t *testing.T) {
+	key, err := OrderRoutingKey(Order{Symbol: "SOL", TargetCurrency: "EUR"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if key != "orders.sol.eur" {
+		t.Errorf("expected orders.sol.eur, got %s", key)
+	}
+}
+
+func TestIntervalName(t *testing.T) {
+	cases := map[time.Duration]string{
+		time.Second:            "1s",
+		15 * time.Second:       "15s",
+		time.Minute:            "1m",
+		5 * time.Minute:        "5m",
+		time.Hour:              "1h",
+		250 * time.Millisecond: "250ms",
+	}
+	for d, want := range cases {
+		if got := IntervalName(d); got != want {
+			t.Errorf("IntervalName(%v) = %q, want %q", d, got, want)
+		}
+	}
+}
+
+func TestNewRoutingKey_RejectsIllegalSegments(t *testing.T) {
+	cases := [][]string{
+		{},
+		{"market", "", "usd"},
+		{"market", "b.tc", "usd"},
+		{"market", "*", "usd"},
+		{"market", "#"},
+		{"market", "btc usd"},
+		{"market", "btc/usd"},
+	}
+	for _, segments := range cases {
+		if _, err := NewRoutingKey(segments...); !errors.Is(err, ErrInvalidRoutingKey) {
+			t.Errorf("expected ErrInvalidRoutingKey for %q, got %v", segments, err)
+		}
+	}
+}
+
+func TestParseTradeRoutingKey(t *testing.T) {
+	symbol, target, err := ParseTradeRoutingKey("MARKET.Eth.JPY")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if symbol != "eth" || target != "jpy" {
+		t.Errorf("expected eth/jpy, got %s/%s", symbol, target)
+	}
+
+	for _, s := range []string{"market.btc", "candles.btc.usd", "market.btc.usd.1m", "market..usd"} {
+		if _, _, err := ParseTradeRoutingKey(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
+
+func TestParseTopicPattern(t *testing.T) {
+	p, err := ParseTopicPattern("Market.*.JPY")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p != "market.*.jpy" {
+		t.Errorf("expected market.*.jpy, got %s", p)
+	}
+
+	for _, s := range []string{"", "market..jpy", "market.b*.jpy", "market.#x"} {
+		if _, err := ParseTopicPattern(s); !errors.Is(err, ErrInvalidTopicPattern) {
+			t.Errorf("expected ErrInvalidTopicPattern for %q, got %v", s, err)
+		}
+	}
+}
+
+func TestTopicPattern_Matches(t *testing.T) {
+	cases := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"market.btc.usd", "market.btc.usd", true},
+		{"market.btc.usd", "market.btc.jpy", false},
+		{"market.*.jpy", "market.eth.jpy", true},
+		{"market.*.jpy", "market.eth.usd", false},
+		{"market.*.jpy", "market.jpy", false},
+		{"market.btc.#", "market.btc.usd", true},
+		{"market.btc.#", "market.btc", true},
+		{"market.btc.#", "market.eth.usd", false},
+		{"market.#", "market.btc.usd.1m", true},
+		{"#", "market.btc.usd", true},
+		{"#.usd", "market.btc.usd", true},
+		{"#.usd", "market.btc.jpy", false},
+		{"market.#.usd", "market.usd", true},
+		{"market.#.#.usd", "market.btc.usd", true},
+		{"*.*", "market.btc.usd", false},
+		{"*.#.*", "market.btc", true},
+		{"*.#.*", "market", false},
+	}
+	for _, c := range cases {
+		p, err := ParseTopicPattern(c.pattern)
+		if err != nil {
+			t.Fatalf("invalid pattern %q: %v", c.pattern, err)
+		}
+		k, err := ParseRoutingKey(c.key)
+		if err != nil {
+			t.Fatalf("invalid key %q: %v", c.key, err)
+		}
+		if got := p.Matches(k); got != c.want {
+			t.Errorf("%s matches %s: expected %v, got %v", c.pattern, c.key, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// TradeMessageType identifies trade messages on the wire.
+	TradeMessageType = "trade"
+	// TradeSchemaVersion is the version of the Trade struct produced by this
+	// code. Version 1 had no Side.
+	TradeSchemaVersion = 2
+
+	// CandleMessageType identifies candle messages on the wire.
+	CandleMessageType = "candle"
+	// CandleSchemaVersion is the version of the Candle struct produced by
+	// this code.
+	CandleSchemaVersion = 1
+
+	// AlertMessageType identifies alert messages on the wire.
+	AlertMessageType = "alert"
+	// AlertSchemaVersion is the version of the Alert struct produced by
+	// this code.
+	AlertSchemaVersion = 1
+
+	// OrderMessageType identifies order messages on the wire.
+	OrderMessageType = "order"
+	// OrderSchemaVersion is the version of the Order struct produced by
+	// this code.
+	OrderSchemaVersion = 1
+)
+
+// ErrUnsupportedSchema is returned for messages that cannot be converted to
+// the current schema, e.g. because they come from a newer producer.
+var ErrUnsupportedSchema = errors.New("unsupported schema")
+
+// Envelope is the metadata transported alongside a message payload.
+type Envelope struct {
+	MessageType   string
+	SchemaVersion int
+	ProducerID    string
+	CorrelationID string
+}
+
+// TradeUpcaster converts a trade decoded from one schema version into the
+// next one.
+type TradeUpcaster func(*Trade) error
+
+// TradeUpcasters holds the upcasters needed to bring trades from older
+// schema versions up to TradeSchemaVersion.
+type TradeUpcasters struct {
+	steps map[int]TradeUpcaster
+}
+
+// NewTradeUpcasters creates an empty registry.
+func NewTradeUpcasters() *TradeUpcasters {
+	return &TradeUpcasters{steps: make(map[int]TradeUpcaster)}
+}
+
+// DefaultTradeUpcasters returns the upcasters for every past schema version.
+func DefaultTradeUpcasters() *TradeUpcasters {
+	u := NewTradeUpcasters()
+	u.Register(1, func(t *Trade) error {
+		if t.Side == "" {
+			t.Side = SideUnknown
+		}
+		return nil
+	})
+	return u
+}
+
+// Register sets the upcaster from version from to from+1.
+func (u *TradeUpcasters) Register(from int, fn TradeUpcaster) {
+	u.steps[from] = fn
+}
+
+// Upcast converts t, decoded from the given schema version, to
+// TradeSchemaVersion by applying each registered step in turn.
+func (u *TradeUpcasters) Upcast(version int, t *Trade) error {
+	if version < 1 || version > TradeSchemaVersion {
+		return fmt.Errorf("%w: trade version %d (current %d)", ErrUnsupportedSchema, version, TradeSchemaVersion)
+	}
+	for v := version; v < TradeSchemaVersion; v++ {
+		step, ok := u.steps[v]
+		if !ok {
+			return fmt.Errorf("%w: no upcaster for trade version %d", ErrUnsupportedSchema, v)
+		}
+		if err := step(t); err != nil {
+			return fmt.Errorf("upcasting trade from version %d: %w", v, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package domain
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDefaultTradeUpcasters_V1(t *testing.T) {
+	trade := Trade{ID: "t1", Symbol: "BTC"}
+	if err := DefaultTradeUpcasters().Upcast(1, &trade); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if trade.Side != SideUnknown {
+		t.Errorf("expected side %s, got %q", SideUnknown, trade.Side)
+	}
+}
+
+func TestTradeUpcasters_CurrentVersionUnchanged(t *testing.T) {
+	trade := Trade{ID: "t1", Side: SideBuy}
+	if err := DefaultTradeUpcasters().Upcast(TradeSchemaVersion, &trade); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if trade.Side != SideBuy {
+		t.Errorf("expected side %s, got %q", SideBuy, trade.Side)
+	}
+}
+
+func TestTradeUpcasters_RejectsUnknownVersions(t *testing.T) {
+	u := DefaultTradeUpcasters()
+	for _, v := range []int{0, TradeSchemaVersion + 1} {
+		if err := u.Upcast(v, &Trade{}); !errors.Is(err, ErrUnsupportedSchema) {
+			t.Errorf("version %d: expected ErrUnsupportedSchema, got %v", v, err)
+		}
+	}
+}
+
+func TestTradeUpcasters_MissingStep(t *testing.T) {
+	if err := NewTradeUpcasters().Upcast(1, &Trade{}); !errors.Is(err, ErrUnsupportedSchema) {
+		t.Errorf("expected ErrUnsupportedSchema, got %v", err)
+	}
+}
+
+func TestTradeUpcasters_StepError(t *testing.T) {
+	boom := errors.New("boom")
+	u := NewTradeUpcasters()
+	u.Register(1, func(t *Trade) error { return boom })
+	if err := u.Upcast(1, &Trade{}); !errors.Is(err, boom) {
+		t.Errorf("expected boom, got %v", err)
+	}
+}
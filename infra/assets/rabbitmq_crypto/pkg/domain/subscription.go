@@ -0,0 +1,108 @@
+package domain
+
+import "time"
+
+// SubscribeOptions controls how a TradeSubscriber delivers trades to a handler.
+type SubscribeOptions struct {
+	// ManualAck acknowledges a trade only once the handler returns nil.
+	// A handler error causes the trade to be redelivered.
+	ManualAck bool
+	// MaxRetries is how many times a failed trade is redelivered before it
+	// is given up on. Only used with ManualAck.
+	MaxRetries int
+	// DeadLetterExchange receives trades that exhausted their retries or
+	// could not be decoded. Empty means such trades are discarded.
+	DeadLetterExchange string
+
+	// Queue names a durable queue that survives consumer restarts and is
+	// shared by every consumer using the same name, so they compete for
+	// trades. Empty means a private, temporary queue.
+	Queue string
+	// MessageTTL discards trades that waited in the queue longer than this.
+	MessageTTL time.Duration
+	// MaxLength caps the number of trades waiting in the queue; the oldest
+	// are dropped (or dead-lettered) first.
+	MaxLength int
+	// Quorum declares a replicated quorum queue. Requires Queue.
+	Quorum bool
+
+	// Workers is the number of handlers running in parallel. Trades of the
+	// same symbol always go to the same worker, so their order is kept.
+	Workers int
+	// Prefetch limits how many unacknowledged trades the broker sends
+	// ahead. Zero means no limit.
+	Prefetch int
+}
+
+// SubscribeOption configures a subscription.
+type SubscribeOption func(*SubscribeOptions)
+
+// WithManualAck makes the subscriber acknowledge a trade only after the
+// handler succeeds, redelivering it up to maxRetries times on error.
+func WithManualAck(maxRetries int) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.ManualAck = true
+		o.MaxRetries = maxRetries
+	}
+}
+
+// WithDeadLetter routes poison trades to the given exchange instead of
+// discarding them.
+func WithDeadLetter(exchange string) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.DeadLetterExchange = exchange
+	}
+}
+
+// WithDurableQueue consumes from a durable queue with the given name.
+// Consumers sharing the name split the trades between them and pick up
+// where they left off after a restart.
+func WithDurableQueue(name string) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Queue = name
+	}
+}
+
+// WithMessageTTL expires trades that are not consumed within ttl.
+func WithMessageTTL(ttl time.Duration) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.MessageTTL = ttl
+	}
+}
+
+// WithMaxLength limits the queue to n waiting trades.
+func WithMaxLength(n int) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.MaxLength = n
+	}
+}
+
+// WithQuorumQueue declares the durable queue as a replicated quorum queue.
+func WithQuorumQueue() SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Quorum = true
+	}
+}
+
+// WithWorkers runs up to n handlers in parallel, sharding trades by symbol.
+func WithWorkers(n int) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Workers = n
+	}
+}
+
+// WithPrefetch limits the number of unacknowledged trades in flight.
+func WithPrefetch(n int) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Prefetch = n
+	}
+}
+
+// NewSubscribeOptions applies opts over the defaults.
+func NewSubscribeOptions(opts ...SubscribeOption) SubscribeOptions {
+	var o SubscribeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
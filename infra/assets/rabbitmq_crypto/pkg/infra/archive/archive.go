@@ -0,0 +1,221 @@
+// Package archive writes trades to rotated, compressed segment files and
+// reads them back.
+//
+// A Writer appends trades to one open segment in a directory and closes it
+// once it reaches a size or a wall-clock boundary. An open segment is a
+// JSON Lines journal ending in ".part", synced after every trade, and is
+// not listed. A closed segment is converted to its format, compressed and
+// recorded in the directory's manifest, a JSON Lines file listing each
+// segment with the symbols and hours of the trades it holds, so that Find
+// and NewReader open only the segments a query needs.
+//
+// Segments are JSON Lines, CSV or Parquet. JSON Lines and CSV segments are
+// compressed as a whole (trades-….jsonl.gz); Parquet segments compress
+// their pages with the same codec and keep the .parquet name.
+package archive
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// Format is the file format of a segment.
+type Format string
+
+// Supported formats.
+const (
+	JSONL   Format = "jsonl"
+	CSV     Format = "csv"
+	Parquet Format = "parquet"
+)
+
+// Compression is the codec applied to closed segments.
+type Compression string
+
+// Supported compressions.
+const (
+	None Compression = "none"
+	Gzip Compression = "gzip"
+	Zstd Compression = "zstd"
+)
+
+// ParseFormat returns the format named s.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case JSONL, CSV, Parquet:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown archive format %q", s)
+}
+
+// ParseCompression returns the compression named s; empty means None.
+func ParseCompression(s string) (Compression, error) {
+	switch c := Compression(s); c {
+	case "":
+		return None, nil
+	case None, Gzip, Zstd:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown archive compression %q", s)
+}
+
+// ext returns the file extension of a closed segment.
+func ext(f Format, c Compression) string {
+	e := "." + string(f)
+	if f == Parquet {
+		return e
+	}
+	switch c {
+	case Gzip:
+		e += ".gz"
+	case Zstd:
+		e += ".zst"
+	}
+	return e
+}
+
+// ManifestFile is the name of the manifest in an archive directory.
+const ManifestFile = "manifest.jsonl"
+
+// Segment describes one closed segment in the manifest.
+type Segment struct {
+	// File is the segment's file name within the archive directory.
+	File        string      `json:"file"`
+	Format      Format      `json:"format"`
+	Compression Compression `json:"compression"`
+	Trades      int         `json:"trades"`
+	// First and Last are the earliest and latest trade timestamps.
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+	// Symbols maps each symbol in the segment to the UTC hours, in order,
+	// in which it traded.
+	Symbols map[string][]time.Time `json:"symbols"`
+}
+
+// add accounts for trade in the segment's statistics.
+func (s *Segment) add(trade domain.Trade) {
+	if s.Trades == 0 || trade.Timestamp.Before(s.First) {
+		s.First = trade.Timestamp
+	}
+	if s.Trades == 0 || trade.Timestamp.After(s.Last) {
+		s.Last = trade.Timestamp
+	}
+	s.Trades++
+
+	if s.Symbols == nil {
+		s.Symbols = make(map[string][]time.Time)
+	}
+	hour := trade.Timestamp.UTC().Truncate(time.Hour)
+	hours := s.Symbols[trade.Symbol]
+	i, found := slices.BinarySearchFunc(hours, hour, time.Time.Compare)
+	if !found {
+		s.Symbols[trade.Symbol] = slices.Insert(hours, i, hour)
+	}
+}
+
+// Matches reports whether the segment may hold trades selected by q. Only
+// the symbol and the time range are considered, at hour granularity.
+func (s Segment) Matches(q domain.TradeQuery) bool {
+	for symbol, hours := range s.Symbols {
+		if q.Symbol != "" && symbol != q.Symbol {
+			continue
+		}
+		for _, h := range hours {
+			if (q.To.IsZero() || h.Before(q.To)) && (q.From.IsZero() || h.Add(time.Hour).After(q.From)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadManifest returns the segments listed in the manifest of dir, oldest
+// first. A directory without a manifest has no segments.
+func ReadManifest(dir string) ([]Segment, error) {
+	f, err := os.Open(filepath.Join(dir, ManifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var segments []Segment
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 0, 64*1024), 16<<20)
+	for line := 1; s.Scan(); line++ {
+		b := s.Bytes()
+		if len(strings.TrimSpace(string(b))) == 0 {
+			continue
+		}
+		var seg Segment
+		if err := json.Unmarshal(b, &seg); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", ManifestFile, line, err)
+		}
+		segments = append(segments, seg)
+	}
+	return segments, s.Err()
+}
+
+// appendManifest adds seg to the manifest of dir.
+func appendManifest(dir string, seg Segment) error {
+	b, err := json.Marshal(seg)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, ManifestFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return errors.Join(f.Sync(), f.Close())
+}
+
+// Find returns the segments of dir that may hold trades selected by q.
+func Find(dir string, q domain.TradeQuery) ([]Segment, error) {
+	segments, err := ReadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	var found []Segment
+	for _, s := range segments {
+		if s.Matches(q) {
+			found = append(found, s)
+		}
+	}
+	return found, nil
+}
+
+// selects reports whether q selects trade; Limit is not considered.
+func selects(q domain.TradeQuery, trade domain.Trade) bool {
+	return (q.Symbol == "" || trade.Symbol == q.Symbol) &&
+		(q.TargetCurrency == "" || trade.TargetCurrency == q.TargetCurrency) &&
+		(q.From.IsZero() || !trade.Timestamp.Before(q.From)) &&
+		(q.To.IsZero() || trade.Timestamp.Before(q.To))
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,423 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+var epoch = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func trade(id, symbol string, at time.Duration) domain.Trade {
+	return domain.Trade{
+		ID:             id,
+		Symbol:         symbol,
+		TargetCurrency: "USD",
+		Price:          60000.125,
+		Amount:         0.5,
+		Timestamp:      epoch.Add(at),
+		Side:           domain.SideBuy,
+	}
+}
+
+// clock is a settable time source for the writer.
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+func newWriter(t *testing.T, dir string, c *clock, opts ...Option) *Writer {
+	t.Helper()
+	w, err := NewWriter(dir, opts...)
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+	w.now = c.now
+	return w
+}
+
+func readAll(t *testing.T, r domain.TradeReader) []domain.Trade {
+	t.Helper()
+	var trades []domain.Trade
+	for {
+		tr, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return trades
+		}
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		trades = append(trades, tr)
+	}
+}
+
+func files(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestWriter_RoundTripsEveryFormatAndCompression(t *testing.T) {
+	want := []domain.Trade{trade("t1", "BTC", 0), trade("t2", "ETH", time.Second), trade("t3", "BTC", time.Hour)}
+	want[1].Timestamp = want[1].Timestamp.Add(123 * time.Nanosecond)
+	want[1].Side = domain.SideSell
+
+	for _, f := range []Format{JSONL, CSV, Parquet} {
+		for _, c := range []Compression{None, Gzip, Zstd} {
+			t.Run(fmt.Sprintf("%s/%s", f, c), func(t *testing.T) {
+				dir := t.TempDir()
+				w := newWriter(t, dir, &clock{epoch}, WithFormat(f), WithCompression(c))
+				for _, tr := range want {
+					if err := w.Publish(context.Background(), tr); err != nil {
+						t.Fatalf("failed to publish: %v", err)
+					}
+				}
+				if err := w.Close(); err != nil {
+					t.Fatalf("failed to close: %v", err)
+				}
+
+				names := files(t, dir)
+				segment := "trades-20240101T120000.000Z" + ext(f, c)
+				if fmt.Sprint(names) != fmt.Sprint([]string{ManifestFile, segment}) {
+					t.Fatalf("expected the manifest and %s, got %v", segment, names)
+				}
+
+				r, err := OpenFile(filepath.Join(dir, segment))
+				if err != nil {
+					t.Fatalf("failed to open: %v", err)
+				}
+				defer r.Close()
+				got := readAll(t, r)
+				if len(got) != len(want) {
+					t.Fatalf("expected %d trades, got %d", len(want), len(got))
+				}
+				for i := range want {
+					if !got[i].Timestamp.Equal(want[i].Timestamp) {
+						t.Errorf("expected timestamp %v, got %v", want[i].Timestamp, got[i].Timestamp)
+					}
+					got[i].Timestamp = want[i].Timestamp
+					if got[i] != want[i] {
+						t.Errorf("expected %+v, got %+v", want[i], got[i])
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestWriter_RotatesBySize(t *testing.T) {
+	dir := t.TempDir()
+	w := newWriter(t, dir, &clock{epoch}, WithMaxSize(200), WithCompression(Gzip))
+	for i := range 10 {
+		if err := w.Publish(context.Background(), trade(fmt.Sprintf("t%d", i), "BTC", time.Duration(i)*time.Second)); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	segments, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	if len(segments) < 3 {
+		t.Fatalf("expected several segments, got %d", len(segments))
+	}
+	total := 0
+	for _, s := range segments {
+		total += s.Trades
+		if !strings.HasSuffix(s.File, ".jsonl.gz") {
+			t.Errorf("expected a gzipped JSONL segment, got %s", s.File)
+		}
+	}
+	if total != 10 {
+		t.Errorf("expected 10 trades across segments, got %d", total)
+	}
+
+	r, err := NewReader(dir, domain.TradeQuery{})
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	defer r.Close()
+	if got := readAll(t, r); len(got) != 10 || got[9].ID != "t9" {
+		t.Errorf("expected the 10 trades in order, got %d", len(got))
+	}
+}
+
+func TestWriter_ConcurrentPublishesShareASync(t *testing.T) {
+	dir := t.TempDir()
+	w := newWriter(t, dir, &clock{epoch})
+	var syncs atomic.Int32
+	release := make(chan struct{})
+	w.syncFile = func(f *os.File) error {
+		// The first sync waits until every trade has been written.
+		if syncs.Add(1) == 1 {
+			<-release
+		}
+		return f.Sync()
+	}
+
+	errs := make(chan error, 8)
+	for i := range 8 {
+		go func() {
+			errs <- w.Publish(context.Background(), trade(fmt.Sprintf("t%d", i), "BTC", time.Duration(i)*time.Second))
+		}()
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		w.mu.Lock()
+		written := w.seg != nil && w.seg.written == 8
+		w.mu.Unlock()
+		if written {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the trades to be written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	for range 8 {
+		if err := <-errs; err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+
+	// The trades written during the first sync share the next one.
+	if n := syncs.Load(); n > 2 {
+		t.Errorf("expected at most 2 syncs for 8 trades, got %d", n)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	segments, err := ReadManifest(dir)
+	if err != nil || len(segments) != 1 || segments[0].Trades != 8 {
+		t.Errorf("expected one segment of 8 trades, got %+v, %v", segments, err)
+	}
+}
+
+func TestWriter_RotatesOnIntervalBoundaries(t *testing.T) {
+	dir := t.TempDir()
+	c := &clock{epoch.Add(50 * time.Minute)}
+	w := newWriter(t, dir, c, WithInterval(time.Hour))
+	publish := func(id string) {
+		if err := w.Publish(context.Background(), trade(id, "BTC", 0)); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+
+	publish("t1")
+	c.t = epoch.Add(59 * time.Minute)
+	publish("t2")
+	c.t = epoch.Add(60 * time.Minute)
+	publish("t3")
+
+	// The first segment is closed and listed while the second is open.
+	segments, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	if len(segments) != 1 || segments[0].Trades != 2 || segments[0].File != "trades-20240101T125000.000Z.jsonl" {
+		t.Fatalf("expected one closed segment of 2 trades, got %+v", segments)
+	}
+	if names := files(t, dir); !strings.HasSuffix(names[len(names)-1], ".part") {
+		t.Errorf("expected the open segment to end in .part, got %v", names)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	if err := w.Publish(context.Background(), trade("t4", "BTC", 0)); err == nil {
+		t.Error("expected publishing after Close to fail")
+	}
+}
+
+func TestWriter_EmptySegmentIsRemoved(t *testing.T) {
+	dir := t.TempDir()
+	w := newWriter(t, dir, &clock{epoch})
+	if err := w.Rotate(); err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	if names := files(t, dir); len(names) != 0 {
+		t.Errorf("expected an empty directory, got %v", names)
+	}
+}
+
+func TestWriter_RotatesQuietSegmentOnTimer(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(dir, WithInterval(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+	defer w.Close()
+	if err := w.Publish(context.Background(), trade("t1", "BTC", 0)); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	// No further trade arrives, yet the segment is closed on its boundary.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		segments, err := ReadManifest(dir)
+		if err != nil {
+			t.Fatalf("failed to read manifest: %v", err)
+		}
+		if len(segments) == 1 && segments[0].Trades == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the segment to rotate, got %+v", segments)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewWriter_RecoversCrashedSegments(t *testing.T) {
+	dir := t.TempDir()
+	// A writer that is never closed, as if the process crashed.
+	crashed := newWriter(t, dir, &clock{epoch})
+	for _, tr := range []domain.Trade{trade("t1", "BTC", 0), trade("t2", "ETH", time.Minute)} {
+		if err := crashed.Publish(context.Background(), tr); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+	crashed.seg.timer.Stop()
+	journal := filepath.Join(dir, "trades-20240101T120000.000Z"+journalExt)
+	// The crash cut the next trade short and interrupted a conversion.
+	f, err := os.OpenFile(journal, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("expected the trades to be in the journal: %v", err)
+	}
+	if _, err := f.WriteString(`{"id":"t3","sym`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := os.WriteFile(filepath.Join(dir, "trades-20240101T110000.000Z.csv.gz"+tmpExt), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := newWriter(t, dir, &clock{epoch}, WithFormat(CSV), WithCompression(Gzip))
+	segments, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	if len(segments) != 1 || segments[0].Trades != 2 || segments[0].File != "trades-20240101T120000.000Z.csv.gz" {
+		t.Fatalf("expected the crashed segment to be finished, got %+v", segments)
+	}
+	if names := files(t, dir); fmt.Sprint(names) != fmt.Sprint([]string{ManifestFile, segments[0].File}) {
+		t.Errorf("expected the leftovers to be cleaned up, got %v", names)
+	}
+
+	// New segments do not reuse the recovered name.
+	if err := w.Publish(context.Background(), trade("t4", "BTC", time.Minute)); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	if segments, _ := ReadManifest(dir); len(segments) != 2 || segments[1].File != "trades-20240101T120000.000Z-1.csv.gz" {
+		t.Errorf("expected a second segment with a new name, got %+v", segments)
+	}
+	r, err := NewReader(dir, domain.TradeQuery{})
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	defer r.Close()
+	ids := []string{}
+	for _, tr := range readAll(t, r) {
+		ids = append(ids, tr.ID)
+	}
+	if got := fmt.Sprint(ids); got != "[t1 t2 t4]" {
+		t.Errorf("expected [t1 t2 t4], got %s", got)
+	}
+}
+
+func TestFind_BySymbolAndHour(t *testing.T) {
+	dir := t.TempDir()
+	c := &clock{epoch}
+	w := newWriter(t, dir, c, WithFormat(CSV), WithCompression(Zstd))
+	for i, tr := range []domain.Trade{
+		trade("b1", "BTC", 0),
+		trade("e1", "ETH", time.Hour),
+		trade("b2", "BTC", 2*time.Hour),
+		trade("e2", "ETH", 2*time.Hour+time.Minute),
+	} {
+		// One segment per trade.
+		c.t = epoch.Add(time.Duration(i) * time.Hour)
+		if err := w.Publish(context.Background(), tr); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		q        domain.TradeQuery
+		segments int
+		trades   string
+	}{
+		{"all", domain.TradeQuery{}, 4, "[b1 e1 b2 e2]"},
+		{"symbol", domain.TradeQuery{Symbol: "BTC"}, 2, "[b1 b2]"},
+		{"hour", domain.TradeQuery{From: epoch.Add(time.Hour), To: epoch.Add(2 * time.Hour)}, 1, "[e1]"},
+		{"symbol and hour", domain.TradeQuery{Symbol: "ETH", From: epoch.Add(2 * time.Hour)}, 1, "[e2]"},
+		{"within an hour", domain.TradeQuery{From: epoch.Add(2*time.Hour + 30*time.Second)}, 2, "[e2]"},
+		{"limit", domain.TradeQuery{Limit: 1}, 4, "[b1]"},
+		{"none", domain.TradeQuery{Symbol: "SOL"}, 0, "[]"},
+	} {
+		segments, err := Find(dir, tc.q)
+		if err != nil {
+			t.Fatalf("%s: failed to find: %v", tc.name, err)
+		}
+		if len(segments) != tc.segments {
+			t.Errorf("%s: expected %d segments, got %d", tc.name, tc.segments, len(segments))
+		}
+
+		r, err := NewReader(dir, tc.q)
+		if err != nil {
+			t.Fatalf("%s: failed to open: %v", tc.name, err)
+		}
+		ids := []string{}
+		for _, tr := range readAll(t, r) {
+			ids = append(ids, tr.ID)
+		}
+		r.Close()
+		if got := fmt.Sprint(ids); got != tc.trades {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.trades, got)
+		}
+	}
+}
+
+func TestOpenFile_RejectsUnknownNames(t *testing.T) {
+	if _, err := OpenFile("trades.txt.gz"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestNewWriter_RejectsInvalidOptions(t *testing.T) {
+	for _, opt := range []Option{WithFormat("xml"), WithCompression("lz4"), WithMaxSize(0), WithInterval(-time.Second)} {
+		if _, err := NewWriter(t.TempDir(), opt); err == nil {
+			t.Error("expected an error")
+		}
+	}
+}
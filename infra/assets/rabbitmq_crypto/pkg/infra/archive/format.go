@@ -0,0 +1,254 @@
+package archive
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/parquet-go/parquet-go"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/jsonl"
+)
+
+// encoder writes trades in one format.
+type encoder interface {
+	encode(trade domain.Trade) error
+	// close flushes buffered trades; it does not close the underlying writer.
+	close() error
+}
+
+func newEncoder(w io.Writer, f Format, c Compression) encoder {
+	switch f {
+	case CSV:
+		e := &csvEncoder{w: csv.NewWriter(w)}
+		e.err = e.write(csvHeader)
+		return e
+	case Parquet:
+		return newParquetEncoder(w, c)
+	default:
+		return &jsonlEncoder{w: w}
+	}
+}
+
+// decoder reads trades in one format, returning io.EOF at the end.
+type decoder interface {
+	Read() (domain.Trade, error)
+}
+
+// newDecoder reads an uncompressed JSON Lines or CSV stream.
+func newDecoder(r io.Reader, f Format) decoder {
+	if f == CSV {
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = len(csvHeader)
+		cr.ReuseRecord = true
+		return &csvDecoder{r: cr}
+	}
+	return jsonl.NewReader(r)
+}
+
+// The JSON Lines encoder writes every trade in one write, so that the
+// journal's size stays current and a crash cuts at most the last trade
+// short.
+
+type jsonlEncoder struct {
+	w io.Writer
+}
+
+func (e *jsonlEncoder) encode(trade domain.Trade) error {
+	b, err := json.Marshal(trade)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(append(b, '\n'))
+	return err
+}
+
+func (e *jsonlEncoder) close() error {
+	return nil
+}
+
+var csvHeader = []string{"id", "symbol", "target_currency", "price", "amount", "side", "timestamp"}
+
+type csvEncoder struct {
+	w   *csv.Writer
+	err error // from writing the header
+}
+
+func (e *csvEncoder) encode(t domain.Trade) error {
+	if e.err != nil {
+		return e.err
+	}
+	return e.write([]string{
+		t.ID, t.Symbol, t.TargetCurrency,
+		strconv.FormatFloat(t.Price, 'g', -1, 64),
+		strconv.FormatFloat(t.Amount, 'g', -1, 64),
+		t.Side,
+		t.Timestamp.Format(time.RFC3339Nano),
+	})
+}
+
+func (e *csvEncoder) write(record []string) error {
+	if err := e.w.Write(record); err != nil {
+		return err
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvEncoder) close() error {
+	return nil
+}
+
+type csvDecoder struct {
+	r      *csv.Reader
+	header bool
+}
+
+func (d *csvDecoder) Read() (domain.Trade, error) {
+	if !d.header {
+		if _, err := d.r.Read(); err != nil {
+			return domain.Trade{}, err
+		}
+		d.header = true
+	}
+	rec, err := d.r.Read()
+	if err != nil {
+		return domain.Trade{}, err
+	}
+	line, _ := d.r.FieldPos(0)
+	t := domain.Trade{ID: rec[0], Symbol: rec[1], TargetCurrency: rec[2], Side: rec[5]}
+	if t.Price, err = strconv.ParseFloat(rec[3], 64); err != nil {
+		return domain.Trade{}, fmt.Errorf("line %d: price: %w", line, err)
+	}
+	if t.Amount, err = strconv.ParseFloat(rec[4], 64); err != nil {
+		return domain.Trade{}, fmt.Errorf("line %d: amount: %w", line, err)
+	}
+	if t.Timestamp, err = time.Parse(time.RFC3339Nano, rec[6]); err != nil {
+		return domain.Trade{}, fmt.Errorf("line %d: timestamp: %w", line, err)
+	}
+	return t, nil
+}
+
+// parquetRow is the Parquet schema of a trade.
+type parquetRow struct {
+	ID             string  `parquet:"id"`
+	Symbol         string  `parquet:"symbol,dict"`
+	TargetCurrency string  `parquet:"target_currency,dict"`
+	Price          float64 `parquet:"price"`
+	Amount         float64 `parquet:"amount"`
+	Side           string  `parquet:"side,dict"`
+	Timestamp      int64   `parquet:"timestamp,timestamp(nanosecond)"`
+}
+
+// parquetRowGroup is the number of trades buffered before a row group is
+// written. The segment size only grows, and is only checked, per row group.
+const parquetRowGroup = 10000
+
+type parquetEncoder struct {
+	w    *parquet.GenericWriter[parquetRow]
+	rows []parquetRow
+}
+
+func newParquetEncoder(w io.Writer, c Compression) *parquetEncoder {
+	var opt parquet.WriterOption
+	switch c {
+	case Gzip:
+		opt = parquet.Compression(&parquet.Gzip)
+	case Zstd:
+		opt = parquet.Compression(&parquet.Zstd)
+	default:
+		opt = parquet.Compression(&parquet.Uncompressed)
+	}
+	return &parquetEncoder{w: parquet.NewGenericWriter[parquetRow](w, opt)}
+}
+
+func (e *parquetEncoder) encode(t domain.Trade) error {
+	e.rows = append(e.rows, parquetRow{
+		ID: t.ID, Symbol: t.Symbol, TargetCurrency: t.TargetCurrency,
+		Price: t.Price, Amount: t.Amount, Side: t.Side,
+		Timestamp: t.Timestamp.UnixNano(),
+	})
+	if len(e.rows) < parquetRowGroup {
+		return nil
+	}
+	return e.flush()
+}
+
+func (e *parquetEncoder) flush() error {
+	if len(e.rows) == 0 {
+		return nil
+	}
+	if _, err := e.w.Write(e.rows); err != nil {
+		return err
+	}
+	e.rows = e.rows[:0]
+	return e.w.Flush()
+}
+
+func (e *parquetEncoder) close() error {
+	if err := e.flush(); err != nil {
+		return err
+	}
+	return e.w.Close()
+}
+
+type parquetDecoder struct {
+	r    *parquet.GenericReader[parquetRow]
+	rows []parquetRow
+	next int
+}
+
+func (d *parquetDecoder) Read() (domain.Trade, error) {
+	if d.next == len(d.rows) {
+		d.rows = d.rows[:cap(d.rows)]
+		n, err := d.r.Read(d.rows)
+		d.rows, d.next = d.rows[:n], 0
+		if n == 0 {
+			if err == nil {
+				err = io.EOF
+			}
+			return domain.Trade{}, err
+		}
+	}
+	r := d.rows[d.next]
+	d.next++
+	return domain.Trade{
+		ID: r.ID, Symbol: r.Symbol, TargetCurrency: r.TargetCurrency,
+		Price: r.Price, Amount: r.Amount, Side: r.Side,
+		Timestamp: time.Unix(0, r.Timestamp).UTC(),
+	}, nil
+}
+
+// compressor wraps w to apply codec c. Closing the result does not close w.
+func compressor(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("cannot compress with %q", c)
+}
+
+// decompress wraps r to undo codec c. Closing the result does not close r.
+func decompress(r io.Reader, c Compression) (io.ReadCloser, error) {
+	switch c {
+	case None, "":
+		return io.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, errors.New("unknown compression " + string(c))
+}
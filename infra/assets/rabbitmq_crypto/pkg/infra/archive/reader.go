@@ -0,0 +1,156 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// parquetReadBatch is the number of rows decoded from Parquet at once.
+const parquetReadBatch = 1024
+
+// FileReader reads the trades of one segment file.
+type FileReader struct {
+	dec     decoder
+	closers []io.Closer // closed in reverse order
+}
+
+var _ domain.TradeReader = (*FileReader)(nil)
+
+// OpenFile opens a segment file. Its format and compression are taken from
+// the file name, e.g. trades.csv.zst or trades.parquet.
+func OpenFile(path string) (*FileReader, error) {
+	format, compression, err := parseName(filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	return openFile(path, format, compression)
+}
+
+func openFile(path string, format Format, compression Compression) (*FileReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &FileReader{closers: []io.Closer{f}}
+
+	if format == Parquet {
+		pr := parquet.NewGenericReader[parquetRow](f)
+		r.closers = append(r.closers, pr)
+		r.dec = &parquetDecoder{r: pr, rows: make([]parquetRow, 0, parquetReadBatch)}
+		return r, nil
+	}
+	d, err := decompress(f, compression)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	r.closers = append(r.closers, d)
+	r.dec = newDecoder(d, format)
+	return r, nil
+}
+
+// parseName derives the format and compression of a segment from its name.
+func parseName(name string) (Format, Compression, error) {
+	compression := None
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		compression, name = Gzip, strings.TrimSuffix(name, ".gz")
+	case strings.HasSuffix(name, ".zst"):
+		compression, name = Zstd, strings.TrimSuffix(name, ".zst")
+	}
+	format, err := ParseFormat(strings.TrimPrefix(filepath.Ext(name), "."))
+	if err != nil {
+		return "", "", fmt.Errorf("%s: not an archive segment", name)
+	}
+	return format, compression, nil
+}
+
+// Read returns the next trade, or io.EOF at the end of the file.
+func (r *FileReader) Read() (domain.Trade, error) {
+	return r.dec.Read()
+}
+
+// Close closes the file.
+func (r *FileReader) Close() error {
+	var errs []error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		errs = append(errs, r.closers[i].Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Reader reads the trades of an archive directory selected by a query,
+// segment by segment in the order they were written. It implements
+// domain.TradeReader, so an archive can be replayed.
+type Reader struct {
+	dir      string
+	q        domain.TradeQuery
+	segments []Segment
+	cur      *FileReader
+	n        int
+}
+
+var _ domain.TradeReader = (*Reader)(nil)
+
+// NewReader creates a Reader for the trades in dir matching q. Trades are
+// in the order they were archived, which is only roughly by timestamp.
+func NewReader(dir string, q domain.TradeQuery) (*Reader, error) {
+	segments, err := Find(dir, q)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{dir: dir, q: q, segments: segments}, nil
+}
+
+// Read returns the next matching trade, or io.EOF once all are read.
+func (r *Reader) Read() (domain.Trade, error) {
+	for r.q.Limit <= 0 || r.n < r.q.Limit {
+		if r.cur == nil {
+			if len(r.segments) == 0 {
+				break
+			}
+			seg := r.segments[0]
+			r.segments = r.segments[1:]
+			f, err := openFile(filepath.Join(r.dir, seg.File), seg.Format, seg.Compression)
+			if err != nil {
+				return domain.Trade{}, err
+			}
+			r.cur = f
+		}
+
+		trade, err := r.cur.Read()
+		if errors.Is(err, io.EOF) {
+			err = r.cur.Close()
+			r.cur = nil
+			if err != nil {
+				return domain.Trade{}, err
+			}
+			continue
+		}
+		if err != nil {
+			return domain.Trade{}, err
+		}
+		if selects(r.q, trade) {
+			r.n++
+			return trade, nil
+		}
+	}
+	return domain.Trade{}, io.EOF
+}
+
+// Close closes the segment being read.
+func (r *Reader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	err := r.cur.Close()
+	r.cur = nil
+	return err
+}
@@ -0,0 +1,433 @@
+package archive
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/jsonl"
+)
+
+// Defaults used unless overridden by options.
+const (
+	defaultMaxSize  = 64 << 20
+	defaultInterval = time.Hour
+)
+
+// File name suffixes of the files a Writer works on.
+const (
+	// journalExt ends the JSON Lines journal of an open segment.
+	journalExt = ".jsonl.part"
+	// tmpExt ends a closed segment until it is complete.
+	tmpExt = ".tmp"
+)
+
+// Writer appends trades to rotated segments in a directory. It implements
+// domain.TradePublisher and is safe for concurrent use.
+//
+// An open segment is a JSON Lines journal that is synced to disk before
+// Publish returns, so a published trade survives a crash. A sync runs
+// while further trades are written and covers every trade written before
+// it started, so concurrent publishes share one. Closing the segment, on
+// rotation or Close, syncs the journal, converts it to the segment's
+// format and compression and lists it in the manifest.
+type Writer struct {
+	dir         string
+	format      Format
+	compression Compression
+	maxSize     int64
+	interval    time.Duration
+	now         func() time.Time
+	syncFile    func(*os.File) error
+
+	syncMu  sync.Mutex // serializes syncs, which run without holding mu
+	mu      sync.Mutex
+	seg     *openSegment
+	lastRaw string // name of the last segment opened, to keep names unique
+	closed  bool
+}
+
+var _ domain.TradePublisher = (*Writer)(nil)
+
+type openSegment struct {
+	raw   string // the segment's name without extension
+	path  string // the journal being written
+	f     *os.File
+	size  *countingWriter
+	enc   encoder
+	end   time.Time   // wall-clock time at which the segment rotates
+	timer *time.Timer // rotates the segment at end if no trade does
+	stats Segment
+
+	written int // trades written to the journal
+	synced  int // trades synced to disk
+}
+
+// Option configures a Writer.
+type Option func(*Writer)
+
+// WithFormat sets the segment format. Defaults to JSONL.
+func WithFormat(f Format) Option {
+	return func(w *Writer) {
+		w.format = f
+	}
+}
+
+// WithCompression sets the codec applied to closed segments. Defaults to
+// None.
+func WithCompression(c Compression) Option {
+	return func(w *Writer) {
+		w.compression = c
+	}
+}
+
+// WithMaxSize rotates a segment once its journal holds n bytes. Defaults to
+// 64 MiB.
+func WithMaxSize(n int64) Option {
+	return func(w *Writer) {
+		w.maxSize = n
+	}
+}
+
+// WithInterval rotates segments at every multiple of d of UTC wall-clock
+// time, so that time.Hour starts a segment every hour on the hour.
+// Defaults to an hour.
+func WithInterval(d time.Duration) Option {
+	return func(w *Writer) {
+		w.interval = d
+	}
+}
+
+// NewWriter creates a Writer for dir, creating the directory if needed.
+// Segments are added to those already listed in its manifest. Segments left
+// open by a writer that crashed are closed first, with this writer's format
+// and compression; a trade cut short by the crash is dropped.
+func NewWriter(dir string, opts ...Option) (*Writer, error) {
+	w := &Writer{
+		dir:         dir,
+		format:      JSONL,
+		compression: None,
+		maxSize:     defaultMaxSize,
+		interval:    defaultInterval,
+		now:         time.Now,
+		syncFile:    (*os.File).Sync,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if _, err := ParseFormat(string(w.format)); err != nil {
+		return nil, err
+	}
+	if _, err := ParseCompression(string(w.compression)); err != nil {
+		return nil, err
+	}
+	if w.maxSize <= 0 || w.interval <= 0 {
+		return nil, errors.New("archive max size and interval must be positive")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := w.recover(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Publish appends trade to the current segment, first rotating it if it is
+// full or its interval has passed. It returns once the trade is on disk.
+func (w *Writer) Publish(ctx context.Context, trade domain.Trade) error {
+	seg, n, err := w.write(trade)
+	if err != nil {
+		return err
+	}
+	return w.sync(seg, n)
+}
+
+// write appends trade to the current segment and returns the segment and
+// the number of trades written to it so far.
+func (w *Writer) write(trade domain.Trade) (*openSegment, int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil, 0, errors.New("archive writer is closed")
+	}
+
+	now := w.now()
+	if w.seg != nil && (w.seg.size.n >= w.maxSize || !now.Before(w.seg.end)) {
+		if err := w.closeSegment(); err != nil {
+			return nil, 0, err
+		}
+	}
+	if w.seg == nil {
+		if err := w.openSegment(now); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if err := w.seg.enc.encode(trade); err != nil {
+		return nil, 0, fmt.Errorf("could not archive trade: %w", err)
+	}
+	w.seg.stats.add(trade)
+	w.seg.written++
+	return w.seg, w.seg.written, nil
+}
+
+// sync returns once the first n trades of seg are on disk. Trades written
+// while a sync runs wait for the next one, which covers them all.
+func (w *Writer) sync(seg *openSegment, n int) error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	w.mu.Lock()
+	synced, written := seg.synced, seg.written
+	w.mu.Unlock()
+	if synced >= n {
+		return nil
+	}
+
+	err := w.syncFile(seg.f)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err == nil {
+		seg.synced = max(seg.synced, written)
+	}
+	// A rotation may have synced and closed the segment meanwhile.
+	if seg.synced >= n {
+		return nil
+	}
+	return fmt.Errorf("could not archive trade: %w", err)
+}
+
+// Rotate closes the current segment, if any. The next trade starts a new one.
+func (w *Writer) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closeSegment()
+}
+
+// Close closes the current segment. Publishing afterwards fails.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	return w.closeSegment()
+}
+
+func (w *Writer) openSegment(now time.Time) error {
+	start := now.UTC()
+	name := "trades-" + start.Format("20060102T150405.000Z")
+	// Segments opened within the same millisecond get a sequence number.
+	base := name
+	for i := 1; name <= w.lastRaw; i++ {
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+	w.lastRaw = name
+
+	path := filepath.Join(w.dir, name+journalExt)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("could not open archive segment: %w", err)
+	}
+
+	size := &countingWriter{w: f}
+	seg := &openSegment{
+		raw:  name,
+		path: path,
+		f:    f,
+		size: size,
+		enc:  &jsonlEncoder{w: size},
+		end:  start.Truncate(w.interval).Add(w.interval),
+	}
+	// A quiet directory still rotates on the interval boundary.
+	seg.timer = time.AfterFunc(seg.end.Sub(now), func() { w.expire(seg) })
+	w.seg = seg
+	return nil
+}
+
+// expire closes seg if it is still the current segment.
+func (w *Writer) expire(seg *openSegment) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.seg != seg {
+		return
+	}
+	if err := w.closeSegment(); err != nil {
+		log.Printf("Failed to rotate trade archive: %v", err)
+	}
+}
+
+// closeSegment finishes the current segment. An empty segment is removed
+// instead.
+func (w *Writer) closeSegment() error {
+	seg := w.seg
+	if seg == nil {
+		return nil
+	}
+	w.seg = nil
+	seg.timer.Stop()
+
+	err := w.syncFile(seg.f)
+	if cerr := seg.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("could not close archive segment %s: %w", seg.path, err)
+	}
+	seg.synced = seg.written
+	return w.finish(seg.raw, seg.stats)
+}
+
+// finish converts the journal of the segment named raw, holding the trades
+// described by stats, to a closed segment, lists it in the manifest and
+// removes the journal.
+func (w *Writer) finish(raw string, stats Segment) error {
+	journal := filepath.Join(w.dir, raw+journalExt)
+	if stats.Trades == 0 {
+		return os.Remove(journal)
+	}
+
+	stats.File = raw + ext(w.format, w.compression)
+	stats.Format, stats.Compression = w.format, w.compression
+	final := filepath.Join(w.dir, stats.File)
+	tmp := final + tmpExt
+	err := convert(tmp, journal, stats.Trades, w.format, w.compression)
+	if err == nil {
+		err = os.Rename(tmp, final)
+	}
+	// The journal is removed last: a crash before that finishes the segment
+	// again on the next start.
+	if err == nil {
+		err = appendManifest(w.dir, stats)
+	}
+	if err == nil {
+		err = os.Remove(journal)
+	}
+	if err != nil {
+		return fmt.Errorf("could not finish archive segment %s: %w", journal, err)
+	}
+	return nil
+}
+
+// recover finishes the segments a previous writer left open, oldest first,
+// and removes closed segments it did not complete.
+func (w *Writer) recover() error {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return err
+	}
+	segments, err := ReadManifest(w.dir)
+	if err != nil {
+		return err
+	}
+	listed := func(raw string) bool {
+		return slices.ContainsFunc(segments, func(s Segment) bool {
+			return strings.HasPrefix(s.File, raw+".")
+		})
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		switch {
+		case strings.HasSuffix(name, tmpExt):
+			if err := os.Remove(filepath.Join(w.dir, name)); err != nil {
+				return err
+			}
+		case strings.HasSuffix(name, journalExt):
+			raw := strings.TrimSuffix(name, journalExt)
+			w.lastRaw = max(w.lastRaw, raw)
+			var stats Segment
+			// A crash after listing the segment only left its journal.
+			if !listed(raw) {
+				if stats, err = readJournal(filepath.Join(w.dir, name)); err != nil {
+					return err
+				}
+			}
+			if err := w.finish(raw, stats); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readJournal returns the statistics of the trades in the journal at path,
+// up to the first one that cannot be read, such as one cut short by a crash.
+func readJournal(path string) (Segment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Segment{}, err
+	}
+	defer f.Close()
+
+	var stats Segment
+	r := jsonl.NewReader(f)
+	for {
+		trade, err := r.Read()
+		if err != nil {
+			return stats, nil
+		}
+		stats.add(trade)
+	}
+}
+
+// convert writes the first n trades of the journal at src to dst in format
+// f with compression c, and syncs dst.
+func convert(dst, src string, n int, f Format, c Compression) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	// Parquet compresses its pages itself.
+	buf := bufio.NewWriter(out)
+	var w io.Writer = buf
+	var z io.WriteCloser
+	if f != Parquet && c != None {
+		if z, err = compressor(buf, c); err != nil {
+			return err
+		}
+		w = z
+	}
+	enc := newEncoder(w, f, c)
+	r := jsonl.NewReader(in)
+	for range n {
+		trade, err := r.Read()
+		if err != nil {
+			return err
+		}
+		if err := enc.encode(trade); err != nil {
+			return err
+		}
+	}
+	if err := enc.close(); err != nil {
+		return err
+	}
+	if z != nil {
+		if err := z.Close(); err != nil {
+			return err
+		}
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
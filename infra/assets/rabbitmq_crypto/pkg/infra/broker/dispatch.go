@@ -0,0 +1,360 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// ErrUnsupportedOption is returned for subscribe options a broker cannot
+// honour.
+var ErrUnsupportedOption = errors.New("unsupported subscribe option")
+
+// CheckOptions rejects the subscribe options the adapters cannot honour.
+// Their brokers keep one log per exchange rather than a queue per
+// subscription, so there is no queue to cap.
+func CheckOptions(o domain.SubscribeOptions) error {
+	if o.Quorum && o.Queue == "" {
+		return errors.New("quorum queues require a durable queue name")
+	}
+	if o.MaxLength > 0 {
+		return fmt.Errorf("%w: max length", ErrUnsupportedOption)
+	}
+	return nil
+}
+
+// A failed message is retried after retryBackoff, doubling with every
+// further attempt up to maxRetryBackoff, so that a downstream outage has
+// time to pass before the retries run out.
+const (
+	retryBackoff    = 100 * time.Millisecond
+	maxRetryBackoff = 5 * time.Second
+)
+
+// Delivery is a message handed to a subscription. Ack, Reject and Requeue
+// may be called after the source is closed, from any goroutine.
+type Delivery struct {
+	Message
+	// Published is when the broker stored the message, or zero if unknown.
+	// Deliveries older than SubscribeOptions.MessageTTL are rejected.
+	Published time.Time
+	// Attempt counts the deliveries of the message, starting at 1. Sources
+	// that set Requeue must count them across consumers; the others may
+	// leave it zero.
+	Attempt int
+	// Ack settles a handled message.
+	Ack func()
+	// Reject settles a message that is given up on. Sources dead-letter it
+	// when the subscription has a dead-letter exchange.
+	Reject func()
+	// Requeue, if set, hands a failed message back to the broker to be
+	// delivered again. Without it a failed message is retried in place.
+	Requeue func()
+	// Wrap, if set, runs the handler of the message, for instance within a
+	// tracing span.
+	Wrap func(handle func() error) error
+}
+
+// handle runs the handler of d through Wrap.
+func (d Delivery) handle(handle func() error) error {
+	if d.Wrap == nil {
+		return handle()
+	}
+	return d.Wrap(handle)
+}
+
+// Source is the broker consumer behind a subscription.
+type Source interface {
+	// Deliveries is closed once the consumer has stopped, either after
+	// Cancel or because the broker went away.
+	Deliveries() <-chan Delivery
+	// Cancel stops the consumer. Deliveries it has already fetched are
+	// still handed over.
+	Cancel()
+	// Err reports why the deliveries ended without Cancel.
+	Err() error
+	// Close releases the consumer. The broker redelivers whatever is left
+	// unsettled.
+	Close()
+}
+
+// Dispatch runs handler for the trades src delivers until ctx is done or
+// the subscription is stopped. Trades are handled by o.Workers workers,
+// sharded by symbol so that trades of one symbol are handled in order while
+// different symbols proceed in parallel.
+//
+// With manual acks a failed trade is retried up to o.MaxRetries times,
+// with a growing delay in between, before it is rejected. Sources that can
+// requeue hand it back to the broker for each retry. Otherwise the same
+// worker retries it in place, which also keeps the order per symbol. A
+// trade waiting for its next try when the subscription stops is left
+// unsettled for redelivery.
+func Dispatch(ctx context.Context, key string, src Source, dec Decoder, handler func(domain.Trade) error, o domain.SubscribeOptions) domain.Subscription {
+	return dispatch(ctx, key, src, "trade", func(m Message) (job, error) {
+		trade, err := dec.Trade(m)
+		return job{id: trade.ID, symbol: trade.Symbol, handle: func() error { return handler(trade) }}, err
+	}, o)
+}
+
+// DispatchOrders runs handler for the orders src delivers, like Dispatch
+// does for trades.
+func DispatchOrders(ctx context.Context, key string, src Source, dec Decoder, handler func(domain.Order) error, o domain.SubscribeOptions) domain.Subscription {
+	return dispatch(ctx, key, src, "order", func(m Message) (job, error) {
+		order, err := dec.Order(m)
+		return job{id: order.ID, symbol: order.Symbol, handle: func() error { return handler(order) }}, err
+	}, o)
+}
+
+func dispatch(ctx context.Context, key string, src Source, kind string, decode func(Message) (job, error), o domain.SubscribeOptions) domain.Subscription {
+	ctx, cancel := context.WithCancel(ctx)
+	sub := &subscription{
+		key:    key,
+		src:    src,
+		kind:   kind,
+		decode: decode,
+		o:      o,
+		cancel: cancel,
+		abort:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go sub.run(ctx)
+	return sub
+}
+
+// subscription is one active Subscribe call.
+type subscription struct {
+	key    string
+	src    Source
+	kind   string // what the messages carry, for the logs
+	decode func(Message) (job, error)
+	o      domain.SubscribeOptions
+
+	cancel    context.CancelFunc // starts a graceful stop
+	abort     chan struct{}      // closed when Stop gives up waiting
+	abortOnce sync.Once
+	done      chan struct{} // closed when run returns
+	err       error         // final error, valid once done is closed
+}
+
+var _ domain.Subscription = (*subscription)(nil)
+
+// job is a decoded delivery waiting for a worker.
+type job struct {
+	d      Delivery
+	id     string
+	symbol string
+	handle func() error
+}
+
+// Stop cancels the consumer, lets the handlers finish the trades already
+// delivered and settles them. If ctx is done first, the source is closed
+// right away so the broker redelivers whatever is still unsettled, and
+// ctx.Err() is returned.
+func (sub *subscription) Stop(ctx context.Context) error {
+	sub.cancel()
+	select {
+	case <-sub.done:
+		return sub.err
+	case <-ctx.Done():
+		sub.abortOnce.Do(func() { close(sub.abort) })
+		<-sub.done
+		return ctx.Err()
+	}
+}
+
+// Wait blocks until the subscription has ended and returns its final error.
+func (sub *subscription) Wait() error {
+	<-sub.done
+	return sub.err
+}
+
+// run dispatches deliveries to the workers. Once ctx is done it cancels the
+// consumer, dispatches the deliveries already fetched and waits for the
+// workers.
+func (sub *subscription) run(ctx context.Context) {
+	defer close(sub.done)
+	defer sub.cancel()
+	defer sub.src.Close()
+
+	workers := sub.o.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	buffer := sub.o.Prefetch
+	if buffer < 1 {
+		buffer = 1
+	}
+
+	var wg sync.WaitGroup
+	shards := make([]chan job, workers)
+	for i := range shards {
+		shards[i] = make(chan job, buffer)
+		wg.Add(1)
+		go func(jobs <-chan job) {
+			defer wg.Done()
+			for j := range jobs {
+				sub.process(ctx, j)
+			}
+		}(shards[i])
+	}
+	defer func() {
+		for _, jobs := range shards {
+			close(jobs)
+		}
+		idle := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(idle)
+		}()
+		select {
+		case <-idle:
+		case <-sub.abort:
+		}
+	}()
+
+	stopping := ctx.Done()
+	stopped := false
+	deliveries := sub.src.Deliveries()
+	for {
+		select {
+		case <-stopping:
+			stopping = nil
+			stopped = true
+			sub.src.Cancel()
+		case <-sub.abort:
+			return
+		case d, ok := <-deliveries:
+			if !ok {
+				if err := sub.src.Err(); err != nil && !stopped {
+					sub.err = fmt.Errorf("subscription %q: %w", sub.key, err)
+				}
+				return
+			}
+			if sub.o.MessageTTL > 0 && !d.Published.IsZero() && time.Since(d.Published) > sub.o.MessageTTL {
+				d.Reject()
+				continue
+			}
+			if !sub.o.ManualAck {
+				d.Ack()
+			}
+			j, err := sub.decode(d.Message)
+			if err != nil {
+				log.Printf("Error decoding %s: %v", sub.kind, err)
+				if sub.o.ManualAck {
+					d.Reject()
+				}
+				continue
+			}
+			j.d = d
+
+			select {
+			case shards[ShardOf(j.symbol, workers)] <- j:
+			case <-sub.abort:
+				return
+			}
+		}
+	}
+}
+
+// process runs the handler for one message, retrying it on error with
+// manual acks, and settles its delivery.
+func (sub *subscription) process(ctx context.Context, j job) {
+	d := j.d
+	if d.Requeue != nil {
+		sub.requeueing(ctx, j)
+		return
+	}
+	for attempt := 1; ; attempt++ {
+		err := d.handle(j.handle)
+		if !sub.o.ManualAck {
+			if err != nil {
+				log.Printf("Error handling %s: %v", sub.kind, err)
+			}
+			return
+		}
+		if err == nil {
+			d.Ack()
+			return
+		}
+		if attempt > sub.o.MaxRetries {
+			log.Printf("Error handling %s %s, giving up after %d retries: %v", sub.kind, j.id, sub.o.MaxRetries, err)
+			d.Reject()
+			return
+		}
+		delay := backoff(attempt)
+		log.Printf("Error handling %s %s (attempt %d/%d), retrying in %v: %v", sub.kind, j.id, attempt, sub.o.MaxRetries, delay, err)
+		if !sub.sleep(ctx, delay) {
+			return
+		}
+	}
+}
+
+// requeueing runs the handler for one message from a source that can
+// requeue, and settles its delivery, requeueing it on error with manual
+// acks. The source counts the attempts, so that they add up across
+// competing consumers.
+func (sub *subscription) requeueing(ctx context.Context, j job) {
+	d := j.d
+	err := d.handle(j.handle)
+	if !sub.o.ManualAck {
+		if err != nil {
+			log.Printf("Error handling %s: %v", sub.kind, err)
+		}
+		return
+	}
+
+	if err == nil {
+		d.Ack()
+		return
+	}
+
+	if d.Attempt > sub.o.MaxRetries {
+		log.Printf("Error handling %s %s, giving up after %d retries: %v", sub.kind, j.id, sub.o.MaxRetries, err)
+		d.Reject()
+		return
+	}
+	delay := backoff(d.Attempt)
+	log.Printf("Error handling %s %s (attempt %d/%d), requeueing in %v: %v", sub.kind, j.id, d.Attempt, sub.o.MaxRetries, delay, err)
+	if sub.sleep(ctx, delay) {
+		d.Requeue()
+	}
+}
+
+// sleep waits for delay before a message is retried. It reports false if
+// the subscription stopped first, which leaves the message to be
+// redelivered.
+func (sub *subscription) sleep(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-sub.abort:
+		return false
+	}
+}
+
+// backoff returns the delay before retrying a message that failed attempt
+// times.
+func backoff(attempt int) time.Duration {
+	d := retryBackoff
+	for i := 1; i < attempt && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxRetryBackoff)
+}
+
+// ShardOf maps a symbol to the one of n workers that handles its messages.
+func ShardOf(symbol string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(symbol))
+	return int(h.Sum32() % uint32(n))
+}
@@ -0,0 +1,114 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// fakeSource hands over the deliveries sent to it and records how they
+// were settled.
+type fakeSource struct {
+	ch   chan Delivery
+	once sync.Once
+
+	mu      sync.Mutex
+	settled []string
+}
+
+func newFakeSource() *fakeSource {
+	return &fakeSource{ch: make(chan Delivery, 8)}
+}
+
+func (s *fakeSource) send(t *testing.T, trade domain.Trade) {
+	t.Helper()
+	m, err := NewEncoder().Trade(trade)
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	s.ch <- Delivery{
+		Message: m,
+		Ack:     func() { s.settle("ack") },
+		Reject:  func() { s.settle("reject") },
+	}
+}
+
+func (s *fakeSource) settle(how string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settled = append(s.settled, how)
+}
+
+func (s *fakeSource) outcomes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.settled...)
+}
+
+func (s *fakeSource) Deliveries() <-chan Delivery { return s.ch }
+func (s *fakeSource) Cancel()                     { s.once.Do(func() { close(s.ch) }) }
+func (s *fakeSource) Err() error                  { return nil }
+func (s *fakeSource) Close()                      { s.Cancel() }
+
+func TestDispatch_BacksOffBetweenRetries(t *testing.T) {
+	src := newFakeSource()
+	var attempts []time.Time
+	handled := make(chan struct{}, 4)
+	sub := Dispatch(context.Background(), "market.#", src, NewDecoder(), func(domain.Trade) error {
+		attempts = append(attempts, time.Now())
+		handled <- struct{}{}
+		return errors.New("database down")
+	}, domain.NewSubscribeOptions(domain.WithManualAck(2)))
+	src.send(t, domain.Trade{ID: "t1", Symbol: "BTC", TargetCurrency: "USD"})
+	for range 3 {
+		<-handled
+	}
+	if err := sub.Stop(context.Background()); err != nil {
+		t.Fatalf("failed to stop: %v", err)
+	}
+
+	if got := src.outcomes(); len(got) != 1 || got[0] != "reject" {
+		t.Fatalf("expected the trade to be rejected once, got %v", got)
+	}
+	for i, want := range []time.Duration{retryBackoff, 2 * retryBackoff} {
+		if gap := attempts[i+1].Sub(attempts[i]); gap < want {
+			t.Errorf("retry %d came after %v, expected at least %v", i+1, gap, want)
+		}
+	}
+}
+
+func TestDispatch_StopDuringBackoffLeavesTradeUnsettled(t *testing.T) {
+	src := newFakeSource()
+	handled := make(chan struct{}, 1)
+	sub := Dispatch(context.Background(), "market.#", src, NewDecoder(), func(domain.Trade) error {
+		handled <- struct{}{}
+		return errors.New("database down")
+	}, domain.NewSubscribeOptions(domain.WithManualAck(5)))
+	src.send(t, domain.Trade{ID: "t1", Symbol: "BTC", TargetCurrency: "USD"})
+	<-handled
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := sub.Stop(ctx); err != nil {
+		t.Fatalf("expected the stop not to wait for the retries, got %v", err)
+	}
+	if got := src.outcomes(); len(got) != 0 {
+		t.Errorf("expected the trade to be left for redelivery, got %v", got)
+	}
+}
+
+func TestBackoff_IsBounded(t *testing.T) {
+	if got := backoff(1); got != retryBackoff {
+		t.Errorf("expected the first retry after %v, got %v", retryBackoff, got)
+	}
+	if got := backoff(3); got != 4*retryBackoff {
+		t.Errorf("expected the delay to double, got %v", got)
+	}
+	if got := backoff(100); got != maxRetryBackoff {
+		t.Errorf("expected the delay to be capped at %v, got %v", maxRetryBackoff, got)
+	}
+}
@@ -0,0 +1,248 @@
+// Package broker holds what the broker adapters share: the wire form of
+// messages, which carries the envelope in string headers, and the dispatch
+// of deliveries to trade and order handlers.
+package broker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/codec"
+)
+
+// Headers carrying the content type, message ID and envelope. The envelope
+// headers are named like their AMQP counterparts.
+const (
+	HeaderContentType   = "content-type"
+	HeaderMessageID     = "message-id"
+	HeaderMessageType   = "message-type"
+	HeaderSchemaVersion = "schema-version"
+	HeaderProducerID    = "producer-id"
+	HeaderCorrelationID = "correlation-id"
+)
+
+// Message is a trade, candle, alert or order in wire form.
+type Message struct {
+	Key     domain.RoutingKey
+	Headers map[string]string
+	Body    []byte
+	// Value is the message itself, for in-process brokers that pass
+	// messages as values. Headers and Body are then unused.
+	Value any
+}
+
+// Envelope decodes the envelope of m. Messages without one are treated as
+// schema version 1.
+func (m Message) Envelope() domain.Envelope {
+	env := domain.Envelope{
+		SchemaVersion: 1,
+		MessageType:   m.Headers[HeaderMessageType],
+		ProducerID:    m.Headers[HeaderProducerID],
+		CorrelationID: m.Headers[HeaderCorrelationID],
+	}
+	if v, err := strconv.Atoi(m.Headers[HeaderSchemaVersion]); err == nil {
+		env.SchemaVersion = v
+	}
+	return env
+}
+
+// PublisherOption configures how a publisher encodes messages.
+type PublisherOption func(*Encoder)
+
+// WithCodec sets the wire format messages are encoded in. Defaults to JSON.
+func WithCodec(c codec.Codec) PublisherOption {
+	return func(e *Encoder) {
+		e.codec = c
+	}
+}
+
+// WithProducerID sets the producer ID sent in the message envelope.
+// Defaults to <program>@<host>.
+func WithProducerID(id string) PublisherOption {
+	return func(e *Encoder) {
+		e.producerID = id
+	}
+}
+
+// Encoder turns trades, candles, alerts and orders into messages.
+type Encoder struct {
+	codec      codec.Codec
+	producerID string
+}
+
+// NewEncoder applies opts over the defaults.
+func NewEncoder(opts ...PublisherOption) Encoder {
+	e := Encoder{codec: codec.JSON, producerID: defaultProducerID()}
+	for _, opt := range opts {
+		opt(&e)
+	}
+	return e
+}
+
+// Trade encodes a trade for market.<symbol>.<target>.
+func (e Encoder) Trade(trade domain.Trade) (Message, error) {
+	key, err := domain.TradeRoutingKey(trade)
+	if err != nil {
+		return Message{}, err
+	}
+	return e.encode(key, trade, trade.ID, domain.Envelope{
+		MessageType:   domain.TradeMessageType,
+		SchemaVersion: domain.TradeSchemaVersion,
+		CorrelationID: trade.ID,
+	})
+}
+
+// Candle encodes a candle for candles.<symbol>.<target>.<interval>. The
+// message ID identifies the bar, so consumers can drop duplicates.
+func (e Encoder) Candle(candle domain.Candle) (Message, error) {
+	key, err := domain.CandleRoutingKey(candle)
+	if err != nil {
+		return Message{}, err
+	}
+	id := fmt.Sprintf("%s@%d", key, candle.Start.Unix())
+	return e.encode(key, candle, id, domain.Envelope{
+		MessageType:   domain.CandleMessageType,
+		SchemaVersion: domain.CandleSchemaVersion,
+		CorrelationID: id,
+	})
+}
+
+// Alert encodes an alert for alerts.<symbol>.<target>. The message ID
+// identifies the rule and trade that raised it.
+func (e Encoder) Alert(alert domain.Alert) (Message, error) {
+	key, err := domain.AlertRoutingKey(alert)
+	if err != nil {
+		return Message{}, err
+	}
+	return e.encode(key, alert, alert.Rule+"@"+alert.TradeID, domain.Envelope{
+		MessageType:   domain.AlertMessageType,
+		SchemaVersion: domain.AlertSchemaVersion,
+		CorrelationID: alert.TradeID,
+	})
+}
+
+// Order encodes an order for orders.<symbol>.<target>. The message ID
+// includes the order type, so a cancel is not dropped as a duplicate of the
+// order it cancels.
+func (e Encoder) Order(order domain.Order) (Message, error) {
+	key, err := domain.OrderRoutingKey(order)
+	if err != nil {
+		return Message{}, err
+	}
+	return e.encode(key, order, string(order.Type)+"@"+order.ID, domain.Envelope{
+		MessageType:   domain.OrderMessageType,
+		SchemaVersion: domain.OrderSchemaVersion,
+		CorrelationID: order.ID,
+	})
+}
+
+func (e Encoder) encode(key domain.RoutingKey, v any, id string, env domain.Envelope) (Message, error) {
+	body, err := e.codec.Marshal(v)
+	if err != nil {
+		return Message{}, fmt.Errorf("could not marshal %s: %w", env.MessageType, err)
+	}
+	h := map[string]string{
+		HeaderContentType:   e.codec.ContentType(),
+		HeaderMessageID:     id,
+		HeaderMessageType:   env.MessageType,
+		HeaderSchemaVersion: strconv.Itoa(env.SchemaVersion),
+	}
+	if e.producerID != "" {
+		h[HeaderProducerID] = e.producerID
+	}
+	if env.CorrelationID != "" {
+		h[HeaderCorrelationID] = env.CorrelationID
+	}
+	return Message{Key: key, Headers: h, Body: body}, nil
+}
+
+// SubscriberOption configures how a subscriber decodes trades.
+type SubscriberOption func(*Decoder)
+
+// WithCodecs sets the codecs used to decode trades according to their
+// content type. Defaults to codec.Default().
+func WithCodecs(r *codec.Registry) SubscriberOption {
+	return func(d *Decoder) {
+		d.codecs = r
+	}
+}
+
+// WithUpcasters sets the upcasters applied to trades from older producers.
+// Defaults to domain.DefaultTradeUpcasters().
+func WithUpcasters(u *domain.TradeUpcasters) SubscriberOption {
+	return func(d *Decoder) {
+		d.upcasters = u
+	}
+}
+
+// Decoder turns messages back into trades and orders.
+type Decoder struct {
+	codecs    *codec.Registry
+	upcasters *domain.TradeUpcasters
+}
+
+// NewDecoder applies opts over the defaults.
+func NewDecoder(opts ...SubscriberOption) Decoder {
+	d := Decoder{codecs: codec.Default(), upcasters: domain.DefaultTradeUpcasters()}
+	for _, opt := range opts {
+		opt(&d)
+	}
+	return d
+}
+
+// Trade unmarshals m according to its content type and upcasts it to the
+// current trade schema.
+func (d Decoder) Trade(m Message) (domain.Trade, error) {
+	var trade domain.Trade
+	if m.Value != nil {
+		trade, ok := m.Value.(domain.Trade)
+		if !ok {
+			return trade, fmt.Errorf("%s carries a %T", m.Key, m.Value)
+		}
+		return trade, nil
+	}
+	env := m.Envelope()
+	if env.MessageType != "" && env.MessageType != domain.TradeMessageType {
+		return trade, fmt.Errorf("%w: message type %q", domain.ErrUnsupportedSchema, env.MessageType)
+	}
+	if err := d.codecs.Unmarshal(m.Headers[HeaderContentType], m.Body, &trade); err != nil {
+		return trade, err
+	}
+	if err := d.upcasters.Upcast(env.SchemaVersion, &trade); err != nil {
+		return trade, fmt.Errorf("trade %s from %q: %w", trade.ID, env.ProducerID, err)
+	}
+	return trade, nil
+}
+
+// Order unmarshals m according to its content type.
+func (d Decoder) Order(m Message) (domain.Order, error) {
+	var order domain.Order
+	if m.Value != nil {
+		order, ok := m.Value.(domain.Order)
+		if !ok {
+			return order, fmt.Errorf("%s carries a %T", m.Key, m.Value)
+		}
+		return order, nil
+	}
+	env := m.Envelope()
+	if env.MessageType != domain.OrderMessageType {
+		return order, fmt.Errorf("%w: message type %q", domain.ErrUnsupportedSchema, env.MessageType)
+	}
+	if env.SchemaVersion != domain.OrderSchemaVersion {
+		return order, fmt.Errorf("%w: order version %d (current %d)", domain.ErrUnsupportedSchema, env.SchemaVersion, domain.OrderSchemaVersion)
+	}
+	err := d.codecs.Unmarshal(m.Headers[HeaderContentType], m.Body, &order)
+	return order, err
+}
+
+// defaultProducerID identifies this process as <program>@<host>.
+func defaultProducerID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return filepath.Base(os.Args[0]) + "@" + host
+}
@@ -0,0 +1,117 @@
+package broker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/codec"
+)
+
+func TestEncoder_TradeRoundTrip(t *testing.T) {
+	want := domain.Trade{
+		ID:             "t1",
+		Symbol:         "BTC",
+		TargetCurrency: "JPY",
+		Price:          100,
+		Amount:         0.5,
+		Timestamp:      time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		Side:           domain.SideSell,
+	}
+	for _, c := range []codec.Codec{codec.JSON, codec.Protobuf, codec.Msgpack} {
+		m, err := NewEncoder(WithCodec(c), WithProducerID("test")).Trade(want)
+		if err != nil {
+			t.Fatalf("%s: failed to encode: %v", c.ContentType(), err)
+		}
+		if m.Key != "market.btc.jpy" {
+			t.Errorf("%s: unexpected key %s", c.ContentType(), m.Key)
+		}
+		env := m.Envelope()
+		if env.MessageType != domain.TradeMessageType || env.SchemaVersion != domain.TradeSchemaVersion || env.ProducerID != "test" || env.CorrelationID != "t1" {
+			t.Errorf("%s: unexpected envelope %+v", c.ContentType(), env)
+		}
+
+		got, err := NewDecoder().Trade(m)
+		if err != nil {
+			t.Fatalf("%s: failed to decode: %v", c.ContentType(), err)
+		}
+		if !got.Timestamp.Equal(want.Timestamp) {
+			t.Errorf("%s: expected timestamp %v, got %v", c.ContentType(), want.Timestamp, got.Timestamp)
+		}
+		got.Timestamp = want.Timestamp
+		if got != want {
+			t.Errorf("%s: expected %+v, got %+v", c.ContentType(), want, got)
+		}
+	}
+}
+
+func TestDecoder_RejectsOtherMessageTypes(t *testing.T) {
+	m, err := NewEncoder().Candle(domain.Candle{Symbol: "BTC", TargetCurrency: "USD", Interval: "1m"})
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	if _, err := NewDecoder().Trade(m); !errors.Is(err, domain.ErrUnsupportedSchema) {
+		t.Errorf("expected ErrUnsupportedSchema, got %v", err)
+	}
+}
+
+func TestEncoder_OrderRoundTrip(t *testing.T) {
+	want := domain.Order{
+		ID:             "o1",
+		Trader:         "bot-1",
+		Symbol:         "ETH",
+		TargetCurrency: "USD",
+		Type:           domain.OrderLimit,
+		Side:           domain.SideBuy,
+		Price:          3000,
+		Amount:         2,
+		Timestamp:      time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+	}
+	for _, c := range []codec.Codec{codec.JSON, codec.Msgpack} {
+		m, err := NewEncoder(WithCodec(c)).Order(want)
+		if err != nil {
+			t.Fatalf("%s: failed to encode: %v", c.ContentType(), err)
+		}
+		if m.Key != "orders.eth.usd" || m.Headers[HeaderMessageID] != "limit@o1" {
+			t.Errorf("%s: unexpected key %s and headers %v", c.ContentType(), m.Key, m.Headers)
+		}
+		got, err := NewDecoder().Order(m)
+		if err != nil {
+			t.Fatalf("%s: failed to decode: %v", c.ContentType(), err)
+		}
+		if !got.Timestamp.Equal(want.Timestamp) {
+			t.Errorf("%s: expected timestamp %v, got %v", c.ContentType(), want.Timestamp, got.Timestamp)
+		}
+		got.Timestamp = want.Timestamp
+		if got != want {
+			t.Errorf("%s: expected %+v, got %+v", c.ContentType(), want, got)
+		}
+	}
+
+	trade, err := NewEncoder().Trade(domain.Trade{ID: "t1", Symbol: "ETH", TargetCurrency: "USD"})
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	if _, err := NewDecoder().Order(trade); !errors.Is(err, domain.ErrUnsupportedSchema) {
+		t.Errorf("expected a trade to be rejected as an order, got %v", err)
+	}
+}
+
+func TestMessage_EnvelopeDefaultsToVersion1(t *testing.T) {
+	if v := (Message{}).Envelope().SchemaVersion; v != 1 {
+		t.Errorf("expected schema version 1, got %d", v)
+	}
+}
+
+func TestCheckOptions(t *testing.T) {
+	if err := CheckOptions(domain.NewSubscribeOptions(domain.WithMaxLength(1))); !errors.Is(err, ErrUnsupportedOption) {
+		t.Errorf("expected ErrUnsupportedOption, got %v", err)
+	}
+	if err := CheckOptions(domain.NewSubscribeOptions(domain.WithQuorumQueue())); err == nil {
+		t.Error("expected a quorum queue without a name to be rejected")
+	}
+	if err := CheckOptions(domain.NewSubscribeOptions(domain.WithQuorumQueue(), domain.WithDurableQueue("q"), domain.WithMessageTTL(time.Minute))); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
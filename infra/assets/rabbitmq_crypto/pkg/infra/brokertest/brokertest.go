@@ -0,0 +1,386 @@
+// Package brokertest checks that a broker adapter routes, shares and
+// settles trades and orders like the RabbitMQ topic exchange it stands in
+// for. Call Run from the adapter's tests.
+package brokertest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// timeout bounds every wait; brokers with consumer groups take a while to
+// settle in.
+const timeout = 10 * time.Second
+
+// Broker is an adapter under test.
+type Broker struct {
+	Publisher       domain.TradePublisher
+	Subscriber      domain.TradeSubscriber
+	OrderPublisher  domain.OrderPublisher
+	OrderSubscriber domain.OrderSubscriber
+	// DeadLetterExchange receives the trades given up on, and DeadLetters
+	// counts them.
+	DeadLetterExchange string
+	DeadLetters        func() int
+}
+
+// Run tests the broker returned by open, which must be fresh: no queues and
+// no trades left from other tests.
+func Run(t *testing.T, open func(t *testing.T) Broker) {
+	t.Run("Routing", func(t *testing.T) { testRouting(t, open(t)) })
+	t.Run("CompetingConsumers", func(t *testing.T) { testCompetingConsumers(t, open(t)) })
+	t.Run("DurableResume", func(t *testing.T) { testDurableResume(t, open(t)) })
+	t.Run("RetryUntilSuccess", func(t *testing.T) { testRetryUntilSuccess(t, open(t)) })
+	t.Run("RetryThenDeadLetter", func(t *testing.T) { testRetryThenDeadLetter(t, open(t)) })
+	t.Run("PerSymbolOrder", func(t *testing.T) { testPerSymbolOrder(t, open(t)) })
+	t.Run("StopDrains", func(t *testing.T) { testStopDrains(t, open(t)) })
+	t.Run("InvalidKeys", func(t *testing.T) { testInvalidKeys(t, open(t)) })
+	t.Run("Orders", func(t *testing.T) { testOrders(t, open(t)) })
+}
+
+func trade(id, symbol, target string) domain.Trade {
+	return domain.Trade{
+		ID:             id,
+		Symbol:         symbol,
+		TargetCurrency: target,
+		Price:          100,
+		Amount:         1,
+		Timestamp:      time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		Side:           domain.SideBuy,
+	}
+}
+
+func eventually(t *testing.T, cond func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", msg)
+}
+
+// recorder collects the IDs of the trades a handler saw.
+type recorder struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+func (r *recorder) handle(trade domain.Trade) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ids = append(r.ids, trade.ID)
+	return nil
+}
+
+func (r *recorder) seen() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.ids)
+}
+
+func subscribe(t *testing.T, b Broker, pattern string, handler func(domain.Trade) error, opts ...domain.SubscribeOption) domain.Subscription {
+	t.Helper()
+	sub, err := b.Subscriber.Subscribe(context.Background(), pattern, handler, opts...)
+	if err != nil {
+		t.Fatalf("failed to subscribe to %s: %v", pattern, err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		sub.Stop(ctx)
+	})
+	return sub
+}
+
+func publish(t *testing.T, b Broker, trades ...domain.Trade) {
+	t.Helper()
+	for _, tr := range trades {
+		if err := b.Publisher.Publish(context.Background(), tr); err != nil {
+			t.Fatalf("failed to publish %s: %v", tr.ID, err)
+		}
+	}
+}
+
+// testRouting checks the topic matching rules of RabbitMQ, including "#"
+// matching zero segments.
+func testRouting(t *testing.T, b Broker) {
+	trades := []domain.Trade{
+		trade("btc-usd", "BTC", "USD"),
+		trade("eth-jpy", "ETH", "JPY"),
+		trade("xrp-usd", "XRP", "USD"),
+	}
+	cases := []struct {
+		pattern string
+		want    []string
+	}{
+		{"market.#", []string{"btc-usd", "eth-jpy", "xrp-usd"}},
+		{"market.btc.usd", []string{"btc-usd"}},
+		{"market.*.jpy", []string{"eth-jpy"}},
+		{"#.usd", []string{"btc-usd", "xrp-usd"}},
+		{"#.eth.#", []string{"eth-jpy"}},
+		{"*.*.*", []string{"btc-usd", "eth-jpy", "xrp-usd"}},
+		{"market.btc.usd.#", []string{"btc-usd"}},
+		{"market.*", nil},
+		{"candles.#", nil},
+	}
+	recorders := make([]*recorder, len(cases))
+	for i, tc := range cases {
+		recorders[i] = &recorder{}
+		subscribe(t, b, tc.pattern, recorders[i].handle)
+	}
+
+	publish(t, b, trades...)
+	for i, tc := range cases {
+		eventually(t, func() bool { return len(recorders[i].seen()) >= len(tc.want) }, tc.pattern)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for i, tc := range cases {
+		got := recorders[i].seen()
+		slices.Sort(got)
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%s: expected %v, got %v", tc.pattern, tc.want, got)
+		}
+	}
+}
+
+// testCompetingConsumers checks that consumers of one durable queue split
+// the trades instead of each getting a copy.
+func testCompetingConsumers(t *testing.T, b Broker) {
+	var rec recorder
+	for range 2 {
+		subscribe(t, b, "market.#", rec.handle, domain.WithDurableQueue("brokertest.competing"))
+	}
+
+	var want []string
+	for i := range 20 {
+		tr := trade(fmt.Sprintf("t%02d", i), []string{"BTC", "ETH", "XRP", "SOL"}[i%4], "USD")
+		want = append(want, tr.ID)
+		publish(t, b, tr)
+	}
+	eventually(t, func() bool { return len(rec.seen()) >= len(want) }, "20 trades")
+	time.Sleep(100 * time.Millisecond)
+	got := rec.seen()
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Errorf("expected every trade exactly once, got %v", got)
+	}
+}
+
+// testDurableResume checks that a durable queue keeps the trades published
+// while nobody consumes from it.
+func testDurableResume(t *testing.T, b Broker) {
+	const queue = "brokertest.resume"
+	var first recorder
+	sub := subscribe(t, b, "market.#", first.handle, domain.WithDurableQueue(queue), domain.WithManualAck(0))
+	publish(t, b, trade("t1", "BTC", "USD"))
+	eventually(t, func() bool { return len(first.seen()) == 1 }, "t1")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := sub.Stop(ctx); err != nil {
+		t.Fatalf("failed to stop: %v", err)
+	}
+
+	publish(t, b, trade("t2", "BTC", "USD"))
+	var second recorder
+	subscribe(t, b, "market.#", second.handle, domain.WithDurableQueue(queue), domain.WithManualAck(0))
+	eventually(t, func() bool { return len(second.seen()) >= 1 }, "t2")
+	time.Sleep(100 * time.Millisecond)
+	if got := second.seen(); !slices.Equal(got, []string{"t2"}) {
+		t.Errorf("expected only t2 after the restart, got %v", got)
+	}
+}
+
+func testRetryUntilSuccess(t *testing.T, b Broker) {
+	var mu sync.Mutex
+	calls := 0
+	handled := make(chan struct{})
+	subscribe(t, b, "market.#", func(trade domain.Trade) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls < 3 {
+			return errors.New("not yet")
+		}
+		close(handled)
+		return nil
+	}, domain.WithManualAck(3), domain.WithDeadLetter(b.DeadLetterExchange))
+
+	publish(t, b, trade("t1", "BTC", "USD"))
+	select {
+	case <-handled:
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for the third attempt")
+	}
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 3 {
+		t.Errorf("expected 3 calls, got %d", calls)
+	}
+	if n := b.DeadLetters(); n != 0 {
+		t.Errorf("expected no dead letters, got %d", n)
+	}
+}
+
+func testRetryThenDeadLetter(t *testing.T, b Broker) {
+	var mu sync.Mutex
+	calls := 0
+	subscribe(t, b, "market.#", func(trade domain.Trade) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return errors.New("poison")
+	}, domain.WithManualAck(2), domain.WithDeadLetter(b.DeadLetterExchange))
+
+	publish(t, b, trade("t1", "BTC", "USD"))
+	eventually(t, func() bool { return b.DeadLetters() == 1 }, "the dead letter")
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 3 {
+		t.Errorf("expected 1 attempt and 2 retries, got %d calls", calls)
+	}
+}
+
+// testPerSymbolOrder checks that parallel workers keep the order of the
+// trades of each symbol.
+func testPerSymbolOrder(t *testing.T, b Broker) {
+	var mu sync.Mutex
+	got := make(map[string][]string)
+	subscribe(t, b, "market.#", func(trade domain.Trade) error {
+		mu.Lock()
+		defer mu.Unlock()
+		got[trade.Symbol] = append(got[trade.Symbol], trade.ID)
+		return nil
+	}, domain.WithWorkers(4), domain.WithPrefetch(16), domain.WithManualAck(0))
+
+	want := make(map[string][]string)
+	for i := range 60 {
+		symbol := []string{"BTC", "ETH", "XRP"}[i%3]
+		tr := trade(fmt.Sprintf("%s-%02d", symbol, i), symbol, "USD")
+		want[symbol] = append(want[symbol], tr.ID)
+		publish(t, b, tr)
+	}
+	eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(got["BTC"])+len(got["ETH"])+len(got["XRP"]) == 60
+	}, "60 trades")
+
+	mu.Lock()
+	defer mu.Unlock()
+	for symbol, ids := range want {
+		if !slices.Equal(got[symbol], ids) {
+			t.Errorf("%s: expected %v, got %v", symbol, ids, got[symbol])
+		}
+	}
+}
+
+// testStopDrains checks that Stop waits for the handlers and that nothing
+// is handled once it returned.
+func testStopDrains(t *testing.T, b Broker) {
+	var mu sync.Mutex
+	started, handled := 0, 0
+	first := make(chan struct{}, 1)
+	sub := subscribe(t, b, "market.#", func(trade domain.Trade) error {
+		mu.Lock()
+		started++
+		mu.Unlock()
+		select {
+		case first <- struct{}{}:
+		default:
+		}
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		handled++
+		return nil
+	}, domain.WithManualAck(0), domain.WithPrefetch(10))
+
+	for i := range 10 {
+		publish(t, b, trade(fmt.Sprintf("t%d", i), "BTC", "USD"))
+	}
+	select {
+	case <-first:
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for the first trade")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := sub.Stop(ctx); err != nil {
+		t.Fatalf("failed to stop: %v", err)
+	}
+	if err := sub.Wait(); err != nil {
+		t.Errorf("expected a clean end, got %v", err)
+	}
+
+	mu.Lock()
+	stopped := handled
+	if stopped == 0 || stopped != started {
+		t.Errorf("expected every started trade to finish before Stop returned, %d of %d did", stopped, started)
+	}
+	mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if handled != stopped {
+		t.Errorf("expected no trades after Stop, got %d more", handled-stopped)
+	}
+}
+
+func testInvalidKeys(t *testing.T, b Broker) {
+	_, err := b.Subscriber.Subscribe(context.Background(), "market..btc", func(domain.Trade) error { return nil })
+	if !errors.Is(err, domain.ErrInvalidTopicPattern) {
+		t.Errorf("expected ErrInvalidTopicPattern, got %v", err)
+	}
+	err = b.Publisher.Publish(context.Background(), trade("t1", "BTC.X", "USD"))
+	if !errors.Is(err, domain.ErrInvalidRoutingKey) {
+		t.Errorf("expected ErrInvalidRoutingKey, got %v", err)
+	}
+}
+
+// testOrders checks that orders share the exchange with trades without
+// being mistaken for them, and that a cancel follows the order it cancels.
+func testOrders(t *testing.T, b Broker) {
+	var orders recorder
+	sub, err := b.OrderSubscriber.SubscribeOrders(context.Background(), "orders.*.*", func(o domain.Order) error {
+		return orders.handle(domain.Trade{ID: string(o.Type) + "@" + o.ID})
+	}, domain.WithWorkers(4))
+	if err != nil {
+		t.Fatalf("failed to subscribe to orders: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		sub.Stop(ctx)
+	})
+	var trades recorder
+	subscribe(t, b, "#", trades.handle)
+
+	limit := domain.Order{ID: "o1", Symbol: "BTC", TargetCurrency: "USD", Type: domain.OrderLimit, Side: domain.SideBuy, Price: 100, Amount: 1}
+	cancel := domain.Order{ID: "o1", Symbol: "BTC", TargetCurrency: "USD", Type: domain.OrderCancel}
+	for _, o := range []domain.Order{limit, cancel} {
+		if err := b.OrderPublisher.PublishOrder(context.Background(), o); err != nil {
+			t.Fatalf("failed to send %s order: %v", o.Type, err)
+		}
+	}
+	publish(t, b, trade("t1", "BTC", "USD"))
+
+	eventually(t, func() bool { return len(orders.seen()) >= 2 && len(trades.seen()) >= 1 }, "orders and trade")
+	time.Sleep(100 * time.Millisecond)
+	if got := orders.seen(); !slices.Equal(got, []string{"limit@o1", "cancel@o1"}) {
+		t.Errorf("expected the order and then its cancel, got %v", got)
+	}
+	if got := trades.seen(); !slices.Equal(got, []string{"t1"}) {
+		t.Errorf("expected only the trade, got %v", got)
+	}
+}
@@ -0,0 +1,98 @@
+// Package codec provides the wire formats trades can be encoded in, keyed
+// by their MIME content type.
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// Content types of the supported wire formats.
+const (
+	JSONContentType     = "application/json"
+	ProtobufContentType = "application/x-protobuf"
+	MsgpackContentType  = "application/msgpack"
+)
+
+var (
+	// ErrUnsupportedContentType is returned when no codec is registered for a content type.
+	ErrUnsupportedContentType = errors.New("unsupported content type")
+	// ErrUnsupportedType is returned when a codec cannot encode or decode a Go type.
+	ErrUnsupportedType = errors.New("unsupported type")
+)
+
+// Codec encodes and decodes messages in one wire format.
+type Codec interface {
+	// ContentType is the MIME type sent alongside encoded messages.
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// Registry selects a codec by content type.
+type Registry struct {
+	codecs   map[string]Codec
+	fallback Codec
+}
+
+// NewRegistry creates a registry of the given codecs. The first one is used
+// for messages without a content type.
+func NewRegistry(codecs ...Codec) *Registry {
+	r := &Registry{codecs: make(map[string]Codec)}
+	for _, c := range codecs {
+		if r.fallback == nil {
+			r.fallback = c
+		}
+		r.codecs[c.ContentType()] = c
+	}
+	return r
+}
+
+// Default returns a registry of every supported codec, falling back to JSON.
+func Default() *Registry {
+	return NewRegistry(JSON, Protobuf, Msgpack)
+}
+
+// Lookup returns the codec for contentType. Parameters such as charset are
+// ignored and an empty content type selects the fallback codec.
+func (r *Registry) Lookup(contentType string) (Codec, error) {
+	if contentType == "" {
+		if r.fallback == nil {
+			return nil, fmt.Errorf("%w: empty", ErrUnsupportedContentType)
+		}
+		return r.fallback, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q: %v", ErrUnsupportedContentType, contentType, err)
+	}
+	c, ok := r.codecs[mediaType]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedContentType, contentType)
+	}
+	return c, nil
+}
+
+// Unmarshal decodes data with the codec registered for contentType.
+func (r *Registry) Unmarshal(contentType string, data []byte, v any) error {
+	c, err := r.Lookup(contentType)
+	if err != nil {
+		return err
+	}
+	return c.Unmarshal(data, v)
+}
+
+// ByName returns a codec by its short name: json, protobuf or msgpack.
+func ByName(name string) (Codec, error) {
+	switch strings.ToLower(name) {
+	case "json":
+		return JSON, nil
+	case "protobuf", "proto":
+		return Protobuf, nil
+	case "msgpack", "messagepack":
+		return Msgpack, nil
+	}
+	return nil, fmt.Errorf("unknown codec %q", name)
+}
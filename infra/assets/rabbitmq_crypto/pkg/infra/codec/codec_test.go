@@ -0,0 +1,118 @@
+package codec
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+func sampleTrade() domain.Trade {
+	return domain.Trade{
+		ID:             "0b6c3a9e",
+		Symbol:         "BTC",
+		TargetCurrency: "JPY",
+		Price:          9876543.21,
+		Amount:         0.125,
+		Timestamp:      time.Date(2026, 1, 10, 12, 30, 0, 123456789, time.UTC),
+		Side:           domain.SideSell,
+	}
+}
+
+func TestCodecs_RoundTrip(t *testing.T) {
+	want := sampleTrade()
+	for _, c := range []Codec{JSON, Protobuf, Msgpack} {
+		t.Run(c.ContentType(), func(t *testing.T) {
+			b, err := c.Marshal(want)
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			var got domain.Trade
+			if err := c.Unmarshal(b, &got); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			if !got.Timestamp.Equal(want.Timestamp) {
+				t.Errorf("timestamp: expected %v, got %v", want.Timestamp, got.Timestamp)
+			}
+			got.Timestamp = want.Timestamp
+			if got != want {
+				t.Errorf("expected %+v, got %+v", want, got)
+			}
+		})
+	}
+}
+
+func TestCodecs_CompactEncodings(t *testing.T) {
+	trade := sampleTrade()
+	j, _ := JSON.Marshal(trade)
+	for _, c := range []Codec{Protobuf, Msgpack} {
+		b, err := c.Marshal(trade)
+		if err != nil {
+			t.Fatalf("%s: %v", c.ContentType(), err)
+		}
+		if len(b) >= len(j) {
+			t.Errorf("%s: expected smaller than JSON (%d bytes), got %d", c.ContentType(), len(j), len(b))
+		}
+	}
+}
+
+func TestProtobuf_SkipsUnknownFields(t *testing.T) {
+	b, _ := Protobuf.Marshal(sampleTrade())
+	// field 15, varint 1 and field 16, bytes "x" as a newer producer might add.
+	b = append(b, 0x78, 0x01, 0x82, 0x01, 0x01, 'x')
+
+	var got domain.Trade
+	if err := Protobuf.Unmarshal(b, &got); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if got.ID != sampleTrade().ID {
+		t.Errorf("expected ID %s, got %s", sampleTrade().ID, got.ID)
+	}
+}
+
+func TestProtobuf_UnsupportedType(t *testing.T) {
+	if _, err := Protobuf.Marshal(struct{}{}); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("expected ErrUnsupportedType, got %v", err)
+	}
+	if err := Protobuf.Unmarshal(nil, &struct{}{}); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("expected ErrUnsupportedType, got %v", err)
+	}
+}
+
+func TestRegistry_Lookup(t *testing.T) {
+	r := Default()
+	cases := map[string]Codec{
+		"":                                JSON,
+		"application/json":                JSON,
+		"application/json; charset=utf-8": JSON,
+		"application/x-protobuf":          Protobuf,
+		"application/msgpack":             Msgpack,
+	}
+	for ct, want := range cases {
+		got, err := r.Lookup(ct)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", ct, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%q: expected %s, got %s", ct, want.ContentType(), got.ContentType())
+		}
+	}
+
+	if _, err := r.Lookup("text/plain"); !errors.Is(err, ErrUnsupportedContentType) {
+		t.Errorf("expected ErrUnsupportedContentType, got %v", err)
+	}
+}
+
+func TestByName(t *testing.T) {
+	for name, want := range map[string]Codec{"json": JSON, "protobuf": Protobuf, "msgpack": Msgpack} {
+		got, err := ByName(name)
+		if err != nil || got != want {
+			t.Errorf("%s: expected %s, got %v (%v)", name, want.ContentType(), got, err)
+		}
+	}
+	if _, err := ByName("xml"); err == nil {
+		t.Error("expected error for unknown codec")
+	}
+}
@@ -0,0 +1,134 @@
+package codec
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Protobuf encodes trades in the protocol buffers wire format described by
+//
+//	message Trade {
+//	  string id = 1;
+//	  string symbol = 2;
+//	  string target_currency = 3;
+//	  double price = 4;
+//	  double amount = 5;
+//	  int64 timestamp_unix_nano = 6;
+//	  string side = 7;
+//	}
+//
+// It is written against protowire directly so no generated code is needed.
+// Only domain.Trade is supported.
+var Protobuf Codec = protobufCodec{}
+
+type protobufCodec struct{}
+
+const (
+	tradeFieldID             protowire.Number = 1
+	tradeFieldSymbol         protowire.Number = 2
+	tradeFieldTargetCurrency protowire.Number = 3
+	tradeFieldPrice          protowire.Number = 4
+	tradeFieldAmount         protowire.Number = 5
+	tradeFieldTimestamp      protowire.Number = 6
+	tradeFieldSide           protowire.Number = 7
+)
+
+func (protobufCodec) ContentType() string { return ProtobufContentType }
+
+func (protobufCodec) Marshal(v any) ([]byte, error) {
+	var t domain.Trade
+	switch v := v.(type) {
+	case domain.Trade:
+		t = v
+	case *domain.Trade:
+		t = *v
+	default:
+		return nil, fmt.Errorf("%w: protobuf cannot encode %T", ErrUnsupportedType, v)
+	}
+
+	var b []byte
+	b = appendString(b, tradeFieldID, t.ID)
+	b = appendString(b, tradeFieldSymbol, t.Symbol)
+	b = appendString(b, tradeFieldTargetCurrency, t.TargetCurrency)
+	b = appendDouble(b, tradeFieldPrice, t.Price)
+	b = appendDouble(b, tradeFieldAmount, t.Amount)
+	if !t.Timestamp.IsZero() {
+		b = protowire.AppendTag(b, tradeFieldTimestamp, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(t.Timestamp.UnixNano()))
+	}
+	b = appendString(b, tradeFieldSide, t.Side)
+	return b, nil
+}
+
+func (protobufCodec) Unmarshal(data []byte, v any) error {
+	t, ok := v.(*domain.Trade)
+	if !ok {
+		return fmt.Errorf("%w: protobuf cannot decode into %T", ErrUnsupportedType, v)
+	}
+	*t = domain.Trade{}
+
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch {
+		case num == tradeFieldID && typ == protowire.BytesType:
+			t.ID, n = consumeString(data)
+		case num == tradeFieldSymbol && typ == protowire.BytesType:
+			t.Symbol, n = consumeString(data)
+		case num == tradeFieldTargetCurrency && typ == protowire.BytesType:
+			t.TargetCurrency, n = consumeString(data)
+		case num == tradeFieldPrice && typ == protowire.Fixed64Type:
+			t.Price, n = consumeDouble(data)
+		case num == tradeFieldAmount && typ == protowire.Fixed64Type:
+			t.Amount, n = consumeDouble(data)
+		case num == tradeFieldTimestamp && typ == protowire.VarintType:
+			var ns uint64
+			ns, n = protowire.ConsumeVarint(data)
+			t.Timestamp = time.Unix(0, int64(ns))
+		case num == tradeFieldSide && typ == protowire.BytesType:
+			t.Side, n = consumeString(data)
+		default:
+			// Skip fields added by newer producers.
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendDouble(b []byte, num protowire.Number, f float64) []byte {
+	if f == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(f))
+}
+
+func consumeString(b []byte) (string, int) {
+	v, n := protowire.ConsumeBytes(b)
+	return string(v), n
+}
+
+func consumeDouble(b []byte) (float64, int) {
+	v, n := protowire.ConsumeFixed64(b)
+	return math.Float64frombits(v), n
+}
@@ -0,0 +1,238 @@
+// Package gateway streams trades to browsers and other non-AMQP clients
+// over WebSocket and Server-Sent Events.
+//
+// Clients choose their trades with a topic pattern in the "topic" query
+// parameter, in the same syntax as AMQP bindings (market.*.jpy); it
+// defaults to market.#. Each trade is sent as its JSON encoding:
+//
+//	GET /ws?topic=market.btc.#    one text message per trade
+//	GET /sse?topic=market.*.jpy   one "trade" event per trade
+//
+// A client that stops reading is disconnected, either when the feed drops
+// its stream for falling behind or when a single write stalls for longer
+// than the write timeout.
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// Defaults used unless overridden by options.
+const (
+	defaultWriteTimeout = 10 * time.Second
+	defaultHeartbeat    = 15 * time.Second
+	defaultTopic        = domain.MarketTopic + ".#"
+)
+
+// Server serves the trade streams of a feed. It is an http.Handler.
+type Server struct {
+	feed         domain.TradeFeed
+	writeTimeout time.Duration
+	heartbeat    time.Duration
+	origins      []string
+	mux          *http.ServeMux
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithWriteTimeout sets how long sending one trade may take before the
+// client is considered stalled and disconnected.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.writeTimeout = d
+	}
+}
+
+// WithHeartbeat sets how often idle connections are pinged, so that
+// proxies keep them open and dead clients are noticed.
+func WithHeartbeat(d time.Duration) Option {
+	return func(s *Server) {
+		s.heartbeat = d
+	}
+}
+
+// WithAllowedOrigins lets pages served from other hosts connect. Patterns
+// are matched against the host of the Origin header with path.Match, e.g.
+// "*.example.com". Same-origin requests are always allowed.
+func WithAllowedOrigins(patterns ...string) Option {
+	return func(s *Server) {
+		s.origins = patterns
+	}
+}
+
+// New creates a Server streaming the trades of feed.
+func New(feed domain.TradeFeed, opts ...Option) *Server {
+	s := &Server{
+		feed:         feed,
+		writeTimeout: defaultWriteTimeout,
+		heartbeat:    defaultHeartbeat,
+		mux:          http.NewServeMux(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.mux.HandleFunc("GET /ws", s.serveWebSocket)
+	s.mux.HandleFunc("GET /sse", s.serveSSE)
+	s.mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// topic returns the pattern requested by r, or writes an error.
+func topic(w http.ResponseWriter, r *http.Request) (domain.TopicPattern, bool) {
+	q := r.URL.Query().Get("topic")
+	if q == "" {
+		q = defaultTopic
+	}
+	p, err := domain.ParseTopicPattern(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return p, true
+}
+
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	pattern, ok := topic(w, r)
+	if !ok {
+		return
+	}
+	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{OriginPatterns: s.origins})
+	if err != nil {
+		return // Accept has replied
+	}
+	defer c.CloseNow()
+	// Clients only listen; CloseRead handles control frames and ends ctx
+	// when the client goes away.
+	ctx := c.CloseRead(r.Context())
+
+	stream := s.feed.Listen(pattern)
+	defer stream.Close()
+	heartbeat := time.NewTicker(s.heartbeat)
+	defer heartbeat.Stop()
+
+	write := func(f func(ctx context.Context) error) bool {
+		ctx, cancel := context.WithTimeout(ctx, s.writeTimeout)
+		defer cancel()
+		return f(ctx) == nil
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			if !write(c.Ping) {
+				return
+			}
+		case trade, ok := <-stream.Trades():
+			if !ok {
+				code, reason := websocket.StatusGoingAway, "server shutting down"
+				if err := stream.Err(); err != nil {
+					code, reason = websocket.StatusTryAgainLater, err.Error()
+					log.Printf("Disconnecting WebSocket client %s (%s): %v", r.RemoteAddr, pattern, err)
+				}
+				c.Close(code, reason)
+				return
+			}
+			b, _ := json.Marshal(trade)
+			if !write(func(ctx context.Context) error { return c.Write(ctx, websocket.MessageText, b) }) {
+				log.Printf("Disconnecting stalled WebSocket client %s (%s)", r.RemoteAddr, pattern)
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) serveSSE(w http.ResponseWriter, r *http.Request) {
+	pattern, ok := topic(w, r)
+	if !ok {
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if !s.allowOrigin(r, origin) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+	}
+
+	rc := http.NewResponseController(w)
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no") // keep nginx from buffering the stream
+
+	stream := s.feed.Listen(pattern)
+	defer stream.Close()
+	heartbeat := time.NewTicker(s.heartbeat)
+	defer heartbeat.Stop()
+
+	send := func(format string, args ...any) bool {
+		rc.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	if !send(": %s\n\n", pattern) {
+		return
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if !send(": ping\n\n") {
+				return
+			}
+		case trade, ok := <-stream.Trades():
+			if !ok {
+				if err := stream.Err(); err != nil {
+					log.Printf("Disconnecting SSE client %s (%s): %v", r.RemoteAddr, pattern, err)
+					send("event: error\ndata: %s\n\n", err)
+				}
+				return
+			}
+			b, _ := json.Marshal(trade)
+			if !send("id: %s\nevent: trade\ndata: %s\n\n", trade.ID, b) {
+				log.Printf("Disconnecting stalled SSE client %s (%s)", r.RemoteAddr, pattern)
+				return
+			}
+		}
+	}
+}
+
+// allowOrigin applies the same rules to SSE as websocket.Accept does to
+// WebSocket handshakes.
+func (s *Server) allowOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if u.Host == r.Host {
+		return true
+	}
+	for _, p := range s.origins {
+		if ok, _ := path.Match(p, u.Host); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// fakeFeed hands out streams that the test feeds and ends by hand.
+type fakeFeed struct {
+	mu      sync.Mutex
+	streams []*fakeStream
+	opened  chan *fakeStream
+}
+
+func newFakeFeed() *fakeFeed {
+	return &fakeFeed{opened: make(chan *fakeStream, 10)}
+}
+
+func (f *fakeFeed) Listen(p domain.TopicPattern) domain.TradeStream {
+	s := &fakeStream{pattern: p, trades: make(chan domain.Trade, 10), closed: make(chan struct{})}
+	f.mu.Lock()
+	f.streams = append(f.streams, s)
+	f.mu.Unlock()
+	f.opened <- s
+	return s
+}
+
+type fakeStream struct {
+	pattern   domain.TopicPattern
+	trades    chan domain.Trade
+	err       error
+	closeOnce sync.Once
+	closed    chan struct{} // closed by the server
+}
+
+func (s *fakeStream) Trades() <-chan domain.Trade { return s.trades }
+func (s *fakeStream) Err() error                  { return s.err }
+func (s *fakeStream) Close()                      { s.closeOnce.Do(func() { close(s.closed) }) }
+
+// end ends the stream from the feed side, as a dropped listener would.
+func (s *fakeStream) end(err error) {
+	s.err = err
+	close(s.trades)
+}
+
+func (f *fakeFeed) next(t *testing.T) *fakeStream {
+	t.Helper()
+	select {
+	case s := <-f.opened:
+		return s
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a stream")
+		return nil
+	}
+}
+
+func waitClosed(t *testing.T, s *fakeStream) {
+	t.Helper()
+	select {
+	case <-s.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the server to close the stream")
+	}
+}
+
+var btc = domain.Trade{ID: "t1", Symbol: "BTC", TargetCurrency: "JPY", Price: 9000000, Amount: 0.5, Side: domain.SideBuy}
+
+func TestWebSocket_StreamsTradesOfTopic(t *testing.T) {
+	feed := newFakeFeed()
+	srv := httptest.NewServer(New(feed))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?topic=market.*.JPY", nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer c.CloseNow()
+
+	s := feed.next(t)
+	if s.pattern != "market.*.jpy" {
+		t.Errorf("expected the canonical pattern, got %s", s.pattern)
+	}
+	s.trades <- btc
+	_, b, err := c.Read(ctx)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	var got domain.Trade
+	if err := json.Unmarshal(b, &got); err != nil || got != btc {
+		t.Errorf("expected %+v, got %+v (%v)", btc, got, err)
+	}
+
+	// A client that falls behind is told why it is disconnected.
+	s.end(errors.New("listener too slow, trades dropped"))
+	_, _, err = c.Read(ctx)
+	if websocket.CloseStatus(err) != websocket.StatusTryAgainLater {
+		t.Errorf("expected close status %v, got %v", websocket.StatusTryAgainLater, err)
+	}
+	waitClosed(t, s)
+}
+
+func TestWebSocket_ClientGoneClosesStream(t *testing.T) {
+	feed := newFakeFeed()
+	srv := httptest.NewServer(New(feed))
+	defer srv.Close()
+
+	c, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	s := feed.next(t)
+	if s.pattern != "market.#" {
+		t.Errorf("expected the default pattern, got %s", s.pattern)
+	}
+	c.Close(websocket.StatusNormalClosure, "")
+	waitClosed(t, s)
+}
+
+func TestSSE_StreamsTradesOfTopic(t *testing.T) {
+	feed := newFakeFeed()
+	srv := httptest.NewServer(New(feed))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/sse?topic=market.btc.%23")
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected an event stream, got %s", ct)
+	}
+
+	s := feed.next(t)
+	if s.pattern != "market.btc.#" {
+		t.Errorf("expected pattern market.btc.#, got %s", s.pattern)
+	}
+	s.trades <- btc
+	s.end(errors.New("too slow"))
+
+	var lines []string
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	body := strings.Join(lines, "\n")
+	b, _ := json.Marshal(btc)
+	want := "id: t1\nevent: trade\ndata: " + string(b) + "\n\nevent: error\ndata: too slow"
+	if !strings.Contains(body, want) {
+		t.Errorf("expected the stream to contain\n%s\ngot\n%s", want, body)
+	}
+	waitClosed(t, s)
+}
+
+func TestSSE_ChecksOrigin(t *testing.T) {
+	feed := newFakeFeed()
+	srv := httptest.NewServer(New(feed, WithAllowedOrigins("*.example.com")))
+	defer srv.Close()
+
+	for origin, want := range map[string]int{
+		"https://dash.example.com": http.StatusOK,
+		"https://evil.test":        http.StatusForbidden,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/sse", nil)
+		req.Header.Set("Origin", origin)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		if resp.StatusCode != want {
+			t.Errorf("%s: expected status %d, got %d", origin, want, resp.StatusCode)
+		}
+		if want == http.StatusOK {
+			if got := resp.Header.Get("Access-Control-Allow-Origin"); got != origin {
+				t.Errorf("expected the origin to be allowed, got %q", got)
+			}
+			feed.next(t).end(nil)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestInvalidTopicIsRejected(t *testing.T) {
+	srv := httptest.NewServer(New(newFakeFeed()))
+	defer srv.Close()
+	for _, p := range []string{"/ws", "/sse"} {
+		resp, err := http.Get(srv.URL + p + "?topic=market..btc")
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", p, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Package jsonl records trades as JSON Lines, one trade per line, and reads
+// such recordings back.
+package jsonl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// maxLineSize bounds the length of a single recorded trade.
+const maxLineSize = 1 << 20
+
+// Writer appends trades to a JSON Lines stream. It implements
+// domain.TradePublisher so it can be used wherever trades are published.
+type Writer struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+var _ domain.TradePublisher = (*Writer)(nil)
+
+// NewWriter creates a Writer. Call Flush before closing the underlying writer.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Publish writes trade as one line.
+func (w *Writer) Publish(ctx context.Context, trade domain.Trade) error {
+	b, err := json.Marshal(trade)
+	if err != nil {
+		return fmt.Errorf("could not marshal trade: %w", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Flush writes any buffered trades to the underlying writer.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Flush()
+}
+
+// Reader reads trades from a JSON Lines stream. Blank lines are skipped.
+type Reader struct {
+	s    *bufio.Scanner
+	line int
+}
+
+var _ domain.TradeReader = (*Reader)(nil)
+
+// NewReader creates a Reader.
+func NewReader(r io.Reader) *Reader {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	return &Reader{s: s}
+}
+
+// Read returns the next trade, or io.EOF at the end of the stream.
+func (r *Reader) Read() (domain.Trade, error) {
+	for r.s.Scan() {
+		r.line++
+		b := bytes.TrimSpace(r.s.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+		var trade domain.Trade
+		if err := json.Unmarshal(b, &trade); err != nil {
+			return domain.Trade{}, fmt.Errorf("line %d: %w", r.line, err)
+		}
+		return trade, nil
+	}
+	if err := r.s.Err(); err != nil {
+		return domain.Trade{}, err
+	}
+	return domain.Trade{}, io.EOF
+}
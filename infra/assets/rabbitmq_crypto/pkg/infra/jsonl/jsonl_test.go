@@ -0,0 +1,64 @@
+package jsonl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+func TestWriterReader_RoundTrip(t *testing.T) {
+	trades := []domain.Trade{
+		{ID: "t1", Symbol: "BTC", TargetCurrency: "USD", Price: 60000.5, Amount: 0.1, Timestamp: time.Date(2024, 1, 1, 0, 0, 0, 1, time.UTC), Side: domain.SideBuy},
+		{ID: "t2", Symbol: "ETH", TargetCurrency: "JPY", Price: 450000, Amount: 2, Timestamp: time.Date(2024, 1, 1, 0, 0, 1, 0, time.UTC), Side: domain.SideSell},
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, trade := range trades {
+		if err := w.Publish(context.Background(), trade); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != len(trades) {
+		t.Fatalf("expected %d lines, got %d", len(trades), lines)
+	}
+
+	r := NewReader(&buf)
+	for _, want := range trades {
+		got, err := r.Read()
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		if got != want {
+			t.Errorf("expected %+v, got %+v", want, got)
+		}
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestReader_SkipsBlankLinesAndReportsBadLine(t *testing.T) {
+	r := NewReader(strings.NewReader("\n{\"id\":\"t1\"}\n  \n{oops}\n"))
+
+	trade, err := r.Read()
+	if err != nil || trade.ID != "t1" {
+		t.Fatalf("expected trade t1, got %+v, %v", trade, err)
+	}
+	_, err = r.Read()
+	if err == nil || !strings.Contains(err.Error(), "line 4") {
+		t.Errorf("expected an error for line 4, got %v", err)
+	}
+	if errors.Is(err, io.EOF) {
+		t.Error("a malformed line must not look like the end of the recording")
+	}
+}
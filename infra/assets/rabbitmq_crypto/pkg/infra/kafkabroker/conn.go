@@ -0,0 +1,134 @@
+// Package kafkabroker carries trades over Kafka or a Kafka-compatible
+// broker such as Redpanda. Each exchange is a topic whose record keys are
+// the routing keys, and each queue is a consumer group reading that topic.
+package kafkabroker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/broker"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// ExchangeName is the exchange trades are published to unless WithExchange
+// is given. It matches the RabbitMQ exchange.
+const ExchangeName = "crypto_market"
+
+// DefaultPartitions is how many partitions the topics are created with
+// unless WithPartitions is given. Records are partitioned by routing key,
+// so the trades of one pair stay in order.
+const DefaultPartitions = 6
+
+// setupTimeout bounds the requests that are not part of the consume loop.
+const setupTimeout = 10 * time.Second
+
+// probeTimeout bounds the ping behind Connected.
+const probeTimeout = time.Second
+
+// Option configures a connection.
+type Option func(*Conn)
+
+// WithExchange sets the exchange trades are published to and consumed
+// from. Defaults to ExchangeName.
+func WithExchange(name string) Option {
+	return func(c *Conn) {
+		c.exchange = name
+	}
+}
+
+// WithPartitions sets how many partitions missing topics are created with.
+func WithPartitions(n int32) Option {
+	return func(c *Conn) {
+		c.partitions = n
+	}
+}
+
+// Conn is a client of a Kafka cluster, used to produce records and to
+// manage topics and group offsets. Every subscription opens a client of its
+// own to consume.
+type Conn struct {
+	seeds      []string
+	cl         *kgo.Client
+	adm        *kadm.Client
+	exchange   string
+	partitions int32
+}
+
+// Connect connects to the seed brokers in url, e.g.
+// kafka://broker1:9092,broker2:9092, and creates the topic of the exchange.
+func Connect(url string, opts ...Option) (*Conn, error) {
+	c := &Conn{
+		seeds:      strings.Split(strings.TrimPrefix(url, "kafka://"), ","),
+		exchange:   ExchangeName,
+		partitions: DefaultPartitions,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	cl, err := kgo.NewClient(kgo.SeedBrokers(c.seeds...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kafka client: %w", err)
+	}
+	c.cl, c.adm = cl, kadm.NewClient(cl)
+	if err := c.ensureTopic(c.exchange); err != nil {
+		cl.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Exchange names the topic trades are published to.
+func (c *Conn) Exchange() string {
+	return c.exchange
+}
+
+// DeadLetterExchange names the topic dead letters are published to.
+func (c *Conn) DeadLetterExchange() string {
+	return c.exchange + ".dlx"
+}
+
+// Connected reports whether a broker of the cluster answers a ping.
+func (c *Conn) Connected() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	return c.cl.Ping(ctx) == nil
+}
+
+// Close flushes pending records and closes the client.
+func (c *Conn) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), setupTimeout)
+	defer cancel()
+	err := c.cl.Flush(ctx)
+	c.cl.Close()
+	return err
+}
+
+// ensureTopic creates the topic of an exchange unless it exists.
+func (c *Conn) ensureTopic(exchange string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), setupTimeout)
+	defer cancel()
+	res, err := c.adm.CreateTopics(ctx, c.partitions, -1, nil, exchange)
+	if err == nil {
+		err = res[exchange].Err
+	}
+	if err != nil && !errors.Is(err, kerr.TopicAlreadyExists) {
+		return fmt.Errorf("failed to create topic %s: %w", exchange, err)
+	}
+	return nil
+}
+
+// record addresses m to the topic of exchange.
+func record(exchange string, m broker.Message) *kgo.Record {
+	r := &kgo.Record{Topic: exchange, Key: []byte(m.Key), Value: m.Body}
+	for k, v := range m.Headers {
+		r.Headers = append(r.Headers, kgo.RecordHeader{Key: k, Value: []byte(v)})
+	}
+	return r
+}
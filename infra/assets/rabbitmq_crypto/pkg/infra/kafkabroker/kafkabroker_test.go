@@ -0,0 +1,177 @@
+package kafkabroker
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/broker"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/brokertest"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// connect starts an in-process Kafka cluster and connects to it.
+func connect(t *testing.T) *Conn {
+	t.Helper()
+	c, _ := connectCluster(t)
+	return c
+}
+
+// connectCluster is connect that also returns the cluster, for tests that
+// need to control it.
+func connectCluster(t *testing.T) (*Conn, *kfake.Cluster) {
+	t.Helper()
+	cluster, err := kfake.NewCluster(kfake.NumBrokers(1))
+	if err != nil {
+		t.Fatalf("failed to start cluster: %v", err)
+	}
+	t.Cleanup(cluster.Close)
+
+	c, err := Connect("kafka://" + cluster.ListenAddrs()[0])
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, cluster
+}
+
+// topicLen counts the records of the topic of exchange.
+func (c *Conn) topicLen(t *testing.T, exchange string) int {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ends, err := c.adm.ListEndOffsets(ctx, exchange)
+	if err != nil {
+		t.Errorf("failed to list offsets: %v", err)
+		return 0
+	}
+	n := 0
+	ends.Each(func(o kadm.ListedOffset) {
+		if o.Err == nil && o.Offset > 0 {
+			n += int(o.Offset)
+		}
+	})
+	return n
+}
+
+func TestConformance(t *testing.T) {
+	brokertest.Run(t, func(t *testing.T) brokertest.Broker {
+		c := connect(t)
+		return brokertest.Broker{
+			Publisher:          NewPublisher(c),
+			Subscriber:         NewSubscriber(c),
+			OrderPublisher:     NewOrderPublisher(c),
+			OrderSubscriber:    NewOrderSubscriber(c),
+			DeadLetterExchange: c.DeadLetterExchange(),
+			DeadLetters:        func() int { return c.topicLen(t, c.DeadLetterExchange()) },
+		}
+	})
+}
+
+func TestPublisher_PublishAsync(t *testing.T) {
+	c := connect(t)
+	r, err := NewPublisher(c).PublishAsync(context.Background(), domain.Trade{ID: "t1", Symbol: "BTC", TargetCurrency: "USD"})
+	if err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	for range 2 {
+		if err := r.Wait(context.Background()); err != nil {
+			t.Errorf("expected the trade to be acknowledged, got %v", err)
+		}
+	}
+	if n := c.topicLen(t, c.Exchange()); n != 1 {
+		t.Errorf("expected 1 record, got %d", n)
+	}
+}
+
+func TestSubscriber_GroupStartsAtEnd(t *testing.T) {
+	c := connect(t)
+	pub := NewPublisher(c)
+	if err := pub.Publish(context.Background(), domain.Trade{ID: "before", Symbol: "BTC", TargetCurrency: "USD"}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	handled := make(chan string, 2)
+	_, err := NewSubscriber(c).Subscribe(context.Background(), "market.#", func(trade domain.Trade) error {
+		handled <- trade.ID
+		return nil
+	}, domain.WithDurableQueue("late"))
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	if err := pub.Publish(context.Background(), domain.Trade{ID: "after", Symbol: "BTC", TargetCurrency: "USD"}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	select {
+	case id := <-handled:
+		if id != "after" {
+			t.Errorf("expected the group to start after %q, got %s", "before", id)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the trade")
+	}
+}
+
+func TestSubscriber_RejectsMaxLength(t *testing.T) {
+	c := connect(t)
+	_, err := NewSubscriber(c).Subscribe(context.Background(), "market.#", func(domain.Trade) error { return nil }, domain.WithMaxLength(10))
+	if !errors.Is(err, broker.ErrUnsupportedOption) {
+		t.Fatalf("expected ErrUnsupportedOption, got %v", err)
+	}
+}
+
+func TestSubscriber_RetriesFailedDeadLettering(t *testing.T) {
+	c, cluster := connectCluster(t)
+	dlx := c.DeadLetterExchange()
+
+	// Once armed, the next produce, which dead-letters the trade, fails.
+	var armed atomic.Bool
+	cluster.ControlKey(int16(kmsg.Produce), func(req kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		if !armed.CompareAndSwap(true, false) {
+			return nil, nil, false
+		}
+		produce := req.(*kmsg.ProduceRequest)
+		resp := produce.ResponseKind().(*kmsg.ProduceResponse)
+		for _, rt := range produce.Topics {
+			st := kmsg.NewProduceResponseTopic()
+			st.Topic, st.TopicID = rt.Topic, rt.TopicID
+			for _, rp := range rt.Partitions {
+				sp := kmsg.NewProduceResponseTopicPartition()
+				sp.Partition = rp.Partition
+				sp.ErrorCode = kerr.TopicAuthorizationFailed.Code
+				st.Partitions = append(st.Partitions, sp)
+			}
+			resp.Topics = append(resp.Topics, st)
+		}
+		return resp, nil, true
+	})
+
+	sub, err := NewSubscriber(c).Subscribe(context.Background(), "market.#", func(domain.Trade) error {
+		return errors.New("poison")
+	}, domain.WithDurableQueue("dl"), domain.WithManualAck(0), domain.WithDeadLetter(dlx))
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Stop(context.Background())
+	if err := NewPublisher(c).Publish(context.Background(), domain.Trade{ID: "t1", Symbol: "BTC", TargetCurrency: "USD"}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	armed.Store(true)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for c.topicLen(t, dlx) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the trade to be dead-lettered after a failed attempt")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if armed.Load() {
+		t.Error("expected the first dead-lettering to fail")
+	}
+}
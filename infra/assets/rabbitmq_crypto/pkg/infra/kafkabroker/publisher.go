@@ -0,0 +1,113 @@
+package kafkabroker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/broker"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+type publisher struct {
+	c   *Conn
+	enc broker.Encoder
+}
+
+// NewPublisher creates a TradePublisher that produces trades to the topic
+// of the exchange keyed by market.<symbol>.<target>, and waits for the
+// cluster to acknowledge them. A topic keeps records whether or not a group
+// reads them, so trades are never reported unroutable.
+func NewPublisher(c *Conn, opts ...broker.PublisherOption) domain.AsyncTradePublisher {
+	return &publisher{c: c, enc: broker.NewEncoder(opts...)}
+}
+
+// NewCandlePublisher creates a CandlePublisher that produces closed candles
+// keyed by candles.<symbol>.<target>.<interval>.
+func NewCandlePublisher(c *Conn, opts ...broker.PublisherOption) domain.CandlePublisher {
+	return &publisher{c: c, enc: broker.NewEncoder(opts...)}
+}
+
+// NewAlertPublisher creates an AlertNotifier that produces alerts keyed by
+// alerts.<symbol>.<target>.
+func NewAlertPublisher(c *Conn, opts ...broker.PublisherOption) domain.AlertNotifier {
+	return &publisher{c: c, enc: broker.NewEncoder(opts...)}
+}
+
+// NewOrderPublisher creates an OrderPublisher that produces orders keyed by
+// orders.<symbol>.<target>, so the orders of a pair stay in one partition.
+func NewOrderPublisher(c *Conn, opts ...broker.PublisherOption) domain.OrderPublisher {
+	return &publisher{c: c, enc: broker.NewEncoder(opts...)}
+}
+
+func (p *publisher) Publish(ctx context.Context, trade domain.Trade) error {
+	m, err := p.enc.Trade(trade)
+	if err != nil {
+		return err
+	}
+	if err := p.c.cl.ProduceSync(ctx, record(p.c.exchange, m)).FirstErr(); err != nil {
+		return fmt.Errorf("trade %s: %w: %v", trade.ID, domain.ErrTradeNotConfirmed, err)
+	}
+	return nil
+}
+
+// PublishAsync produces a trade without waiting for the cluster to
+// acknowledge it.
+func (p *publisher) PublishAsync(ctx context.Context, trade domain.Trade) (domain.PublishReceipt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m, err := p.enc.Trade(trade)
+	if err != nil {
+		return nil, err
+	}
+	r := receipt{id: trade.ID, done: make(chan error, 1)}
+	p.c.cl.Produce(ctx, record(p.c.exchange, m), func(_ *kgo.Record, err error) {
+		r.done <- err
+	})
+	return r, nil
+}
+
+func (p *publisher) PublishCandle(ctx context.Context, candle domain.Candle) error {
+	m, err := p.enc.Candle(candle)
+	if err != nil {
+		return err
+	}
+	return p.c.cl.ProduceSync(ctx, record(p.c.exchange, m)).FirstErr()
+}
+
+func (p *publisher) Notify(ctx context.Context, alert domain.Alert) error {
+	m, err := p.enc.Alert(alert)
+	if err != nil {
+		return err
+	}
+	return p.c.cl.ProduceSync(ctx, record(p.c.exchange, m)).FirstErr()
+}
+
+func (p *publisher) PublishOrder(ctx context.Context, order domain.Order) error {
+	m, err := p.enc.Order(order)
+	if err != nil {
+		return err
+	}
+	return p.c.cl.ProduceSync(ctx, record(p.c.exchange, m)).FirstErr()
+}
+
+// receipt waits for the acknowledgement of an asynchronous produce.
+type receipt struct {
+	id   string
+	done chan error
+}
+
+func (r receipt) Wait(ctx context.Context) error {
+	select {
+	case err := <-r.done:
+		// Keep the outcome for later calls.
+		r.done <- err
+		if err != nil {
+			return fmt.Errorf("trade %s: %w: %v", r.id, domain.ErrTradeNotConfirmed, err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
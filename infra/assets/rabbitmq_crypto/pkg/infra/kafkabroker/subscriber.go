@@ -0,0 +1,368 @@
+package kafkabroker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/broker"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+const (
+	// defaultCredit is how many trades a consumer polls ahead without a
+	// prefetch limit.
+	defaultCredit = 256
+	// deadLetterRetry is how long a rejected trade waits before it is
+	// dead-lettered again after a failed attempt.
+	deadLetterRetry = time.Second
+)
+
+type subscriber struct {
+	c   *Conn
+	dec broker.Decoder
+}
+
+// NewSubscriber creates a TradeSubscriber reading the topic of the
+// exchange. A durable queue is a consumer group shared by every subscriber
+// using its name, which starts at the end of the topic when it is first
+// used. Otherwise each subscription reads every partition itself, starting
+// with the records produced after Subscribe.
+//
+// A group consumer commits its offsets once every trade of a poll is
+// settled, and only then lets the group rebalance, so that a trade is not
+// handled by two consumers at once. Trades are filtered by key on the
+// client: records the topic pattern does not match are skipped.
+func NewSubscriber(c *Conn, opts ...broker.SubscriberOption) domain.TradeSubscriber {
+	return &subscriber{c: c, dec: broker.NewDecoder(opts...)}
+}
+
+// NewOrderSubscriber creates an OrderSubscriber consuming the topic of the
+// exchange like NewSubscriber does.
+func NewOrderSubscriber(c *Conn, opts ...broker.SubscriberOption) domain.OrderSubscriber {
+	return &subscriber{c: c, dec: broker.NewDecoder(opts...)}
+}
+
+func (s *subscriber) Subscribe(ctx context.Context, routingKey string, handler func(domain.Trade) error, opts ...domain.SubscribeOption) (domain.Subscription, error) {
+	pattern, o, src, err := s.open(routingKey, opts)
+	if err != nil {
+		return nil, err
+	}
+	return broker.Dispatch(ctx, pattern.String(), src, s.dec, handler, o), nil
+}
+
+func (s *subscriber) SubscribeOrders(ctx context.Context, routingKey string, handler func(domain.Order) error, opts ...domain.SubscribeOption) (domain.Subscription, error) {
+	pattern, o, src, err := s.open(routingKey, opts)
+	if err != nil {
+		return nil, err
+	}
+	return broker.DispatchOrders(ctx, pattern.String(), src, s.dec, handler, o), nil
+}
+
+// open starts a consumer for the messages matching routingKey.
+func (s *subscriber) open(routingKey string, opts []domain.SubscribeOption) (domain.TopicPattern, domain.SubscribeOptions, *source, error) {
+	o := domain.NewSubscribeOptions(opts...)
+	if err := broker.CheckOptions(o); err != nil {
+		return "", o, nil, err
+	}
+	pattern, err := domain.ParseTopicPattern(routingKey)
+	if err != nil {
+		return "", o, nil, err
+	}
+	if o.DeadLetterExchange != "" {
+		if err := s.c.ensureTopic(o.DeadLetterExchange); err != nil {
+			return "", o, nil, err
+		}
+	}
+
+	var consume []kgo.Opt
+	if o.Queue != "" {
+		if err := s.c.startGroup(o.Queue); err != nil {
+			return "", o, nil, err
+		}
+		consume = []kgo.Opt{
+			kgo.ConsumerGroup(o.Queue),
+			kgo.ConsumeTopics(s.c.exchange),
+			kgo.DisableAutoCommit(),
+			kgo.BlockRebalanceOnPoll(),
+		}
+	} else {
+		ends, err := s.c.endOffsets()
+		if err != nil {
+			return "", o, nil, err
+		}
+		consume = []kgo.Opt{kgo.ConsumePartitions(ends)}
+	}
+	cl, err := kgo.NewClient(append(consume, kgo.SeedBrokers(s.c.seeds...))...)
+	if err != nil {
+		return "", o, nil, fmt.Errorf("failed to create Kafka client: %w", err)
+	}
+
+	credit := o.Prefetch
+	if credit < 1 {
+		credit = defaultCredit
+	}
+	consuming, stop := context.WithCancel(context.Background())
+	src := &source{
+		c:          s.c,
+		cl:         cl,
+		pattern:    pattern,
+		dlx:        o.DeadLetterExchange,
+		group:      o.Queue != "",
+		credit:     credit,
+		ctx:        consuming,
+		stop:       stop,
+		deliveries: make(chan broker.Delivery),
+		quit:       make(chan struct{}),
+		settled:    make(chan struct{}, 1),
+	}
+	go src.run()
+	return pattern, o, src, nil
+}
+
+// startGroup commits the end offsets of the topic for a group that has not
+// committed any, so that it starts with the records produced from now on
+// rather than when its first consumer joins.
+func (c *Conn) startGroup(group string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), setupTimeout)
+	defer cancel()
+	committed, err := c.adm.FetchOffsetsForTopics(ctx, group, c.exchange)
+	if err != nil && !errors.Is(err, kerr.GroupIDNotFound) {
+		return fmt.Errorf("failed to fetch offsets of %s: %w", group, err)
+	}
+	started := false
+	committed.Each(func(o kadm.OffsetResponse) {
+		started = started || o.At >= 0
+	})
+	if started {
+		return nil
+	}
+	ends, err := c.adm.ListEndOffsets(ctx, c.exchange)
+	if err != nil {
+		return fmt.Errorf("failed to list offsets of %s: %w", c.exchange, err)
+	}
+	res, err := c.adm.CommitOffsets(ctx, group, ends.Offsets())
+	if err == nil {
+		err = res.Error()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to start group %s: %w", group, err)
+	}
+	return nil
+}
+
+// endOffsets returns where each partition of the topic ends.
+func (c *Conn) endOffsets() (map[string]map[int32]kgo.Offset, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), setupTimeout)
+	defer cancel()
+	ends, err := c.adm.ListEndOffsets(ctx, c.exchange)
+	if err == nil {
+		err = ends.Error()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list offsets of %s: %w", c.exchange, err)
+	}
+	return ends.KOffsets(), nil
+}
+
+// source feeds a subscription from a consuming client.
+type source struct {
+	c       *Conn
+	cl      *kgo.Client
+	pattern domain.TopicPattern
+	dlx     string
+	group   bool
+	credit  int
+
+	ctx        context.Context // cancelled by Cancel
+	stop       context.CancelFunc
+	deliveries chan broker.Delivery
+	quit       chan struct{} // closed by Close
+	closeOnce  sync.Once
+	settled    chan struct{} // signalled when credit is returned
+
+	mu      sync.Mutex
+	pending int
+	err     error
+}
+
+var _ broker.Source = (*source)(nil)
+
+func (s *source) Deliveries() <-chan broker.Delivery {
+	return s.deliveries
+}
+
+// Cancel stops polling once the trades already polled are handed over and,
+// for a group, settled and committed.
+func (s *source) Cancel() {
+	s.stop()
+}
+
+func (s *source) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close closes the client, leaving the group. Trades not committed are
+// consumed again by the next member of the group.
+func (s *source) Close() {
+	s.closeOnce.Do(func() {
+		s.stop()
+		close(s.quit)
+		s.cl.Close()
+	})
+}
+
+// run polls until the source is cancelled, never holding more than credit
+// unsettled trades.
+func (s *source) run() {
+	defer close(s.deliveries)
+
+	for s.ctx.Err() == nil {
+		n := s.credit - s.unsettled()
+		if n < 1 {
+			if !s.await(func() bool { return s.unsettled() < s.credit }) {
+				return
+			}
+			continue
+		}
+
+		fetches := s.cl.PollRecords(s.ctx, n)
+		if fetches.IsClientClosed() {
+			s.fail(kgo.ErrClientClosed)
+			return
+		}
+		fetches.EachError(func(topic string, p int32, err error) {
+			if !errors.Is(err, context.Canceled) {
+				log.Printf("Error fetching %s/%d: %v", topic, p, err)
+			}
+		})
+		closed := false
+		fetches.EachRecord(func(r *kgo.Record) {
+			if !closed && !s.deliver(r) {
+				closed = true
+			}
+		})
+		if closed {
+			return
+		}
+
+		if s.group {
+			// Commit the poll once settled, then let the group
+			// rebalance: no partition moves while its trades are in
+			// flight.
+			if !s.await(func() bool { return s.unsettled() == 0 }) {
+				return
+			}
+			if err := s.cl.CommitUncommittedOffsets(context.Background()); err != nil {
+				log.Printf("Error committing offsets: %v", err)
+			}
+			s.cl.AllowRebalance()
+		}
+	}
+}
+
+// await waits until cond holds, re-checking whenever a trade is settled.
+// It reports false once the source is closed.
+func (s *source) await(cond func() bool) bool {
+	for !cond() {
+		select {
+		case <-s.settled:
+		case <-s.quit:
+			return false
+		}
+	}
+	return true
+}
+
+func (s *source) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx.Err() == nil {
+		s.err = err
+	}
+}
+
+// deliver hands r to the subscription unless the pattern does not match its
+// key. It reports false once the source is closed.
+func (s *source) deliver(r *kgo.Record) bool {
+	m := broker.Message{Key: domain.RoutingKey(r.Key), Headers: make(map[string]string), Body: r.Value}
+	if !s.pattern.Matches(m.Key) {
+		return true
+	}
+	for _, h := range r.Headers {
+		m.Headers[h.Key] = string(h.Value)
+	}
+
+	d := broker.Delivery{Message: m, Published: r.Timestamp}
+	var once sync.Once
+	d.Ack = func() { once.Do(s.release) }
+	d.Reject = func() {
+		once.Do(func() {
+			// A trade that could not be dead-lettered keeps its credit,
+			// so its offset is never committed.
+			if err := s.reject(m); err != nil {
+				log.Printf("Error dead-lettering message, leaving it uncommitted: %v", err)
+				return
+			}
+			s.release()
+		})
+	}
+
+	s.mu.Lock()
+	s.pending++
+	s.mu.Unlock()
+	select {
+	case s.deliveries <- d:
+		return true
+	case <-s.quit:
+		return false
+	}
+}
+
+func (s *source) unsettled() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending
+}
+
+// release returns the credit of a settled trade.
+func (s *source) release() {
+	s.mu.Lock()
+	s.pending--
+	s.mu.Unlock()
+	select {
+	case s.settled <- struct{}{}:
+	default:
+	}
+}
+
+// reject dead-letters m if the subscription has a dead-letter exchange. It
+// retries until the dead-letter topic takes m and only gives up, with the
+// last error, once the source is closed.
+func (s *source) reject(m broker.Message) error {
+	if s.dlx == "" {
+		return nil
+	}
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), setupTimeout)
+		err := s.c.cl.ProduceSync(ctx, record(s.dlx, m)).FirstErr()
+		cancel()
+		if err == nil {
+			return nil
+		}
+		log.Printf("Error dead-lettering message (attempt %d), retrying in %v: %v", attempt, deadLetterRetry, err)
+		select {
+		case <-time.After(deadLetterRetry):
+		case <-s.quit:
+			return err
+		}
+	}
+}
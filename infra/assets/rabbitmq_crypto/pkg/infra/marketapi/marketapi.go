@@ -0,0 +1,127 @@
+// Package marketapi serves the current market as a JSON REST API:
+//
+//	GET /prices                   last price of every pair
+//	GET /prices/{symbol}/{target} last price of one pair, 404 if none yet
+//	GET /trades?symbol=&since=    recent trades, optionally of one symbol
+//	                              and after since (RFC 3339 time, or a
+//	                              duration such as 5m meaning that long ago)
+//
+// Every response carries an ETag; a request whose If-None-Match matches
+// the current one gets 304 Not Modified without a body, so pollers only
+// download what changed.
+package marketapi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// Server serves a domain.MarketView. It is an http.Handler.
+type Server struct {
+	view domain.MarketView
+	now  func() time.Time
+	mux  *http.ServeMux
+}
+
+// New creates a Server for view.
+func New(view domain.MarketView) *Server {
+	s := &Server{view: view, now: time.Now, mux: http.NewServeMux()}
+	s.mux.HandleFunc("GET /prices", s.prices)
+	s.mux.HandleFunc("GET /prices/{symbol}/{target}", s.price)
+	s.mux.HandleFunc("GET /trades", s.trades)
+	s.mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) prices(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, s.view.Prices())
+}
+
+func (s *Server) price(w http.ResponseWriter, r *http.Request) {
+	symbol, target := r.PathValue("symbol"), r.PathValue("target")
+	p, ok := s.view.Price(symbol, target)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no trades of %s/%s yet", symbol, target))
+		return
+	}
+	writeJSON(w, r, http.StatusOK, p)
+}
+
+func (s *Server) trades(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		var err error
+		if since, err = s.parseSince(v); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	writeJSON(w, r, http.StatusOK, s.view.Trades(q.Get("symbol"), since))
+}
+
+// parseSince accepts an RFC 3339 time or a duration before now.
+func (s *Server) parseSince(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+		return s.now().Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("since: %q is neither an RFC 3339 time nor a duration", v)
+}
+
+// writeJSON writes v with an ETag derived from its encoding, or 304 if the
+// client already has it.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", "no-cache")
+	if matchesETag(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// matchesETag reports whether an If-None-Match header lists etag, using
+// the weak comparison RFC 9110 prescribes for it.
+func matchesETag(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
@@ -0,0 +1,143 @@
+package marketapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+var epoch = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// fakeView serves fixed prices and filters a fixed list of trades.
+type fakeView struct {
+	prices []domain.LastPrice
+	trades []domain.Trade
+}
+
+func (f *fakeView) Prices() []domain.LastPrice { return f.prices }
+
+func (f *fakeView) Price(symbol, target string) (domain.LastPrice, bool) {
+	for _, p := range f.prices {
+		if strings.EqualFold(p.Symbol, symbol) && strings.EqualFold(p.TargetCurrency, target) {
+			return p, true
+		}
+	}
+	return domain.LastPrice{}, false
+}
+
+func (f *fakeView) Trades(symbol string, since time.Time) []domain.Trade {
+	out := []domain.Trade{}
+	for _, t := range f.trades {
+		if (symbol == "" || strings.EqualFold(t.Symbol, symbol)) && (since.IsZero() || t.Timestamp.After(since)) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func newServer() (*Server, *fakeView) {
+	view := &fakeView{
+		prices: []domain.LastPrice{
+			{Symbol: "BTC", TargetCurrency: "USD", Price: 60000, TradeID: "t2", Timestamp: epoch.Add(2 * time.Minute)},
+			{Symbol: "ETH", TargetCurrency: "JPY", Price: 450000, TradeID: "t1", Timestamp: epoch},
+		},
+		trades: []domain.Trade{
+			{ID: "t1", Symbol: "ETH", TargetCurrency: "JPY", Timestamp: epoch},
+			{ID: "t2", Symbol: "BTC", TargetCurrency: "USD", Timestamp: epoch.Add(2 * time.Minute)},
+		},
+	}
+	s := New(view)
+	s.now = func() time.Time { return epoch.Add(3 * time.Minute) }
+	return s, view
+}
+
+func get(t *testing.T, h http.Handler, target string, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPrices(t *testing.T) {
+	s, _ := newServer()
+	rec := get(t, s, "/prices")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("expected JSON, got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var prices []domain.LastPrice
+	if err := json.Unmarshal(rec.Body.Bytes(), &prices); err != nil || len(prices) != 2 {
+		t.Errorf("expected 2 prices, got %s (%v)", rec.Body, err)
+	}
+}
+
+func TestPrice(t *testing.T) {
+	s, _ := newServer()
+	rec := get(t, s, "/prices/btc/usd")
+	var p domain.LastPrice
+	if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil || rec.Code != http.StatusOK || p.Price != 60000 {
+		t.Errorf("expected BTC/USD at 60000, got %d %s", rec.Code, rec.Body)
+	}
+
+	rec = get(t, s, "/prices/sol/usd")
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), `"error"`) {
+		t.Errorf("expected a JSON 404, got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestTrades_Filters(t *testing.T) {
+	s, _ := newServer()
+	for _, tc := range []struct {
+		query string
+		code  int
+		want  int
+	}{
+		{"", http.StatusOK, 2},
+		{"?symbol=eth", http.StatusOK, 1},
+		{"?since=2024-01-01T12:01:00Z", http.StatusOK, 1},
+		{"?since=2m", http.StatusOK, 1},
+		{"?symbol=btc&since=30s", http.StatusOK, 0},
+		{"?since=yesterday", http.StatusBadRequest, 0},
+	} {
+		rec := get(t, s, "/trades"+tc.query)
+		if rec.Code != tc.code {
+			t.Errorf("%s: expected status %d, got %d", tc.query, tc.code, rec.Code)
+			continue
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+		var trades []domain.Trade
+		if err := json.Unmarshal(rec.Body.Bytes(), &trades); err != nil || len(trades) != tc.want {
+			t.Errorf("%s: expected %d trades, got %s", tc.query, tc.want, rec.Body)
+		}
+	}
+}
+
+func TestETag(t *testing.T) {
+	s, view := newServer()
+	first := get(t, s, "/prices")
+	etag := first.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected an ETag")
+	}
+
+	rec := get(t, s, "/prices", "If-None-Match", `"other", W/`+etag)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 || rec.Header().Get("ETag") != etag {
+		t.Errorf("expected 304 without body, got %d %q", rec.Code, rec.Body)
+	}
+
+	view.prices[0].Price = 61000
+	rec = get(t, s, "/prices", "If-None-Match", etag)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Errorf("expected a new representation after a price change, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,419 @@
+// Package memory is an in-process message broker with the topic exchange
+// semantics of RabbitMQ: messages are routed to every queue bound with a
+// matching pattern, where "*" matches exactly one segment and "#" zero or
+// more. Queues support competing consumers, manual acknowledgement with
+// redelivery, dead-lettering, message TTLs and length limits, so the
+// commands and use cases can run end to end without a running broker.
+//
+// Messages are passed as values and never encoded, and nothing survives the
+// process.
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/broker"
+)
+
+const (
+	// ExchangeName is the default trade exchange, named like RabbitMQ's.
+	ExchangeName = "crypto_market"
+	// DeadLetterExchangeName is the conventional dead-letter exchange for
+	// the default exchange. See Broker.DeadLetterExchange.
+	DeadLetterExchangeName = ExchangeName + ".dlx"
+
+	// defaultCredit is how many unsettled messages a consumer without a
+	// prefetch limit is handed at a time.
+	defaultCredit = 256
+)
+
+// ErrClosed is returned when using a closed broker.
+var ErrClosed = errors.New("memory broker closed")
+
+// Option configures a Broker.
+type Option func(*Broker)
+
+// WithExchange sets the name of the trade exchange. Defaults to
+// ExchangeName.
+func WithExchange(name string) Option {
+	return func(b *Broker) {
+		if name != "" {
+			b.exchange = name
+		}
+	}
+}
+
+// Broker is an in-process topic exchange broker. It is safe for concurrent
+// use.
+type Broker struct {
+	exchange string
+	now      func() time.Time
+
+	mu        sync.Mutex
+	exchanges map[string][]*queue // bound queues by exchange name
+	queues    map[string]*queue
+	seq       uint64 // publish order, for requeueing in order
+	closed    bool
+}
+
+// NewBroker creates an empty broker with its trade exchange declared.
+func NewBroker(opts ...Option) *Broker {
+	b := &Broker{
+		exchange:  ExchangeName,
+		now:       time.Now,
+		exchanges: make(map[string][]*queue),
+		queues:    make(map[string]*queue),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	b.exchanges[b.exchange] = nil
+	return b
+}
+
+// Exchange returns the name of the trade exchange.
+func (b *Broker) Exchange() string {
+	return b.exchange
+}
+
+// DeadLetterExchange returns the conventional dead-letter exchange for the
+// trade exchange: its name with a .dlx suffix.
+func (b *Broker) DeadLetterExchange() string {
+	return b.exchange + ".dlx"
+}
+
+// Len returns how many messages wait in the named queue, e.g. how many
+// trades were dead-lettered. Unknown queues are empty.
+func (b *Broker) Len(queue string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if q, ok := b.queues[queue]; ok {
+		return len(q.ready)
+	}
+	return 0
+}
+
+// Connected reports whether the broker is still open.
+func (b *Broker) Connected() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.closed
+}
+
+// Close ends every subscription with ErrClosed and makes further publishes
+// fail.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	for _, q := range b.queues {
+		for _, c := range q.consumers {
+			c.closed = true
+			close(c.deliveries)
+		}
+		q.consumers = nil
+	}
+	return nil
+}
+
+// message is one copy of a published payload in one queue.
+type message struct {
+	seq      uint64
+	key      domain.RoutingKey
+	payload  any // domain.Trade, domain.Candle, domain.Alert or domain.Order
+	enqueued time.Time
+	// deliveries counts how often the message was handed to a consumer.
+	deliveries int
+}
+
+type queue struct {
+	name     string
+	durable  bool
+	bindings []binding
+	opts     domain.SubscribeOptions
+
+	ready     []*message
+	consumers []*consumer
+	next      int // round-robin position among consumers
+}
+
+type binding struct {
+	exchange string
+	pattern  domain.TopicPattern
+}
+
+type consumer struct {
+	q          *queue
+	credit     int
+	unsettled  map[*message]struct{}
+	deliveries chan broker.Delivery
+	closed     bool
+}
+
+// publish routes payload to every queue bound to exchange with a pattern
+// matching key and reports whether any queue received it.
+func (b *Broker) publish(exchange string, key domain.RoutingKey, payload any) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return false, ErrClosed
+	}
+	return b.route(exchange, key, payload), nil
+}
+
+// route enqueues payload like publish. Callers must hold b.mu.
+func (b *Broker) route(exchange string, key domain.RoutingKey, payload any) bool {
+	routed := false
+	for _, q := range b.exchanges[exchange] {
+		if !q.boundTo(exchange, key) {
+			continue
+		}
+		routed = true
+		b.seq++
+		b.enqueue(q, &message{seq: b.seq, key: key, payload: payload, enqueued: b.now()})
+	}
+	return routed
+}
+
+// enqueue appends m to q, dropping the oldest message if q is full, and
+// hands out what its consumers can take. Callers must hold b.mu.
+func (b *Broker) enqueue(q *queue, m *message) {
+	if q.opts.MaxLength > 0 && len(q.ready) >= q.opts.MaxLength {
+		oldest := q.ready[0]
+		q.ready = q.ready[1:]
+		b.deadLetter(q, oldest)
+	}
+	q.ready = append(q.ready, m)
+	b.dispatch(q)
+}
+
+// dispatch hands ready messages to consumers with credit left, round-robin,
+// expiring those that outlived the queue's TTL. Callers must hold b.mu.
+func (b *Broker) dispatch(q *queue) {
+	for len(q.ready) > 0 {
+		m := q.ready[0]
+		if ttl := q.opts.MessageTTL; ttl > 0 && b.now().Sub(m.enqueued) > ttl {
+			q.ready = q.ready[1:]
+			b.deadLetter(q, m)
+			continue
+		}
+		c := q.nextConsumer()
+		if c == nil {
+			return
+		}
+		q.ready = q.ready[1:]
+		m.deliveries++
+		c.unsettled[m] = struct{}{}
+		c.deliveries <- b.delivery(c, m) // never blocks: unsettled messages fill at most credit slots
+	}
+}
+
+// delivery hands m to c. The queue expires messages itself, so the
+// delivery carries no publish time.
+func (b *Broker) delivery(c *consumer, m *message) broker.Delivery {
+	return broker.Delivery{
+		Message: broker.Message{Key: m.key, Value: m.payload},
+		// The broker counts deliveries itself, like a quorum queue does.
+		Attempt: m.deliveries,
+		Ack:     func() { b.settle(c, m, true, false) },
+		Reject:  func() { b.settle(c, m, false, false) },
+		Requeue: func() { b.settle(c, m, false, true) },
+	}
+}
+
+// deadLetter republishes m to q's dead-letter exchange, if it has one.
+// Callers must hold b.mu.
+func (b *Broker) deadLetter(q *queue, m *message) {
+	if dlx := q.opts.DeadLetterExchange; dlx != "" {
+		b.route(dlx, m.key, m.payload)
+	}
+}
+
+// settle acknowledges m, or rejects it and either requeues it at the head
+// of its queue or dead-letters it. Messages whose consumer went away in the
+// meantime were already requeued and are left alone.
+func (b *Broker) settle(c *consumer, m *message, ack, requeue bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := c.unsettled[m]; !ok {
+		return
+	}
+	delete(c.unsettled, m)
+	q := c.q
+	switch {
+	case ack:
+	case requeue:
+		q.ready = append([]*message{m}, q.ready...)
+	default:
+		b.deadLetter(q, m)
+	}
+	b.dispatch(q)
+}
+
+// declareQueue returns the named durable queue, creating it if needed, or
+// a new private queue if name is empty, and binds it to pattern on the
+// trade exchange. Callers must hold b.mu.
+func (b *Broker) declareQueue(name string, pattern domain.TopicPattern, o domain.SubscribeOptions) (*queue, error) {
+	if o.Quorum && name == "" {
+		return nil, errors.New("quorum queues require a durable queue name")
+	}
+	if o.DeadLetterExchange != "" {
+		b.declareDeadLetter(o.DeadLetterExchange)
+	}
+
+	q, ok := b.queues[name]
+	if !ok {
+		durable := name != ""
+		if !durable {
+			name = "amq.gen-" + uuid.NewString()
+		}
+		q = &queue{name: name, durable: durable, opts: o}
+		b.queues[name] = q
+	} else if q.opts.MessageTTL != o.MessageTTL || q.opts.MaxLength != o.MaxLength ||
+		q.opts.DeadLetterExchange != o.DeadLetterExchange || q.opts.Quorum != o.Quorum {
+		return nil, fmt.Errorf("could not declare queue: %s exists with different arguments", name)
+	}
+	b.bind(q, b.exchange, pattern)
+	return q, nil
+}
+
+// declareDeadLetter declares a dead-letter exchange together with a
+// durable queue of the same name that keeps everything routed to it.
+// Callers must hold b.mu.
+func (b *Broker) declareDeadLetter(exchange string) {
+	if _, ok := b.queues[exchange]; ok {
+		return
+	}
+	q := &queue{name: exchange, durable: true}
+	b.queues[exchange] = q
+	b.bind(q, exchange, "#")
+}
+
+// bind routes the messages published to exchange with a key matching
+// pattern to q. Binding twice is harmless. Callers must hold b.mu.
+func (b *Broker) bind(q *queue, exchange string, pattern domain.TopicPattern) {
+	bd := binding{exchange: exchange, pattern: pattern}
+	for _, existing := range q.bindings {
+		if existing == bd {
+			return
+		}
+	}
+	q.bindings = append(q.bindings, bd)
+	for _, bound := range b.exchanges[exchange] {
+		if bound == q {
+			return
+		}
+	}
+	b.exchanges[exchange] = append(b.exchanges[exchange], q)
+}
+
+// consume attaches a consumer to q. Callers must hold b.mu.
+func (b *Broker) consume(q *queue, prefetch int) *consumer {
+	credit := prefetch
+	if credit <= 0 {
+		credit = defaultCredit
+	}
+	c := &consumer{
+		q:          q,
+		credit:     credit,
+		unsettled:  make(map[*message]struct{}),
+		deliveries: make(chan broker.Delivery, credit),
+	}
+	q.consumers = append(q.consumers, c)
+	b.dispatch(q)
+	return c
+}
+
+// cancel detaches c from its queue so it receives no further messages and
+// closes its deliveries once the ones already handed over are read. A
+// private queue is deleted with its last consumer.
+func (b *Broker) cancel(c *consumer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.detach(c)
+}
+
+// release cancels c and requeues every message it still holds, as a
+// broker does when a consumer's channel closes.
+func (b *Broker) release(c *consumer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.detach(c)
+	if len(c.unsettled) == 0 {
+		return
+	}
+	held := make([]*message, 0, len(c.unsettled))
+	for m := range c.unsettled {
+		held = append(held, m)
+	}
+	c.unsettled = make(map[*message]struct{})
+	sort.Slice(held, func(i, j int) bool { return held[i].seq < held[j].seq })
+	q := c.q
+	q.ready = append(held, q.ready...)
+	b.dispatch(q)
+}
+
+// detach implements cancel. Callers must hold b.mu.
+func (b *Broker) detach(c *consumer) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.deliveries)
+	q := c.q
+	for i, other := range q.consumers {
+		if other == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	if !q.durable && len(q.consumers) == 0 {
+		b.deleteQueue(q)
+	}
+}
+
+// deleteQueue removes q and its bindings. Callers must hold b.mu.
+func (b *Broker) deleteQueue(q *queue) {
+	delete(b.queues, q.name)
+	for _, bd := range q.bindings {
+		bound := b.exchanges[bd.exchange]
+		for i, other := range bound {
+			if other == q {
+				b.exchanges[bd.exchange] = append(bound[:i], bound[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// boundTo reports whether q receives messages published to exchange with key.
+func (q *queue) boundTo(exchange string, key domain.RoutingKey) bool {
+	for _, bd := range q.bindings {
+		if bd.exchange == exchange && bd.pattern.Matches(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextConsumer returns the next consumer in round-robin order that has
+// credit left, or nil if none has.
+func (q *queue) nextConsumer() *consumer {
+	for i := 0; i < len(q.consumers); i++ {
+		c := q.consumers[(q.next+i)%len(q.consumers)]
+		if len(c.unsettled) < c.credit {
+			q.next = (q.next + i + 1) % len(q.consumers)
+			return c
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/brokertest"
+)
+
+func eventually(t *testing.T, cond func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", msg)
+}
+
+// TestBroker_TopicRouting checks the routing of the topic exchange against
+// the matching rules of RabbitMQ.
+func TestBroker_TopicRouting(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"market.btc.usd", "market.btc.usd", true},
+		{"market.btc.usd", "market.btc.jpy", false},
+		{"market.*.usd", "market.eth.usd", true},
+		{"market.*.usd", "market.usd", false},
+		{"market.*", "market.btc.usd", false},
+		{"*.*.*", "market.btc.usd", true},
+		{"*.*", "market.btc.usd", false},
+		{"market.#", "market", true},
+		{"market.#", "market.btc.usd", true},
+		{"market.#", "markets.btc", false},
+		{"#", "market.btc.usd", true},
+		{"#.usd", "usd", true},
+		{"#.usd", "market.btc.usd", true},
+		{"#.usd", "market.btc.jpy", false},
+		{"market.#.usd", "market.usd", true},
+		{"market.#.usd", "market.btc.x.usd", true},
+		{"market.#.#.usd", "market.usd", true},
+		{"#.btc.#", "market.btc.usd", true},
+		{"#.btc.#", "btc", true},
+		{"*.#", "market", true},
+		{"#.*", "market.btc", true},
+		{"market.*.#", "market", false},
+		{"market.*.#", "market.btc", true},
+		{"MARKET.BTC.*", "market.btc.usd", true},
+	} {
+		b := NewBroker()
+		ctx, cancel := context.WithCancel(context.Background())
+		received := make(chan string, 1)
+		_, err := NewSubscriber(b).Subscribe(ctx, tc.pattern, func(trade domain.Trade) error {
+			received <- trade.ID
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: failed to subscribe: %v", tc.pattern, err)
+		}
+
+		key, err := domain.ParseRoutingKey(tc.key)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.key, err)
+		}
+		routed, err := b.publish(b.Exchange(), key, domain.Trade{ID: tc.key})
+		if err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+		if routed != tc.want {
+			t.Errorf("%s routed to %s: expected %v, got %v", tc.key, tc.pattern, tc.want, routed)
+		}
+		if tc.want {
+			select {
+			case <-received:
+			case <-time.After(2 * time.Second):
+				t.Errorf("%s: timed out waiting for %s", tc.pattern, tc.key)
+			}
+		}
+		cancel()
+	}
+}
+
+func TestBroker_CopiesToEveryBoundQueue(t *testing.T) {
+	b := NewBroker()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan string, 10)
+	for _, pattern := range []string{"market.#", "market.*.jpy", "market.eth.#"} {
+		pattern := pattern
+		_, err := NewSubscriber(b).Subscribe(ctx, pattern, func(trade domain.Trade) error {
+			received <- pattern
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed to subscribe: %v", err)
+		}
+	}
+
+	if err := NewPublisher(b).Publish(ctx, domain.Trade{ID: "t1", Symbol: "BTC", TargetCurrency: "JPY"}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	eventually(t, func() bool { return len(received) == 2 }, "two copies")
+	time.Sleep(20 * time.Millisecond)
+	if n := len(received); n != 2 {
+		t.Errorf("expected 2 copies, got %d", n)
+	}
+}
+
+func TestPublisher_ReportsUnroutable(t *testing.T) {
+	b := NewBroker()
+	pub := NewPublisher(b)
+	trade := domain.Trade{ID: "t1", Symbol: "BTC", TargetCurrency: "USD"}
+
+	if err := pub.Publish(context.Background(), trade); !errors.Is(err, domain.ErrTradeUnroutable) {
+		t.Errorf("expected ErrTradeUnroutable, got %v", err)
+	}
+	r, err := pub.PublishAsync(context.Background(), trade)
+	if err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	if err := r.Wait(context.Background()); !errors.Is(err, domain.ErrTradeUnroutable) {
+		t.Errorf("expected an unroutable receipt, got %v", err)
+	}
+
+	// Candles and alerts nobody listens to are dropped silently.
+	candle := domain.Candle{Symbol: "BTC", TargetCurrency: "USD", Interval: "1m"}
+	if err := NewCandlePublisher(b).PublishCandle(context.Background(), candle); err != nil {
+		t.Errorf("expected unroutable candle to be dropped, got %v", err)
+	}
+}
+
+func TestPublisher_RejectsInvalidSymbol(t *testing.T) {
+	err := NewPublisher(NewBroker()).Publish(context.Background(), domain.Trade{ID: "t1", Symbol: "BTC.X", TargetCurrency: "USD"})
+	if !errors.Is(err, domain.ErrInvalidRoutingKey) {
+		t.Fatalf("expected ErrInvalidRoutingKey, got %v", err)
+	}
+}
+
+func TestBroker_CloseEndsSubscriptions(t *testing.T) {
+	b := NewBroker()
+	sub, err := NewSubscriber(b).Subscribe(context.Background(), "market.#", func(trade domain.Trade) error { return nil })
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	b.Close()
+	if err := sub.Wait(); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	if err := NewPublisher(b).Publish(context.Background(), domain.Trade{ID: "t1", Symbol: "BTC", TargetCurrency: "USD"}); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed on publish, got %v", err)
+	}
+}
+
+func TestBroker_Conformance(t *testing.T) {
+	brokertest.Run(t, func(t *testing.T) brokertest.Broker {
+		b := NewBroker()
+		t.Cleanup(func() { b.Close() })
+		return brokertest.Broker{
+			Publisher:          NewPublisher(b),
+			Subscriber:         NewSubscriber(b),
+			OrderPublisher:     NewOrderPublisher(b),
+			OrderSubscriber:    NewOrderSubscriber(b),
+			DeadLetterExchange: b.DeadLetterExchange(),
+			DeadLetters:        func() int { return b.Len(b.DeadLetterExchange()) },
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package memory_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/memory"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/memstore"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/usecase"
+)
+
+// TestPipeline runs the simulator, the logger's recorder and the market
+// API's price book against one broker, the way the commands are wired.
+func TestPipeline(t *testing.T) {
+	b := memory.NewBroker()
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := memstore.New()
+	rec := usecase.NewTradeRecorder(store)
+	logged, err := usecase.NewTradeObserver(memory.NewSubscriber(b)).Start(ctx, "market.#", rec.Record,
+		domain.WithDurableQueue(b.Exchange()+".logger"), domain.WithManualAck(3), domain.WithDeadLetter(b.DeadLetterExchange()))
+	if err != nil {
+		t.Fatalf("failed to start logger: %v", err)
+	}
+	book := usecase.NewPriceBook()
+	priced, err := usecase.NewTradeObserver(memory.NewSubscriber(b)).Start(ctx, "market.*.jpy", book.Observe)
+	if err != nil {
+		t.Fatalf("failed to start price book: %v", err)
+	}
+
+	simulated, stop := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- usecase.NewMarketSimulator(memory.NewPublisher(b), usecase.WithSeed(1)).Run(simulated, time.Millisecond)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(book.Prices()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	stop()
+	<-done
+
+	for _, sub := range []domain.Subscription{logged, priced} {
+		if err := sub.Stop(ctx); err != nil {
+			t.Fatalf("failed to stop: %v", err)
+		}
+	}
+
+	stored, err := store.Find(ctx, domain.TradeQuery{})
+	if err != nil {
+		t.Fatalf("failed to read store: %v", err)
+	}
+	if len(stored) == 0 {
+		t.Fatal("expected the logger to store trades")
+	}
+	jpy := 0
+	for _, tr := range stored {
+		if tr.TargetCurrency == "JPY" {
+			jpy++
+		}
+	}
+	if got := len(book.Trades("", time.Time{})); got != jpy {
+		t.Errorf("expected the price book to see the %d JPY trades, got %d", jpy, got)
+	}
+	for _, p := range book.Prices() {
+		if p.TargetCurrency != "JPY" {
+			t.Errorf("unexpected price of %s/%s", p.Symbol, p.TargetCurrency)
+		}
+	}
+}
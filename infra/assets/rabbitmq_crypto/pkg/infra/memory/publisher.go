@@ -0,0 +1,111 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+type publisher struct {
+	b *Broker
+}
+
+// NewPublisher creates a TradePublisher that publishes trades to the trade
+// exchange on market.<symbol>.<target>. Like a confirming RabbitMQ
+// publisher it reports domain.ErrTradeUnroutable when no queue is bound to
+// receive a trade.
+func NewPublisher(b *Broker) domain.AsyncTradePublisher {
+	return &publisher{b: b}
+}
+
+// NewCandlePublisher creates a CandlePublisher that publishes closed candles
+// to the trade exchange on candles.<symbol>.<target>.<interval>.
+func NewCandlePublisher(b *Broker) domain.CandlePublisher {
+	return &publisher{b: b}
+}
+
+// NewAlertPublisher creates an AlertNotifier that republishes alerts to the
+// trade exchange on alerts.<symbol>.<target>.
+func NewAlertPublisher(b *Broker) domain.AlertNotifier {
+	return &publisher{b: b}
+}
+
+// NewOrderPublisher creates an OrderPublisher that sends orders to the
+// trade exchange on orders.<symbol>.<target>.
+func NewOrderPublisher(b *Broker) domain.OrderPublisher {
+	return &publisher{b: b}
+}
+
+func (p *publisher) Publish(ctx context.Context, trade domain.Trade) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	key, err := domain.TradeRoutingKey(trade)
+	if err != nil {
+		return err
+	}
+	routed, err := p.b.publish(p.b.exchange, key, trade)
+	if err != nil {
+		return err
+	}
+	if !routed {
+		return fmt.Errorf("trade %s to %s: %w", trade.ID, key, domain.ErrTradeUnroutable)
+	}
+	return nil
+}
+
+// PublishAsync publishes a trade right away; the receipt is already settled.
+func (p *publisher) PublishAsync(ctx context.Context, trade domain.Trade) (domain.PublishReceipt, error) {
+	err := p.Publish(ctx, trade)
+	if err != nil && !errors.Is(err, domain.ErrTradeUnroutable) {
+		return nil, err
+	}
+	return receipt{err: err}, nil
+}
+
+func (p *publisher) PublishCandle(ctx context.Context, candle domain.Candle) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	key, err := domain.CandleRoutingKey(candle)
+	if err != nil {
+		return err
+	}
+	_, err = p.b.publish(p.b.exchange, key, candle)
+	return err
+}
+
+func (p *publisher) Notify(ctx context.Context, alert domain.Alert) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	key, err := domain.AlertRoutingKey(alert)
+	if err != nil {
+		return err
+	}
+	_, err = p.b.publish(p.b.exchange, key, alert)
+	return err
+}
+
+func (p *publisher) PublishOrder(ctx context.Context, order domain.Order) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	key, err := domain.OrderRoutingKey(order)
+	if err != nil {
+		return err
+	}
+	_, err = p.b.publish(p.b.exchange, key, order)
+	return err
+}
+
+// receipt is the outcome of a publish that completed synchronously.
+type receipt struct {
+	err error
+}
+
+func (r receipt) Wait(ctx context.Context) error {
+	return r.err
+}
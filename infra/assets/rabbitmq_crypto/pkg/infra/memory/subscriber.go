@@ -0,0 +1,92 @@
+package memory
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/broker"
+)
+
+type subscriber struct {
+	b *Broker
+}
+
+// NewSubscriber creates a TradeSubscriber consuming from b.
+func NewSubscriber(b *Broker) domain.TradeSubscriber {
+	return &subscriber{b: b}
+}
+
+// NewOrderSubscriber creates an OrderSubscriber consuming from b.
+func NewOrderSubscriber(b *Broker) domain.OrderSubscriber {
+	return &subscriber{b: b}
+}
+
+// Subscribe consumes the trades matching routingKey until ctx is done, the
+// subscription is stopped or the broker is closed. Failed trades are
+// requeued at the head of their queue.
+func (s *subscriber) Subscribe(ctx context.Context, routingKey string, handler func(domain.Trade) error, opts ...domain.SubscribeOption) (domain.Subscription, error) {
+	pattern, src, o, err := s.consume(routingKey, opts)
+	if err != nil {
+		return nil, err
+	}
+	return broker.Dispatch(ctx, pattern.String(), src, broker.NewDecoder(), handler, o), nil
+}
+
+// SubscribeOrders consumes the orders matching routingKey, like Subscribe
+// does for trades.
+func (s *subscriber) SubscribeOrders(ctx context.Context, routingKey string, handler func(domain.Order) error, opts ...domain.SubscribeOption) (domain.Subscription, error) {
+	pattern, src, o, err := s.consume(routingKey, opts)
+	if err != nil {
+		return nil, err
+	}
+	return broker.DispatchOrders(ctx, pattern.String(), src, broker.NewDecoder(), handler, o), nil
+}
+
+// consume declares the queue for routingKey and attaches a consumer to it.
+func (s *subscriber) consume(routingKey string, opts []domain.SubscribeOption) (domain.TopicPattern, *source, domain.SubscribeOptions, error) {
+	o := domain.NewSubscribeOptions(opts...)
+
+	pattern, err := domain.ParseTopicPattern(routingKey)
+	if err != nil {
+		return "", nil, o, err
+	}
+
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	if s.b.closed {
+		return "", nil, o, ErrClosed
+	}
+	q, err := s.b.declareQueue(o.Queue, pattern, o)
+	if err != nil {
+		return "", nil, o, err
+	}
+	return pattern, &source{b: s.b, c: s.b.consume(q, o.Prefetch)}, o, nil
+}
+
+// source is a consumer of the broker.
+type source struct {
+	b         *Broker
+	c         *consumer
+	cancelled atomic.Bool
+}
+
+var _ broker.Source = (*source)(nil)
+
+func (src *source) Deliveries() <-chan broker.Delivery { return src.c.deliveries }
+
+func (src *source) Cancel() {
+	src.cancelled.Store(true)
+	src.b.cancel(src.c)
+}
+
+// Err reports that the broker was closed.
+func (src *source) Err() error {
+	if src.cancelled.Load() {
+		return nil
+	}
+	return ErrClosed
+}
+
+// Close requeues the messages still unsettled.
+func (src *source) Close() { src.b.release(src.c) }
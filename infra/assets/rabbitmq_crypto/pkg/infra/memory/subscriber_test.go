@@ -0,0 +1,332 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+func TestSubscriber_Subscribe(t *testing.T) {
+	b := NewBroker()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	received := make(chan domain.Trade, 1)
+	_, err := NewSubscriber(b).Subscribe(ctx, "market.btc.usd", func(trade domain.Trade) error {
+		received <- trade
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	trade := domain.Trade{ID: "test-id", Symbol: "BTC", TargetCurrency: "USD", Price: 50000}
+	if err := NewPublisher(b).Publish(ctx, trade); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	select {
+	case r := <-received:
+		if r != trade {
+			t.Errorf("expected %+v, got %+v", trade, r)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for trade")
+	}
+}
+
+func TestSubscriber_ManualAckRetriesThenDeadLetters(t *testing.T) {
+	b := NewBroker()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls atomic.Int32
+	_, err := NewSubscriber(b).Subscribe(ctx, "market.#", func(trade domain.Trade) error {
+		calls.Add(1)
+		return errors.New("downstream unavailable")
+	}, domain.WithManualAck(2), domain.WithDeadLetter(DeadLetterExchangeName))
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	if err := NewPublisher(b).Publish(ctx, domain.Trade{ID: "poison", Symbol: "btc", TargetCurrency: "usd"}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	eventually(t, func() bool { return b.Len(DeadLetterExchangeName) == 1 }, "trade to be dead-lettered")
+	// One initial delivery plus two retries.
+	if got := calls.Load(); got != 3 {
+		t.Errorf("expected 3 handler calls, got %d", got)
+	}
+}
+
+func TestSubscriber_ManualAckRetriesUntilSuccess(t *testing.T) {
+	b := NewBroker()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls atomic.Int32
+	done := make(chan struct{})
+	_, err := NewSubscriber(b).Subscribe(ctx, "market.#", func(trade domain.Trade) error {
+		if calls.Add(1) < 2 {
+			return errors.New("transient")
+		}
+		close(done)
+		return nil
+	}, domain.WithManualAck(5), domain.WithDeadLetter(DeadLetterExchangeName), domain.WithDurableQueue("q"))
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	if err := NewPublisher(b).Publish(ctx, domain.Trade{ID: "t1", Symbol: "eth", TargetCurrency: "jpy"}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	<-done
+
+	eventually(t, func() bool { return b.Len("q") == 0 }, "trade to be acked")
+	if n := b.Len(DeadLetterExchangeName); n != 0 {
+		t.Errorf("expected empty dead-letter queue, got %d", n)
+	}
+}
+
+func TestSubscriber_DeadLettersOtherMessages(t *testing.T) {
+	b := NewBroker()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A trade subscriber bound to everything also receives candles, which it
+	// cannot handle.
+	_, err := NewSubscriber(b).Subscribe(ctx, "#", func(trade domain.Trade) error {
+		t.Error("handler must not see candles")
+		return nil
+	}, domain.WithManualAck(3), domain.WithDeadLetter(DeadLetterExchangeName))
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	candle := domain.Candle{Symbol: "BTC", TargetCurrency: "USD", Interval: "1m"}
+	if err := NewCandlePublisher(b).PublishCandle(ctx, candle); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	eventually(t, func() bool { return b.Len(DeadLetterExchangeName) == 1 }, "candle to be dead-lettered")
+}
+
+func TestSubscriber_DurableQueueCompetingConsumers(t *testing.T) {
+	b := NewBroker()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	counts := make(map[int]int)
+	for i := 0; i < 2; i++ {
+		i := i
+		_, err := NewSubscriber(b).Subscribe(ctx, "market.#", func(trade domain.Trade) error {
+			mu.Lock()
+			counts[i]++
+			mu.Unlock()
+			return nil
+		}, domain.WithDurableQueue("workers"))
+		if err != nil {
+			t.Fatalf("failed to subscribe: %v", err)
+		}
+	}
+
+	pub := NewPublisher(b)
+	for i := 0; i < 10; i++ {
+		if err := pub.Publish(ctx, domain.Trade{ID: fmt.Sprint(i), Symbol: "btc", TargetCurrency: "usd"}); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+
+	eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return counts[0]+counts[1] == 10
+	}, "all trades to be consumed")
+	mu.Lock()
+	defer mu.Unlock()
+	if counts[0] != 5 || counts[1] != 5 {
+		t.Errorf("expected work to be shared round-robin, got %v", counts)
+	}
+}
+
+func TestSubscriber_DurableQueueResumesAfterRestart(t *testing.T) {
+	b := NewBroker()
+	pub := NewPublisher(b)
+
+	first, err := NewSubscriber(b).Subscribe(context.Background(), "market.#", func(trade domain.Trade) error { return nil },
+		domain.WithDurableQueue("logger"))
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	if err := first.Stop(context.Background()); err != nil {
+		t.Fatalf("failed to stop: %v", err)
+	}
+
+	// The consumer is gone, but the queue keeps collecting trades.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := pub.Publish(ctx, domain.Trade{ID: "missed", Symbol: "btc", TargetCurrency: "usd"}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	received := make(chan domain.Trade, 1)
+	_, err = NewSubscriber(b).Subscribe(ctx, "market.#", func(trade domain.Trade) error {
+		received <- trade
+		return nil
+	}, domain.WithDurableQueue("logger"))
+	if err != nil {
+		t.Fatalf("failed to resubscribe: %v", err)
+	}
+
+	select {
+	case tr := <-received:
+		if tr.ID != "missed" {
+			t.Errorf("expected trade missed, got %s", tr.ID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("trade published while the consumer was down was lost")
+	}
+}
+
+func TestSubscriber_PrivateQueueIsDeletedOnStop(t *testing.T) {
+	b := NewBroker()
+	sub, err := NewSubscriber(b).Subscribe(context.Background(), "market.#", func(trade domain.Trade) error { return nil })
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	if err := sub.Stop(context.Background()); err != nil {
+		t.Fatalf("failed to stop: %v", err)
+	}
+
+	err = NewPublisher(b).Publish(context.Background(), domain.Trade{ID: "t1", Symbol: "btc", TargetCurrency: "usd"})
+	if !errors.Is(err, domain.ErrTradeUnroutable) {
+		t.Errorf("expected ErrTradeUnroutable once the private queue is gone, got %v", err)
+	}
+}
+
+func TestSubscriber_StopAbortRequeuesUnsettled(t *testing.T) {
+	b := NewBroker()
+	pub := NewPublisher(b)
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	sub, err := NewSubscriber(b).Subscribe(context.Background(), "market.#", func(trade domain.Trade) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}, domain.WithDurableQueue("slow"), domain.WithManualAck(0))
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer close(release)
+
+	for _, id := range []string{"t1", "t2"} {
+		if err := pub.Publish(context.Background(), domain.Trade{ID: id, Symbol: "btc", TargetCurrency: "usd"}); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := sub.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+	if n := b.Len("slow"); n != 2 {
+		t.Errorf("expected both trades back in the queue, got %d", n)
+	}
+}
+
+func TestSubscriber_MaxLengthDropsOldest(t *testing.T) {
+	b := NewBroker()
+	pub := NewPublisher(b)
+
+	sub, err := NewSubscriber(b).Subscribe(context.Background(), "market.#", func(trade domain.Trade) error { return nil },
+		domain.WithDurableQueue("capped"), domain.WithMaxLength(2), domain.WithDeadLetter(DeadLetterExchangeName))
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	if err := sub.Stop(context.Background()); err != nil {
+		t.Fatalf("failed to stop: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := pub.Publish(context.Background(), domain.Trade{ID: fmt.Sprint(i), Symbol: "btc", TargetCurrency: "usd"}); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+	if n := b.Len("capped"); n != 2 {
+		t.Errorf("expected 2 trades kept, got %d", n)
+	}
+	if n := b.Len(DeadLetterExchangeName); n != 1 {
+		t.Errorf("expected the oldest trade dead-lettered, got %d", n)
+	}
+}
+
+func TestSubscriber_MessageTTLExpires(t *testing.T) {
+	b := NewBroker()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var mu sync.Mutex
+	b.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+
+	sub, err := NewSubscriber(b).Subscribe(context.Background(), "market.#", func(trade domain.Trade) error { return nil },
+		domain.WithDurableQueue("ttl"), domain.WithMessageTTL(time.Minute))
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	if err := sub.Stop(context.Background()); err != nil {
+		t.Fatalf("failed to stop: %v", err)
+	}
+	if err := NewPublisher(b).Publish(context.Background(), domain.Trade{ID: "stale", Symbol: "btc", TargetCurrency: "usd"}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	mu.Lock()
+	now = now.Add(2 * time.Minute)
+	mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err = NewSubscriber(b).Subscribe(ctx, "market.#", func(trade domain.Trade) error {
+		t.Errorf("expired trade %s was delivered", trade.ID)
+		return nil
+	}, domain.WithDurableQueue("ttl"), domain.WithMessageTTL(time.Minute))
+	if err != nil {
+		t.Fatalf("failed to resubscribe: %v", err)
+	}
+	if n := b.Len("ttl"); n != 0 {
+		t.Errorf("expected the expired trade to be discarded, got %d", n)
+	}
+}
+
+func TestSubscriber_QueueOptionErrors(t *testing.T) {
+	b := NewBroker()
+	noop := func(trade domain.Trade) error { return nil }
+
+	if _, err := NewSubscriber(b).Subscribe(context.Background(), "market..usd", noop); !errors.Is(err, domain.ErrInvalidTopicPattern) {
+		t.Errorf("expected ErrInvalidTopicPattern, got %v", err)
+	}
+	if _, err := NewSubscriber(b).Subscribe(context.Background(), "market.#", noop, domain.WithQuorumQueue()); err == nil {
+		t.Error("expected error for quorum queue without a name")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := NewSubscriber(b).Subscribe(ctx, "market.#", noop, domain.WithDurableQueue("q"), domain.WithMaxLength(10)); err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	if _, err := NewSubscriber(b).Subscribe(ctx, "market.#", noop, domain.WithDurableQueue("q"), domain.WithMaxLength(20)); err == nil {
+		t.Error("expected error redeclaring a queue with different arguments")
+	}
+}
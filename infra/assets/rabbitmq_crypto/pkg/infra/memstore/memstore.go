@@ -0,0 +1,64 @@
+// Package memstore is an in-memory domain.TradeRepository for tests and
+// short-lived runs.
+package memstore
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// Store keeps trades in memory. It is safe for concurrent use.
+type Store struct {
+	mu     sync.Mutex
+	trades []domain.Trade // sorted by timestamp, then ID
+	ids    map[string]struct{}
+}
+
+// New creates an empty Store.
+func New() *Store {
+	return &Store{ids: make(map[string]struct{})}
+}
+
+func (s *Store) Save(ctx context.Context, trades ...domain.Trade) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range trades {
+		if _, ok := s.ids[t.ID]; ok {
+			continue
+		}
+		s.ids[t.ID] = struct{}{}
+		i := sort.Search(len(s.trades), func(i int) bool { return less(t, s.trades[i]) })
+		s.trades = append(s.trades, domain.Trade{})
+		copy(s.trades[i+1:], s.trades[i:])
+		s.trades[i] = t
+	}
+	return nil
+}
+
+func (s *Store) Find(ctx context.Context, q domain.TradeQuery) ([]domain.Trade, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := []domain.Trade{}
+	for _, t := range s.trades {
+		if q.Limit > 0 && len(result) == q.Limit {
+			break
+		}
+		if (q.Symbol == "" || t.Symbol == q.Symbol) &&
+			(q.TargetCurrency == "" || t.TargetCurrency == q.TargetCurrency) &&
+			(q.From.IsZero() || !t.Timestamp.Before(q.From)) &&
+			(q.To.IsZero() || t.Timestamp.Before(q.To)) {
+			result = append(result, t)
+		}
+	}
+	return result, nil
+}
+
+func less(a, b domain.Trade) bool {
+	if !a.Timestamp.Equal(b.Timestamp) {
+		return a.Timestamp.Before(b.Timestamp)
+	}
+	return a.ID < b.ID
+}
@@ -0,0 +1,207 @@
+// Package metrics exports the trade metrics of a command in the Prometheus
+// format and serves its health probes:
+//
+//	GET /metrics  Prometheus metrics
+//	GET /healthz  liveness: 200 as long as the process serves requests
+//	GET /readyz   readiness: 200 while the broker is connected, else 503
+//
+// A lost broker connection only fails readiness: the connection recovers on
+// its own, so restarting the process would not help.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// Namespace prefixes the name of every metric.
+const Namespace = "crypto"
+
+// Stages of a trade counted as failed.
+const (
+	StagePublish = "publish"
+	StageConsume = "consume"
+)
+
+// shutdownTimeout bounds how long Serve waits for scrapes in flight.
+const shutdownTimeout = 5 * time.Second
+
+// lagBuckets spans trades handled right away to trades that waited in a
+// queue for minutes.
+var lagBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// Broker is the connection the probes and the connection metrics report on.
+// If it also has a Reconnects() uint64 method, reconnects are counted too.
+type Broker interface {
+	Connected() bool
+}
+
+type reconnecter interface {
+	Reconnects() uint64
+}
+
+// Exporter records trade metrics and serves them with the health probes. It
+// is a domain.TradeMetrics and an http.Handler.
+type Exporter struct {
+	broker    Broker
+	reg       *prometheus.Registry
+	published *prometheus.CounterVec
+	consumed  *prometheus.CounterVec
+	failed    *prometheus.CounterVec
+	handling  *prometheus.HistogramVec
+	lag       *prometheus.HistogramVec
+	mux       *http.ServeMux
+}
+
+var _ domain.TradeMetrics = (*Exporter)(nil)
+
+// New creates an Exporter reporting on broker. Besides the trade metrics,
+// it exports the Go runtime and process metrics.
+func New(broker Broker) *Exporter {
+	e := &Exporter{
+		broker: broker,
+		reg:    prometheus.NewRegistry(),
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "trades_published_total",
+			Help:      "Trades the broker confirmed, by routing key.",
+		}, []string{"routing_key"}),
+		consumed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "trades_consumed_total",
+			Help:      "Trades handled successfully, by routing key.",
+		}, []string{"routing_key"}),
+		failed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "trades_failed_total",
+			Help:      "Trades the broker did not confirm or route (stage publish) or a handler failed (stage consume), by routing key.",
+		}, []string{"routing_key", "stage"}),
+		handling: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "handler_duration_seconds",
+			Help:      "How long handlers took per trade, by routing key.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"routing_key"}),
+		lag: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "consumer_lag_seconds",
+			Help:      "How long after its timestamp a trade reached its handler, by routing key.",
+			Buckets:   lagBuckets,
+		}, []string{"routing_key"}),
+		mux: http.NewServeMux(),
+	}
+	e.reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		e.published, e.consumed, e.failed, e.handling, e.lag,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "broker_connected",
+			Help:      "Whether the broker is connected (1) or not (0).",
+		}, func() float64 {
+			if broker.Connected() {
+				return 1
+			}
+			return 0
+		}),
+	)
+	if r, ok := broker.(reconnecter); ok {
+		e.reg.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "broker_reconnects_total",
+			Help:      "Times the broker connection was re-established after it was lost.",
+		}, func() float64 {
+			return float64(r.Reconnects())
+		}))
+	}
+
+	e.mux.Handle("GET /metrics", promhttp.HandlerFor(e.reg, promhttp.HandlerOpts{Registry: e.reg}))
+	e.mux.HandleFunc("GET /healthz", e.healthz)
+	e.mux.HandleFunc("GET /readyz", e.readyz)
+	return e
+}
+
+// Registry returns the registry the metrics are kept in, so that a command
+// can add metrics of its own.
+func (e *Exporter) Registry() *prometheus.Registry {
+	return e.reg
+}
+
+func (e *Exporter) Published(trade domain.Trade, err error) {
+	key := routingKey(trade)
+	if err != nil {
+		e.failed.WithLabelValues(key, StagePublish).Inc()
+		return
+	}
+	e.published.WithLabelValues(key).Inc()
+}
+
+func (e *Exporter) Consumed(trade domain.Trade, lag, took time.Duration, err error) {
+	key := routingKey(trade)
+	e.lag.WithLabelValues(key).Observe(max(lag, 0).Seconds())
+	e.handling.WithLabelValues(key).Observe(took.Seconds())
+	if err != nil {
+		e.failed.WithLabelValues(key, StageConsume).Inc()
+		return
+	}
+	e.consumed.WithLabelValues(key).Inc()
+}
+
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mux.ServeHTTP(w, r)
+}
+
+// Serve serves the Exporter on addr until ctx is done.
+func (e *Exporter) Serve(ctx context.Context, addr string) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           e,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	stopped := context.AfterFunc(ctx, func() {
+		shutdown, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	})
+	defer stopped()
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (e *Exporter) healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "ok\nbroker: %s\n", e.state())
+}
+
+func (e *Exporter) readyz(w http.ResponseWriter, r *http.Request) {
+	if !e.broker.Connected() {
+		http.Error(w, "broker: disconnected", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (e *Exporter) state() string {
+	if e.broker.Connected() {
+		return "connected"
+	}
+	return "disconnected"
+}
+
+// routingKey labels a trade by the key it is routed with.
+func routingKey(trade domain.Trade) string {
+	key, err := domain.TradeRoutingKey(trade)
+	if err != nil {
+		return "invalid"
+	}
+	return key.String()
+}
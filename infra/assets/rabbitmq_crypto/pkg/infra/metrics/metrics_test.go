@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// fakeBroker is connected at will.
+type fakeBroker struct {
+	connected  atomic.Bool
+	reconnects atomic.Uint64
+}
+
+func (b *fakeBroker) Connected() bool    { return b.connected.Load() }
+func (b *fakeBroker) Reconnects() uint64 { return b.reconnects.Load() }
+
+// get requests path and returns the status and body.
+func get(t *testing.T, h http.Handler, path string) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	body, _ := io.ReadAll(rec.Body)
+	return rec.Code, string(body)
+}
+
+func TestExporter_TradeMetrics(t *testing.T) {
+	e := New(&fakeBroker{})
+	btc := domain.Trade{ID: "t1", Symbol: "BTC", TargetCurrency: "USD"}
+	eth := domain.Trade{ID: "t2", Symbol: "ETH", TargetCurrency: "JPY"}
+	e.Published(btc, nil)
+	e.Published(btc, nil)
+	e.Published(eth, domain.ErrTradeUnroutable)
+	e.Consumed(btc, 2*time.Second, 30*time.Millisecond, nil)
+	e.Consumed(eth, time.Second, time.Millisecond, errors.New("boom"))
+
+	code, body := get(t, e, "/metrics")
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	for _, want := range []string{
+		`crypto_trades_published_total{routing_key="market.btc.usd"} 2`,
+		`crypto_trades_failed_total{routing_key="market.eth.jpy",stage="publish"} 1`,
+		`crypto_trades_consumed_total{routing_key="market.btc.usd"} 1`,
+		`crypto_trades_failed_total{routing_key="market.eth.jpy",stage="consume"} 1`,
+		`crypto_handler_duration_seconds_count{routing_key="market.btc.usd"} 1`,
+		`crypto_handler_duration_seconds_sum{routing_key="market.btc.usd"} 0.03`,
+		`crypto_consumer_lag_seconds_bucket{routing_key="market.btc.usd",le="2.5"} 1`,
+		`crypto_consumer_lag_seconds_bucket{routing_key="market.btc.usd",le="1"} 0`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in:\n%s", want, body)
+		}
+	}
+}
+
+func TestExporter_BrokerState(t *testing.T) {
+	b := &fakeBroker{}
+	e := New(b)
+
+	if code, _ := get(t, e, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 while disconnected, got %d", code)
+	}
+	if code, body := get(t, e, "/healthz"); code != http.StatusOK || !strings.Contains(body, "disconnected") {
+		t.Errorf("expected a live process with a disconnected broker, got %d %q", code, body)
+	}
+	if _, body := get(t, e, "/metrics"); !strings.Contains(body, "crypto_broker_connected 0") {
+		t.Errorf("expected the broker to be reported disconnected:\n%s", body)
+	}
+
+	b.connected.Store(true)
+	b.reconnects.Store(3)
+	if code, _ := get(t, e, "/readyz"); code != http.StatusOK {
+		t.Errorf("expected 200 while connected, got %d", code)
+	}
+	_, body := get(t, e, "/metrics")
+	for _, want := range []string{"crypto_broker_connected 1", "crypto_broker_reconnects_total 3"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in:\n%s", want, body)
+		}
+	}
+}
+
+func TestExporter_WithoutReconnects(t *testing.T) {
+	e := New(struct{ Broker }{&fakeBroker{}})
+	if _, body := get(t, e, "/metrics"); strings.Contains(body, "reconnects") {
+		t.Errorf("expected no reconnect count for a broker without one:\n%s", body)
+	}
+}
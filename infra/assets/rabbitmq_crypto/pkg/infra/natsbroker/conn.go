@@ -0,0 +1,120 @@
+// Package natsbroker carries trades over NATS JetStream. Each exchange is a
+// stream whose subjects are the routing keys under the exchange name, and
+// each queue is a consumer of that stream.
+package natsbroker
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// ExchangeName is the exchange trades are published to unless WithExchange
+// is given. It matches the RabbitMQ exchange.
+const ExchangeName = "crypto_market"
+
+// setupTimeout bounds the JetStream API calls made while connecting and
+// subscribing.
+const setupTimeout = 10 * time.Second
+
+// Option configures a connection.
+type Option func(*Conn)
+
+// WithExchange sets the exchange trades are published to and consumed
+// from. Defaults to ExchangeName.
+func WithExchange(name string) Option {
+	return func(c *Conn) {
+		c.exchange = name
+	}
+}
+
+// Conn is a connection to a NATS server with JetStream enabled. The client
+// reconnects on its own; JetStream keeps streams and durable consumers
+// across reconnects.
+type Conn struct {
+	nc       *nats.Conn
+	js       jetstream.JetStream
+	exchange string
+}
+
+// Connect connects to url (e.g. nats://localhost:4222) and creates the
+// stream of the exchange.
+func Connect(url string, opts ...Option) (*Conn, error) {
+	c := &Conn{exchange: ExchangeName}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	nc, err := nats.Connect(url, nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("failed to open JetStream: %w", err)
+	}
+	c.nc, c.js = nc, js
+
+	// Like a topic exchange, the stream only keeps trades some consumer
+	// is interested in.
+	if err := c.ensureStream(c.exchange, jetstream.InterestPolicy); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Exchange names the stream trades are published to.
+func (c *Conn) Exchange() string {
+	return c.exchange
+}
+
+// DeadLetterExchange names the stream dead letters are published to.
+func (c *Conn) DeadLetterExchange() string {
+	return c.exchange + ".dlx"
+}
+
+// Connected reports whether the server is connected right now; the client
+// reconnects on its own after losing it.
+func (c *Conn) Connected() bool {
+	return c.nc.IsConnected()
+}
+
+// Reconnects returns how many times the client reconnected to a server.
+func (c *Conn) Reconnects() uint64 {
+	return c.nc.Stats().Reconnects
+}
+
+// Close drains the connection.
+func (c *Conn) Close() error {
+	return c.nc.Drain()
+}
+
+// ensureStream creates or updates the stream of an exchange.
+func (c *Conn) ensureStream(exchange string, retention jetstream.RetentionPolicy) error {
+	ctx, cancel := context.WithTimeout(context.Background(), setupTimeout)
+	defer cancel()
+	name := streamName(exchange)
+	_, err := c.js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:      name,
+		Subjects:  []string{name + ".>"},
+		Retention: retention,
+		Storage:   jetstream.FileStorage,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create stream %s: %w", name, err)
+	}
+	return nil
+}
+
+// streamName turns an exchange name into a stream name, which may not
+// contain dots. It is also the first token of the subjects of the stream,
+// so that the subjects of the trade and dead-letter streams do not overlap.
+func streamName(exchange string) string {
+	return strings.NewReplacer(".", "_", " ", "_", "*", "_", ">", "_").Replace(exchange)
+}
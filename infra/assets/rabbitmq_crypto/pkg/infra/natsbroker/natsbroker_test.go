@@ -0,0 +1,146 @@
+package natsbroker
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/brokertest"
+)
+
+// connect starts an embedded NATS server with JetStream and connects to it.
+func connect(t *testing.T) *Conn {
+	t.Helper()
+	srv, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+	t.Cleanup(srv.Shutdown)
+
+	c, err := Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func (c *Conn) streamLen(t *testing.T, exchange string) int {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	stream, err := c.js.Stream(ctx, streamName(exchange))
+	if err != nil {
+		return 0
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		t.Errorf("failed to read stream info: %v", err)
+		return 0
+	}
+	return int(info.State.Msgs)
+}
+
+func TestConformance(t *testing.T) {
+	brokertest.Run(t, func(t *testing.T) brokertest.Broker {
+		c := connect(t)
+		return brokertest.Broker{
+			Publisher:          NewPublisher(c),
+			Subscriber:         NewSubscriber(c),
+			OrderPublisher:     NewOrderPublisher(c),
+			OrderSubscriber:    NewOrderSubscriber(c),
+			DeadLetterExchange: c.DeadLetterExchange(),
+			DeadLetters:        func() int { return c.streamLen(t, c.DeadLetterExchange()) },
+		}
+	})
+}
+
+func TestFilterSubjects(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		want    []string
+	}{
+		{"market.btc.usd", []string{"x.market.btc.usd"}},
+		{"market.*.jpy", []string{"x.market.*.jpy"}},
+		{"market.#", []string{"x.market", "x.market.>"}},
+		{"market.*.#", []string{"x.market.*", "x.market.*.>"}},
+		{"#.usd", []string{"x.>"}},
+		{"#", []string{"x.>"}},
+	} {
+		pattern, err := domain.ParseTopicPattern(tc.pattern)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.pattern, err)
+		}
+		if got := filterSubjects("x", pattern); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: expected %v, got %v", tc.pattern, tc.want, got)
+		}
+	}
+}
+
+func TestStreamName(t *testing.T) {
+	if got := streamName("crypto_market.dlx"); got != "crypto_market_dlx" {
+		t.Errorf("expected crypto_market_dlx, got %s", got)
+	}
+}
+
+func TestSubscriber_PrivateConsumerDeletedOnStop(t *testing.T) {
+	c := connect(t)
+	sub, err := NewSubscriber(c).Subscribe(context.Background(), "market.#", func(domain.Trade) error { return nil })
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	if n := c.consumerCount(t); n != 1 {
+		t.Fatalf("expected 1 consumer, got %d", n)
+	}
+	if err := sub.Stop(context.Background()); err != nil {
+		t.Fatalf("failed to stop: %v", err)
+	}
+	if n := c.consumerCount(t); n != 0 {
+		t.Errorf("expected the private consumer to be deleted, got %d consumers", n)
+	}
+}
+
+func TestPublisher_PublishAsync(t *testing.T) {
+	c := connect(t)
+	r, err := NewPublisher(c).PublishAsync(context.Background(), domain.Trade{ID: "t1", Symbol: "BTC", TargetCurrency: "USD"})
+	if err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	if err := r.Wait(context.Background()); err != nil {
+		t.Errorf("expected the trade to be stored, got %v", err)
+	}
+}
+
+func TestSubscriber_RejectsMaxLength(t *testing.T) {
+	c := connect(t)
+	_, err := NewSubscriber(c).Subscribe(context.Background(), "market.#", func(domain.Trade) error { return nil }, domain.WithMaxLength(10))
+	if err == nil {
+		t.Fatal("expected max length to be rejected")
+	}
+}
+
+func (c *Conn) consumerCount(t *testing.T) int {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	stream, err := c.js.Stream(ctx, streamName(c.exchange))
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		t.Fatalf("failed to read stream info: %v", err)
+	}
+	return info.State.Consumers
+}
@@ -0,0 +1,125 @@
+package natsbroker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/broker"
+)
+
+type publisher struct {
+	c   *Conn
+	enc broker.Encoder
+}
+
+// NewPublisher creates a TradePublisher that publishes trades to
+// <exchange>.market.<symbol>.<target> and waits for JetStream to store
+// them. A stream keeps trades whether or not a consumer is interested, so
+// trades are never reported unroutable.
+func NewPublisher(c *Conn, opts ...broker.PublisherOption) domain.AsyncTradePublisher {
+	return &publisher{c: c, enc: broker.NewEncoder(opts...)}
+}
+
+// NewCandlePublisher creates a CandlePublisher that publishes closed candles
+// on candles.<symbol>.<target>.<interval>.
+func NewCandlePublisher(c *Conn, opts ...broker.PublisherOption) domain.CandlePublisher {
+	return &publisher{c: c, enc: broker.NewEncoder(opts...)}
+}
+
+// NewAlertPublisher creates an AlertNotifier that republishes alerts on
+// alerts.<symbol>.<target>.
+func NewAlertPublisher(c *Conn, opts ...broker.PublisherOption) domain.AlertNotifier {
+	return &publisher{c: c, enc: broker.NewEncoder(opts...)}
+}
+
+// NewOrderPublisher creates an OrderPublisher that sends orders on
+// orders.<symbol>.<target> and waits for JetStream to store them.
+func NewOrderPublisher(c *Conn, opts ...broker.PublisherOption) domain.OrderPublisher {
+	return &publisher{c: c, enc: broker.NewEncoder(opts...)}
+}
+
+func (p *publisher) Publish(ctx context.Context, trade domain.Trade) error {
+	m, err := p.enc.Trade(trade)
+	if err != nil {
+		return err
+	}
+	if _, err := p.c.js.PublishMsg(ctx, p.c.msg(p.c.exchange, m)); err != nil {
+		return fmt.Errorf("trade %s: %w: %v", trade.ID, domain.ErrTradeNotConfirmed, err)
+	}
+	return nil
+}
+
+// PublishAsync publishes a trade without waiting for JetStream to store it.
+func (p *publisher) PublishAsync(ctx context.Context, trade domain.Trade) (domain.PublishReceipt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m, err := p.enc.Trade(trade)
+	if err != nil {
+		return nil, err
+	}
+	f, err := p.c.js.PublishMsgAsync(p.c.msg(p.c.exchange, m))
+	if err != nil {
+		return nil, err
+	}
+	return receipt{id: trade.ID, f: f}, nil
+}
+
+func (p *publisher) PublishCandle(ctx context.Context, candle domain.Candle) error {
+	m, err := p.enc.Candle(candle)
+	if err != nil {
+		return err
+	}
+	_, err = p.c.js.PublishMsg(ctx, p.c.msg(p.c.exchange, m))
+	return err
+}
+
+func (p *publisher) Notify(ctx context.Context, alert domain.Alert) error {
+	m, err := p.enc.Alert(alert)
+	if err != nil {
+		return err
+	}
+	_, err = p.c.js.PublishMsg(ctx, p.c.msg(p.c.exchange, m))
+	return err
+}
+
+func (p *publisher) PublishOrder(ctx context.Context, order domain.Order) error {
+	m, err := p.enc.Order(order)
+	if err != nil {
+		return err
+	}
+	_, err = p.c.js.PublishMsg(ctx, p.c.msg(p.c.exchange, m))
+	return err
+}
+
+// msg addresses m to the stream of exchange.
+func (c *Conn) msg(exchange string, m broker.Message) *nats.Msg {
+	msg := nats.NewMsg(streamName(exchange) + "." + m.Key.String())
+	for k, v := range m.Headers {
+		msg.Header.Set(k, v)
+	}
+	// JetStream drops duplicates of a message ID within its window.
+	msg.Header.Set(jetstream.MsgIDHeader, m.Headers[broker.HeaderMessageID])
+	msg.Data = m.Body
+	return msg
+}
+
+// receipt waits for the acknowledgement of an asynchronous publish.
+type receipt struct {
+	id string
+	f  jetstream.PubAckFuture
+}
+
+func (r receipt) Wait(ctx context.Context) error {
+	select {
+	case <-r.f.Ok():
+		return nil
+	case err := <-r.f.Err():
+		return fmt.Errorf("trade %s: %w: %v", r.id, domain.ErrTradeNotConfirmed, err)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
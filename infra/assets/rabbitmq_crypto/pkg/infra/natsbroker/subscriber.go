@@ -0,0 +1,312 @@
+package natsbroker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/broker"
+)
+
+const (
+	// defaultCredit is how many trades a consumer fetches ahead without a
+	// prefetch limit.
+	defaultCredit = 256
+	// ackWait is how long JetStream waits for a trade to be settled before
+	// it redelivers it, e.g. after the subscriber crashed.
+	ackWait = 30 * time.Second
+	// privateInactivity is how long a private consumer outlives a
+	// subscriber that went away without deleting it.
+	privateInactivity = time.Minute
+)
+
+// errConsumerClosed is reported when the consumer stops on its own.
+var errConsumerClosed = errors.New("consumer closed")
+
+type subscriber struct {
+	c   *Conn
+	dec broker.Decoder
+}
+
+// NewSubscriber creates a TradeSubscriber consuming from the stream of the
+// exchange. A durable queue is a durable consumer shared by every
+// subscriber using its name; otherwise each subscription gets an ephemeral
+// consumer that starts with the trades published after Subscribe.
+//
+// Topic patterns become subject filters: "*" maps onto the NATS wildcard
+// and "#" onto ">" plus the subject without it, since "#" may match zero
+// segments. Trades the filter lets through that the pattern does not match,
+// such as market.usd for #.usd, are acknowledged without being handled.
+func NewSubscriber(c *Conn, opts ...broker.SubscriberOption) domain.TradeSubscriber {
+	return &subscriber{c: c, dec: broker.NewDecoder(opts...)}
+}
+
+// NewOrderSubscriber creates an OrderSubscriber consuming from the stream
+// of the exchange like NewSubscriber does.
+func NewOrderSubscriber(c *Conn, opts ...broker.SubscriberOption) domain.OrderSubscriber {
+	return &subscriber{c: c, dec: broker.NewDecoder(opts...)}
+}
+
+func (s *subscriber) Subscribe(ctx context.Context, routingKey string, handler func(domain.Trade) error, opts ...domain.SubscribeOption) (domain.Subscription, error) {
+	pattern, o, src, err := s.open(routingKey, opts)
+	if err != nil {
+		return nil, err
+	}
+	return broker.Dispatch(ctx, pattern.String(), src, s.dec, handler, o), nil
+}
+
+func (s *subscriber) SubscribeOrders(ctx context.Context, routingKey string, handler func(domain.Order) error, opts ...domain.SubscribeOption) (domain.Subscription, error) {
+	pattern, o, src, err := s.open(routingKey, opts)
+	if err != nil {
+		return nil, err
+	}
+	return broker.DispatchOrders(ctx, pattern.String(), src, s.dec, handler, o), nil
+}
+
+// open starts a consumer for the messages matching routingKey.
+func (s *subscriber) open(routingKey string, opts []domain.SubscribeOption) (domain.TopicPattern, domain.SubscribeOptions, *source, error) {
+	o := domain.NewSubscribeOptions(opts...)
+	if err := broker.CheckOptions(o); err != nil {
+		return "", o, nil, err
+	}
+	pattern, err := domain.ParseTopicPattern(routingKey)
+	if err != nil {
+		return "", o, nil, err
+	}
+	if o.DeadLetterExchange != "" {
+		// Dead letters are kept until someone removes them.
+		if err := s.c.ensureStream(o.DeadLetterExchange, jetstream.LimitsPolicy); err != nil {
+			return "", o, nil, err
+		}
+	}
+
+	src, err := s.consume(pattern, o)
+	return pattern, o, src, err
+}
+
+func (s *subscriber) consume(pattern domain.TopicPattern, o domain.SubscribeOptions) (*source, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), setupTimeout)
+	defer cancel()
+
+	stream := streamName(s.c.exchange)
+	cfg := jetstream.ConsumerConfig{
+		FilterSubjects: filterSubjects(stream, pattern),
+		AckPolicy:      jetstream.AckExplicitPolicy,
+		DeliverPolicy:  jetstream.DeliverNewPolicy,
+		AckWait:        ackWait,
+		MaxAckPending:  o.Prefetch,
+	}
+	var (
+		cons jetstream.Consumer
+		err  error
+	)
+	if o.Queue != "" {
+		cfg.Durable = streamName(o.Queue)
+		cons, err = s.c.js.CreateOrUpdateConsumer(ctx, stream, cfg)
+	} else {
+		cfg.InactiveThreshold = privateInactivity
+		cons, err = s.c.js.CreateConsumer(ctx, stream, cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	src := &source{
+		c:          s.c,
+		stream:     stream,
+		pattern:    pattern,
+		dlx:        o.DeadLetterExchange,
+		private:    o.Queue == "",
+		name:       cons.CachedInfo().Name,
+		deliveries: make(chan broker.Delivery),
+		quit:       make(chan struct{}),
+		unsettled:  make(map[jetstream.Msg]struct{}),
+	}
+	credit := o.Prefetch
+	if credit < 1 {
+		credit = defaultCredit
+	}
+	src.cc, err = cons.Consume(src.handle,
+		jetstream.PullMaxMessages(credit),
+		jetstream.ConsumeErrHandler(src.fail))
+	if err != nil {
+		src.deleteConsumer()
+		return nil, err
+	}
+	go func() {
+		<-src.cc.Closed()
+		close(src.deliveries)
+	}()
+	return src, nil
+}
+
+// filterSubjects maps a topic pattern onto the subjects of stream.
+func filterSubjects(stream string, pattern domain.TopicPattern) []string {
+	segments := strings.Split(pattern.String(), ".")
+	i := 0
+	for i < len(segments) && segments[i] != "#" {
+		i++
+	}
+	if i == len(segments) {
+		return []string{stream + "." + pattern.String()}
+	}
+	base := strings.Join(append([]string{stream}, segments[:i]...), ".")
+	if i == 0 {
+		return []string{base + ".>"}
+	}
+	return []string{base, base + ".>"}
+}
+
+// source feeds a subscription from a JetStream consumer.
+type source struct {
+	c       *Conn
+	stream  string
+	pattern domain.TopicPattern
+	dlx     string
+	private bool
+	name    string
+	cc      jetstream.ConsumeContext
+
+	deliveries chan broker.Delivery
+	quit       chan struct{} // closed by Close
+	cancelOnce sync.Once
+	closeOnce  sync.Once
+
+	mu        sync.Mutex
+	unsettled map[jetstream.Msg]struct{}
+	err       error
+}
+
+var _ broker.Source = (*source)(nil)
+
+func (s *source) Deliveries() <-chan broker.Delivery {
+	return s.deliveries
+}
+
+// Cancel stops fetching and hands over the trades already fetched.
+func (s *source) Cancel() {
+	s.cancelOnce.Do(s.cc.Drain)
+}
+
+func (s *source) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		return errConsumerClosed
+	}
+	return s.err
+}
+
+// Close stops the consumer and negatively acknowledges the trades still
+// unsettled, so that JetStream redelivers them right away. A private
+// consumer is deleted.
+func (s *source) Close() {
+	s.closeOnce.Do(func() {
+		close(s.quit)
+		s.cc.Stop()
+
+		s.mu.Lock()
+		unsettled := s.unsettled
+		s.unsettled = make(map[jetstream.Msg]struct{})
+		s.mu.Unlock()
+		for msg := range unsettled {
+			if err := msg.Nak(); err != nil {
+				log.Printf("Error requeueing message: %v", err)
+			}
+		}
+		if s.private {
+			s.deleteConsumer()
+		}
+	})
+}
+
+func (s *source) deleteConsumer() {
+	if !s.private {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), setupTimeout)
+	defer cancel()
+	if err := s.c.js.DeleteConsumer(ctx, s.stream, s.name); err != nil && !errors.Is(err, jetstream.ErrConsumerNotFound) {
+		log.Printf("Error deleting consumer %s: %v", s.name, err)
+	}
+}
+
+// fail records errors that end the consumer.
+func (s *source) fail(_ jetstream.ConsumeContext, err error) {
+	if errors.Is(err, jetstream.ErrConsumerDeleted) || errors.Is(err, nats.ErrConnectionClosed) {
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+		return
+	}
+	log.Printf("Error consuming from %s: %v", s.stream, err)
+}
+
+// handle turns a message into a delivery and waits for the subscription to
+// take it.
+func (s *source) handle(msg jetstream.Msg) {
+	key, err := domain.ParseRoutingKey(strings.TrimPrefix(msg.Subject(), s.stream+"."))
+	if err != nil || !s.pattern.Matches(key) {
+		if err := msg.Ack(); err != nil {
+			log.Printf("Error acking message: %v", err)
+		}
+		return
+	}
+
+	d := broker.Delivery{Message: broker.Message{Key: key, Headers: make(map[string]string), Body: msg.Data()}}
+	for k, v := range msg.Headers() {
+		if len(v) > 0 {
+			d.Headers[k] = v[0]
+		}
+	}
+	if md, err := msg.Metadata(); err == nil {
+		d.Published = md.Timestamp
+	}
+	d.Ack = func() { s.settle(msg, msg.Ack) }
+	d.Reject = func() { s.settle(msg, func() error { return s.reject(msg, d.Message) }) }
+
+	s.mu.Lock()
+	s.unsettled[msg] = struct{}{}
+	s.mu.Unlock()
+	select {
+	case s.deliveries <- d:
+	case <-s.quit:
+		s.settle(msg, msg.Nak)
+	}
+}
+
+// settle runs fn unless msg was settled already, which happens to trades
+// still being handled when Close gave them back.
+func (s *source) settle(msg jetstream.Msg, fn func() error) {
+	s.mu.Lock()
+	_, ok := s.unsettled[msg]
+	delete(s.unsettled, msg)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	if err := fn(); err != nil {
+		log.Printf("Error settling message: %v", err)
+	}
+}
+
+// reject dead-letters msg if the subscription has a dead-letter exchange
+// and terminates its delivery.
+func (s *source) reject(msg jetstream.Msg, m broker.Message) error {
+	if s.dlx != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), setupTimeout)
+		defer cancel()
+		if _, err := s.c.js.PublishMsg(ctx, s.c.msg(s.dlx, m)); err != nil {
+			// Keep the trade rather than lose it.
+			msg.Nak()
+			return err
+		}
+	}
+	return msg.Term()
+}
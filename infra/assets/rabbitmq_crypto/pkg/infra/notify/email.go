@@ -0,0 +1,125 @@
+package notify
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+const defaultEmailBody = `{{.Message}}
+
+Rule:      {{.Rule}} ({{.Kind}})
+Pair:      {{.Symbol}}/{{.TargetCurrency}}
+Value:     {{.Value}} (threshold {{.Threshold}})
+Trade:     {{.TradeID}}
+Time:      {{.Time.UTC.Format "2006-01-02T15:04:05Z07:00"}}
+`
+
+// Email sends alerts as plain-text mail over SMTP, upgrading to TLS with
+// STARTTLS when the server offers it.
+type Email struct {
+	addr string
+	from string
+	to   []string
+	opts options
+}
+
+// NewEmail creates a notifier that mails each alert from from to the to
+// addresses through the SMTP server at addr (host:port).
+func NewEmail(addr, from string, to []string, opts ...Option) *Email {
+	o := newOptions(defaultEmailBody, nil)
+	o.subject = template.Must(ParseTemplate("subject", "[alert] {{.Rule}} {{.Symbol}}/{{.TargetCurrency}}"))
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Email{addr: addr, from: from, to: to, opts: o}
+}
+
+func (e *Email) Notify(ctx context.Context, alert domain.Alert) error {
+	subject, err := render(e.opts.subject, alert)
+	if err != nil {
+		return Permanent(err)
+	}
+	body, err := render(e.opts.body, alert)
+	if err != nil {
+		return Permanent(err)
+	}
+	return e.send(ctx, e.message(subject, body))
+}
+
+// message formats an RFC 5322 message with CRLF line endings.
+func (e *Email) message(subject, body string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", e.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(e.to, ", "))
+	// A line break in a rendered subject would start a new header.
+	subject = strings.NewReplacer("\r", " ", "\n", " ").Replace(subject)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// send delivers msg within the timeout, or until ctx ends.
+func (e *Email) send(ctx context.Context, msg []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, e.opts.timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", e.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// The SMTP client does not take a context: the deadline interrupts a
+	// stalled server, and ending ctx moves it forward to now.
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	host, _, _ := net.SplitHostPort(e.addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}); err != nil {
+			return err
+		}
+	}
+	if e.opts.auth != nil {
+		if err := c.Auth(e.opts.auth); err != nil {
+			return Permanent(err)
+		}
+	}
+	if err := c.Mail(e.from); err != nil {
+		return err
+	}
+	for _, to := range e.to {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
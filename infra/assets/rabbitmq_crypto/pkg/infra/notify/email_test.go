@@ -0,0 +1,159 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mail is a message received by the SMTP stub.
+type mail struct {
+	from string
+	to   []string
+	data string
+}
+
+// startSMTPStub serves just enough SMTP to accept messages, which it
+// reports on the returned channel. rcptStatus is the reply to RCPT TO.
+func startSMTPStub(t *testing.T, rcptStatus string) (string, <-chan mail) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	received := make(chan mail, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, rcptStatus, received)
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+func serveSMTP(conn net.Conn, rcptStatus string, received chan<- mail) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 stub ESMTP")
+
+	var m mail
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch {
+		case cmd == "EHLO" || cmd == "HELO":
+			tp.PrintfLine("250 stub")
+		case strings.HasPrefix(strings.ToUpper(line), "MAIL FROM:"):
+			m = mail{from: strings.Trim(line[len("MAIL FROM:"):], "<>")}
+			tp.PrintfLine("250 OK")
+		case strings.HasPrefix(strings.ToUpper(line), "RCPT TO:"):
+			m.to = append(m.to, strings.Trim(line[len("RCPT TO:"):], "<>"))
+			tp.PrintfLine("%s", rcptStatus)
+		case cmd == "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			m.data = string(data)
+			received <- m
+			tp.PrintfLine("250 queued")
+		case cmd == "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func TestEmail_SendsAlert(t *testing.T) {
+	addr, received := startSMTPStub(t, "250 OK")
+	subject, err := ParseTemplate("subject", "🚨 {{.Rule}} on {{.Symbol}}")
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	e := NewEmail(addr, "alerts@example.com", []string{"desk@example.com", "oncall@example.com"}, WithSubject(subject))
+	if err := e.Notify(context.Background(), testAlert); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+
+	var m mail
+	select {
+	case m = <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no mail received")
+	}
+	if m.from != "alerts@example.com" || len(m.to) != 2 || m.to[1] != "oncall@example.com" {
+		t.Errorf("unexpected envelope %s -> %v", m.from, m.to)
+	}
+	msg, err := textproto.NewReader(bufio.NewReader(strings.NewReader(m.data))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatalf("invalid message headers: %v", err)
+	}
+	if got := msg.Get("Subject"); got != "=?utf-8?q?=F0=9F=9A=A8_whale_on_BTC?=" {
+		t.Errorf("expected an encoded subject, got %s", got)
+	}
+	for _, want := range []string{testAlert.Message, "Pair:      BTC/USD", "Time:      2024-01-01T12:00:00Z"} {
+		if !strings.Contains(m.data, want) {
+			t.Errorf("expected body to contain %q:\n%s", want, m.data)
+		}
+	}
+}
+
+func TestEmail_ReportsRejectedRecipient(t *testing.T) {
+	addr, _ := startSMTPStub(t, "550 no such user")
+
+	err := NewEmail(addr, "alerts@example.com", []string{"nobody@example.com"}).Notify(context.Background(), testAlert)
+	if err == nil || !strings.Contains(err.Error(), "no such user") {
+		t.Errorf("expected the rejection to be reported, got %v", err)
+	}
+}
+
+func TestEmail_SubjectCannotAddHeaders(t *testing.T) {
+	e := NewEmail("localhost:25", "a@example.com", []string{"b@example.com"})
+	if got := string(e.message("[alert] whale BTC/USD\r\nBcc: x@example.com", "hi")); !strings.Contains(got, "Subject: [alert] whale BTC/USD  Bcc: x@example.com\r\n") {
+		t.Errorf("expected line breaks in the subject to be removed:\n%s", got)
+	}
+}
+
+func TestEmail_TimesOutOnStalledServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	// Accept connections but never greet.
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	start := time.Now()
+	err = NewEmail(ln.Addr().String(), "a@example.com", []string{"b@example.com"}, WithTimeout(100*time.Millisecond)).
+		Notify(context.Background(), testAlert)
+	if err == nil {
+		t.Fatal("expected a stalled server to fail the delivery")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the delivery to give up after its timeout, took %v", elapsed)
+	}
+}
@@ -0,0 +1,213 @@
+// Package notify delivers alerts to people and systems: generic HTTP
+// webhooks, Slack-compatible incoming webhooks, email and the log. Wrap a
+// notifier with Retry to ride out transient failures and combine several
+// with Multi.
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// DefaultTimeout bounds a single delivery unless WithTimeout sets another
+// limit.
+const DefaultTimeout = 10 * time.Second
+
+// Option configures a notifier.
+type Option func(*options)
+
+type options struct {
+	body    *template.Template
+	subject *template.Template
+	client  *http.Client
+	auth    smtp.Auth
+	timeout time.Duration
+}
+
+// WithTemplate sets the template rendering an alert: the request body of a
+// webhook, the message text of a Slack webhook, the body of an email or the
+// log line.
+func WithTemplate(t *template.Template) Option {
+	return func(o *options) {
+		o.body = t
+	}
+}
+
+// WithSubject sets the template rendering the subject of an email.
+func WithSubject(t *template.Template) Option {
+	return func(o *options) {
+		o.subject = t
+	}
+}
+
+// WithHTTPClient sets the client used by webhooks. Defaults to a client
+// with a 10 second timeout.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *options) {
+		o.client = c
+	}
+}
+
+// WithTimeout bounds each delivery attempt of a webhook or an email, so
+// that an unresponsive server cannot hold up the caller. Defaults to
+// DefaultTimeout.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// WithSMTPAuth authenticates email delivery, e.g. with smtp.PlainAuth.
+func WithSMTPAuth(a smtp.Auth) Option {
+	return func(o *options) {
+		o.auth = a
+	}
+}
+
+func newOptions(body string, opts []Option) options {
+	o := options{
+		body:    template.Must(ParseTemplate("body", body)),
+		client:  &http.Client{Timeout: DefaultTimeout},
+		timeout: DefaultTimeout,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// ParseTemplate parses a text/template that renders a domain.Alert. Besides
+// the builtins it offers json, which encodes a value as JSON, and upper and
+// lower.
+func ParseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"upper": strings.ToUpper,
+		"lower": strings.ToLower,
+	}).Parse(text)
+}
+
+func render(t *template.Template, alert domain.Alert) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, alert); err != nil {
+		return "", fmt.Errorf("could not render %s template: %w", t.Name(), err)
+	}
+	return b.String(), nil
+}
+
+// permanentError marks a failure that retrying cannot fix.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not worth retrying, e.g. a rejected request.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// IsPermanent reports whether err was marked with Permanent.
+func IsPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+type retrying struct {
+	next     domain.AlertNotifier
+	attempts int
+	backoff  time.Duration
+}
+
+// Retry makes up to attempts tries to deliver each alert, doubling the delay
+// between them starting from backoff. Permanent errors are not retried.
+func Retry(n domain.AlertNotifier, attempts int, backoff time.Duration) domain.AlertNotifier {
+	return &retrying{next: n, attempts: attempts, backoff: backoff}
+}
+
+func (r *retrying) Notify(ctx context.Context, alert domain.Alert) error {
+	for attempt := 1; ; attempt++ {
+		err := r.next.Notify(ctx, alert)
+		if err == nil || IsPermanent(err) || attempt >= r.attempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(r.backoff << (attempt - 1)):
+		}
+	}
+}
+
+type timeout struct {
+	next domain.AlertNotifier
+	d    time.Duration
+}
+
+// Timeout bounds each delivery by n to d, for notifiers without a timeout
+// of their own such as a broker publisher waiting for a connection.
+func Timeout(n domain.AlertNotifier, d time.Duration) domain.AlertNotifier {
+	return &timeout{next: n, d: d}
+}
+
+func (t *timeout) Notify(ctx context.Context, alert domain.Alert) error {
+	ctx, cancel := context.WithTimeout(ctx, t.d)
+	defer cancel()
+	return t.next.Notify(ctx, alert)
+}
+
+type multi []domain.AlertNotifier
+
+// Multi delivers each alert to all notifiers in parallel and returns their
+// combined errors.
+func Multi(ns ...domain.AlertNotifier) domain.AlertNotifier {
+	return multi(ns)
+}
+
+func (m multi) Notify(ctx context.Context, alert domain.Alert) error {
+	errs := make([]error, len(m))
+	var wg sync.WaitGroup
+	for i, n := range m {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = n.Notify(ctx, alert)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Log writes alerts to the standard logger.
+type Log struct {
+	opts options
+}
+
+// NewLog creates a notifier that logs each alert's message.
+func NewLog(opts ...Option) *Log {
+	return &Log{opts: newOptions("🚨 ALERT {{.Message}}", opts)}
+}
+
+func (l *Log) Notify(ctx context.Context, alert domain.Alert) error {
+	line, err := render(l.opts.body, alert)
+	if err != nil {
+		return Permanent(err)
+	}
+	log.Print(line)
+	return nil
+}
@@ -0,0 +1,121 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+var testAlert = domain.Alert{
+	Rule:           "whale",
+	Kind:           domain.RuleAmount,
+	Symbol:         "BTC",
+	TargetCurrency: "USD",
+	Value:          5,
+	Threshold:      3,
+	TradeID:        "t1",
+	Time:           time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+	Message:        "whale: buy 5.0000 BTC/USD at 60000.00",
+}
+
+// flaky fails the first failures calls with err.
+type flaky struct {
+	mu       sync.Mutex
+	failures int
+	err      error
+	calls    int
+}
+
+func (f *flaky) Notify(ctx context.Context, alert domain.Alert) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.calls <= f.failures {
+		return f.err
+	}
+	return nil
+}
+
+func TestRetry_RetriesTransientErrors(t *testing.T) {
+	sink := &flaky{failures: 2, err: errors.New("503")}
+	if err := Retry(sink, 3, time.Millisecond).Notify(context.Background(), testAlert); err != nil {
+		t.Fatalf("expected the third attempt to succeed, got %v", err)
+	}
+	if sink.calls != 3 {
+		t.Errorf("expected 3 attempts, got %d", sink.calls)
+	}
+
+	sink = &flaky{failures: 5, err: errors.New("503")}
+	if err := Retry(sink, 3, time.Millisecond).Notify(context.Background(), testAlert); err == nil {
+		t.Error("expected an error after 3 attempts")
+	}
+	if sink.calls != 3 {
+		t.Errorf("expected 3 attempts, got %d", sink.calls)
+	}
+}
+
+func TestRetry_StopsOnPermanentError(t *testing.T) {
+	sink := &flaky{failures: 5, err: Permanent(errors.New("400"))}
+	err := Retry(sink, 3, time.Millisecond).Notify(context.Background(), testAlert)
+	if !IsPermanent(err) || sink.calls != 1 {
+		t.Errorf("expected one attempt and a permanent error, got %d and %v", sink.calls, err)
+	}
+}
+
+func TestRetry_GivesUpWhenContextEnds(t *testing.T) {
+	sink := &flaky{failures: 5, err: errors.New("503")}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err := Retry(sink, 5, time.Hour).Notify(ctx, testAlert)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to end retrying, got %v", err)
+	}
+}
+
+// blocking waits until its context ends.
+type blocking struct{}
+
+func (blocking) Notify(ctx context.Context, alert domain.Alert) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestTimeout_BoundsDelivery(t *testing.T) {
+	err := Timeout(blocking{}, 10*time.Millisecond).Notify(context.Background(), testAlert)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the delivery to time out, got %v", err)
+	}
+}
+
+func TestMulti_DeliversToEverySink(t *testing.T) {
+	ok := &flaky{}
+	broken := &flaky{failures: 1, err: errors.New("down")}
+
+	err := Multi(ok, broken).Notify(context.Background(), testAlert)
+	if err == nil || !strings.Contains(err.Error(), "down") {
+		t.Errorf("expected the failing sink's error, got %v", err)
+	}
+	if ok.calls != 1 || broken.calls != 1 {
+		t.Errorf("expected each sink to be called once, got %d and %d", ok.calls, broken.calls)
+	}
+}
+
+func TestParseTemplate_Funcs(t *testing.T) {
+	tmpl, err := ParseTemplate("t", `{"pair": {{json (printf "%s/%s" .Symbol .TargetCurrency)}}, "rule": "{{upper .Rule}}"}`)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	got, err := render(tmpl, testAlert)
+	if err != nil {
+		t.Fatalf("failed to render: %v", err)
+	}
+	if got != `{"pair": "BTC/USD", "rule": "WHALE"}` {
+		t.Errorf("unexpected rendering %s", got)
+	}
+}
@@ -0,0 +1,82 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// Webhook posts alerts as JSON to an HTTP endpoint.
+type Webhook struct {
+	url     string
+	opts    options
+	payload func(rendered string) ([]byte, error)
+}
+
+// NewWebhook creates a notifier that posts each alert to url. The body is
+// the alert as JSON unless WithTemplate gives another one.
+func NewWebhook(url string, opts ...Option) *Webhook {
+	return &Webhook{
+		url:     url,
+		opts:    newOptions("{{json .}}", opts),
+		payload: func(rendered string) ([]byte, error) { return []byte(rendered), nil },
+	}
+}
+
+// NewSlack creates a notifier that posts each alert to a Slack-compatible
+// incoming webhook as {"text": ...}. WithTemplate sets the text, which may
+// use Slack's mrkdwn.
+func NewSlack(url string, opts ...Option) *Webhook {
+	return &Webhook{
+		url:  url,
+		opts: newOptions(":rotating_light: *{{.Rule}}* {{.Message}}", opts),
+		payload: func(rendered string) ([]byte, error) {
+			return json.Marshal(struct {
+				Text string `json:"text"`
+			}{rendered})
+		},
+	}
+}
+
+// Notify posts the alert. Responses other than 2xx fail; 4xx other than
+// 408 and 429 fail permanently, since resending the same alert will not help.
+func (w *Webhook) Notify(ctx context.Context, alert domain.Alert) error {
+	rendered, err := render(w.opts.body, alert)
+	if err != nil {
+		return Permanent(err)
+	}
+	body, err := w.payload(rendered)
+	if err != nil {
+		return Permanent(err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, w.opts.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.opts.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain the body so that the connection can be reused.
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("webhook responded %s", resp.Status)
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return Permanent(err)
+	}
+	return err
+}
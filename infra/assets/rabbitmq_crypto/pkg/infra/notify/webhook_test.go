@@ -0,0 +1,117 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// recordingServer responds with the given statuses in turn, then 200, and
+// records the bodies it received.
+func recordingServer(t *testing.T, statuses ...int) (*httptest.Server, <-chan []byte) {
+	t.Helper()
+	bodies := make(chan []byte, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected content type %q", r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		bodies <- body
+		status := http.StatusOK
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, bodies
+}
+
+func TestWebhook_PostsAlertAsJSON(t *testing.T) {
+	srv, bodies := recordingServer(t)
+
+	if err := NewWebhook(srv.URL).Notify(context.Background(), testAlert); err != nil {
+		t.Fatalf("failed to notify: %v", err)
+	}
+	var got domain.Alert
+	if err := json.Unmarshal(<-bodies, &got); err != nil {
+		t.Fatalf("body is not an alert: %v", err)
+	}
+	if got != testAlert {
+		t.Errorf("expected %+v, got %+v", testAlert, got)
+	}
+}
+
+func TestWebhook_Template(t *testing.T) {
+	srv, bodies := recordingServer(t)
+	tmpl, err := ParseTemplate("body", `{"summary": {{json .Message}}, "severity": "high"}`)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	if err := NewWebhook(srv.URL, WithTemplate(tmpl)).Notify(context.Background(), testAlert); err != nil {
+		t.Fatalf("failed to notify: %v", err)
+	}
+	if got := string(<-bodies); got != `{"summary": "whale: buy 5.0000 BTC/USD at 60000.00", "severity": "high"}` {
+		t.Errorf("unexpected body %s", got)
+	}
+}
+
+func TestSlack_PostsText(t *testing.T) {
+	srv, bodies := recordingServer(t)
+
+	if err := NewSlack(srv.URL).Notify(context.Background(), testAlert); err != nil {
+		t.Fatalf("failed to notify: %v", err)
+	}
+	var got struct{ Text string }
+	if err := json.Unmarshal(<-bodies, &got); err != nil {
+		t.Fatalf("body is not a Slack message: %v", err)
+	}
+	if got.Text != ":rotating_light: *whale* "+testAlert.Message {
+		t.Errorf("unexpected text %q", got.Text)
+	}
+}
+
+func TestWebhook_RetriesServerErrorsOnly(t *testing.T) {
+	srv, bodies := recordingServer(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	if err := Retry(NewWebhook(srv.URL), 3, time.Millisecond).Notify(context.Background(), testAlert); err != nil {
+		t.Fatalf("expected delivery on the third attempt, got %v", err)
+	}
+	if n := len(bodies); n != 3 {
+		t.Errorf("expected 3 requests, got %d", n)
+	}
+
+	srv, bodies = recordingServer(t, http.StatusBadRequest)
+	err := Retry(NewWebhook(srv.URL), 3, time.Millisecond).Notify(context.Background(), testAlert)
+	if !IsPermanent(err) {
+		t.Errorf("expected a permanent error for 400, got %v", err)
+	}
+	if n := len(bodies); n != 1 {
+		t.Errorf("expected a single request, got %d", n)
+	}
+}
+
+func TestWebhook_TimesOut(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	// A client without a timeout of its own.
+	n := NewWebhook(srv.URL, WithHTTPClient(&http.Client{}), WithTimeout(100*time.Millisecond))
+	start := time.Now()
+	if err := n.Notify(context.Background(), testAlert); err == nil {
+		t.Fatal("expected a stalled server to fail the delivery")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the delivery to give up after its timeout, took %v", elapsed)
+	}
+}
@@ -0,0 +1,301 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/broker"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// UnroutableError is returned for a trade the broker could not route to any
+// queue. It matches domain.ErrTradeUnroutable with errors.Is.
+type UnroutableError struct {
+	TradeID    string
+	RoutingKey string
+	ReplyCode  uint16
+	ReplyText  string
+}
+
+func (e *UnroutableError) Error() string {
+	return fmt.Sprintf("trade %s unroutable via %q: %d %s", e.TradeID, e.RoutingKey, e.ReplyCode, e.ReplyText)
+}
+
+func (e *UnroutableError) Is(target error) bool {
+	return target == domain.ErrTradeUnroutable
+}
+
+var (
+	errNacked   = fmt.Errorf("%w: nacked by broker", domain.ErrTradeNotConfirmed)
+	errChanLost = fmt.Errorf("%w: channel closed before confirmation", domain.ErrTradeNotConfirmed)
+)
+
+// headerPublishSeq carries the sequence number of a publish, so that a
+// returned message is matched to its publish even if another one carries
+// the same trade.
+const headerPublishSeq = "x-publish-seq"
+
+// Receipt is the pending delivery outcome of a trade published with
+// ConfirmingPublisher.PublishAsync.
+type Receipt struct {
+	trade domain.Trade
+	span  trace.Span // ends with the outcome
+	done  chan struct{}
+	err   error
+}
+
+func (r *Receipt) resolve(err error) {
+	r.err = err
+	if r.span != nil {
+		endSpan(r.span, err)
+	}
+	close(r.done)
+}
+
+// Wait blocks until the broker settled the trade or ctx is done.
+func (r *Receipt) Wait(ctx context.Context) error {
+	select {
+	case <-r.done:
+		return r.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ConfirmingPublisher publishes trades in confirm mode with the mandatory
+// flag set, so every trade is reported as acknowledged, rejected or
+// unroutable.
+type ConfirmingPublisher struct {
+	conn *Connection
+	enc  broker.Encoder
+
+	mu sync.Mutex // serializes publishes so sequence numbers match
+	cc *confirmChannel
+}
+
+// NewConfirmingPublisher creates a publisher that waits for broker confirms.
+func NewConfirmingPublisher(conn *Connection, opts ...broker.PublisherOption) *ConfirmingPublisher {
+	return &ConfirmingPublisher{conn: conn, enc: broker.NewEncoder(opts...)}
+}
+
+var _ domain.AsyncTradePublisher = (*ConfirmingPublisher)(nil)
+
+// Publish publishes a trade and waits until the broker confirmed it.
+func (p *ConfirmingPublisher) Publish(ctx context.Context, trade domain.Trade) error {
+	r, err := p.publish(ctx, trade)
+	if err != nil {
+		return err
+	}
+	return r.Wait(ctx)
+}
+
+// PublishAsync publishes a trade and returns immediately; the receipt
+// resolves once the broker confirmed it.
+func (p *ConfirmingPublisher) PublishAsync(ctx context.Context, trade domain.Trade) (domain.PublishReceipt, error) {
+	r, err := p.publish(ctx, trade)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// PublishBatch publishes all trades before waiting for their confirms and
+// returns one outcome per trade, in order.
+func (p *ConfirmingPublisher) PublishBatch(ctx context.Context, trades []domain.Trade) []error {
+	errs := make([]error, len(trades))
+	receipts := make([]*Receipt, len(trades))
+	for i, trade := range trades {
+		receipts[i], errs[i] = p.publish(ctx, trade)
+	}
+	for i, r := range receipts {
+		if r != nil {
+			errs[i] = r.Wait(ctx)
+		}
+	}
+	return errs
+}
+
+func (p *ConfirmingPublisher) publish(ctx context.Context, trade domain.Trade) (*Receipt, error) {
+	m, err := p.enc.Trade(trade)
+	if err != nil {
+		return nil, err
+	}
+	routingKey, msg := m.Key.String(), publishing(m)
+	// The span lasts until the broker settles the trade.
+	span := p.conn.startPublish(ctx, routingKey, &msg)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		cc, err := p.channel(ctx)
+		if err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+
+		r := &Receipt{trade: trade, span: span, done: make(chan struct{})}
+		seq := cc.ch.GetNextPublishSeqNo()
+		cc.track(seq, r)
+		msg.Headers[headerPublishSeq] = int64(seq)
+
+		err = cc.ch.PublishWithContext(ctx,
+			p.conn.exchange, // exchange
+			routingKey,      // routing key
+			true,            // mandatory
+			false,           // immediate
+			msg,
+		)
+		if err == nil {
+			return r, nil
+		}
+		cc.untrack(seq)
+		if !errors.Is(err, amqp.ErrClosed) {
+			endSpan(span, err)
+			return nil, err
+		}
+		// The channel died under us; reopen it and try again.
+		p.cc = nil
+	}
+}
+
+// channel returns the current confirm-mode channel, opening a new one if
+// needed. Callers must hold p.mu.
+func (p *ConfirmingPublisher) channel(ctx context.Context) (*confirmChannel, error) {
+	if p.cc != nil && !p.cc.ch.IsClosed() {
+		return p.cc, nil
+	}
+	ch, err := p.conn.channel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("could not enable confirm mode: %w", err)
+	}
+	p.cc = newConfirmChannel(ch)
+	return p.cc, nil
+}
+
+// confirmChannel matches broker confirms and returns on one channel to the
+// receipts of outstanding publishes.
+type confirmChannel struct {
+	ch amqpChannel
+
+	mu       sync.Mutex
+	pending  map[uint64]*Receipt
+	returned map[uint64]amqp.Return // by publish sequence number
+}
+
+func newConfirmChannel(ch amqpChannel) *confirmChannel {
+	cc := &confirmChannel{
+		ch:       ch,
+		pending:  make(map[uint64]*Receipt),
+		returned: make(map[uint64]amqp.Return),
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 256))
+	returns := ch.NotifyReturn(make(chan amqp.Return, 256))
+	go cc.listen(confirms, returns)
+	return cc
+}
+
+func (cc *confirmChannel) track(seq uint64, r *Receipt) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.pending[seq] = r
+}
+
+func (cc *confirmChannel) untrack(seq uint64) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	delete(cc.pending, seq)
+}
+
+// listen resolves receipts until the channel is closed, then fails whatever
+// is still outstanding.
+func (cc *confirmChannel) listen(confirms <-chan amqp.Confirmation, returns <-chan amqp.Return) {
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			cc.recordReturn(r)
+		case c, ok := <-confirms:
+			if !ok {
+				cc.failPending()
+				return
+			}
+			// The broker sends basic.return before the matching ack, so
+			// make sure it has been recorded before settling.
+			returns = cc.drainReturns(returns)
+			cc.settle(c)
+		}
+	}
+}
+
+func (cc *confirmChannel) drainReturns(returns <-chan amqp.Return) <-chan amqp.Return {
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				return nil
+			}
+			cc.recordReturn(r)
+		default:
+			return returns
+		}
+	}
+}
+
+func (cc *confirmChannel) recordReturn(r amqp.Return) {
+	seq, ok := r.Headers[headerPublishSeq].(int64)
+	if !ok {
+		return
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.returned[uint64(seq)] = r
+}
+
+func (cc *confirmChannel) settle(c amqp.Confirmation) {
+	cc.mu.Lock()
+	r, ok := cc.pending[c.DeliveryTag]
+	delete(cc.pending, c.DeliveryTag)
+	ret, returned := cc.returned[c.DeliveryTag]
+	delete(cc.returned, c.DeliveryTag)
+	cc.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	switch {
+	case !c.Ack:
+		r.resolve(errNacked)
+	case returned:
+		r.resolve(&UnroutableError{
+			TradeID:    r.trade.ID,
+			RoutingKey: ret.RoutingKey,
+			ReplyCode:  ret.ReplyCode,
+			ReplyText:  ret.ReplyText,
+		})
+	default:
+		r.resolve(nil)
+	}
+}
+
+func (cc *confirmChannel) failPending() {
+	cc.mu.Lock()
+	pending := cc.pending
+	cc.pending = make(map[uint64]*Receipt)
+	cc.mu.Unlock()
+
+	for _, r := range pending {
+		r.resolve(errChanLost)
+	}
+}
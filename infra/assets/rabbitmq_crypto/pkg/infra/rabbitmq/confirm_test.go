@@ -0,0 +1,147 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// bindQueue declares a queue bound to key so that published trades are routable.
+func bindQueue(t *testing.T, conn *Connection, key string) {
+	t.Helper()
+	ch, err := conn.channel(context.Background())
+	if err != nil {
+		t.Fatalf("failed to open channel: %v", err)
+	}
+	if _, err := ch.QueueDeclare("sink", true, false, false, false, nil); err != nil {
+		t.Fatalf("failed to declare queue: %v", err)
+	}
+	if err := ch.QueueBind("sink", key, ExchangeName, false, nil); err != nil {
+		t.Fatalf("failed to bind queue: %v", err)
+	}
+}
+
+func TestConfirmingPublisher_Acked(t *testing.T) {
+	broker := newFakeBroker()
+	conn := broker.setup(t)
+	bindQueue(t, conn, "market.#")
+
+	pub := NewConfirmingPublisher(conn)
+	err := pub.Publish(context.Background(), domain.Trade{ID: "t1", Symbol: "btc", TargetCurrency: "usd"})
+	if err != nil {
+		t.Fatalf("expected confirmed publish, got %v", err)
+	}
+}
+
+func TestConfirmingPublisher_Unroutable(t *testing.T) {
+	broker := newFakeBroker()
+	conn := broker.setup(t)
+	bindQueue(t, conn, "market.eth.#")
+
+	pub := NewConfirmingPublisher(conn)
+	err := pub.Publish(context.Background(), domain.Trade{ID: "t1", Symbol: "btc", TargetCurrency: "usd"})
+	if !errors.Is(err, domain.ErrTradeUnroutable) {
+		t.Fatalf("expected ErrTradeUnroutable, got %v", err)
+	}
+	var unroutable *UnroutableError
+	if !errors.As(err, &unroutable) {
+		t.Fatalf("expected *UnroutableError, got %T", err)
+	}
+	if unroutable.TradeID != "t1" || unroutable.RoutingKey != "market.btc.usd" {
+		t.Errorf("unexpected error details: %+v", unroutable)
+	}
+}
+
+func TestConfirmChannel_MatchesReturnsByPublish(t *testing.T) {
+	cc := &confirmChannel{
+		pending:  make(map[uint64]*Receipt),
+		returned: make(map[uint64]amqp.Return),
+	}
+	first := &Receipt{trade: domain.Trade{ID: "t1"}, done: make(chan struct{})}
+	second := &Receipt{trade: domain.Trade{ID: "t1"}, done: make(chan struct{})}
+	cc.track(1, first)
+	cc.track(2, second)
+
+	// Both publishes carry the same trade, but only the second is returned.
+	cc.recordReturn(amqp.Return{
+		ReplyCode:  amqp.NoRoute,
+		RoutingKey: "market.btc.usd",
+		MessageId:  "t1",
+		Headers:    amqp.Table{headerPublishSeq: int64(2)},
+	})
+	cc.settle(amqp.Confirmation{DeliveryTag: 1, Ack: true})
+	cc.settle(amqp.Confirmation{DeliveryTag: 2, Ack: true})
+
+	if err := first.Wait(context.Background()); err != nil {
+		t.Errorf("expected the first publish to be confirmed, got %v", err)
+	}
+	if err := second.Wait(context.Background()); !errors.Is(err, domain.ErrTradeUnroutable) {
+		t.Errorf("expected the second publish to be unroutable, got %v", err)
+	}
+}
+
+func TestConfirmingPublisher_Nacked(t *testing.T) {
+	broker := newFakeBroker()
+	conn := broker.setup(t)
+	bindQueue(t, conn, "market.#")
+	broker.nackPublishes = true
+
+	pub := NewConfirmingPublisher(conn)
+	err := pub.Publish(context.Background(), domain.Trade{ID: "t1", Symbol: "btc", TargetCurrency: "usd"})
+	if !errors.Is(err, domain.ErrTradeNotConfirmed) {
+		t.Fatalf("expected ErrTradeNotConfirmed, got %v", err)
+	}
+}
+
+func TestConfirmingPublisher_Batch(t *testing.T) {
+	broker := newFakeBroker()
+	conn := broker.setup(t)
+	bindQueue(t, conn, "market.*.usd")
+
+	pub := NewConfirmingPublisher(conn)
+	errs := pub.PublishBatch(context.Background(), []domain.Trade{
+		{ID: "t1", Symbol: "btc", TargetCurrency: "usd"},
+		{ID: "t2", Symbol: "btc", TargetCurrency: "jpy"},
+		{ID: "t3", Symbol: "eth", TargetCurrency: "usd"},
+	})
+	if len(errs) != 3 {
+		t.Fatalf("expected 3 outcomes, got %d", len(errs))
+	}
+	if errs[0] != nil || errs[2] != nil {
+		t.Errorf("expected t1 and t3 to be confirmed, got %v", errs)
+	}
+	if !errors.Is(errs[1], domain.ErrTradeUnroutable) {
+		t.Errorf("expected t2 to be unroutable, got %v", errs[1])
+	}
+}
+
+func TestConfirmingPublisher_ChannelLost(t *testing.T) {
+	broker := newFakeBroker()
+	conn := broker.setup(t)
+	bindQueue(t, conn, "market.#")
+
+	pub := NewConfirmingPublisher(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pub.Publish(ctx, domain.Trade{ID: "t1", Symbol: "btc", TargetCurrency: "usd"}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	// Outstanding receipts fail when the channel dies; publishing again
+	// transparently uses a new channel.
+	r := &Receipt{trade: domain.Trade{ID: "lost"}, done: make(chan struct{})}
+	pub.cc.track(99, r)
+	broker.restart()
+	if err := r.Wait(ctx); !errors.Is(err, domain.ErrTradeNotConfirmed) {
+		t.Fatalf("expected ErrTradeNotConfirmed for outstanding trade, got %v", err)
+	}
+
+	bindQueue(t, conn, "market.#")
+	if err := pub.Publish(ctx, domain.Trade{ID: "t2", Symbol: "btc", TargetCurrency: "usd"}); err != nil {
+		t.Fatalf("failed to publish after reconnect: %v", err)
+	}
+}
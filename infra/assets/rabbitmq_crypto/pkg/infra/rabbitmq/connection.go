@@ -1,44 +1,271 @@
 package rabbitmq
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
+	// ExchangeName is the default trade exchange; see WithExchange.
 	ExchangeName = "crypto_market"
 	ExchangeType = "topic"
 )
 
-// SetupConn handles the connection and exchange declaration.
-func SetupConn(url string) (*amqp.Connection, *amqp.Channel, error) {
-	var conn *amqp.Connection
+// ErrConnectionClosed is returned once the Connection has been closed by its owner.
+var ErrConnectionClosed = errors.New("rabbitmq connection closed")
+
+// amqpConnection is the subset of *amqp.Connection used by this package.
+// It allows tests to drive the supervisor with a fake broker.
+type amqpConnection interface {
+	Channel() (amqpChannel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// amqpChannel is the subset of *amqp.Channel used by this package.
+type amqpChannel interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Cancel(consumer string, noWait bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	GetNextPublishSeqNo() uint64
+	IsClosed() bool
+	Close() error
+}
+
+// dialer opens a new broker connection.
+type dialer func(url string) (amqpConnection, error)
+
+type realConnection struct {
+	*amqp.Connection
+}
+
+func (c realConnection) Channel() (amqpChannel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// dialAMQP dials the broker, using tlsCfg for amqps:// URLs and the given
+// SASL mechanisms, or the credentials in url when sasl is nil.
+func dialAMQP(url string, tlsCfg *tls.Config, sasl []amqp.Authentication) (amqpConnection, error) {
+	cfg := amqp.Config{SASL: sasl, Locale: "en_US"}
+	if tlsCfg != nil {
+		// DialConfig fills in ServerName; keep the caller's config untouched
+		// so that reconnects to another host verify against that host.
+		cfg.TLSClientConfig = tlsCfg.Clone()
+	}
+	conn, err := amqp.DialConfig(url, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return realConnection{conn}, nil
+}
+
+// Option configures a Connection.
+type Option func(*Connection)
+
+// WithBackoff sets the initial and maximum delay between connection attempts.
+func WithBackoff(initial, max time.Duration) Option {
+	return func(c *Connection) {
+		c.minBackoff = initial
+		c.maxBackoff = max
+	}
+}
+
+// WithStartupAttempts sets how many times SetupConn tries to reach the broker
+// before giving up. It must be at least 1; defaults to 5.
+func WithStartupAttempts(n int) Option {
+	return func(c *Connection) {
+		c.startupAttempts = n
+	}
+}
+
+// WithExchange sets the name of the topic exchange trades are published to
+// and consumed from. Defaults to ExchangeName.
+func WithExchange(name string) Option {
+	return func(c *Connection) {
+		c.exchange = name
+	}
+}
+
+// WithTLS sets the TLS configuration used for amqps:// URLs, e.g. to trust
+// a private CA or present a client certificate.
+func WithTLS(cfg *tls.Config) Option {
+	return func(c *Connection) {
+		c.tls = cfg
+	}
+}
+
+// WithExternalAuth authenticates with the SASL EXTERNAL mechanism, i.e. by
+// the client certificate set with WithTLS, instead of the credentials in
+// the URL. The broker needs the rabbitmq_auth_mechanism_ssl plugin.
+func WithExternalAuth() Option {
+	return func(c *Connection) {
+		c.sasl = []amqp.Authentication{&amqp.ExternalAuth{}}
+	}
+}
+
+func withDialer(d dialer) Option {
+	return func(c *Connection) {
+		c.dial = d
+	}
+}
+
+// Connection supervises a RabbitMQ connection. It watches NotifyClose,
+// reconnects with exponential backoff and re-declares the exchange, so that
+// publishers and subscribers built on top of it survive broker restarts.
+type Connection struct {
+	url             string
+	exchange        string
+	tls             *tls.Config
+	sasl            []amqp.Authentication
+	dial            dialer
+	minBackoff      time.Duration
+	maxBackoff      time.Duration
+	startupAttempts int
+	tracerProvider  trace.TracerProvider
+	propagator      propagation.TextMapPropagator
+
+	mu         sync.Mutex
+	conn       amqpConnection
+	changed    chan struct{} // closed and replaced whenever conn changes
+	closed     bool
+	reconnects uint64
+	done       chan struct{}
+}
+
+// SetupConn connects to the broker, declares the exchange and starts
+// supervising the connection.
+func SetupConn(url string, opts ...Option) (*Connection, error) {
+	c := &Connection{
+		url:             url,
+		exchange:        ExchangeName,
+		minBackoff:      2 * time.Second,
+		maxBackoff:      30 * time.Second,
+		startupAttempts: 5,
+		changed:         make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.startupAttempts < 1 {
+		return nil, fmt.Errorf("rabbitmq startup attempts must be at least 1, got %d", c.startupAttempts)
+	}
+	if c.dial == nil {
+		c.dial = func(url string) (amqpConnection, error) {
+			return dialAMQP(url, c.tls, c.sasl)
+		}
+	}
+
+	var conn amqpConnection
+	var closing chan *amqp.Error
 	var err error
 
 	// Simple retry logic for container startup
-	for i := 0; i < 5; i++ {
-		conn, err = amqp.Dial(url)
+	for i := 0; i < c.startupAttempts; i++ {
+		conn, closing, err = c.connect()
 		if err == nil {
 			break
 		}
 		log.Printf("Failed to connect to RabbitMQ (attempt %d): %v", i+1, err)
-		time.Sleep(2 * time.Second)
+		if i+1 < c.startupAttempts {
+			time.Sleep(c.backoff(i))
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to RabbitMQ: %w", err)
+	}
+
+	c.setConn(conn)
+	go c.supervise(closing)
+
+	return c, nil
+}
+
+// Exchange returns the name of the trade exchange.
+func (c *Connection) Exchange() string {
+	return c.exchange
+}
+
+// DeadLetterExchange returns the conventional dead-letter exchange for the
+// trade exchange, <exchange>.dlx.
+func (c *Connection) DeadLetterExchange() string {
+	return c.exchange + ".dlx"
+}
+
+// Connected reports whether the broker is connected right now. It is false
+// while the supervisor is reconnecting and once the Connection is closed.
+func (c *Connection) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil
+}
+
+// Reconnects returns how many times the connection was re-established
+// after it was lost.
+func (c *Connection) Reconnects() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reconnects
+}
+
+// Close stops the supervisor and closes the underlying connection.
+func (c *Connection) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	conn := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+
+	if conn == nil {
+		return nil
 	}
+	return conn.Close()
+}
+
+// connect dials the broker and declares the exchange. The returned channel
+// is notified when the connection is lost.
+func (c *Connection) connect() (amqpConnection, chan *amqp.Error, error) {
+	conn, err := c.dial(c.url)
 	if err != nil {
-		return nil, nil, fmt.Errorf("could not connect to RabbitMQ: %w", err)
+		return nil, nil, err
 	}
+	closing := conn.NotifyClose(make(chan *amqp.Error, 1))
 
 	ch, err := conn.Channel()
 	if err != nil {
+		conn.Close()
 		return nil, nil, fmt.Errorf("could not open channel: %w", err)
 	}
+	defer ch.Close()
 
 	// Declare Topic Exchange
 	err = ch.ExchangeDeclare(
-		ExchangeName, // name
+		c.exchange,   // name
 		ExchangeType, // type
 		true,         // durable
 		false,        // auto-deleted
@@ -47,8 +274,126 @@ func SetupConn(url string) (*amqp.Connection, *amqp.Channel, error) {
 		nil,          // arguments
 	)
 	if err != nil {
+		conn.Close()
 		return nil, nil, fmt.Errorf("could not declare exchange: %w", err)
 	}
 
-	return conn, ch, nil
+	return conn, closing, nil
+}
+
+// supervise waits for the connection to drop and reconnects until Close is called.
+func (c *Connection) supervise(closing chan *amqp.Error) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case amqpErr := <-closing:
+			if c.isClosed() {
+				return
+			}
+			log.Printf("RabbitMQ connection lost: %v", amqpErr)
+		}
+
+		c.setConn(nil)
+
+		for attempt := 0; ; attempt++ {
+			select {
+			case <-c.done:
+				return
+			case <-time.After(c.backoff(attempt)):
+			}
+
+			conn, next, err := c.connect()
+			if err != nil {
+				log.Printf("Failed to reconnect to RabbitMQ (attempt %d): %v", attempt+1, err)
+				continue
+			}
+			if !c.setConn(conn) {
+				conn.Close()
+				return
+			}
+			c.mu.Lock()
+			c.reconnects++
+			c.mu.Unlock()
+			log.Println("Reconnected to RabbitMQ")
+			closing = next
+			break
+		}
+	}
+}
+
+// setConn swaps the current connection and wakes up waiters. It reports
+// false if the Connection was closed in the meantime.
+func (c *Connection) setConn(conn amqpConnection) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.conn = conn
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return true
+}
+
+func (c *Connection) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// channel opens a new channel, waiting for a reconnect if the broker is
+// currently unreachable.
+func (c *Connection) channel(ctx context.Context) (amqpChannel, error) {
+	for {
+		c.mu.Lock()
+		conn, changed, closed := c.conn, c.changed, c.closed
+		c.mu.Unlock()
+		if closed {
+			return nil, ErrConnectionClosed
+		}
+
+		if conn != nil {
+			ch, err := conn.Channel()
+			if err == nil {
+				return ch, nil
+			}
+			if !errors.Is(err, amqp.ErrClosed) {
+				return nil, fmt.Errorf("could not open channel: %w", err)
+			}
+			// The connection is going away; wait for the supervisor to notice.
+		}
+
+		select {
+		case <-changed:
+		case <-c.done:
+			return nil, ErrConnectionClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// wait sleeps for the given backoff attempt, returning false if ctx is done
+// or the Connection is closed first.
+func (c *Connection) wait(ctx context.Context, attempt int) bool {
+	select {
+	case <-time.After(c.backoff(attempt)):
+		return true
+	case <-c.done:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (c *Connection) backoff(attempt int) time.Duration {
+	d := c.minBackoff
+	for i := 0; i < attempt && d < c.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.maxBackoff {
+		d = c.maxBackoff
+	}
+	return d
 }
@@ -0,0 +1,192 @@
+package rabbitmq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+func TestSetupConn_RetriesAtStartup(t *testing.T) {
+	broker := newFakeBroker()
+	broker.failDials = 2
+
+	conn, err := SetupConn("amqp://fake/", withDialer(broker.dial), WithBackoff(time.Millisecond, time.Millisecond), WithStartupAttempts(3))
+	if err != nil {
+		t.Fatalf("expected connection after retries, got %v", err)
+	}
+	defer conn.Close()
+
+	if got := broker.dialCount(); got != 3 {
+		t.Errorf("expected 3 dials, got %d", got)
+	}
+	if !broker.hasExchange(ExchangeName) {
+		t.Errorf("expected exchange %s to be declared", ExchangeName)
+	}
+}
+
+func TestSetupConn_GivesUp(t *testing.T) {
+	broker := newFakeBroker()
+	broker.failDials = 10
+
+	_, err := SetupConn("amqp://fake/", withDialer(broker.dial), WithBackoff(time.Millisecond, time.Millisecond), WithStartupAttempts(2))
+	if err == nil {
+		t.Fatal("expected error when broker is unreachable")
+	}
+	if got := broker.dialCount(); got != 2 {
+		t.Errorf("expected 2 dials, got %d", got)
+	}
+}
+
+func TestSetupConn_RejectsNoStartupAttempts(t *testing.T) {
+	broker := newFakeBroker()
+
+	for _, n := range []int{0, -1} {
+		conn, err := SetupConn("amqp://fake/", withDialer(broker.dial), WithStartupAttempts(n))
+		if err == nil || conn != nil {
+			t.Errorf("expected an error for %d startup attempts, got %v", n, err)
+		}
+	}
+	if got := broker.dialCount(); got != 0 {
+		t.Errorf("expected no dials, got %d", got)
+	}
+}
+
+func TestConnection_ReconnectsAndRedeclaresExchange(t *testing.T) {
+	broker := newFakeBroker()
+	broker.setup(t)
+
+	broker.failDials = 2
+	broker.restart()
+
+	eventually(t, func() bool { return broker.hasExchange(ExchangeName) }, "exchange to be re-declared")
+	if got := broker.dialCount(); got != 4 {
+		t.Errorf("expected 4 dials (1 initial, 2 failed, 1 reconnect), got %d", got)
+	}
+}
+
+func TestConnection_ReportsState(t *testing.T) {
+	broker := newFakeBroker()
+	conn := broker.setup(t)
+	if !conn.Connected() || conn.Reconnects() != 0 {
+		t.Fatalf("expected a connected connection without reconnects, got %v/%d", conn.Connected(), conn.Reconnects())
+	}
+
+	broker.mu.Lock()
+	broker.failDials = 1 << 20
+	broker.mu.Unlock()
+	broker.restart()
+	eventually(t, func() bool { return !conn.Connected() }, "connection to be lost")
+
+	broker.mu.Lock()
+	broker.failDials = 0
+	broker.mu.Unlock()
+	eventually(t, func() bool { return conn.Connected() && conn.Reconnects() == 1 }, "reconnect to be counted")
+
+	conn.Close()
+	if conn.Connected() {
+		t.Error("expected a closed connection to be disconnected")
+	}
+}
+
+func TestConnection_ResubscribesAfterReconnect(t *testing.T) {
+	broker := newFakeBroker()
+	conn := broker.setup(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	received := make(chan domain.Trade, 16)
+	sub := NewSubscriber(conn)
+	_, err := sub.Subscribe(ctx, "market.btc.#", func(trade domain.Trade) error {
+		received <- trade
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	pub := NewPublisher(conn)
+	if err := pub.Publish(ctx, domain.Trade{ID: "before", Symbol: "btc", TargetCurrency: "usd"}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	if tr := <-received; tr.ID != "before" {
+		t.Fatalf("expected trade before, got %s", tr.ID)
+	}
+
+	broker.restart()
+
+	// Trades published before the binding is back are lost, so keep
+	// publishing until one makes it through.
+	deadline := time.After(2 * time.Second)
+	for {
+		if err := pub.Publish(ctx, domain.Trade{ID: "after", Symbol: "btc", TargetCurrency: "usd"}); err != nil {
+			t.Fatalf("failed to publish after reconnect: %v", err)
+		}
+		select {
+		case tr := <-received:
+			if tr.ID != "after" {
+				t.Fatalf("expected trade after, got %s", tr.ID)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("subscription was not re-established")
+		}
+	}
+}
+
+func TestConnection_CloseStopsSupervisor(t *testing.T) {
+	broker := newFakeBroker()
+	conn := broker.setup(t)
+
+	if err := conn.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	if _, err := conn.channel(context.Background()); err != ErrConnectionClosed {
+		t.Errorf("expected ErrConnectionClosed, got %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if got := broker.dialCount(); got != 1 {
+		t.Errorf("expected no reconnect after Close, got %d dials", got)
+	}
+}
+
+func TestConnection_CustomExchange(t *testing.T) {
+	broker := newFakeBroker()
+	conn, err := SetupConn("amqp://fake/", withDialer(broker.dial), WithExchange("staging_market"))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	if !broker.hasExchange("staging_market") || broker.hasExchange(ExchangeName) {
+		t.Fatal("expected only the configured exchange to be declared")
+	}
+	if got := conn.DeadLetterExchange(); got != "staging_market.dlx" {
+		t.Errorf("expected dead-letter exchange staging_market.dlx, got %s", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	received := make(chan domain.Trade, 1)
+	if _, err := NewSubscriber(conn).Subscribe(ctx, "market.#", func(trade domain.Trade) error {
+		received <- trade
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	if err := NewPublisher(conn).Publish(ctx, domain.Trade{ID: "t1", Symbol: "btc", TargetCurrency: "usd"}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	select {
+	case tr := <-received:
+		if tr.ID != "t1" {
+			t.Errorf("expected trade t1, got %s", tr.ID)
+		}
+	case <-ctx.Done():
+		t.Fatal("trade not routed through the configured exchange")
+	}
+}
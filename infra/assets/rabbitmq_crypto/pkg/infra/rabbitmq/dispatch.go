@@ -0,0 +1,256 @@
+package rabbitmq
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/broker"
+)
+
+// source is the consumer behind a subscription. It survives reconnects by
+// re-declaring its queue on a fresh channel whenever the broker closes the
+// current one.
+type source struct {
+	s   *subscriber
+	key string
+	tag string
+	o   domain.SubscribeOptions
+
+	ctx       context.Context // ends re-establishing the consumer
+	stop      context.CancelFunc
+	out       chan broker.Delivery
+	closed    chan struct{} // closed by Close
+	closeOnce sync.Once
+	err       error // why out was closed, valid once it is
+
+	mu        sync.Mutex
+	ch        amqpChannel
+	cancelled bool
+}
+
+var _ broker.Source = (*source)(nil)
+
+func newSource(ctx context.Context, s *subscriber, key, tag string, o domain.SubscribeOptions, c consumer) *source {
+	ctx, stop := context.WithCancel(ctx)
+	src := &source{
+		s:      s,
+		key:    key,
+		tag:    tag,
+		o:      o,
+		ctx:    ctx,
+		stop:   stop,
+		out:    make(chan broker.Delivery),
+		closed: make(chan struct{}),
+		ch:     c.ch,
+	}
+	go src.run(c)
+	return src
+}
+
+func (src *source) Deliveries() <-chan broker.Delivery { return src.out }
+
+// Cancel cancels the consumer. The client library then hands over the
+// deliveries it has buffered and closes them. A consumer being
+// re-established is given up on instead.
+func (src *source) Cancel() {
+	src.stop()
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	src.cancelled = true
+	if src.ch.IsClosed() {
+		return
+	}
+	if err := src.ch.Cancel(src.tag, false); err != nil {
+		log.Printf("Error cancelling consumer %s: %v", src.tag, err)
+		src.ch.Close()
+	}
+}
+
+// Err reports why the consumer could not be re-established.
+func (src *source) Err() error { return src.err }
+
+// Close closes the channel, so the broker requeues whatever is still
+// unacknowledged.
+func (src *source) Close() {
+	src.stop()
+	src.closeOnce.Do(func() { close(src.closed) })
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	src.cancelled = true
+	src.ch.Close()
+}
+
+// run forwards deliveries until the consumer is cancelled, re-establishing
+// it whenever the broker closes its channel.
+func (src *source) run(c consumer) {
+	defer close(src.out)
+	for {
+		if !src.forward(c) {
+			return
+		}
+		// A cancelled consumer keeps its channel until Close, so that the
+		// deliveries already handed over can still be settled.
+		src.mu.Lock()
+		cancelled := src.cancelled
+		src.mu.Unlock()
+		if cancelled || src.ctx.Err() != nil {
+			return
+		}
+
+		src.ch.Close()
+		log.Printf("Subscription %q lost, re-establishing...", src.key)
+		next, err := src.s.resubscribe(src.ctx, src.key, src.tag, src.o)
+		if err != nil {
+			if src.ctx.Err() == nil {
+				src.err = err
+			}
+			return
+		}
+		src.mu.Lock()
+		if src.cancelled {
+			src.mu.Unlock()
+			next.ch.Close()
+			return
+		}
+		src.ch = next.ch
+		src.mu.Unlock()
+		c = next
+	}
+}
+
+// forward hands over the deliveries of c until they end. It reports false
+// if the source was closed first.
+func (src *source) forward(c consumer) bool {
+	for d := range c.msgs {
+		select {
+		case src.out <- src.delivery(d, c.queue):
+		case <-src.closed:
+			return false
+		}
+	}
+	return true
+}
+
+// delivery converts d, consumed from queue, handling it within a consumer
+// span.
+func (src *source) delivery(d amqp.Delivery, queue string) broker.Delivery {
+	attempt := deliveryAttempt(d)
+	bd := broker.Delivery{
+		Message: message(d),
+		Attempt: attempt,
+		Ack:     func() { ack(d) },
+		Reject:  func() { reject(d) },
+		Requeue: func() { requeue(d) },
+		Wrap: func(handle func() error) error {
+			span := src.s.conn.startConsume(d)
+			err := handle()
+			endSpan(span, err)
+			return err
+		},
+	}
+	if !src.o.ManualAck {
+		// The broker acknowledged it when delivering it.
+		bd.Ack = func() {}
+	}
+	if !src.o.Quorum {
+		bd.Requeue = func() { republish(d, queue, attempt) }
+	}
+	return bd
+}
+
+// deliveryAttempt counts the deliveries of d. Quorum queues report the
+// previous ones in the x-delivery-count header. Classic queues do not, so
+// a requeued message is republished with the count in HeaderAttempt.
+func deliveryAttempt(d amqp.Delivery) int {
+	if n, ok := headerInt(d.Headers["x-delivery-count"]); ok {
+		return n + 1
+	}
+	if n, ok := headerInt(d.Headers[HeaderAttempt]); ok {
+		return n + 1
+	}
+	return 1
+}
+
+// routingKey returns the key d was originally published with, which a
+// republished message keeps in HeaderRoutingKey.
+func routingKey(d amqp.Delivery) string {
+	if key, ok := d.Headers[HeaderRoutingKey].(string); ok {
+		return key
+	}
+	return d.RoutingKey
+}
+
+// message converts d to the wire form the broker package decodes.
+func message(d amqp.Delivery) broker.Message {
+	env := envelopeFromHeaders(d.Headers)
+	return broker.Message{
+		Key: domain.RoutingKey(routingKey(d)),
+		Headers: map[string]string{
+			broker.HeaderContentType:   d.ContentType,
+			broker.HeaderMessageID:     d.MessageId,
+			broker.HeaderMessageType:   env.MessageType,
+			broker.HeaderSchemaVersion: strconv.Itoa(env.SchemaVersion),
+			broker.HeaderProducerID:    env.ProducerID,
+			broker.HeaderCorrelationID: env.CorrelationID,
+		},
+		Body: d.Body,
+	}
+}
+
+// ack acknowledges d.
+func ack(d amqp.Delivery) {
+	if err := d.Ack(false); err != nil {
+		log.Printf("Error acking message: %v", err)
+	}
+}
+
+// requeue nacks d so that the broker delivers it again.
+func requeue(d amqp.Delivery) {
+	if err := d.Nack(false, true); err != nil {
+		log.Printf("Error requeueing message: %v", err)
+	}
+}
+
+// republish requeues d, which failed its attempt-th delivery from queue,
+// for a classic queue: a copy counting the attempt goes to the back of the
+// queue through the default exchange and d is acked. Both go over the
+// channel d came from, so the broker cannot see the ack without the copy.
+// If the copy cannot be published, d is nacked instead.
+func republish(d amqp.Delivery, queue string, attempt int) {
+	ch, ok := d.Acknowledger.(amqpChannel)
+	if !ok {
+		requeue(d)
+		return
+	}
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[HeaderAttempt] = int32(attempt)
+	headers[HeaderRoutingKey] = routingKey(d)
+	err := ch.PublishWithContext(context.Background(), "", queue, false, false, amqp.Publishing{
+		ContentType:  d.ContentType,
+		DeliveryMode: d.DeliveryMode,
+		MessageId:    d.MessageId,
+		Headers:      headers,
+		Body:         d.Body,
+	})
+	if err != nil {
+		log.Printf("Error republishing message, requeueing it: %v", err)
+		requeue(d)
+		return
+	}
+	ack(d)
+}
+
+// reject nacks d without requeueing, which dead-letters it if the queue has
+// a dead-letter exchange.
+func reject(d amqp.Delivery) {
+	if err := d.Nack(false, false); err != nil {
+		log.Printf("Error rejecting message: %v", err)
+	}
+}
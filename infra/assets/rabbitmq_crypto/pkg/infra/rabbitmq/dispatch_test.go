@@ -0,0 +1,287 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/broker"
+)
+
+func TestSubscriber_WorkersKeepPerSymbolOrder(t *testing.T) {
+	broker := newFakeBroker()
+	conn := broker.setup(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	symbols := []string{"btc", "eth", "sol", "ada"}
+	const perSymbol = 50
+
+	var mu sync.Mutex
+	seen := make(map[string][]int)
+	var total int
+	_, err := NewSubscriber(conn).Subscribe(ctx, "market.#", func(trade domain.Trade) error {
+		var n int
+		fmt.Sscanf(trade.ID, trade.Symbol+"-%d", &n)
+		mu.Lock()
+		seen[trade.Symbol] = append(seen[trade.Symbol], n)
+		total++
+		mu.Unlock()
+		return nil
+	}, domain.WithManualAck(0), domain.WithWorkers(4), domain.WithPrefetch(8))
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	pub := NewPublisher(conn)
+	for i := 0; i < perSymbol; i++ {
+		for _, sym := range symbols {
+			trade := domain.Trade{ID: fmt.Sprintf("%s-%d", sym, i), Symbol: sym, TargetCurrency: "usd"}
+			if err := pub.Publish(ctx, trade); err != nil {
+				t.Fatalf("failed to publish: %v", err)
+			}
+		}
+	}
+
+	eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return total == perSymbol*len(symbols)
+	}, "all trades to be handled")
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, sym := range symbols {
+		for i, n := range seen[sym] {
+			if n != i {
+				t.Fatalf("%s trades out of order: %v", sym, seen[sym])
+			}
+		}
+	}
+	if acks, _ := broker.ackCounts(); acks != perSymbol*len(symbols) {
+		t.Errorf("expected %d acks, got %d", perSymbol*len(symbols), acks)
+	}
+}
+
+func TestSubscriber_WorkersRunSymbolsInParallel(t *testing.T) {
+	// Pick two symbols that land on different shards.
+	const workers = 2
+	a, b := "btc", ""
+	for _, sym := range []string{"eth", "sol", "ada", "xrp", "dot"} {
+		if broker.ShardOf(sym, workers) != broker.ShardOf(a, workers) {
+			b = sym
+			break
+		}
+	}
+	if b == "" {
+		t.Fatal("no symbol on a different shard")
+	}
+
+	fake := newFakeBroker()
+	conn := fake.setup(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Each handler waits for the other, so they only both finish if they
+	// run at the same time.
+	var barrier sync.WaitGroup
+	barrier.Add(2)
+	done := make(chan string, 2)
+	_, err := NewSubscriber(conn).Subscribe(ctx, "market.#", func(trade domain.Trade) error {
+		barrier.Done()
+		barrier.Wait()
+		done <- trade.Symbol
+		return nil
+	}, domain.WithWorkers(workers))
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	pub := NewPublisher(conn)
+	for _, sym := range []string{a, b} {
+		if err := pub.Publish(ctx, domain.Trade{ID: sym, Symbol: sym, TargetCurrency: "usd"}); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("handlers for different symbols did not run in parallel")
+		}
+	}
+}
+
+func TestSubscriber_SetsPrefetch(t *testing.T) {
+	broker := newFakeBroker()
+	conn := broker.setup(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := NewSubscriber(conn).Subscribe(ctx, "market.#", func(domain.Trade) error { return nil },
+		domain.WithManualAck(0), domain.WithPrefetch(16))
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	if got := broker.prefetchCount(); got != 16 {
+		t.Errorf("expected prefetch 16, got %d", got)
+	}
+}
+
+func TestSubscriber_DrainsInFlightTradesOnCancel(t *testing.T) {
+	broker := newFakeBroker()
+	conn := broker.setup(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	_, err := NewSubscriber(conn).Subscribe(ctx, "market.#", func(domain.Trade) error {
+		close(started)
+		<-release
+		return nil
+	}, domain.WithManualAck(0), domain.WithWorkers(2))
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	if err := NewPublisher(conn).Publish(ctx, domain.Trade{ID: "t1", Symbol: "btc", TargetCurrency: "usd"}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	<-started
+
+	// Cancelling must not abandon the trade being handled: it is acked
+	// once the handler returns instead of being redelivered.
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	eventually(t, func() bool {
+		acks, _ := broker.ackCounts()
+		return acks == 1
+	}, "in-flight trade to be acked after cancel")
+	if _, nacks := broker.ackCounts(); nacks != 0 {
+		t.Errorf("expected no nacks, got %d", nacks)
+	}
+}
+
+func TestSubscription_StopDrainsBufferedTrades(t *testing.T) {
+	broker := newFakeBroker()
+	conn := broker.setup(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var handled atomic.Int32
+	sub, err := NewSubscriber(conn).Subscribe(ctx, "market.#", func(domain.Trade) error {
+		select {
+		case started <- struct{}{}:
+			<-release
+		default:
+		}
+		handled.Add(1)
+		return nil
+	}, domain.WithManualAck(0))
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	pub := NewPublisher(conn)
+	for i := 0; i < 5; i++ {
+		if err := pub.Publish(ctx, domain.Trade{ID: fmt.Sprint(i), Symbol: "btc", TargetCurrency: "usd"}); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+	<-started
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- sub.Stop(context.Background()) }()
+	close(release)
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("expected clean stop, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop did not return")
+	}
+	if got := handled.Load(); got != 5 {
+		t.Errorf("expected all 5 delivered trades to be handled, got %d", got)
+	}
+	if acks, nacks := broker.ackCounts(); acks != 5 || nacks != 0 {
+		t.Errorf("expected 5 acks and no nacks, got %d and %d", acks, nacks)
+	}
+	if err := sub.Wait(); err != nil {
+		t.Errorf("expected Wait to return nil, got %v", err)
+	}
+}
+
+func TestSubscription_StopTimeoutRequeues(t *testing.T) {
+	broker := newFakeBroker()
+	conn := broker.setup(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	sub, err := NewSubscriber(conn).Subscribe(ctx, "market.#", func(domain.Trade) error {
+		close(started)
+		<-release
+		return nil
+	}, domain.WithDurableQueue("work"), domain.WithManualAck(0))
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	if err := NewPublisher(conn).Publish(ctx, domain.Trade{ID: "stuck", Symbol: "btc", TargetCurrency: "usd"}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	<-started
+
+	shutdown, cancelShutdown := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancelShutdown()
+	if err := sub.Stop(shutdown); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if got := broker.queueLen("work"); got != 1 {
+		t.Errorf("expected the unfinished trade to be requeued, got %d in queue", got)
+	}
+}
+
+func TestSubscription_WaitReportsLostConnection(t *testing.T) {
+	broker := newFakeBroker()
+	conn := broker.setup(t)
+
+	sub, err := NewSubscriber(conn).Subscribe(context.Background(), "market.#", func(domain.Trade) error { return nil })
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	conn.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- sub.Wait() }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrConnectionClosed) {
+			t.Errorf("expected ErrConnectionClosed, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Wait did not return")
+	}
+}
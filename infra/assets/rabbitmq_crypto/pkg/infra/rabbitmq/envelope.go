@@ -0,0 +1,74 @@
+package rabbitmq
+
+import (
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/broker"
+)
+
+// AMQP headers carrying the message envelope, named like the headers of
+// the other brokers.
+const (
+	HeaderMessageType   = broker.HeaderMessageType
+	HeaderSchemaVersion = broker.HeaderSchemaVersion
+	HeaderProducerID    = broker.HeaderProducerID
+	HeaderCorrelationID = broker.HeaderCorrelationID
+)
+
+// AMQP headers of a message requeued on a classic queue: the failed
+// deliveries so far and the routing key it was originally published with.
+const (
+	HeaderAttempt    = "x-attempt"
+	HeaderRoutingKey = "x-routing-key"
+)
+
+// envelopeHeaders encodes env into AMQP headers.
+func envelopeHeaders(env domain.Envelope) amqp.Table {
+	h := amqp.Table{
+		HeaderMessageType:   env.MessageType,
+		HeaderSchemaVersion: int32(env.SchemaVersion),
+	}
+	if env.ProducerID != "" {
+		h[HeaderProducerID] = env.ProducerID
+	}
+	if env.CorrelationID != "" {
+		h[HeaderCorrelationID] = env.CorrelationID
+	}
+	return h
+}
+
+// envelopeFromHeaders decodes the envelope of a delivery. Messages from
+// producers that predate the envelope are treated as schema version 1.
+func envelopeFromHeaders(h amqp.Table) domain.Envelope {
+	env := domain.Envelope{SchemaVersion: 1}
+	env.MessageType, _ = h[HeaderMessageType].(string)
+	env.ProducerID, _ = h[HeaderProducerID].(string)
+	env.CorrelationID, _ = h[HeaderCorrelationID].(string)
+	if v, ok := headerInt(h[HeaderSchemaVersion]); ok {
+		env.SchemaVersion = v
+	}
+	return env
+}
+
+// headerInt converts the integer types an AMQP table may hold.
+func headerInt(v any) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case int8:
+		return int(n), true
+	case int16:
+		return int(n), true
+	case int32:
+		return int(n), true
+	case int64:
+		return int(n), true
+	case uint8:
+		return int(n), true
+	case uint16:
+		return int(n), true
+	case uint32:
+		return int(n), true
+	}
+	return 0, false
+}
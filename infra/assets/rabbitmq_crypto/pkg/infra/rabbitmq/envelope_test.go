@@ -0,0 +1,210 @@
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/broker"
+)
+
+func TestPublisher_SetsEnvelopeHeaders(t *testing.T) {
+	fake := newFakeBroker()
+	conn := fake.setup(t)
+	bindQueue(t, conn, "market.#")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	pub := NewPublisher(conn, broker.WithProducerID("ticker-1"))
+	if err := pub.Publish(ctx, domain.Trade{ID: "t1", Symbol: "btc", TargetCurrency: "usd"}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	ch, err := conn.channel(ctx)
+	if err != nil {
+		t.Fatalf("failed to open channel: %v", err)
+	}
+	msgs, err := ch.Consume("sink", "", true, false, false, false, nil)
+	if err != nil {
+		t.Fatalf("failed to consume: %v", err)
+	}
+	d := <-msgs
+
+	env := envelopeFromHeaders(d.Headers)
+	want := domain.Envelope{
+		MessageType:   domain.TradeMessageType,
+		SchemaVersion: domain.TradeSchemaVersion,
+		ProducerID:    "ticker-1",
+		CorrelationID: "t1",
+	}
+	if env != want {
+		t.Errorf("expected envelope %+v, got %+v", want, env)
+	}
+}
+
+func TestSubscriber_UpcastsLegacyTrades(t *testing.T) {
+	broker := newFakeBroker()
+	conn := broker.setup(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	received := make(chan domain.Trade, 1)
+	_, err := NewSubscriber(conn).Subscribe(ctx, "market.#", func(trade domain.Trade) error {
+		received <- trade
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	// A version 1 producer sent plain JSON without an envelope or side.
+	ch, err := conn.channel(ctx)
+	if err != nil {
+		t.Fatalf("failed to open channel: %v", err)
+	}
+	legacy := amqp.Publishing{
+		ContentType: "application/json",
+		Body:        []byte(`{"id":"old","symbol":"BTC","target_currency":"USD","price":1,"amount":2,"timestamp":"2025-12-01T00:00:00Z"}`),
+	}
+	if err := ch.PublishWithContext(ctx, ExchangeName, "market.btc.usd", false, false, legacy); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	select {
+	case tr := <-received:
+		if tr.ID != "old" || tr.Side != domain.SideUnknown {
+			t.Errorf("expected upcast trade with side %s, got %+v", domain.SideUnknown, tr)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for legacy trade")
+	}
+}
+
+func TestSubscriber_RejectsUnsupportedEnvelopes(t *testing.T) {
+	cases := map[string]amqp.Table{
+		"newer schema": {HeaderMessageType: domain.TradeMessageType, HeaderSchemaVersion: int32(domain.TradeSchemaVersion + 1)},
+		"other type":   {HeaderMessageType: "candle", HeaderSchemaVersion: int32(1)},
+	}
+	for name, headers := range cases {
+		t.Run(name, func(t *testing.T) {
+			broker := newFakeBroker()
+			conn := broker.setup(t)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			_, err := NewSubscriber(conn).Subscribe(ctx, "market.#", func(trade domain.Trade) error {
+				t.Error("handler must not see unsupported messages")
+				return nil
+			}, domain.WithManualAck(3), domain.WithDeadLetter(DeadLetterExchangeName))
+			if err != nil {
+				t.Fatalf("failed to subscribe: %v", err)
+			}
+
+			ch, err := conn.channel(ctx)
+			if err != nil {
+				t.Fatalf("failed to open channel: %v", err)
+			}
+			msg := amqp.Publishing{ContentType: "application/json", Headers: headers, Body: []byte(`{"id":"t1"}`)}
+			if err := ch.PublishWithContext(ctx, ExchangeName, "market.btc.usd", false, false, msg); err != nil {
+				t.Fatalf("failed to publish: %v", err)
+			}
+
+			eventually(t, func() bool { return broker.queueLen(DeadLetterExchangeName) == 1 }, "message to be dead-lettered")
+		})
+	}
+}
+
+func TestEnvelopeFromHeaders_IntegerTypes(t *testing.T) {
+	for _, v := range []any{int8(3), int16(3), int32(3), int64(3), 3} {
+		env := envelopeFromHeaders(amqp.Table{HeaderSchemaVersion: v})
+		if env.SchemaVersion != 3 {
+			t.Errorf("%T: expected version 3, got %d", v, env.SchemaVersion)
+		}
+	}
+	if env := envelopeFromHeaders(nil); env.SchemaVersion != 1 {
+		t.Errorf("expected legacy messages to be version 1, got %d", env.SchemaVersion)
+	}
+}
+
+func TestCandlePublisher_RoutesByInterval(t *testing.T) {
+	broker := newFakeBroker()
+	conn := broker.setup(t)
+	bindQueue(t, conn, "candles.*.*.1m")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	pub := NewCandlePublisher(conn)
+	for _, interval := range []string{"1s", "1m"} {
+		candle := domain.Candle{Symbol: "BTC", TargetCurrency: "USD", Interval: interval, Start: start, Close: 100}
+		if err := pub.PublishCandle(ctx, candle); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+
+	ch, err := conn.channel(ctx)
+	if err != nil {
+		t.Fatalf("failed to open channel: %v", err)
+	}
+	msgs, err := ch.Consume("sink", "", true, false, false, false, nil)
+	if err != nil {
+		t.Fatalf("failed to consume: %v", err)
+	}
+	d := <-msgs
+
+	if d.RoutingKey != "candles.btc.usd.1m" {
+		t.Errorf("expected routing key candles.btc.usd.1m, got %s", d.RoutingKey)
+	}
+	if env := envelopeFromHeaders(d.Headers); env.MessageType != domain.CandleMessageType {
+		t.Errorf("expected message type %s, got %s", domain.CandleMessageType, env.MessageType)
+	}
+	if d.MessageId != fmt.Sprintf("candles.btc.usd.1m@%d", start.Unix()) {
+		t.Errorf("unexpected message ID %s", d.MessageId)
+	}
+	select {
+	case d := <-msgs:
+		t.Errorf("expected only the 1m candle to be routed, also got %s", d.RoutingKey)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestAlertPublisher_RoutesBySymbol(t *testing.T) {
+	broker := newFakeBroker()
+	conn := broker.setup(t)
+	bindQueue(t, conn, "alerts.#")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	alert := domain.Alert{Rule: "whale", Symbol: "BTC", TargetCurrency: "JPY", TradeID: "t1", Message: "whale: buy 5 BTC/JPY"}
+	if err := NewAlertPublisher(conn).Notify(ctx, alert); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	ch, err := conn.channel(ctx)
+	if err != nil {
+		t.Fatalf("failed to open channel: %v", err)
+	}
+	msgs, err := ch.Consume("sink", "", true, false, false, false, nil)
+	if err != nil {
+		t.Fatalf("failed to consume: %v", err)
+	}
+	d := <-msgs
+
+	if d.RoutingKey != "alerts.btc.jpy" {
+		t.Errorf("expected routing key alerts.btc.jpy, got %s", d.RoutingKey)
+	}
+	if env := envelopeFromHeaders(d.Headers); env.MessageType != domain.AlertMessageType || env.CorrelationID != "t1" {
+		t.Errorf("unexpected envelope %+v", env)
+	}
+	if d.MessageId != "whale@t1" {
+		t.Errorf("unexpected message ID %s", d.MessageId)
+	}
+}
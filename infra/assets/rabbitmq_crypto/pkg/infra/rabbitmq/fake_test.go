@@ -0,0 +1,660 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fakeBroker is an in-process stand-in for RabbitMQ that supports just
+// enough of the protocol to exercise the connection supervisor, publisher
+// and subscriber without a running broker.
+type fakeBroker struct {
+	mu        sync.Mutex
+	failDials int
+	dials     int
+	conns     []*fakeConn
+	exchanges map[string]string
+	queues    map[string]*fakeQueue
+	nextID    int
+	acks      int
+	nacks     int
+	// prefetch is the last prefetch count set by any channel.
+	prefetch int
+	// nackPublishes makes the broker reject published messages in confirm mode.
+	nackPublishes bool
+}
+
+type fakeQueue struct {
+	name       string
+	durable    bool
+	exclusive  bool
+	autoDelete bool
+	args       amqp.Table
+	owner      *fakeConn
+	bindings   []fakeBinding
+	consumers  []*fakeConsumer
+	next       int
+	pending    []amqp.Delivery
+}
+
+type fakeBinding struct {
+	exchange string
+	key      string
+}
+
+type fakeConsumer struct {
+	ch         *fakeChannel
+	queue      *fakeQueue
+	tag        string
+	autoAck    bool
+	deliveries chan amqp.Delivery
+}
+
+type fakeUnacked struct {
+	queue    *fakeQueue
+	delivery amqp.Delivery
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{
+		exchanges: make(map[string]string),
+		queues:    make(map[string]*fakeQueue),
+	}
+}
+
+func (b *fakeBroker) dial(url string) (amqpConnection, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dials++
+	if b.failDials > 0 {
+		b.failDials--
+		return nil, errors.New("connection refused")
+	}
+	c := &fakeConn{broker: b}
+	b.conns = append(b.conns, c)
+	return c, nil
+}
+
+// setup connects a supervised Connection to the fake broker with short backoffs.
+func (b *fakeBroker) setup(t *testing.T) *Connection {
+	t.Helper()
+	conn, err := SetupConn("amqp://fake/", withDialer(b.dial), WithBackoff(time.Millisecond, 10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to setup connection: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// restart simulates a broker restart: every connection is dropped and all
+// non-durable state is lost.
+func (b *fakeBroker) restart() {
+	b.mu.Lock()
+	conns := b.conns
+	b.conns = nil
+	b.exchanges = make(map[string]string)
+	for name, q := range b.queues {
+		if !q.durable {
+			delete(b.queues, name)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, c := range conns {
+		c.drop(amqp.ErrClosed)
+	}
+}
+
+func (b *fakeBroker) dialCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dials
+}
+
+func (b *fakeBroker) ackCounts() (acks, nacks int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.acks, b.nacks
+}
+
+// queueLen returns the number of messages waiting in the named queue.
+func (b *fakeBroker) queueLen(name string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		return 0
+	}
+	return len(q.pending)
+}
+
+// consumerCount returns the number of consumers attached to the named queue.
+func (b *fakeBroker) consumerCount(name string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		return 0
+	}
+	return len(q.consumers)
+}
+
+// queueArgs returns the arguments the named queue was declared with.
+func (b *fakeBroker) queueArgs(name string) (amqp.Table, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		return nil, false
+	}
+	return q.args, true
+}
+
+func (b *fakeBroker) prefetchCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.prefetch
+}
+
+func (b *fakeBroker) hasExchange(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.exchanges[name]
+	return ok
+}
+
+// route delivers msg to every queue bound to exchange with a matching key,
+// or for the default exchange to the queue named key. Callers must hold
+// b.mu.
+func (b *fakeBroker) route(exchange, key string, msg amqp.Publishing) int {
+	if exchange == "" {
+		q, ok := b.queues[key]
+		if !ok {
+			return 0
+		}
+		q.enqueue(amqp.Delivery{
+			RoutingKey:  key,
+			ContentType: msg.ContentType,
+			Headers:     copyTable(msg.Headers),
+			MessageId:   msg.MessageId,
+			Body:        msg.Body,
+		})
+		return 1
+	}
+	routed := 0
+	for _, q := range b.queues {
+		for _, bd := range q.bindings {
+			if bd.exchange == exchange && topicMatch(bd.key, key) {
+				q.enqueue(amqp.Delivery{
+					Exchange:    exchange,
+					RoutingKey:  key,
+					ContentType: msg.ContentType,
+					Headers:     copyTable(msg.Headers),
+					MessageId:   msg.MessageId,
+					Body:        msg.Body,
+				})
+				routed++
+				break
+			}
+		}
+	}
+	return routed
+}
+
+// enqueue hands d to the next consumer in round-robin order, or keeps it
+// until one appears. Callers must hold the broker lock.
+func (q *fakeQueue) enqueue(d amqp.Delivery) {
+	if len(q.consumers) == 0 {
+		q.pending = append(q.pending, d)
+		return
+	}
+	c := q.consumers[q.next%len(q.consumers)]
+	q.next++
+	c.ch.nextTag++
+	d.DeliveryTag = c.ch.nextTag
+	d.ConsumerTag = c.tag
+	d.Acknowledger = c.ch
+	if !c.autoAck {
+		c.ch.unacked[d.DeliveryTag] = fakeUnacked{queue: q, delivery: d}
+	}
+	c.deliveries <- d
+}
+
+// settle removes an unacknowledged delivery and either requeues it or, if
+// the queue has a dead-letter exchange, dead-letters it. Callers must hold
+// the broker lock.
+func (b *fakeBroker) settle(u fakeUnacked, requeue bool) {
+	d := u.delivery
+	d.Acknowledger = nil
+	if requeue {
+		d.Redelivered = true
+		if u.queue.args["x-queue-type"] == "quorum" {
+			// Quorum queues count redeliveries in a header.
+			d.Headers = copyTable(d.Headers)
+			if d.Headers == nil {
+				d.Headers = amqp.Table{}
+			}
+			n, _ := d.Headers["x-delivery-count"].(int64)
+			d.Headers["x-delivery-count"] = n + 1
+		}
+		u.queue.enqueue(d)
+		return
+	}
+	if dlx, ok := u.queue.args["x-dead-letter-exchange"].(string); ok {
+		b.route(dlx, d.RoutingKey, amqp.Publishing{
+			ContentType: d.ContentType,
+			Headers:     d.Headers,
+			MessageId:   d.MessageId,
+			Body:        d.Body,
+		})
+	}
+}
+
+func copyTable(t amqp.Table) amqp.Table {
+	if t == nil {
+		return nil
+	}
+	c := make(amqp.Table, len(t))
+	for k, v := range t {
+		c[k] = v
+	}
+	return c
+}
+
+func (q *fakeQueue) removeConsumer(c *fakeConsumer) {
+	for i, qc := range q.consumers {
+		if qc == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			return
+		}
+	}
+}
+
+type fakeConn struct {
+	broker *fakeBroker
+
+	mu       sync.Mutex
+	closed   bool
+	notify   []chan *amqp.Error
+	channels []*fakeChannel
+}
+
+func (c *fakeConn) Channel() (amqpChannel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch := &fakeChannel{conn: c, unacked: make(map[uint64]fakeUnacked)}
+	c.channels = append(c.channels, ch)
+	return ch, nil
+}
+
+func (c *fakeConn) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		close(receiver)
+		return receiver
+	}
+	c.notify = append(c.notify, receiver)
+	return receiver
+}
+
+func (c *fakeConn) Close() error {
+	c.drop(nil)
+	return nil
+}
+
+// drop closes the connection, its channels and exclusive queues, and
+// notifies listeners with reason (nil for a graceful close).
+func (c *fakeConn) drop(reason *amqp.Error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	channels := c.channels
+	notify := c.notify
+	c.mu.Unlock()
+
+	for _, ch := range channels {
+		ch.Close()
+	}
+
+	b := c.broker
+	b.mu.Lock()
+	for name, q := range b.queues {
+		if q.owner == c && q.exclusive {
+			delete(b.queues, name)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, n := range notify {
+		if reason != nil {
+			n <- reason
+		}
+		close(n)
+	}
+}
+
+type fakeChannel struct {
+	conn *fakeConn
+
+	// guarded by conn.broker.mu
+	closed     bool
+	nextTag    uint64
+	consumers  []*fakeConsumer
+	unacked    map[uint64]fakeUnacked
+	confirming bool
+	prefetch   int
+	publishSeq uint64
+	confirms   []chan amqp.Confirmation
+	returns    []chan amqp.Return
+}
+
+func (ch *fakeChannel) broker() *fakeBroker {
+	return ch.conn.broker
+}
+
+func (ch *fakeChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	b.exchanges[name] = kind
+	return nil
+}
+
+func (ch *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	if name == "" {
+		b.nextID++
+		name = fmt.Sprintf("amq.gen-%d", b.nextID)
+	}
+	q, ok := b.queues[name]
+	if ok && (q.durable != durable || !reflect.DeepEqual(q.args, args)) {
+		return amqp.Queue{}, fmt.Errorf("PRECONDITION_FAILED - inequivalent arguments for queue %q", name)
+	}
+	if !ok {
+		q = &fakeQueue{
+			name:       name,
+			durable:    durable,
+			exclusive:  exclusive,
+			autoDelete: autoDelete,
+			args:       args,
+			owner:      ch.conn,
+		}
+		b.queues[name] = q
+	}
+	return amqp.Queue{Name: name, Messages: len(q.pending)}, nil
+}
+
+func (ch *fakeChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return fmt.Errorf("no queue %q", name)
+	}
+	if _, ok := b.exchanges[exchange]; !ok {
+		return fmt.Errorf("no exchange %q", exchange)
+	}
+	q.bindings = append(q.bindings, fakeBinding{exchange: exchange, key: key})
+	return nil
+}
+
+func (ch *fakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.prefetch = prefetchCount
+	b.prefetch = prefetchCount
+	return nil
+}
+
+func (ch *fakeChannel) Cancel(consumer string, noWait bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	for i, c := range ch.consumers {
+		if c.tag == consumer {
+			c.queue.removeConsumer(c)
+			close(c.deliveries)
+			ch.consumers = append(ch.consumers[:i], ch.consumers[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no consumer %q", consumer)
+}
+
+func (ch *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, fmt.Errorf("no queue %q", queue)
+	}
+	if consumer == "" {
+		b.nextID++
+		consumer = fmt.Sprintf("ctag-%d", b.nextID)
+	}
+	c := &fakeConsumer{ch: ch, queue: q, tag: consumer, autoAck: autoAck, deliveries: make(chan amqp.Delivery, 1024)}
+	q.consumers = append(q.consumers, c)
+	ch.consumers = append(ch.consumers, c)
+	pending := q.pending
+	q.pending = nil
+	for _, d := range pending {
+		q.enqueue(d)
+	}
+	return c.deliveries, nil
+}
+
+func (ch *fakeChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	routed := b.route(exchange, key, msg)
+	if mandatory && routed == 0 {
+		for _, r := range ch.returns {
+			r <- amqp.Return{
+				ReplyCode:   amqp.NoRoute,
+				ReplyText:   "NO_ROUTE",
+				Exchange:    exchange,
+				RoutingKey:  key,
+				ContentType: msg.ContentType,
+				Headers:     copyTable(msg.Headers),
+				MessageId:   msg.MessageId,
+				Body:        msg.Body,
+			}
+		}
+	}
+	if ch.confirming {
+		ch.publishSeq++
+		for _, c := range ch.confirms {
+			c <- amqp.Confirmation{DeliveryTag: ch.publishSeq, Ack: !b.nackPublishes}
+		}
+	}
+	return nil
+}
+
+func (ch *fakeChannel) Confirm(noWait bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.confirming = true
+	return nil
+}
+
+func (ch *fakeChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(confirm)
+		return confirm
+	}
+	ch.confirms = append(ch.confirms, confirm)
+	return confirm
+}
+
+func (ch *fakeChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(c)
+		return c
+	}
+	ch.returns = append(ch.returns, c)
+	return c
+}
+
+func (ch *fakeChannel) GetNextPublishSeqNo() uint64 {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return ch.publishSeq + 1
+}
+
+func (ch *fakeChannel) IsClosed() bool {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return ch.closed
+}
+
+func (ch *fakeChannel) Close() error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return nil
+	}
+	ch.closed = true
+	for _, c := range ch.consumers {
+		c.queue.removeConsumer(c)
+		close(c.deliveries)
+	}
+	ch.consumers = nil
+	for _, c := range ch.confirms {
+		close(c)
+	}
+	ch.confirms = nil
+	for _, r := range ch.returns {
+		close(r)
+	}
+	ch.returns = nil
+	// Unacknowledged deliveries go back to their queue.
+	for tag, u := range ch.unacked {
+		delete(ch.unacked, tag)
+		if _, ok := b.queues[u.queue.name]; ok {
+			b.settle(u, true)
+		}
+	}
+	return nil
+}
+
+func (ch *fakeChannel) Ack(tag uint64, multiple bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := ch.unacked[tag]; !ok {
+		return fmt.Errorf("unknown delivery tag %d", tag)
+	}
+	delete(ch.unacked, tag)
+	b.acks++
+	return nil
+}
+
+func (ch *fakeChannel) Nack(tag uint64, multiple, requeue bool) error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	u, ok := ch.unacked[tag]
+	if !ok {
+		return fmt.Errorf("unknown delivery tag %d", tag)
+	}
+	delete(ch.unacked, tag)
+	b.nacks++
+	b.settle(u, requeue)
+	return nil
+}
+
+func (ch *fakeChannel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+// topicMatch reports whether key matches the AMQP topic binding pattern.
+func topicMatch(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(key); i++ {
+			if matchWords(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(key) > 0 && matchWords(pattern[1:], key[1:])
+	default:
+		return len(key) > 0 && pattern[0] == key[0] && matchWords(pattern[1:], key[1:])
+	}
+}
+
+// eventually polls cond until it holds or the timeout expires.
+func eventually(t *testing.T, cond func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", msg)
+}
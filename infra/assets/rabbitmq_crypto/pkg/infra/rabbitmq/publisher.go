@@ -2,39 +2,127 @@ package rabbitmq
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
+	"errors"
+	"sync"
 
-	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/broker"
 )
 
 type publisher struct {
-	ch *amqp.Channel
+	conn *Connection
+	enc  broker.Encoder
+
+	mu sync.Mutex
+	ch amqpChannel
 }
 
 // NewPublisher creates a new TradePublisher implementation using RabbitMQ.
-func NewPublisher(ch *amqp.Channel) domain.TradePublisher {
-	return &publisher{ch: ch}
+// The publishing channel is reopened transparently after a reconnect.
+func NewPublisher(conn *Connection, opts ...broker.PublisherOption) domain.TradePublisher {
+	return &publisher{conn: conn, enc: broker.NewEncoder(opts...)}
+}
+
+// NewCandlePublisher creates a CandlePublisher that publishes closed candles
+// to the trade exchange on candles.<symbol>.<target>.<interval>.
+func NewCandlePublisher(conn *Connection, opts ...broker.PublisherOption) domain.CandlePublisher {
+	return &publisher{conn: conn, enc: broker.NewEncoder(opts...)}
+}
+
+// NewAlertPublisher creates an AlertNotifier that republishes alerts to the
+// trade exchange on alerts.<symbol>.<target>.
+func NewAlertPublisher(conn *Connection, opts ...broker.PublisherOption) domain.AlertNotifier {
+	return &publisher{conn: conn, enc: broker.NewEncoder(opts...)}
+}
+
+// NewOrderPublisher creates an OrderPublisher that sends orders to the
+// trade exchange on orders.<symbol>.<target>.
+func NewOrderPublisher(conn *Connection, opts ...broker.PublisherOption) domain.OrderPublisher {
+	return &publisher{conn: conn, enc: broker.NewEncoder(opts...)}
 }
 
 func (p *publisher) Publish(ctx context.Context, trade domain.Trade) error {
-	body, err := json.Marshal(trade)
+	m, err := p.enc.Trade(trade)
+	if err != nil {
+		return err
+	}
+	return p.publish(ctx, m.Key.String(), publishing(m))
+}
+
+func (p *publisher) PublishCandle(ctx context.Context, candle domain.Candle) error {
+	m, err := p.enc.Candle(candle)
+	if err != nil {
+		return err
+	}
+	return p.publish(ctx, m.Key.String(), publishing(m))
+}
+
+func (p *publisher) Notify(ctx context.Context, alert domain.Alert) error {
+	m, err := p.enc.Alert(alert)
+	if err != nil {
+		return err
+	}
+	return p.publish(ctx, m.Key.String(), publishing(m))
+}
+
+func (p *publisher) PublishOrder(ctx context.Context, order domain.Order) error {
+	m, err := p.enc.Order(order)
+	if err != nil {
+		return err
+	}
+	return p.publish(ctx, m.Key.String(), publishing(m))
+}
+
+func (p *publisher) publish(ctx context.Context, routingKey string, msg amqp.Publishing) (err error) {
+	span := p.conn.startPublish(ctx, routingKey, &msg)
+	defer func() { endSpan(span, err) }()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		ch, err := p.channel(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = ch.PublishWithContext(ctx,
+			p.conn.exchange, // exchange
+			routingKey,      // routing key
+			false,           // mandatory
+			false,           // immediate
+			msg,
+		)
+		if !errors.Is(err, amqp.ErrClosed) {
+			return err
+		}
+		// The channel died under us; reopen it and try again.
+		p.ch = nil
+	}
+}
+
+// channel returns the current publishing channel, opening a new one if
+// there is none or the previous one was closed. Callers must hold p.mu.
+func (p *publisher) channel(ctx context.Context) (amqpChannel, error) {
+	if p.ch != nil && !p.ch.IsClosed() {
+		return p.ch, nil
+	}
+	ch, err := p.conn.channel(ctx)
 	if err != nil {
-		return fmt.Errorf("could not marshal trade: %w", err)
-	}
-
-	// Routing Key: market.<symbol>.<target> (e.g., market.btc.usd)
-	routingKey := fmt.Sprintf("market.%s.%s", trade.Symbol, trade.TargetCurrency)
-
-	return p.ch.PublishWithContext(ctx,
-		ExchangeName, // exchange
-		routingKey,   // routing key
-		false,        // mandatory
-		false,        // immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        body,
-		},
-	)
+		return nil, err
+	}
+	p.ch = ch
+	return ch, nil
+}
+
+// publishing converts m to an AMQP message. The envelope goes into AMQP
+// headers with the schema version as an integer.
+func publishing(m broker.Message) amqp.Publishing {
+	return amqp.Publishing{
+		ContentType: m.Headers[broker.HeaderContentType],
+		MessageId:   m.Headers[broker.HeaderMessageID],
+		Headers:     envelopeHeaders(m.Envelope()),
+		Body:        m.Body,
+	}
 }
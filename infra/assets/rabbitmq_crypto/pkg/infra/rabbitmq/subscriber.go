@@ -2,83 +2,216 @@ package rabbitmq
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 
-	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/google/uuid"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/broker"
 )
 
+// DeadLetterExchangeName is the conventional exchange for trades that could
+// not be processed, for the default exchange. See Connection.DeadLetterExchange.
+const DeadLetterExchangeName = ExchangeName + ".dlx"
+
 type subscriber struct {
-	ch *amqp.Channel
+	conn *Connection
+	dec  broker.Decoder
 }
 
 // NewSubscriber creates a new TradeSubscriber implementation using RabbitMQ.
-func NewSubscriber(ch *amqp.Channel) domain.TradeSubscriber {
-	return &subscriber{ch: ch}
+// Active subscriptions are re-established transparently after a reconnect.
+func NewSubscriber(conn *Connection, opts ...broker.SubscriberOption) domain.TradeSubscriber {
+	return newSubscriber(conn, opts)
 }
 
-func (s *subscriber) Subscribe(ctx context.Context, routingKey string, handler func(domain.Trade) error) error {
-	// 1. Declare a temporary queue (exclusive to this consumer)
-	q, err := s.ch.QueueDeclare(
-		"",    // random name
-		false, // non-durable
-		true,  // delete when unused
-		true,  // exclusive
-		false, // no-wait
-		nil,   // arguments
-	)
+// NewOrderSubscriber creates an OrderSubscriber using RabbitMQ. Like trade
+// subscriptions, order subscriptions survive reconnects.
+func NewOrderSubscriber(conn *Connection, opts ...broker.SubscriberOption) domain.OrderSubscriber {
+	return newSubscriber(conn, opts)
+}
+
+func newSubscriber(conn *Connection, opts []broker.SubscriberOption) *subscriber {
+	return &subscriber{conn: conn, dec: broker.NewDecoder(opts...)}
+}
+
+func (s *subscriber) Subscribe(ctx context.Context, routingKey string, handler func(domain.Trade) error, opts ...domain.SubscribeOption) (domain.Subscription, error) {
+	pattern, src, o, err := s.subscribe(ctx, routingKey, opts)
+	if err != nil {
+		return nil, err
+	}
+	return broker.Dispatch(ctx, pattern.String(), src, s.dec, handler, o), nil
+}
+
+func (s *subscriber) SubscribeOrders(ctx context.Context, routingKey string, handler func(domain.Order) error, opts ...domain.SubscribeOption) (domain.Subscription, error) {
+	pattern, src, o, err := s.subscribe(ctx, routingKey, opts)
+	if err != nil {
+		return nil, err
+	}
+	return broker.DispatchOrders(ctx, pattern.String(), src, s.dec, handler, o), nil
+}
+
+// subscribe starts consuming the messages matching routingKey.
+func (s *subscriber) subscribe(ctx context.Context, routingKey string, opts []domain.SubscribeOption) (domain.TopicPattern, *source, domain.SubscribeOptions, error) {
+	o := domain.NewSubscribeOptions(opts...)
+
+	pattern, err := domain.ParseTopicPattern(routingKey)
+	if err != nil {
+		return "", nil, o, err
+	}
+
+	tag := "ctag-" + uuid.NewString()
+	c, err := s.consume(ctx, pattern.String(), tag, o)
 	if err != nil {
-		return fmt.Errorf("could not declare queue: %w", err)
+		return "", nil, o, err
+	}
+	return pattern, newSource(ctx, s, pattern.String(), tag, o, c), o, nil
+}
+
+// consumer is a queue being consumed on a channel.
+type consumer struct {
+	ch    amqpChannel
+	queue string
+	msgs  <-chan amqp.Delivery
+}
+
+// consume opens a channel, declares and binds a queue and starts consuming from it.
+func (s *subscriber) consume(ctx context.Context, routingKey, tag string, o domain.SubscribeOptions) (consumer, error) {
+	ch, err := s.conn.channel(ctx)
+	if err != nil {
+		return consumer{}, err
+	}
+
+	args, err := queueArgs(o)
+	if err != nil {
+		ch.Close()
+		return consumer{}, err
+	}
+	if o.DeadLetterExchange != "" {
+		if err := declareDeadLetter(ch, o.DeadLetterExchange); err != nil {
+			ch.Close()
+			return consumer{}, err
+		}
+	}
+
+	// 1. Declare the queue: a named durable one shared by competing
+	// consumers, or a temporary one exclusive to this consumer.
+	var q amqp.Queue
+	if o.Queue != "" {
+		q, err = ch.QueueDeclare(
+			o.Queue, // name
+			true,    // durable
+			false,   // delete when unused
+			false,   // exclusive
+			false,   // no-wait
+			args,    // arguments
+		)
+	} else {
+		q, err = ch.QueueDeclare(
+			"",    // random name
+			false, // non-durable
+			true,  // delete when unused
+			true,  // exclusive
+			false, // no-wait
+			args,  // arguments
+		)
+	}
+	if err != nil {
+		ch.Close()
+		return consumer{}, fmt.Errorf("could not declare queue: %w", err)
 	}
 
 	// 2. Bind the queue to the exchange with the routing key
-	err = s.ch.QueueBind(
-		q.Name,       // queue name
-		routingKey,   // routing key
-		ExchangeName, // exchange
+	err = ch.QueueBind(
+		q.Name,          // queue name
+		routingKey,      // routing key
+		s.conn.exchange, // exchange
 		false,
 		nil,
 	)
 	if err != nil {
-		return fmt.Errorf("could not bind queue: %w", err)
+		ch.Close()
+		return consumer{}, fmt.Errorf("could not bind queue: %w", err)
+	}
+
+	if o.Prefetch > 0 {
+		if err := ch.Qos(o.Prefetch, 0, false); err != nil {
+			ch.Close()
+			return consumer{}, fmt.Errorf("could not set prefetch: %w", err)
+		}
 	}
 
 	// 3. Start consuming
-	msgs, err := s.ch.Consume(
-		q.Name, // queue
-		"",     // consumer tag
-		true,   // auto-ack
-		false,  // exclusive
-		false,  // no-local
-		false,  // no-wait
-		nil,    // args
+	msgs, err := ch.Consume(
+		q.Name,       // queue
+		tag,          // consumer tag
+		!o.ManualAck, // auto-ack
+		false,        // exclusive
+		false,        // no-local
+		false,        // no-wait
+		nil,          // args
 	)
 	if err != nil {
-		return fmt.Errorf("could not start consume: %w", err)
-	}
-
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case d, ok := <-msgs:
-				if !ok {
-					return
-				}
-				var trade domain.Trade
-				if err := json.Unmarshal(d.Body, &trade); err != nil {
-					log.Printf("Error unmarshaling trade: %v", err)
-					continue
-				}
-				if err := handler(trade); err != nil {
-					log.Printf("Error handling trade: %v", err)
-				}
-			}
-		}
-	}()
+		ch.Close()
+		return consumer{}, fmt.Errorf("could not start consume: %w", err)
+	}
+
+	return consumer{ch: ch, queue: q.Name, msgs: msgs}, nil
+}
 
+// queueArgs translates the subscription options into queue arguments.
+func queueArgs(o domain.SubscribeOptions) (amqp.Table, error) {
+	if o.Quorum && o.Queue == "" {
+		return nil, errors.New("quorum queues require a durable queue name")
+	}
+
+	args := amqp.Table{}
+	if o.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = o.DeadLetterExchange
+	}
+	if o.MessageTTL > 0 {
+		args["x-message-ttl"] = o.MessageTTL.Milliseconds()
+	}
+	if o.MaxLength > 0 {
+		args["x-max-length"] = int64(o.MaxLength)
+	}
+	if o.Quorum {
+		args["x-queue-type"] = "quorum"
+	}
+	if len(args) == 0 {
+		return nil, nil
+	}
+	return args, nil
+}
+
+// declareDeadLetter declares the dead-letter exchange together with a
+// durable queue that keeps everything routed to it for later inspection.
+func declareDeadLetter(ch amqpChannel, exchange string) error {
+	if err := ch.ExchangeDeclare(exchange, ExchangeType, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("could not declare dead-letter exchange: %w", err)
+	}
+	if _, err := ch.QueueDeclare(exchange, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("could not declare dead-letter queue: %w", err)
+	}
+	if err := ch.QueueBind(exchange, "#", exchange, false, nil); err != nil {
+		return fmt.Errorf("could not bind dead-letter queue: %w", err)
+	}
 	return nil
 }
+
+// resubscribe retries consume with backoff until it succeeds, ctx is done or
+// the connection is closed.
+func (s *subscriber) resubscribe(ctx context.Context, routingKey, tag string, o domain.SubscribeOptions) (consumer, error) {
+	for attempt := 0; ; attempt++ {
+		c, err := s.consume(ctx, routingKey, tag, o)
+		if err == nil {
+			return c, nil
+		}
+		log.Printf("Failed to re-establish subscription %q (attempt %d): %v", routingKey, attempt+1, err)
+		if !s.conn.wait(ctx, attempt) {
+			return consumer{}, err
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package rabbitmq
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testPKI is a CA generated for the test together with a server and a
+// client certificate it signed, written as PEM files to a temp directory.
+type testPKI struct {
+	dir              string
+	caFile           string
+	serverCert       tls.Certificate
+	clientCertFile   string
+	clientKeyFile    string
+	caPool           *x509.CertPool
+	serverName       string
+	clientCommonName string
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	p := &testPKI{dir: t.TempDir(), serverName: "rabbitmq.test", clientCommonName: "ticker"}
+
+	caKey, caCert, caDER := issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "workshop test CA"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	p.caPool = x509.NewCertPool()
+	p.caPool.AddCert(caCert)
+	p.caFile = p.writePEM(t, "ca.pem", "CERTIFICATE", caDER)
+
+	serverKey, _, serverDER := issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: p.serverName},
+		DNSNames:    []string{p.serverName},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, caKey)
+	p.serverCert = tls.Certificate{Certificate: [][]byte{serverDER}, PrivateKey: serverKey}
+
+	clientKey, _, clientDER := issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: p.clientCommonName},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCert, caKey)
+	p.clientCertFile = p.writePEM(t, "client.pem", "CERTIFICATE", clientDER)
+	keyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	p.clientKeyFile = p.writePEM(t, "client-key.pem", "EC PRIVATE KEY", keyDER)
+	return p
+}
+
+// issue creates a certificate from tmpl signed by parent, or self-signed
+// when parent is nil.
+func issue(t *testing.T, tmpl, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*ecdsa.PrivateKey, *x509.Certificate, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return key, cert, der
+}
+
+func (p *testPKI) writePEM(t *testing.T, name, typ string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(p.dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+// handshake is what the TLS broker saw from a client.
+type handshake struct {
+	mechanism  string
+	commonName string
+	exchange   string
+}
+
+// startTLSBroker serves just enough of AMQP 0-9-1 over mutual TLS for
+// SetupConn to connect and declare its exchange. It reports each completed
+// handshake on the returned channel.
+func startTLSBroker(t *testing.T, p *testPKI) (string, <-chan handshake) {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{p.serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    p.caPool,
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	seen := make(chan handshake, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveAMQP(conn.(*tls.Conn), seen)
+		}
+	}()
+	return "amqps://" + ln.Addr().String() + "/", seen
+}
+
+func serveAMQP(conn *tls.Conn, seen chan<- handshake) {
+	defer conn.Close()
+	if err := conn.Handshake(); err != nil {
+		return
+	}
+	var hs handshake
+	hs.commonName = conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+
+	r := bufio.NewReader(conn)
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil || string(header) != "AMQP\x00\x00\x09\x01" {
+		return
+	}
+
+	var start []byte
+	start = append(start, 0, 9)                     // version-major, version-minor
+	start = binary.BigEndian.AppendUint32(start, 0) // server-properties
+	start = appendLongstr(start, "EXTERNAL PLAIN")
+	start = appendLongstr(start, "en_US")
+	writeMethod(conn, 0, 10, 10, start)
+
+	for {
+		channel, class, method, args, err := readMethod(r)
+		if err != nil {
+			return
+		}
+		switch {
+		case class == 10 && method == 11: // connection.start-ok
+			props := binary.BigEndian.Uint32(args)
+			hs.mechanism = shortstr(args[4+props:])
+			var tune []byte
+			tune = binary.BigEndian.AppendUint16(tune, 2047)   // channel-max
+			tune = binary.BigEndian.AppendUint32(tune, 131072) // frame-max
+			tune = binary.BigEndian.AppendUint16(tune, 0)      // heartbeat
+			writeMethod(conn, 0, 10, 30, tune)
+		case class == 10 && method == 40: // connection.open
+			writeMethod(conn, 0, 10, 41, []byte{0})
+		case class == 10 && method == 50: // connection.close
+			writeMethod(conn, 0, 10, 51, nil)
+			return
+		case class == 20 && method == 10: // channel.open
+			writeMethod(conn, channel, 20, 11, binary.BigEndian.AppendUint32(nil, 0))
+		case class == 20 && method == 40: // channel.close
+			writeMethod(conn, channel, 20, 41, nil)
+		case class == 40 && method == 10: // exchange.declare
+			hs.exchange = shortstr(args[2:])
+			writeMethod(conn, channel, 40, 11, nil)
+			seen <- hs
+		}
+	}
+}
+
+// readMethod returns the next method frame, skipping heartbeats.
+func readMethod(r *bufio.Reader) (channel, class, method uint16, args []byte, err error) {
+	for {
+		head := make([]byte, 7)
+		if _, err = io.ReadFull(r, head); err != nil {
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(head[3:])+1) // with frame-end
+		if _, err = io.ReadFull(r, payload); err != nil {
+			return
+		}
+		if head[0] != 1 {
+			continue
+		}
+		channel = binary.BigEndian.Uint16(head[1:])
+		class = binary.BigEndian.Uint16(payload)
+		method = binary.BigEndian.Uint16(payload[2:])
+		return channel, class, method, payload[4 : len(payload)-1], nil
+	}
+}
+
+func writeMethod(w io.Writer, channel, class, method uint16, args []byte) {
+	frame := []byte{1}
+	frame = binary.BigEndian.AppendUint16(frame, channel)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(4+len(args)))
+	frame = binary.BigEndian.AppendUint16(frame, class)
+	frame = binary.BigEndian.AppendUint16(frame, method)
+	frame = append(frame, args...)
+	frame = append(frame, 0xCE)
+	w.Write(frame)
+}
+
+func appendLongstr(b []byte, s string) []byte {
+	return append(binary.BigEndian.AppendUint32(b, uint32(len(s))), s...)
+}
+
+func shortstr(b []byte) string {
+	return string(b[1 : 1+b[0]])
+}
+
+func TestSetupConn_TLSWithExternalAuth(t *testing.T) {
+	p := newTestPKI(t)
+	url, seen := startTLSBroker(t, p)
+
+	cfg, err := LoadTLSConfig(p.caFile, p.clientCertFile, p.clientKeyFile, p.serverName)
+	if err != nil {
+		t.Fatalf("failed to load TLS config: %v", err)
+	}
+	conn, err := SetupConn(url, WithTLS(cfg), WithExternalAuth(), WithExchange("prod_market"), WithStartupAttempts(1))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	select {
+	case hs := <-seen:
+		if hs.mechanism != "EXTERNAL" {
+			t.Errorf("expected EXTERNAL auth, got %q", hs.mechanism)
+		}
+		if hs.commonName != p.clientCommonName {
+			t.Errorf("expected client certificate %q, got %q", p.clientCommonName, hs.commonName)
+		}
+		if hs.exchange != "prod_market" {
+			t.Errorf("expected exchange to be declared, got %q", hs.exchange)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("broker saw no handshake")
+	}
+	if cfg.ServerName != p.serverName {
+		t.Errorf("caller's TLS config was modified: %q", cfg.ServerName)
+	}
+}
+
+func TestSetupConn_TLSRejectsUntrustedBroker(t *testing.T) {
+	p := newTestPKI(t)
+	url, _ := startTLSBroker(t, p)
+
+	// Without the CA bundle the broker certificate cannot be verified.
+	cfg, err := LoadTLSConfig("", p.clientCertFile, p.clientKeyFile, p.serverName)
+	if err != nil {
+		t.Fatalf("failed to load TLS config: %v", err)
+	}
+	_, err = SetupConn(url, WithTLS(cfg), WithExternalAuth(), WithStartupAttempts(1))
+	var verr *tls.CertificateVerificationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected a certificate verification error, got %v", err)
+	}
+}
+
+func TestLoadTLSConfig_InvalidFiles(t *testing.T) {
+	p := newTestPKI(t)
+	if _, err := LoadTLSConfig(p.clientKeyFile, "", "", ""); err == nil {
+		t.Error("expected an error for a CA file without certificates")
+	}
+	if _, err := LoadTLSConfig(p.caFile, p.clientCertFile, "", ""); err == nil {
+		t.Error("expected an error for a certificate without key")
+	}
+	if _, err := LoadTLSConfig(filepath.Join(p.dir, "missing.pem"), "", "", ""); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected a missing file error, got %v", err)
+	}
+}
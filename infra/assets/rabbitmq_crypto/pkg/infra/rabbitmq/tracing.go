@@ -0,0 +1,114 @@
+package rabbitmq
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName names the tracer spans are started with.
+const instrumentationName = "github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/rabbitmq"
+
+// WithTracerProvider sets where publish and consume spans are recorded.
+// Defaults to the global provider, which records nothing until one is
+// installed with otel.SetTracerProvider.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(c *Connection) {
+		c.tracerProvider = tp
+	}
+}
+
+// WithPropagator sets how the trace context travels in message headers.
+// Defaults to the global propagator.
+func WithPropagator(p propagation.TextMapPropagator) Option {
+	return func(c *Connection) {
+		c.propagator = p
+	}
+}
+
+func (c *Connection) tracer() trace.Tracer {
+	tp := c.tracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(instrumentationName)
+}
+
+func (c *Connection) textMapPropagator() propagation.TextMapPropagator {
+	if c.propagator != nil {
+		return c.propagator
+	}
+	return otel.GetTextMapPropagator()
+}
+
+// headerCarrier lets a propagator read and write AMQP headers.
+type headerCarrier amqp.Table
+
+var _ propagation.TextMapCarrier = headerCarrier(nil)
+
+func (h headerCarrier) Get(key string) string {
+	v, _ := h[key].(string)
+	return v
+}
+
+func (h headerCarrier) Set(key, value string) {
+	h[key] = value
+}
+
+func (h headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// startPublish starts a producer span for msg and injects its context into
+// the headers of msg, so that consumers continue the trace.
+func (c *Connection) startPublish(ctx context.Context, routingKey string, msg *amqp.Publishing) trace.Span {
+	ctx, span := c.tracer().Start(ctx, routingKey+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "rabbitmq"),
+			attribute.String("messaging.operation.type", "send"),
+			attribute.String("messaging.destination.name", c.exchange),
+			attribute.String("messaging.rabbitmq.destination.routing_key", routingKey),
+			attribute.String("messaging.message.id", msg.MessageId),
+		))
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	c.textMapPropagator().Inject(ctx, headerCarrier(msg.Headers))
+	return span
+}
+
+// startConsume starts a consumer span for d, continuing the trace whose
+// context the publisher put in its headers.
+func (c *Connection) startConsume(d amqp.Delivery) trace.Span {
+	ctx := c.textMapPropagator().Extract(context.Background(), headerCarrier(d.Headers))
+	_, span := c.tracer().Start(ctx, routingKey(d)+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "rabbitmq"),
+			attribute.String("messaging.operation.type", "process"),
+			attribute.String("messaging.destination.name", d.Exchange),
+			attribute.String("messaging.rabbitmq.destination.routing_key", routingKey(d)),
+			attribute.String("messaging.message.id", d.MessageId),
+			attribute.Bool("messaging.rabbitmq.redelivered", d.Redelivered),
+		))
+	return span
+}
+
+// endSpan ends span, marking it failed if err is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
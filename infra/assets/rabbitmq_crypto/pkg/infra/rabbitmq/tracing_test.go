@@ -0,0 +1,137 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/broker"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// setupTraced connects to the fake broker recording spans in the returned
+// recorder.
+func (b *fakeBroker) setupTraced(t *testing.T) (*Connection, *tracetest.SpanRecorder) {
+	t.Helper()
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	conn, err := SetupConn("amqp://fake/", withDialer(b.dial), WithBackoff(time.Millisecond, 10*time.Millisecond),
+		WithTracerProvider(tp), WithPropagator(propagation.TraceContext{}))
+	if err != nil {
+		t.Fatalf("failed to setup connection: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, rec
+}
+
+// spanNamed waits for the span called name to end.
+func spanNamed(t *testing.T, rec *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	t.Helper()
+	var found sdktrace.ReadOnlySpan
+	eventually(t, func() bool {
+		for _, s := range rec.Ended() {
+			if s.Name() == name {
+				found = s
+				return true
+			}
+		}
+		return false
+	}, "span "+name)
+	return found
+}
+
+func TestTracing_ConsumerContinuesPublisherTrace(t *testing.T) {
+	broker := newFakeBroker()
+	conn, rec := broker.setupTraced(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	boom := errors.New("boom")
+	if _, err := NewSubscriber(conn).Subscribe(ctx, "market.btc.#", func(domain.Trade) error {
+		return boom
+	}); err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	// The publish span is a child of whatever span the caller is in.
+	parentCtx, parent := conn.tracer().Start(ctx, "tick")
+	if err := NewPublisher(conn).Publish(parentCtx, domain.Trade{ID: "t1", Symbol: "btc", TargetCurrency: "usd"}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	parent.End()
+
+	pub := spanNamed(t, rec, "market.btc.usd publish")
+	sub := spanNamed(t, rec, "market.btc.usd process")
+
+	if pub.SpanKind() != trace.SpanKindProducer || sub.SpanKind() != trace.SpanKindConsumer {
+		t.Errorf("unexpected span kinds %v and %v", pub.SpanKind(), sub.SpanKind())
+	}
+	if pub.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Error("expected the publish span to be a child of the caller's span")
+	}
+	if sub.SpanContext().TraceID() != pub.SpanContext().TraceID() || sub.Parent().SpanID() != pub.SpanContext().SpanID() {
+		t.Error("expected the consumer span to continue the trace of the publish span")
+	}
+	if !sub.Parent().IsRemote() {
+		t.Error("expected the consumer span's parent to come from the message headers")
+	}
+	if sub.Status().Code != codes.Error || len(sub.Events()) == 0 {
+		t.Errorf("expected the handler error to be recorded, got %+v", sub.Status())
+	}
+	attrs := make(map[string]string)
+	for _, kv := range sub.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attrs["messaging.message.id"] != "t1" || attrs["messaging.rabbitmq.destination.routing_key"] != "market.btc.usd" {
+		t.Errorf("unexpected attributes %v", attrs)
+	}
+}
+
+func TestTracing_ConfirmSpanEndsWithOutcome(t *testing.T) {
+	broker := newFakeBroker()
+	conn, rec := broker.setupTraced(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Nothing is bound, so the trade is returned unroutable.
+	err := NewConfirmingPublisher(conn).Publish(ctx, domain.Trade{ID: "t1", Symbol: "eth", TargetCurrency: "jpy"})
+	if !errors.Is(err, domain.ErrTradeUnroutable) {
+		t.Fatalf("expected ErrTradeUnroutable, got %v", err)
+	}
+	if s := spanNamed(t, rec, "market.eth.jpy publish"); s.Status().Code != codes.Error {
+		t.Errorf("expected the publish span to record the failure, got %+v", s.Status())
+	}
+}
+
+func TestTracing_WithoutContextStartsNewTrace(t *testing.T) {
+	fake := newFakeBroker()
+	conn, rec := fake.setupTraced(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := NewSubscriber(conn).Subscribe(ctx, "market.#", func(domain.Trade) error { return nil }); err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	// A publisher without tracing sends no trace context.
+	plain := fake.setup(t)
+	if err := NewPublisher(plain, broker.WithProducerID("legacy")).Publish(ctx, domain.Trade{ID: "t1", Symbol: "btc", TargetCurrency: "usd"}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	s := spanNamed(t, rec, "market.btc.usd process")
+	if s.Parent().IsValid() {
+		t.Error("expected a root span for a message without trace context")
+	}
+	if s.Status().Code == codes.Error {
+		t.Errorf("unexpected error status %+v", s.Status())
+	}
+}
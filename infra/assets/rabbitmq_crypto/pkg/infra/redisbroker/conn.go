@@ -0,0 +1,118 @@
+// Package redisbroker carries trades over Redis Streams. Each exchange is a
+// stream holding every message published to it, and each queue is a
+// consumer group reading that stream.
+package redisbroker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/broker"
+)
+
+// ExchangeName is the exchange trades are published to unless WithExchange
+// is given. It matches the RabbitMQ exchange.
+const ExchangeName = "crypto_market"
+
+// DefaultMaxLen is roughly how many messages a stream keeps unless
+// WithMaxLen is given.
+const DefaultMaxLen = 1_000_000
+
+// setupTimeout bounds the commands that are not part of the consume loop.
+const setupTimeout = 10 * time.Second
+
+// probeTimeout bounds the ping behind Connected.
+const probeTimeout = time.Second
+
+// Stream fields besides the headers, which are stored one field each.
+const (
+	fieldKey  = "key"
+	fieldBody = "body"
+)
+
+// Option configures a connection.
+type Option func(*Conn)
+
+// WithExchange sets the exchange trades are published to and consumed
+// from. Defaults to ExchangeName.
+func WithExchange(name string) Option {
+	return func(c *Conn) {
+		c.exchange = name
+	}
+}
+
+// WithMaxLen sets roughly how many messages a stream keeps. Older ones are
+// trimmed even if a consumer group has not read them yet.
+func WithMaxLen(n int64) Option {
+	return func(c *Conn) {
+		c.maxLen = n
+	}
+}
+
+// Conn is a connection pool to a Redis server.
+type Conn struct {
+	rdb      *redis.Client
+	exchange string
+	maxLen   int64
+}
+
+// Connect connects to url (e.g. redis://localhost:6379/0).
+func Connect(url string, opts ...Option) (*Conn, error) {
+	c := &Conn{exchange: ExchangeName, maxLen: DefaultMaxLen}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	ro, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	c.rdb = redis.NewClient(ro)
+	ctx, cancel := context.WithTimeout(context.Background(), setupTimeout)
+	defer cancel()
+	if err := c.rdb.Ping(ctx).Err(); err != nil {
+		c.rdb.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+	return c, nil
+}
+
+// Exchange names the stream trades are published to.
+func (c *Conn) Exchange() string {
+	return c.exchange
+}
+
+// DeadLetterExchange names the stream dead letters are published to.
+func (c *Conn) DeadLetterExchange() string {
+	return c.exchange + ".dlx"
+}
+
+// Connected reports whether the server answers a ping.
+func (c *Conn) Connected() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	return c.rdb.Ping(ctx).Err() == nil
+}
+
+// Close closes the connection pool.
+func (c *Conn) Close() error {
+	return c.rdb.Close()
+}
+
+// add appends m to the stream of exchange.
+func (c *Conn) add(ctx context.Context, exchange string, m broker.Message) error {
+	values := make(map[string]any, len(m.Headers)+2)
+	for k, v := range m.Headers {
+		values[k] = v
+	}
+	values[fieldKey] = m.Key.String()
+	values[fieldBody] = m.Body
+	return c.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: exchange,
+		MaxLen: c.maxLen,
+		Approx: true,
+		Values: values,
+	}).Err()
+}
@@ -0,0 +1,93 @@
+package redisbroker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/broker"
+)
+
+type publisher struct {
+	c   *Conn
+	enc broker.Encoder
+}
+
+// NewPublisher creates a TradePublisher that appends trades to the stream
+// of the exchange under the key market.<symbol>.<target>. A stream keeps
+// trades whether or not a group reads them, so trades are never reported
+// unroutable.
+func NewPublisher(c *Conn, opts ...broker.PublisherOption) domain.AsyncTradePublisher {
+	return &publisher{c: c, enc: broker.NewEncoder(opts...)}
+}
+
+// NewCandlePublisher creates a CandlePublisher that appends closed candles
+// under candles.<symbol>.<target>.<interval>.
+func NewCandlePublisher(c *Conn, opts ...broker.PublisherOption) domain.CandlePublisher {
+	return &publisher{c: c, enc: broker.NewEncoder(opts...)}
+}
+
+// NewAlertPublisher creates an AlertNotifier that appends alerts under
+// alerts.<symbol>.<target>.
+func NewAlertPublisher(c *Conn, opts ...broker.PublisherOption) domain.AlertNotifier {
+	return &publisher{c: c, enc: broker.NewEncoder(opts...)}
+}
+
+// NewOrderPublisher creates an OrderPublisher that appends orders under
+// orders.<symbol>.<target>.
+func NewOrderPublisher(c *Conn, opts ...broker.PublisherOption) domain.OrderPublisher {
+	return &publisher{c: c, enc: broker.NewEncoder(opts...)}
+}
+
+func (p *publisher) Publish(ctx context.Context, trade domain.Trade) error {
+	m, err := p.enc.Trade(trade)
+	if err != nil {
+		return err
+	}
+	if err := p.c.add(ctx, p.c.exchange, m); err != nil {
+		return fmt.Errorf("trade %s: %w: %v", trade.ID, domain.ErrTradeNotConfirmed, err)
+	}
+	return nil
+}
+
+// PublishAsync appends a trade right away; the receipt is already settled.
+func (p *publisher) PublishAsync(ctx context.Context, trade domain.Trade) (domain.PublishReceipt, error) {
+	err := p.Publish(ctx, trade)
+	if err != nil && !errors.Is(err, domain.ErrTradeNotConfirmed) {
+		return nil, err
+	}
+	return receipt{err: err}, nil
+}
+
+func (p *publisher) PublishCandle(ctx context.Context, candle domain.Candle) error {
+	m, err := p.enc.Candle(candle)
+	if err != nil {
+		return err
+	}
+	return p.c.add(ctx, p.c.exchange, m)
+}
+
+func (p *publisher) Notify(ctx context.Context, alert domain.Alert) error {
+	m, err := p.enc.Alert(alert)
+	if err != nil {
+		return err
+	}
+	return p.c.add(ctx, p.c.exchange, m)
+}
+
+func (p *publisher) PublishOrder(ctx context.Context, order domain.Order) error {
+	m, err := p.enc.Order(order)
+	if err != nil {
+		return err
+	}
+	return p.c.add(ctx, p.c.exchange, m)
+}
+
+type receipt struct {
+	err error
+}
+
+func (r receipt) Wait(ctx context.Context) error {
+	return r.err
+}
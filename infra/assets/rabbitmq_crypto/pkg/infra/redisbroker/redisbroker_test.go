@@ -0,0 +1,131 @@
+package redisbroker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/broker"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/brokertest"
+)
+
+// connect starts an in-process Redis server and connects to it.
+func connect(t *testing.T) (*Conn, *miniredis.Miniredis) {
+	t.Helper()
+	srv := miniredis.RunT(t)
+	c, err := Connect("redis://" + srv.Addr())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, srv
+}
+
+func (c *Conn) streamLen(exchange string) int {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	n, _ := c.rdb.XLen(ctx, exchange).Result()
+	return int(n)
+}
+
+func TestConformance(t *testing.T) {
+	brokertest.Run(t, func(t *testing.T) brokertest.Broker {
+		c, _ := connect(t)
+		return brokertest.Broker{
+			Publisher:          NewPublisher(c),
+			Subscriber:         NewSubscriber(c),
+			OrderPublisher:     NewOrderPublisher(c),
+			OrderSubscriber:    NewOrderSubscriber(c),
+			DeadLetterExchange: c.DeadLetterExchange(),
+			DeadLetters:        func() int { return c.streamLen(c.DeadLetterExchange()) },
+		}
+	})
+}
+
+func TestSubscriber_PrivateGroupDestroyedOnStop(t *testing.T) {
+	c, _ := connect(t)
+	sub, err := NewSubscriber(c).Subscribe(context.Background(), "market.#", func(domain.Trade) error { return nil })
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	if n := c.groupCount(t); n != 1 {
+		t.Fatalf("expected 1 group, got %d", n)
+	}
+	if err := sub.Stop(context.Background()); err != nil {
+		t.Fatalf("failed to stop: %v", err)
+	}
+	if n := c.groupCount(t); n != 0 {
+		t.Errorf("expected the private group to be destroyed, got %d groups", n)
+	}
+}
+
+func (c *Conn) groupCount(t *testing.T) int {
+	groups, err := c.rdb.XInfoGroups(context.Background(), c.exchange).Result()
+	if err != nil {
+		t.Fatalf("failed to list groups: %v", err)
+	}
+	return len(groups)
+}
+
+func TestSubscriber_ExpiresOldTrades(t *testing.T) {
+	c, _ := connect(t)
+	handled := make(chan string, 2)
+	_, err := NewSubscriber(c).Subscribe(context.Background(), "market.#", func(trade domain.Trade) error {
+		handled <- trade.ID
+		return nil
+	}, domain.WithDurableQueue("ttl"), domain.WithMessageTTL(time.Minute), domain.WithDeadLetter(c.DeadLetterExchange()))
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	// An entry ID carries the time it was appended.
+	m, err := broker.NewEncoder().Trade(domain.Trade{ID: "old", Symbol: "BTC", TargetCurrency: "USD"})
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	values := map[string]any{fieldKey: m.Key.String(), fieldBody: m.Body}
+	for k, v := range m.Headers {
+		values[k] = v
+	}
+	old := fmt.Sprintf("%d-0", time.Now().Add(-time.Hour).UnixMilli())
+	if err := c.rdb.XAdd(context.Background(), &redis.XAddArgs{Stream: c.exchange, ID: old, Values: values}).Err(); err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+	if err := NewPublisher(c).Publish(context.Background(), domain.Trade{ID: "new", Symbol: "BTC", TargetCurrency: "USD"}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	select {
+	case id := <-handled:
+		if id != "new" {
+			t.Errorf("expected only the new trade, got %s", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the new trade")
+	}
+	if n := c.streamLen(c.DeadLetterExchange()); n != 1 {
+		t.Errorf("expected the expired trade to be dead-lettered, got %d dead letters", n)
+	}
+}
+
+func TestSubscriber_RejectsMaxLength(t *testing.T) {
+	c, _ := connect(t)
+	_, err := NewSubscriber(c).Subscribe(context.Background(), "market.#", func(domain.Trade) error { return nil }, domain.WithMaxLength(10))
+	if !errors.Is(err, broker.ErrUnsupportedOption) {
+		t.Fatalf("expected ErrUnsupportedOption, got %v", err)
+	}
+}
+
+func TestIDTime(t *testing.T) {
+	if got := idTime("1700000000123-4"); !got.Equal(time.UnixMilli(1700000000123)) {
+		t.Errorf("unexpected time %v", got)
+	}
+	if got := idTime("bogus"); !got.IsZero() {
+		t.Errorf("expected zero time, got %v", got)
+	}
+}
@@ -0,0 +1,345 @@
+package redisbroker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/infra/broker"
+)
+
+const (
+	// defaultCredit is how many trades a consumer reads ahead without a
+	// prefetch limit.
+	defaultCredit = 256
+	// pollInterval is how long a read blocks waiting for new trades, and
+	// so how long a cancelled consumer may take to notice.
+	pollInterval = 500 * time.Millisecond
+	// claimIdle is how long a trade may stay unsettled with another
+	// consumer of the group before it is claimed, e.g. after that consumer
+	// crashed.
+	claimIdle = 30 * time.Second
+	// retryDelay is how long the consume loop waits after a failed read.
+	retryDelay = time.Second
+)
+
+type subscriber struct {
+	c   *Conn
+	dec broker.Decoder
+}
+
+// NewSubscriber creates a TradeSubscriber reading the stream of the
+// exchange through a consumer group. A durable queue is a group shared by
+// every subscriber using its name; otherwise each subscription gets a group
+// of its own, which starts with the trades appended after Subscribe and is
+// destroyed when the subscription ends.
+//
+// Streams cannot filter by key, so every consumer reads every message and
+// acknowledges those its topic pattern does not match without handling
+// them.
+func NewSubscriber(c *Conn, opts ...broker.SubscriberOption) domain.TradeSubscriber {
+	return &subscriber{c: c, dec: broker.NewDecoder(opts...)}
+}
+
+// NewOrderSubscriber creates an OrderSubscriber reading the stream of the
+// exchange like NewSubscriber does.
+func NewOrderSubscriber(c *Conn, opts ...broker.SubscriberOption) domain.OrderSubscriber {
+	return &subscriber{c: c, dec: broker.NewDecoder(opts...)}
+}
+
+func (s *subscriber) Subscribe(ctx context.Context, routingKey string, handler func(domain.Trade) error, opts ...domain.SubscribeOption) (domain.Subscription, error) {
+	pattern, o, src, err := s.open(routingKey, opts)
+	if err != nil {
+		return nil, err
+	}
+	return broker.Dispatch(ctx, pattern.String(), src, s.dec, handler, o), nil
+}
+
+func (s *subscriber) SubscribeOrders(ctx context.Context, routingKey string, handler func(domain.Order) error, opts ...domain.SubscribeOption) (domain.Subscription, error) {
+	pattern, o, src, err := s.open(routingKey, opts)
+	if err != nil {
+		return nil, err
+	}
+	return broker.DispatchOrders(ctx, pattern.String(), src, s.dec, handler, o), nil
+}
+
+// open starts a consumer for the messages matching routingKey.
+func (s *subscriber) open(routingKey string, opts []domain.SubscribeOption) (domain.TopicPattern, domain.SubscribeOptions, *source, error) {
+	o := domain.NewSubscribeOptions(opts...)
+	if err := broker.CheckOptions(o); err != nil {
+		return "", o, nil, err
+	}
+	pattern, err := domain.ParseTopicPattern(routingKey)
+	if err != nil {
+		return "", o, nil, err
+	}
+
+	group := o.Queue
+	if group == "" {
+		group = "private-" + uuid.NewString()
+	}
+	setup, cancel := context.WithTimeout(context.Background(), setupTimeout)
+	defer cancel()
+	err = s.c.rdb.XGroupCreateMkStream(setup, s.c.exchange, group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return "", o, nil, fmt.Errorf("failed to create group %s: %w", group, err)
+	}
+
+	credit := o.Prefetch
+	if credit < 1 {
+		credit = defaultCredit
+	}
+	consuming, stop := context.WithCancel(context.Background())
+	src := &source{
+		c:          s.c,
+		group:      group,
+		consumer:   uuid.NewString(),
+		pattern:    pattern,
+		dlx:        o.DeadLetterExchange,
+		private:    o.Queue == "",
+		credit:     credit,
+		ctx:        consuming,
+		stop:       stop,
+		deliveries: make(chan broker.Delivery),
+		quit:       make(chan struct{}),
+		settled:    make(chan struct{}, 1),
+		unsettled:  make(map[string]struct{}),
+	}
+	go src.run()
+	return pattern, o, src, nil
+}
+
+// source feeds a subscription from one consumer of a group.
+type source struct {
+	c        *Conn
+	group    string
+	consumer string
+	pattern  domain.TopicPattern
+	dlx      string
+	private  bool
+	credit   int
+
+	ctx        context.Context // cancelled by Cancel
+	stop       context.CancelFunc
+	deliveries chan broker.Delivery
+	quit       chan struct{} // closed by Close
+	closeOnce  sync.Once
+	settled    chan struct{} // signalled when credit is returned
+
+	mu        sync.Mutex
+	unsettled map[string]struct{}
+	err       error
+}
+
+var _ broker.Source = (*source)(nil)
+
+func (s *source) Deliveries() <-chan broker.Delivery {
+	return s.deliveries
+}
+
+// Cancel stops reading once the trades already read are handed over.
+func (s *source) Cancel() {
+	s.stop()
+}
+
+func (s *source) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close stops reading. Trades left unsettled stay pending in the group until
+// another consumer claims them; a private group is destroyed with them.
+func (s *source) Close() {
+	s.closeOnce.Do(func() {
+		s.stop()
+		close(s.quit)
+		ctx, cancel := context.WithTimeout(context.Background(), setupTimeout)
+		defer cancel()
+		if s.private {
+			if err := s.c.rdb.XGroupDestroy(ctx, s.c.exchange, s.group).Err(); err != nil {
+				log.Printf("Error destroying group %s: %v", s.group, err)
+			}
+			return
+		}
+		// A consumer without pending trades can go without losing any.
+		if s.pending() == 0 {
+			if err := s.c.rdb.XGroupDelConsumer(ctx, s.c.exchange, s.group, s.consumer).Err(); err != nil {
+				log.Printf("Error deleting consumer %s: %v", s.consumer, err)
+			}
+		}
+	})
+}
+
+// run reads the stream until the source is cancelled, never holding more
+// than credit unsettled trades. Now and then it first claims the trades
+// other consumers of the group have left unsettled for too long.
+func (s *source) run() {
+	defer close(s.deliveries)
+
+	var claimed time.Time
+	for s.ctx.Err() == nil {
+		n := s.credit - s.pending()
+		if n < 1 {
+			select {
+			case <-s.settled:
+			case <-s.ctx.Done():
+			}
+			continue
+		}
+
+		var msgs []redis.XMessage
+		var err error
+		if !s.private && time.Since(claimed) > claimIdle/2 {
+			claimed = time.Now()
+			msgs, _, err = s.c.rdb.XAutoClaim(s.ctx, &redis.XAutoClaimArgs{
+				Stream:   s.c.exchange,
+				Group:    s.group,
+				Consumer: s.consumer,
+				MinIdle:  claimIdle,
+				Start:    "0-0",
+				Count:    int64(n),
+			}).Result()
+		}
+		if err == nil && len(msgs) == 0 {
+			var streams []redis.XStream
+			streams, err = s.c.rdb.XReadGroup(s.ctx, &redis.XReadGroupArgs{
+				Group:    s.group,
+				Consumer: s.consumer,
+				Streams:  []string{s.c.exchange, ">"},
+				Count:    int64(n),
+				Block:    pollInterval,
+			}).Result()
+			for _, st := range streams {
+				msgs = append(msgs, st.Messages...)
+			}
+		}
+		if err != nil && !errors.Is(err, redis.Nil) {
+			if s.ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, redis.ErrClosed) || strings.HasPrefix(err.Error(), "NOGROUP") {
+				s.mu.Lock()
+				s.err = err
+				s.mu.Unlock()
+				return
+			}
+			log.Printf("Error reading %s: %v", s.c.exchange, err)
+			select {
+			case <-time.After(retryDelay):
+			case <-s.ctx.Done():
+			}
+			continue
+		}
+
+		// Trades read are pending with this consumer, so hand them all
+		// over even if the source was cancelled meanwhile.
+		for _, msg := range msgs {
+			if !s.deliver(msg) {
+				return
+			}
+		}
+	}
+}
+
+// deliver hands msg to the subscription unless it is not for this
+// subscription or already being handled. It reports false once the source
+// is closed.
+func (s *source) deliver(msg redis.XMessage) bool {
+	s.mu.Lock()
+	_, handling := s.unsettled[msg.ID]
+	s.mu.Unlock()
+	if handling {
+		return true
+	}
+
+	m := broker.Message{Headers: make(map[string]string)}
+	for k, v := range msg.Values {
+		str, _ := v.(string)
+		switch k {
+		case fieldKey:
+			m.Key = domain.RoutingKey(str)
+		case fieldBody:
+			m.Body = []byte(str)
+		default:
+			m.Headers[k] = str
+		}
+	}
+	if !s.pattern.Matches(m.Key) {
+		s.ack(msg.ID)
+		return true
+	}
+
+	d := broker.Delivery{Message: m, Published: idTime(msg.ID)}
+	d.Ack = func() { s.settle(msg.ID, func() error { return s.ack(msg.ID) }) }
+	d.Reject = func() { s.settle(msg.ID, func() error { return s.reject(msg.ID, m) }) }
+
+	s.mu.Lock()
+	s.unsettled[msg.ID] = struct{}{}
+	s.mu.Unlock()
+	select {
+	case s.deliveries <- d:
+		return true
+	case <-s.quit:
+		return false
+	}
+}
+
+func (s *source) pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.unsettled)
+}
+
+// settle runs fn and returns the credit of the trade.
+func (s *source) settle(id string, fn func() error) {
+	if err := fn(); err != nil {
+		log.Printf("Error settling message %s: %v", id, err)
+	}
+	s.mu.Lock()
+	delete(s.unsettled, id)
+	s.mu.Unlock()
+	select {
+	case s.settled <- struct{}{}:
+	default:
+	}
+}
+
+func (s *source) ack(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), setupTimeout)
+	defer cancel()
+	return s.c.rdb.XAck(ctx, s.c.exchange, s.group, id).Err()
+}
+
+// reject dead-letters m if the subscription has a dead-letter exchange and
+// acknowledges it.
+func (s *source) reject(id string, m broker.Message) error {
+	if s.dlx != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), setupTimeout)
+		defer cancel()
+		if err := s.c.add(ctx, s.dlx, m); err != nil {
+			// Leave the trade pending rather than lose it.
+			return err
+		}
+	}
+	return s.ack(id)
+}
+
+// idTime returns when an entry was appended, from the milliseconds in its
+// ID.
+func idTime(id string) time.Time {
+	ms, _, _ := strings.Cut(id, "-")
+	n, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(n)
+}
@@ -0,0 +1,157 @@
+// Package rulefile reads alert rules from a YAML file and reloads them when
+// the file changes.
+//
+// The file lists the rules under "rules":
+//
+//	rules:
+//	  - name: btc-whale
+//	    kind: amount        # amount, price, notional, move or velocity
+//	    symbol: BTC         # optional, default any
+//	    currency: "*"       # optional, default any
+//	    above: 3
+//	    cooldown: 10s
+//	  - name: eth-drop
+//	    kind: move
+//	    symbol: ETH
+//	    below: -2           # percent
+//	    window: 5m
+//
+// A file without the "rules" key, such as an empty file, is rejected; write
+// "rules: []" to turn every rule off.
+package rulefile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultPollInterval is how often Watch checks the file for changes.
+const DefaultPollInterval = 2 * time.Second
+
+// ErrNoRules reports a file without the "rules" key. An editor that is
+// still writing the file may leave it empty, so this is not taken to mean
+// that there are no rules.
+var ErrNoRules = errors.New(`no "rules" key (write "rules: []" to remove all rules)`)
+
+type file struct {
+	Rules *[]rule `yaml:"rules"`
+}
+
+type rule struct {
+	Name     string        `yaml:"name"`
+	Kind     string        `yaml:"kind"`
+	Symbol   string        `yaml:"symbol"`
+	Currency string        `yaml:"currency"`
+	Above    *float64      `yaml:"above"`
+	Below    *float64      `yaml:"below"`
+	Window   time.Duration `yaml:"window"`
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// Load reads and validates the rules in the file at path.
+func Load(path string) ([]domain.AlertRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// Parse decodes and validates rules in the file format. Unknown keys are
+// rejected so that typos do not silently disable a rule.
+func Parse(data []byte) ([]domain.AlertRule, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var f file
+	if err := dec.Decode(&f); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if f.Rules == nil {
+		return nil, ErrNoRules
+	}
+
+	rules := make([]domain.AlertRule, len(*f.Rules))
+	for i, r := range *f.Rules {
+		rules[i] = domain.AlertRule{
+			Name:     r.Name,
+			Kind:     domain.RuleKind(r.Kind),
+			Symbol:   r.Symbol,
+			Currency: r.Currency,
+			Above:    r.Above,
+			Below:    r.Below,
+			Window:   r.Window,
+			Cooldown: r.Cooldown,
+		}
+		if err := rules[i].Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// Watch polls the file at path every interval and passes the rules to apply
+// whenever it changed. A file that fails to load or is rejected by apply is
+// logged and the previous rules stay in effect; this includes a file caught
+// half-written, which is empty or fails to parse. Editors that replace the
+// file by renaming a new one over it are never caught that way. Watch
+// returns when ctx is done.
+func Watch(ctx context.Context, path string, interval time.Duration, apply func([]domain.AlertRule) error) {
+	last, _ := stat(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current, err := stat(path)
+		if err != nil || current.equal(last) {
+			continue
+		}
+		last = current
+
+		rules, err := Load(path)
+		if err == nil {
+			err = apply(rules)
+		}
+		if err != nil {
+			log.Printf("Keeping previous alert rules: %v", err)
+			continue
+		}
+		log.Printf("Reloaded %d alert rules from %s", len(rules), path)
+	}
+}
+
+// version identifies a revision of a file.
+type version struct {
+	modTime time.Time
+	size    int64
+}
+
+func (v version) equal(o version) bool {
+	return v.modTime.Equal(o.modTime) && v.size == o.size
+}
+
+func stat(path string) (version, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return version{}, err
+	}
+	return version{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
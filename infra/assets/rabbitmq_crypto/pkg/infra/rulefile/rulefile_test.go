@@ -0,0 +1,146 @@
+package rulefile
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+func TestParse(t *testing.T) {
+	rules, err := Parse([]byte(`
+rules:
+  - name: btc-whale
+    kind: amount
+    symbol: BTC
+    above: 3
+    cooldown: 10s
+  - name: eth-move
+    kind: move
+    symbol: ETH
+    above: 1
+    below: -1
+    window: 5m
+`))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 rules, got %d", len(rules))
+	}
+	whale := rules[0]
+	if whale.Kind != domain.RuleAmount || whale.Symbol != "BTC" || *whale.Above != 3 || whale.Below != nil || whale.Cooldown != 10*time.Second {
+		t.Errorf("unexpected rule %+v", whale)
+	}
+	if move := rules[1]; move.Window != 5*time.Minute || *move.Below != -1 {
+		t.Errorf("unexpected rule %+v", move)
+	}
+}
+
+func TestParse_RejectsInvalidRules(t *testing.T) {
+	for name, doc := range map[string]string{
+		"unknown key":  "rules:\n  - name: a\n    kind: amount\n    abvoe: 3\n",
+		"no threshold": "rules:\n  - name: a\n    kind: amount\n",
+		"bad duration": "rules:\n  - name: a\n    kind: move\n    above: 1\n    window: soon\n",
+	} {
+		if _, err := Parse([]byte(doc)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestParse_RequiresRulesKey(t *testing.T) {
+	for _, doc := range []string{"", "rules:\n", "# rules\n"} {
+		if _, err := Parse([]byte(doc)); !errors.Is(err, ErrNoRules) {
+			t.Errorf("%q: expected ErrNoRules, got %v", doc, err)
+		}
+	}
+	rules, err := Parse([]byte("rules: []\n"))
+	if err != nil || len(rules) != 0 {
+		t.Errorf("expected an explicit empty list to clear the rules, got %+v, %v", rules, err)
+	}
+}
+
+func TestWatch_ReloadsChangedFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.yaml")
+	// write replaces the file atomically, as editors do, so that Watch never
+	// reads it half-written unless a test does so on purpose.
+	write := func(doc string, mtime time.Time) {
+		t.Helper()
+		tmp := filepath.Join(dir, "rules.yaml.tmp")
+		if err := os.WriteFile(tmp, []byte(doc), 0o600); err != nil {
+			t.Fatalf("failed to write rules: %v", err)
+		}
+		// Set the time explicitly; quick successive writes may share one.
+		if err := os.Chtimes(tmp, mtime, mtime); err != nil {
+			t.Fatalf("failed to set mtime: %v", err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatalf("failed to replace rules: %v", err)
+		}
+	}
+	now := time.Now()
+	write("rules:\n  - {name: a, kind: amount, above: 1}\n", now)
+
+	applied := make(chan []domain.AlertRule, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Watch(ctx, path, 10*time.Millisecond, func(rules []domain.AlertRule) error {
+		applied <- rules
+		return nil
+	})
+	next := func() []domain.AlertRule {
+		t.Helper()
+		select {
+		case rules := <-applied:
+			return rules
+		case <-time.After(2 * time.Second):
+			t.Fatal("rules were not reloaded")
+			return nil
+		}
+	}
+	expectNone := func(what string) {
+		t.Helper()
+		select {
+		case rules := <-applied:
+			t.Fatalf("expected %s not to be applied, got %+v", what, rules)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// A broken edit is not applied.
+	write("rules:\n  - {name: a, kind: amount}\n", now.Add(time.Second))
+	expectNone("a broken edit")
+	// Nor is a file caught empty or half-written.
+	write("", now.Add(2*time.Second))
+	expectNone("an empty file")
+	write("rules:\n  - {name: b, kind: pri", now.Add(3*time.Second))
+	expectNone("a truncated file")
+
+	write("rules:\n  - {name: b, kind: price, below: 5}\n", now.Add(4*time.Second))
+	if rules := next(); len(rules) != 1 || rules[0].Name != "b" {
+		t.Errorf("expected the valid edit to be applied, got %+v", rules)
+	}
+
+	// Only an explicit empty list clears the rules.
+	write("rules: []\n", now.Add(5*time.Second))
+	if rules := next(); len(rules) != 0 {
+		t.Errorf("expected the rules to be cleared, got %+v", rules)
+	}
+}
+
+func TestLoad_NamesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte("rules:\n  - {name: a, kind: velocity, above: 5}\n"), 0o600); err != nil {
+		t.Fatalf("failed to write rules: %v", err)
+	}
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "rules.yaml") {
+		t.Errorf("expected an error naming the file, got %v", err)
+	}
+}
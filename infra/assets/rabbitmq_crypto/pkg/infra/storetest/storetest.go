@@ -0,0 +1,147 @@
+// Package storetest checks that a domain.TradeRepository implementation
+// behaves like the others. Call Run from the implementation's tests.
+package storetest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+var epoch = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func trade(id, symbol, target string, sec int) domain.Trade {
+	return domain.Trade{
+		ID:             id,
+		Symbol:         symbol,
+		TargetCurrency: target,
+		Price:          100.25 + float64(sec),
+		Amount:         0.125,
+		Timestamp:      epoch.Add(time.Duration(sec) * time.Second),
+		Side:           domain.SideBuy,
+	}
+}
+
+// Run tests the repository returned by open, which must be empty.
+func Run(t *testing.T, open func(t *testing.T) domain.TradeRepository) {
+	t.Run("RoundTrip", func(t *testing.T) { testRoundTrip(t, open(t)) })
+	t.Run("IdempotentSave", func(t *testing.T) { testIdempotentSave(t, open(t)) })
+	t.Run("Query", func(t *testing.T) { testQuery(t, open(t)) })
+	t.Run("LargeBatch", func(t *testing.T) { testLargeBatch(t, open(t)) })
+}
+
+func testRoundTrip(t *testing.T, repo domain.TradeRepository) {
+	ctx := context.Background()
+	want := trade("t1", "BTC", "USD", 0)
+	want.Timestamp = want.Timestamp.Add(123456789 * time.Nanosecond)
+	want.Side = domain.SideSell
+	if err := repo.Save(ctx, want); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+
+	got, err := repo.Find(ctx, domain.TradeQuery{})
+	if err != nil {
+		t.Fatalf("failed to find: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected 1 trade, got %d", len(got))
+	}
+	if !got[0].Timestamp.Equal(want.Timestamp) {
+		t.Errorf("expected timestamp %v, got %v", want.Timestamp, got[0].Timestamp)
+	}
+	got[0].Timestamp = want.Timestamp
+	if got[0] != want {
+		t.Errorf("expected %+v, got %+v", want, got[0])
+	}
+}
+
+func testIdempotentSave(t *testing.T, repo domain.TradeRepository) {
+	ctx := context.Background()
+	first := trade("t1", "BTC", "USD", 0)
+	if err := repo.Save(ctx, first, trade("t2", "BTC", "USD", 1)); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+
+	// A redelivered batch overlapping the first one, with a duplicate
+	// inside it.
+	changed := first
+	changed.Price = 1
+	if err := repo.Save(ctx, changed, trade("t3", "BTC", "USD", 2), trade("t3", "BTC", "USD", 2)); err != nil {
+		t.Fatalf("failed to save duplicates: %v", err)
+	}
+
+	got, err := repo.Find(ctx, domain.TradeQuery{})
+	if err != nil {
+		t.Fatalf("failed to find: %v", err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("expected 3 trades, got %d", len(got))
+	}
+	if got[0].Price != first.Price {
+		t.Errorf("expected the first stored version to win, got price %v", got[0].Price)
+	}
+}
+
+func testQuery(t *testing.T, repo domain.TradeRepository) {
+	ctx := context.Background()
+	// Saved out of order to check the result is sorted by time, then ID.
+	if err := repo.Save(ctx,
+		trade("b3", "BTC", "USD", 30),
+		trade("b1", "BTC", "USD", 10),
+		trade("e1", "ETH", "USD", 15),
+		trade("j1", "BTC", "JPY", 20),
+		trade("b2", "BTC", "USD", 20),
+		trade("b0", "BTC", "USD", 0),
+	); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		q    domain.TradeQuery
+		want string
+	}{
+		{"all", domain.TradeQuery{}, "[b0 b1 e1 b2 j1 b3]"},
+		{"symbol", domain.TradeQuery{Symbol: "BTC"}, "[b0 b1 b2 j1 b3]"},
+		{"currency", domain.TradeQuery{TargetCurrency: "USD"}, "[b0 b1 e1 b2 b3]"},
+		{"pair", domain.TradeQuery{Symbol: "BTC", TargetCurrency: "USD"}, "[b0 b1 b2 b3]"},
+		{"range", domain.TradeQuery{Symbol: "BTC", TargetCurrency: "USD", From: epoch.Add(10 * time.Second), To: epoch.Add(30 * time.Second)}, "[b1 b2]"},
+		{"from", domain.TradeQuery{From: epoch.Add(20 * time.Second)}, "[b2 j1 b3]"},
+		{"limit", domain.TradeQuery{Symbol: "BTC", Limit: 2}, "[b0 b1]"},
+		{"none", domain.TradeQuery{Symbol: "SOL"}, "[]"},
+	} {
+		got, err := repo.Find(ctx, tc.q)
+		if err != nil {
+			t.Fatalf("%s: failed to find: %v", tc.name, err)
+		}
+		ids := make([]string, len(got))
+		for i, tr := range got {
+			ids[i] = tr.ID
+		}
+		if s := fmt.Sprint(ids); s != tc.want {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.want, s)
+		}
+	}
+}
+
+func testLargeBatch(t *testing.T, repo domain.TradeRepository) {
+	ctx := context.Background()
+	const n = 2500
+	trades := make([]domain.Trade, n)
+	for i := range trades {
+		trades[i] = trade(fmt.Sprintf("t%04d", i), "SOL", "EUR", i)
+	}
+	if err := repo.Save(ctx, trades...); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+	got, err := repo.Find(ctx, domain.TradeQuery{Symbol: "SOL"})
+	if err != nil {
+		t.Fatalf("failed to find: %v", err)
+	}
+	if len(got) != n || got[n-1].ID != "t2499" {
+		t.Errorf("expected %d trades ending with t2499, got %d", n, len(got))
+	}
+}
@@ -0,0 +1,92 @@
+// Package tracing installs the OpenTelemetry tracer provider and the W3C
+// trace-context propagator the broker adapters record spans with.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+)
+
+// Supported exporters.
+const (
+	// ExporterNone records no spans but still propagates trace context
+	// received from upstream.
+	ExporterNone = ""
+	// ExporterStdout writes spans as JSON, for trying tracing out.
+	ExporterStdout = "stdout"
+	// ExporterOTLP sends spans to an OpenTelemetry collector over HTTP.
+	ExporterOTLP = "otlp"
+)
+
+// Option configures Setup.
+type Option func(*setup)
+
+type setup struct {
+	endpoint string
+	out      io.Writer
+}
+
+// WithEndpoint sets the URL of the OTLP collector, e.g.
+// http://localhost:4318. Defaults to OTEL_EXPORTER_OTLP_ENDPOINT or, without
+// it, http://localhost:4318.
+func WithEndpoint(url string) Option {
+	return func(s *setup) {
+		s.endpoint = url
+	}
+}
+
+// WithWriter sets where the stdout exporter writes. Defaults to os.Stdout.
+func WithWriter(w io.Writer) Option {
+	return func(s *setup) {
+		s.out = w
+	}
+}
+
+// Setup installs a global tracer provider exporting the spans of service
+// with exporter, and the W3C trace-context and baggage propagators. The
+// returned function flushes the spans still buffered and must be called
+// before the program exits.
+func Setup(ctx context.Context, service, exporter string, opts ...Option) (shutdown func(context.Context) error, err error) {
+	s := setup{out: os.Stdout}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exp sdktrace.SpanExporter
+	switch exporter {
+	case ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(s.out))
+	case ExporterOTLP:
+		var o []otlptracehttp.Option
+		if s.endpoint != "" {
+			o = append(o, otlptracehttp.WithEndpointURL(s.endpoint))
+		}
+		exp, err = otlptracehttp.New(ctx, o...)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %w", exporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(service)))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
@@ -0,0 +1,52 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+func TestSetup_Stdout(t *testing.T) {
+	var out bytes.Buffer
+	shutdown, err := Setup(context.Background(), "ticker", ExporterStdout, WithWriter(&out))
+	if err != nil {
+		t.Fatalf("failed to set up: %v", err)
+	}
+
+	ctx, span := otel.Tracer("test").Start(context.Background(), "tick")
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to shut down: %v", err)
+	}
+
+	if !strings.HasPrefix(carrier.Get("traceparent"), "00-"+span.SpanContext().TraceID().String()) {
+		t.Errorf("expected a W3C traceparent, got %v", carrier)
+	}
+	for _, want := range []string{`"Name":"tick"`, `"Value":"ticker"`} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %s in:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestSetup_None(t *testing.T) {
+	shutdown, err := Setup(context.Background(), "ticker", ExporterNone)
+	if err != nil {
+		t.Fatalf("failed to set up: %v", err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestSetup_UnknownExporter(t *testing.T) {
+	if _, err := Setup(context.Background(), "ticker", "zipkin"); err == nil {
+		t.Error("expected an unknown exporter to be rejected")
+	}
+}
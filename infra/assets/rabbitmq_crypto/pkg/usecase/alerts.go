@@ -0,0 +1,240 @@
+package usecase
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// defaultDedupSize is how many trade IDs the engine remembers to ignore
+// redelivered trades.
+const defaultDedupSize = 10000
+
+// AlertEngine evaluates alert rules against trades. Rules are evaluated per
+// symbol and target currency, and all times are trade timestamps, so the
+// outcome does not depend on when trades arrive.
+//
+// A trade seen before, e.g. one redelivered by the broker, is ignored. The
+// rules can be replaced at any time with SetRules. An AlertEngine is safe
+// for concurrent use.
+type AlertEngine struct {
+	mu     sync.Mutex
+	rules  []domain.AlertRule
+	states map[alertKey]*ruleState
+	seen   map[string]struct{}
+	order  []string // ring of the IDs in seen, oldest at next
+	next   int
+}
+
+// AlertEngineOption configures an AlertEngine.
+type AlertEngineOption func(*AlertEngine)
+
+// WithDedupSize sets how many trade IDs are remembered to ignore
+// redeliveries.
+func WithDedupSize(n int) AlertEngineOption {
+	return func(e *AlertEngine) {
+		e.order = make([]string, n)
+	}
+}
+
+// NewAlertEngine creates an AlertEngine with the given rules.
+func NewAlertEngine(rules []domain.AlertRule, opts ...AlertEngineOption) (*AlertEngine, error) {
+	e := &AlertEngine{
+		states: make(map[alertKey]*ruleState),
+		seen:   make(map[string]struct{}),
+		order:  make([]string, defaultDedupSize),
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	if err := e.SetRules(rules); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+type alertKey struct {
+	rule   string
+	symbol string
+	target string
+}
+
+// ruleState is what a rule remembers about one symbol and currency.
+type ruleState struct {
+	samples []sample // trades within the window, oldest first
+	active  bool     // a state rule is currently breached
+	fired   time.Time
+}
+
+type sample struct {
+	at    time.Time
+	price float64
+}
+
+// insert adds smp in timestamp order, after the samples of the same time,
+// and returns the number of samples up to and including it.
+func (st *ruleState) insert(smp sample) int {
+	i := sort.Search(len(st.samples), func(i int) bool { return st.samples[i].at.After(smp.at) })
+	st.samples = slices.Insert(st.samples, i, smp)
+	return i + 1
+}
+
+// prune drops the samples before cutoff.
+func (st *ruleState) prune(cutoff time.Time) {
+	i := sort.Search(len(st.samples), func(i int) bool { return !st.samples[i].at.Before(cutoff) })
+	st.samples = st.samples[i:]
+}
+
+// SetRules validates rules and replaces the current ones. Rules that did not
+// change keep their windows and cooldowns.
+func (e *AlertEngine) SetRules(rules []domain.AlertRule) error {
+	names := make(map[string]domain.AlertRule, len(rules))
+	for _, r := range rules {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+		if _, ok := names[r.Name]; ok {
+			return fmt.Errorf("rule %q: defined twice", r.Name)
+		}
+		names[r.Name] = r
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	old := make(map[string]domain.AlertRule, len(e.rules))
+	for _, r := range e.rules {
+		old[r.Name] = r
+	}
+	for key := range e.states {
+		prev, kept := names[key.rule]
+		if !kept || !reflect.DeepEqual(prev, old[key.rule]) {
+			delete(e.states, key)
+		}
+	}
+	e.rules = append([]domain.AlertRule(nil), rules...)
+	return nil
+}
+
+// Rules returns the current rules.
+func (e *AlertEngine) Rules() []domain.AlertRule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]domain.AlertRule(nil), e.rules...)
+}
+
+// Evaluate feeds a trade to every matching rule and returns the alerts it
+// raised.
+func (e *AlertEngine) Evaluate(trade domain.Trade) []domain.Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.remember(trade.ID) {
+		return nil
+	}
+
+	var alerts []domain.Alert
+	for _, r := range e.rules {
+		if !r.Matches(trade) {
+			continue
+		}
+		key := alertKey{rule: r.Name, symbol: trade.Symbol, target: trade.TargetCurrency}
+		st, ok := e.states[key]
+		if !ok {
+			st = &ruleState{}
+			e.states[key] = st
+		}
+		if a, ok := st.evaluate(r, trade); ok {
+			alerts = append(alerts, a)
+		}
+	}
+	return alerts
+}
+
+// remember records a trade ID and reports whether it is new. Trades without
+// an ID are always new. Callers must hold e.mu.
+func (e *AlertEngine) remember(id string) bool {
+	if id == "" || len(e.order) == 0 {
+		return true
+	}
+	if _, ok := e.seen[id]; ok {
+		return false
+	}
+	delete(e.seen, e.order[e.next])
+	e.order[e.next] = id
+	e.next = (e.next + 1) % len(e.order)
+	e.seen[id] = struct{}{}
+	return true
+}
+
+func (st *ruleState) evaluate(r domain.AlertRule, trade domain.Trade) (domain.Alert, bool) {
+	at := trade.Timestamp
+	var value float64
+	switch r.Kind {
+	case domain.RuleAmount:
+		value = trade.Amount
+	case domain.RulePrice:
+		value = trade.Price
+	case domain.RuleNotional:
+		value = trade.Price * trade.Amount
+	case domain.RuleMove, domain.RuleVelocity:
+		// The window ends at the trade, also when it arrives after newer
+		// ones. Only the samples the newest trade's window still covers
+		// are kept.
+		end := st.insert(sample{at: at, price: trade.Price})
+		start := sort.Search(end, func(i int) bool { return !st.samples[i].at.Before(at.Add(-r.Window)) })
+		if r.Kind == domain.RuleVelocity {
+			value = float64(end - start)
+		} else if first := st.samples[start].price; first != 0 {
+			value = (trade.Price/first - 1) * 100
+		}
+		st.prune(st.samples[len(st.samples)-1].at.Add(-r.Window))
+	}
+
+	threshold, breached := r.Breached(value)
+	stateful := r.Kind == domain.RulePrice || r.Kind == domain.RuleMove || r.Kind == domain.RuleVelocity
+	if !breached {
+		st.active = false
+		return domain.Alert{}, false
+	}
+	if stateful && st.active {
+		return domain.Alert{}, false
+	}
+	if !st.fired.IsZero() && at.Sub(st.fired) < r.Cooldown {
+		return domain.Alert{}, false
+	}
+	st.active = true
+	st.fired = at
+
+	return domain.Alert{
+		Rule:           r.Name,
+		Kind:           r.Kind,
+		Symbol:         trade.Symbol,
+		TargetCurrency: trade.TargetCurrency,
+		Value:          value,
+		Threshold:      threshold,
+		TradeID:        trade.ID,
+		Time:           at,
+		Message:        alertMessage(r, trade, value),
+	}, true
+}
+
+func alertMessage(r domain.AlertRule, trade domain.Trade, value float64) string {
+	pair := trade.Symbol + "/" + trade.TargetCurrency
+	switch r.Kind {
+	case domain.RuleAmount:
+		return fmt.Sprintf("%s: %s %.4f %s at %.2f", r.Name, trade.Side, trade.Amount, pair, trade.Price)
+	case domain.RulePrice:
+		return fmt.Sprintf("%s: %s at %.2f", r.Name, pair, value)
+	case domain.RuleNotional:
+		return fmt.Sprintf("%s: %s %s worth %.2f %s", r.Name, trade.Side, pair, value, trade.TargetCurrency)
+	case domain.RuleMove:
+		return fmt.Sprintf("%s: %s moved %+.2f%% within %v to %.2f", r.Name, pair, value, r.Window, trade.Price)
+	default:
+		return fmt.Sprintf("%s: %s had %.0f trades within %v", r.Name, pair, value, r.Window)
+	}
+}
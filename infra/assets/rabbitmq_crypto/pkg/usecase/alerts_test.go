@@ -0,0 +1,218 @@
+package usecase
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+func bound(v float64) *float64 { return &v }
+
+// feed evaluates trades of symbol/USD with unique IDs and returns the
+// alerts they raised.
+type feed struct {
+	engine *AlertEngine
+	n      int
+}
+
+func (f *feed) trade(symbol string, sec, price, amount float64) []domain.Alert {
+	f.n++
+	tr := tradeAt(sec, price, amount)
+	tr.ID = fmt.Sprintf("t%d", f.n)
+	tr.Symbol = symbol
+	return f.engine.Evaluate(tr)
+}
+
+func newFeed(t *testing.T, rules ...domain.AlertRule) *feed {
+	t.Helper()
+	e, err := NewAlertEngine(rules)
+	if err != nil {
+		t.Fatalf("failed to create engine: %v", err)
+	}
+	return &feed{engine: e}
+}
+
+func TestAlertEngine_AmountFiresPerTradeForMatchingSymbol(t *testing.T) {
+	f := newFeed(t, domain.AlertRule{Name: "whale", Kind: domain.RuleAmount, Symbol: "btc", Above: bound(3)})
+
+	if got := f.trade("BTC", 0, 60000, 5); len(got) != 1 || got[0].Value != 5 || got[0].Threshold != 3 {
+		t.Fatalf("expected an alert for a 5 BTC trade, got %+v", got)
+	}
+	if got := f.trade("BTC", 1, 60000, 4); len(got) != 1 {
+		t.Errorf("expected every whale trade to fire, got %+v", got)
+	}
+	if got := f.trade("ETH", 2, 3000, 50); len(got) != 0 {
+		t.Errorf("expected other symbols to be ignored, got %+v", got)
+	}
+	if got := f.trade("BTC", 3, 60000, 1); len(got) != 0 {
+		t.Errorf("expected small trades to be ignored, got %+v", got)
+	}
+}
+
+func TestAlertEngine_NotionalUsesPriceTimesAmount(t *testing.T) {
+	f := newFeed(t, domain.AlertRule{Name: "big", Kind: domain.RuleNotional, Currency: "USD", Above: bound(100000)})
+
+	if got := f.trade("ETH", 0, 3000, 30); len(got) != 0 {
+		t.Errorf("expected 90000 USD to stay quiet, got %+v", got)
+	}
+	got := f.trade("ETH", 1, 3000, 40)
+	if len(got) != 1 || got[0].Value != 120000 || !strings.Contains(got[0].Message, "ETH/USD") {
+		t.Errorf("expected an alert for 120000 USD, got %+v", got)
+	}
+}
+
+func TestAlertEngine_PriceFiresOncePerBreach(t *testing.T) {
+	f := newFeed(t, domain.AlertRule{Name: "floor", Kind: domain.RulePrice, Symbol: "BTC", Below: bound(55000)})
+
+	fired := 0
+	for i, price := range []float64{56000, 54000, 53000, 54500, 56000, 54900} {
+		fired += len(f.trade("BTC", float64(i), price, 1))
+	}
+	// Once on the first drop, once after recovering and dropping again.
+	if fired != 2 {
+		t.Errorf("expected 2 alerts, got %d", fired)
+	}
+}
+
+func TestAlertEngine_MoveOverWindow(t *testing.T) {
+	f := newFeed(t, domain.AlertRule{Name: "drop", Kind: domain.RuleMove, Symbol: "ETH", Below: bound(-2), Window: time.Minute})
+
+	f.trade("ETH", 0, 3000, 1)
+	if got := f.trade("ETH", 30, 2950, 1); len(got) != 0 {
+		t.Fatalf("expected -1.7%% to stay quiet, got %+v", got)
+	}
+	got := f.trade("ETH", 50, 2925, 1)
+	if len(got) != 1 || got[0].Value > -2.49 || got[0].Value < -2.51 {
+		t.Fatalf("expected a -2.5%% alert, got %+v", got)
+	}
+
+	// A minute later the 3000 trade left the window; the move measured
+	// from 2950 is within bounds.
+	if got := f.trade("ETH", 85, 2900, 1); len(got) != 0 {
+		t.Errorf("expected the old price to have left the window, got %+v", got)
+	}
+}
+
+func TestAlertEngine_VelocityCountsTradesInWindow(t *testing.T) {
+	f := newFeed(t, domain.AlertRule{Name: "burst", Kind: domain.RuleVelocity, Above: bound(5), Window: 10 * time.Second})
+
+	fired := 0
+	for i := 0; i < 10; i++ {
+		fired += len(f.trade("SOL", float64(i)/2, 150, 1))
+	}
+	if fired != 1 {
+		t.Errorf("expected one alert for the burst, got %d", fired)
+	}
+	// Trades per symbol are counted separately.
+	if got := f.trade("ADA", 5, 0.4, 1); len(got) != 0 {
+		t.Errorf("expected ADA to have its own count, got %+v", got)
+	}
+}
+
+func TestAlertEngine_WindowsEndAtLateTrades(t *testing.T) {
+	f := newFeed(t, domain.AlertRule{Name: "burst", Kind: domain.RuleVelocity, Above: bound(3), Window: 10 * time.Second})
+
+	// The trade at 5s arrives first; the window of each later one still
+	// ends at its own timestamp.
+	var fired []float64
+	for _, sec := range []float64{5, 0, 1, 2} {
+		for _, a := range f.trade("SOL", sec, 150, 1) {
+			fired = append(fired, sec, a.Value)
+		}
+	}
+	if fmt.Sprint(fired) != "[2 3]" {
+		t.Errorf("expected one alert for the 3 trades up to 2s, got %v", fired)
+	}
+}
+
+func TestAlertEngine_MoveIgnoresZeroPrices(t *testing.T) {
+	f := newFeed(t, domain.AlertRule{Name: "jump", Kind: domain.RuleMove, Above: bound(1), Window: time.Minute})
+
+	f.trade("ETH", 0, 0, 1)
+	if got := f.trade("ETH", 10, 3000, 1); len(got) != 0 {
+		t.Errorf("expected no move from a zero price, got %+v", got)
+	}
+}
+
+func TestAlertEngine_CooldownRateLimits(t *testing.T) {
+	f := newFeed(t, domain.AlertRule{Name: "whale", Kind: domain.RuleAmount, Above: bound(3), Cooldown: 10 * time.Second})
+
+	var fired []float64
+	for _, sec := range []float64{0, 2, 9, 10, 12, 21} {
+		if len(f.trade("BTC", sec, 60000, 5)) == 1 {
+			fired = append(fired, sec)
+		}
+	}
+	if fmt.Sprint(fired) != "[0 10 21]" {
+		t.Errorf("expected alerts at 0, 10 and 21s, got %v", fired)
+	}
+}
+
+func TestAlertEngine_IgnoresRedeliveredTrades(t *testing.T) {
+	e, err := NewAlertEngine([]domain.AlertRule{{Name: "whale", Kind: domain.RuleAmount, Above: bound(3)}}, WithDedupSize(2))
+	if err != nil {
+		t.Fatalf("failed to create engine: %v", err)
+	}
+	whale := func(id string) domain.Trade {
+		tr := tradeAt(0, 60000, 5)
+		tr.ID = id
+		return tr
+	}
+
+	for _, step := range []struct {
+		id   string
+		want int
+	}{{"a", 1}, {"a", 0}, {"b", 1}, {"c", 1}, {"a", 1}} { // a was forgotten after b and c
+		if got := e.Evaluate(whale(step.id)); len(got) != step.want {
+			t.Errorf("trade %s: expected %d alerts, got %d", step.id, step.want, len(got))
+		}
+	}
+}
+
+func TestAlertEngine_SetRulesKeepsStateOfUnchangedRules(t *testing.T) {
+	floor := domain.AlertRule{Name: "floor", Kind: domain.RulePrice, Below: bound(55000)}
+	f := newFeed(t, floor)
+
+	if got := f.trade("BTC", 0, 54000, 1); len(got) != 1 {
+		t.Fatalf("expected an alert, got %+v", got)
+	}
+
+	// Adding a rule must not make the ongoing breach fire again.
+	whale := domain.AlertRule{Name: "whale", Kind: domain.RuleAmount, Above: bound(3)}
+	if err := f.engine.SetRules([]domain.AlertRule{floor, whale}); err != nil {
+		t.Fatalf("failed to set rules: %v", err)
+	}
+	if got := f.trade("BTC", 1, 53000, 5); len(got) != 1 || got[0].Rule != "whale" {
+		t.Errorf("expected only the new rule to fire, got %+v", got)
+	}
+
+	// A changed rule starts afresh.
+	floor.Below = bound(60000)
+	if err := f.engine.SetRules([]domain.AlertRule{floor}); err != nil {
+		t.Fatalf("failed to set rules: %v", err)
+	}
+	if got := f.trade("BTC", 2, 53000, 1); len(got) != 1 {
+		t.Errorf("expected the changed rule to fire, got %+v", got)
+	}
+}
+
+func TestAlertEngine_SetRulesRejectsInvalidRules(t *testing.T) {
+	f := newFeed(t, domain.AlertRule{Name: "whale", Kind: domain.RuleAmount, Above: bound(3)})
+
+	for _, rules := range [][]domain.AlertRule{
+		{{Name: "move", Kind: domain.RuleMove, Above: bound(1)}}, // no window
+		{{Name: "odd", Kind: "volume", Above: bound(1)}},         // unknown kind
+		{{Name: "open", Kind: domain.RuleAmount}},                // no threshold
+		{{Name: "a", Kind: domain.RuleAmount, Above: bound(1)}, {Name: "a", Kind: domain.RulePrice, Above: bound(1)}},
+	} {
+		if err := f.engine.SetRules(rules); err == nil {
+			t.Errorf("expected %+v to be rejected", rules)
+		}
+	}
+	if got := f.engine.Rules(); len(got) != 1 || got[0].Name != "whale" {
+		t.Errorf("expected the previous rules to stay in effect, got %+v", got)
+	}
+}
@@ -0,0 +1,194 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+const (
+	// takeProbability is how often a bot sends a market order rather than
+	// a quote.
+	takeProbability = 0.3
+	// quoteSpread is how far from the fair price quotes are placed at most,
+	// as a fraction of it.
+	quoteSpread = 0.002
+	// maxQuotes is how many quotes a bot keeps before it withdraws its
+	// oldest one.
+	maxQuotes = 10
+)
+
+// TradingBots simulate traders feeding the order books. At every tick one
+// of the bots, picked at random, either quotes a limit order a little below
+// the fair price to buy or above it to sell, or takes liquidity with a
+// market order in the direction the market moved. A bot holding too many
+// quotes first cancels its oldest one, which may have filled already.
+//
+// Fair prices, pairs and sizes come from a MarketModel, so matched trades
+// follow the same random walk as those of a MarketSimulator.
+type TradingBots struct {
+	pub    domain.OrderPublisher
+	model  MarketModel
+	bots   int
+	rng    *rand.Rand
+	seeded bool
+	clock  Clock
+	ids    IDGenerator
+	quotes map[string][]domain.Order // per trader, oldest first
+}
+
+// BotsOption configures TradingBots.
+type BotsOption func(*TradingBots)
+
+// WithBotCount sets how many bots trade. Defaults to 5.
+func WithBotCount(n int) BotsOption {
+	return func(b *TradingBots) {
+		b.bots = n
+	}
+}
+
+// WithBotMarketModel sets the model fair prices and sizes are drawn from.
+// Defaults to a GBMMarket with the default assets and currencies.
+func WithBotMarketModel(m MarketModel) BotsOption {
+	return func(b *TradingBots) {
+		b.model = m
+	}
+}
+
+// WithBotSeed makes the bots reproducible: with the same seed, clock and
+// market model, a run sends the same orders, including their IDs unless
+// WithBotIDGenerator is given.
+func WithBotSeed(seed int64) BotsOption {
+	return func(b *TradingBots) {
+		b.rng = rand.New(rand.NewSource(seed))
+		b.seeded = true
+	}
+}
+
+// WithBotClock sets the clock used for order timestamps and ticks.
+// Defaults to SystemClock.
+func WithBotClock(c Clock) BotsOption {
+	return func(b *TradingBots) {
+		b.clock = c
+	}
+}
+
+// WithBotIDGenerator sets how order IDs are generated. Defaults to random
+// UUIDs, drawn from the seeded source if WithBotSeed is given.
+func WithBotIDGenerator(ids IDGenerator) BotsOption {
+	return func(b *TradingBots) {
+		b.ids = ids
+	}
+}
+
+// NewTradingBots creates bots sending their orders to pub.
+func NewTradingBots(pub domain.OrderPublisher, opts ...BotsOption) *TradingBots {
+	b := &TradingBots{
+		pub:    pub,
+		model:  NewGBMMarket(nil, nil),
+		bots:   5,
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		clock:  SystemClock,
+		quotes: make(map[string][]domain.Order),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.bots < 1 {
+		b.bots = 1
+	}
+	if b.ids == nil {
+		b.ids = uuid.NewString
+		if b.seeded {
+			b.ids = func() string {
+				return uuid.Must(uuid.NewRandomFromReader(b.rng)).String()
+			}
+		}
+	}
+	return b
+}
+
+// Run lets one bot act every interval until ctx is done or an order cannot
+// be sent.
+func (b *TradingBots) Run(ctx context.Context, interval time.Duration) error {
+	last := b.clock.Now()
+	next := b.clock.After(interval)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-next:
+			now := b.clock.Now()
+			next = b.clock.After(interval)
+			market := b.model.Next(b.rng, now.Sub(last))
+			last = now
+			for _, order := range b.act(market, now) {
+				if err := b.pub.PublishOrder(ctx, order); err != nil {
+					return fmt.Errorf("could not send %s order %s: %w", order.Type, order.ID, err)
+				}
+			}
+		}
+	}
+}
+
+// act returns the orders a random bot sends given the latest market trade.
+func (b *TradingBots) act(market domain.Trade, now time.Time) []domain.Order {
+	trader := fmt.Sprintf("bot-%d", b.rng.Intn(b.bots)+1)
+	var orders []domain.Order
+
+	if quotes := b.quotes[trader]; len(quotes) >= maxQuotes {
+		oldest := quotes[0]
+		b.quotes[trader] = quotes[1:]
+		orders = append(orders, domain.Order{
+			ID:             oldest.ID,
+			Trader:         trader,
+			Symbol:         oldest.Symbol,
+			TargetCurrency: oldest.TargetCurrency,
+			Type:           domain.OrderCancel,
+			Timestamp:      now,
+		})
+	}
+
+	order := domain.Order{
+		ID:             b.ids(),
+		Trader:         trader,
+		Symbol:         market.Symbol,
+		TargetCurrency: market.TargetCurrency,
+		Side:           market.Side,
+		Amount:         market.Amount,
+		Timestamp:      now,
+	}
+	if b.rng.Float64() < takeProbability {
+		order.Type = domain.OrderMarket
+		if order.Side != domain.SideBuy && order.Side != domain.SideSell {
+			order.Side = []string{domain.SideBuy, domain.SideSell}[b.rng.Intn(2)]
+		}
+		return append(orders, order)
+	}
+
+	order.Type = domain.OrderLimit
+	order.Side = domain.SideBuy
+	offset := -market.Price * quoteSpread * b.rng.Float64()
+	if b.rng.Intn(2) == 0 {
+		order.Side = domain.SideSell
+		offset = -offset
+	}
+	order.Price = roundPrice(market.Price + offset)
+	b.quotes[trader] = append(b.quotes[trader], order)
+	return append(orders, order)
+}
+
+// roundPrice rounds p to five significant digits, so that quotes share
+// price levels.
+func roundPrice(p float64) float64 {
+	if p <= 0 {
+		return p
+	}
+	tick := math.Pow(10, math.Floor(math.Log10(p))-4)
+	return math.Round(p/tick) * tick
+}
@@ -0,0 +1,95 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// orderFeed sends orders straight to an engine and cancels the run after n
+// orders.
+type orderFeed struct {
+	e      *MatchingEngine
+	n      int
+	cancel context.CancelFunc
+	orders []domain.Order
+}
+
+func (f *orderFeed) PublishOrder(ctx context.Context, order domain.Order) error {
+	if len(f.orders) == f.n {
+		return nil
+	}
+	f.orders = append(f.orders, order)
+	if len(f.orders) == f.n {
+		f.cancel()
+	}
+	return f.e.Submit(ctx, order)
+}
+
+// runBots runs seeded bots against a fresh engine until they sent n orders.
+func runBots(t *testing.T, n int) (*orderFeed, *mockPublisher) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	trades := &mockPublisher{}
+	feed := &orderFeed{e: NewMatchingEngine(trades), n: n, cancel: cancel}
+	bots := NewTradingBots(feed, WithBotSeed(7), WithBotCount(2),
+		WithBotClock(&stepClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}))
+	if err := bots.Run(ctx, time.Second); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the run to be cancelled, got %v", err)
+	}
+	return feed, trades
+}
+
+func TestTradingBots_FeedEngine(t *testing.T) {
+	feed, trades := runBots(t, 500)
+
+	types := make(map[domain.OrderType]int)
+	for _, o := range feed.orders {
+		if err := o.Validate(); err != nil {
+			t.Fatalf("invalid order: %v", err)
+		}
+		if o.Trader != "bot-1" && o.Trader != "bot-2" {
+			t.Errorf("unexpected trader %q", o.Trader)
+		}
+		types[o.Type]++
+	}
+	for _, typ := range []domain.OrderType{domain.OrderLimit, domain.OrderMarket, domain.OrderCancel} {
+		if types[typ] == 0 {
+			t.Errorf("expected some %s orders, got %v", typ, types)
+		}
+	}
+	if len(trades.trades) == 0 {
+		t.Fatal("expected the orders to match into trades")
+	}
+	for _, tr := range trades.trades {
+		if tr.Price <= 0 || tr.Amount <= 0 || (tr.Side != domain.SideBuy && tr.Side != domain.SideSell) {
+			t.Errorf("invalid trade %+v", tr)
+		}
+	}
+}
+
+func TestTradingBots_SeedIsReproducible(t *testing.T) {
+	first, _ := runBots(t, 50)
+	second, _ := runBots(t, 50)
+	if !reflect.DeepEqual(first.orders, second.orders) {
+		t.Error("expected the same seed to send the same orders")
+	}
+}
+
+func TestRoundPrice(t *testing.T) {
+	cases := map[float64]float64{
+		61234.567: 61235,
+		0.4512345: 0.45123,
+		150:       150,
+	}
+	for in, want := range cases {
+		if got := roundPrice(in); got-want > 1e-9 || want-got > 1e-9 {
+			t.Errorf("roundPrice(%v): expected %v, got %v", in, want, got)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// defaultClientBuffer is how many trades a listener may fall behind before
+// it is dropped, unless WithClientBuffer is given.
+const defaultClientBuffer = 256
+
+var (
+	// ErrSlowListener is the reason a listener is dropped when it does not
+	// keep up with the trades it asked for.
+	ErrSlowListener = errors.New("listener too slow, trades dropped")
+	// ErrBroadcastClosed is the reason listeners end when the broadcaster
+	// is closed.
+	ErrBroadcastClosed = errors.New("broadcast closed")
+)
+
+// TradeBroadcaster fans trades out to listeners, each of which selects
+// trades with a topic pattern, the way queues bound to a topic exchange
+// would. Use it as the handler of a single subscription to serve many
+// clients.
+//
+// Publish never blocks on a listener. Every listener has a buffer that
+// absorbs bursts; a listener whose buffer is full when a trade arrives is
+// dropped with ErrSlowListener rather than holding up the others.
+type TradeBroadcaster struct {
+	buffer int
+
+	mu        sync.Mutex
+	listeners map[*Listener]struct{}
+	closed    bool
+}
+
+var _ domain.TradeFeed = (*TradeBroadcaster)(nil)
+
+// Listener receives the trades matching its pattern until it is closed or
+// dropped.
+type Listener struct {
+	b       *TradeBroadcaster
+	pattern domain.TopicPattern
+	trades  chan domain.Trade
+	err     error // set before trades is closed
+}
+
+// BroadcastOption configures a TradeBroadcaster.
+type BroadcastOption func(*TradeBroadcaster)
+
+// WithClientBuffer sets how many trades a listener may fall behind.
+func WithClientBuffer(n int) BroadcastOption {
+	return func(b *TradeBroadcaster) {
+		if n > 0 {
+			b.buffer = n
+		}
+	}
+}
+
+// NewTradeBroadcaster creates a new TradeBroadcaster.
+func NewTradeBroadcaster(opts ...BroadcastOption) *TradeBroadcaster {
+	b := &TradeBroadcaster{buffer: defaultClientBuffer, listeners: make(map[*Listener]struct{})}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// Listen registers a listener for the trades whose routing key matches
+// pattern. The returned stream is a *Listener.
+func (b *TradeBroadcaster) Listen(pattern domain.TopicPattern) domain.TradeStream {
+	l := &Listener{b: b, pattern: pattern, trades: make(chan domain.Trade, b.buffer)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		l.err = ErrBroadcastClosed
+		close(l.trades)
+		return l
+	}
+	b.listeners[l] = struct{}{}
+	return l
+}
+
+// Publish hands trade to every listener whose pattern matches it. Trades
+// that have no valid routing key are ignored.
+func (b *TradeBroadcaster) Publish(ctx context.Context, trade domain.Trade) error {
+	key, err := domain.TradeRoutingKey(trade)
+	if err != nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for l := range b.listeners {
+		if !l.pattern.Matches(key) {
+			continue
+		}
+		select {
+		case l.trades <- trade:
+		default:
+			b.drop(l, ErrSlowListener)
+		}
+	}
+	return nil
+}
+
+// Listeners returns the number of registered listeners.
+func (b *TradeBroadcaster) Listeners() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.listeners)
+}
+
+// Close ends every listener with ErrBroadcastClosed; later listeners end
+// immediately.
+func (b *TradeBroadcaster) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for l := range b.listeners {
+		b.drop(l, ErrBroadcastClosed)
+	}
+}
+
+// drop unregisters l. b.mu must be held.
+func (b *TradeBroadcaster) drop(l *Listener, err error) {
+	if _, ok := b.listeners[l]; !ok {
+		return
+	}
+	delete(b.listeners, l)
+	l.err = err
+	close(l.trades)
+}
+
+// Trades delivers the matching trades. It is closed when the listener is
+// closed or dropped; Err then tells why.
+func (l *Listener) Trades() <-chan domain.Trade {
+	return l.trades
+}
+
+// Err returns why the listener ended: ErrSlowListener, ErrBroadcastClosed,
+// or nil if it was closed by its owner. It is only meaningful once Trades
+// is closed.
+func (l *Listener) Err() error {
+	l.b.mu.Lock()
+	defer l.b.mu.Unlock()
+	return l.err
+}
+
+// Close unregisters the listener.
+func (l *Listener) Close() {
+	l.b.mu.Lock()
+	defer l.b.mu.Unlock()
+	l.b.drop(l, nil)
+}
@@ -0,0 +1,91 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+func pattern(t *testing.T, s string) domain.TopicPattern {
+	t.Helper()
+	p, err := domain.ParseTopicPattern(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestTradeBroadcaster_DeliversByPattern(t *testing.T) {
+	b := NewTradeBroadcaster()
+	jpy := b.Listen(pattern(t, "market.*.jpy"))
+	btc := b.Listen(pattern(t, "market.btc.#"))
+
+	for _, tr := range []domain.Trade{
+		{ID: "1", Symbol: "BTC", TargetCurrency: "JPY"},
+		{ID: "2", Symbol: "ETH", TargetCurrency: "JPY"},
+		{ID: "3", Symbol: "BTC", TargetCurrency: "USD"},
+		{ID: "4", Symbol: "ETH", TargetCurrency: "USD"},
+	} {
+		b.Publish(context.Background(), tr)
+	}
+
+	for _, tc := range []struct {
+		name string
+		l    domain.TradeStream
+		want []string
+	}{{"jpy", jpy, []string{"1", "2"}}, {"btc", btc, []string{"1", "3"}}} {
+		for _, id := range tc.want {
+			if got := <-tc.l.Trades(); got.ID != id {
+				t.Errorf("%s: expected trade %s, got %s", tc.name, id, got.ID)
+			}
+		}
+		if n := len(tc.l.Trades()); n != 0 {
+			t.Errorf("%s: expected no more trades, got %d", tc.name, n)
+		}
+	}
+}
+
+func TestTradeBroadcaster_DropsSlowListenerOnly(t *testing.T) {
+	b := NewTradeBroadcaster(WithClientBuffer(2))
+	slow := b.Listen(pattern(t, "market.#"))
+	fast := b.Listen(pattern(t, "market.#"))
+
+	for i := 0; i < 3; i++ {
+		b.Publish(context.Background(), domain.Trade{ID: "t", Symbol: "BTC", TargetCurrency: "USD"})
+		<-fast.Trades()
+	}
+
+	n := 0
+	for range slow.Trades() {
+		n++
+	}
+	if n != 2 || !errors.Is(slow.Err(), ErrSlowListener) {
+		t.Errorf("expected the slow listener dropped after 2 buffered trades, got %d trades and %v", n, slow.Err())
+	}
+	if b.Listeners() != 1 {
+		t.Errorf("expected the fast listener to remain, got %d listeners", b.Listeners())
+	}
+}
+
+func TestTradeBroadcaster_CloseEndsListeners(t *testing.T) {
+	b := NewTradeBroadcaster()
+	own := b.Listen(pattern(t, "market.#"))
+	other := b.Listen(pattern(t, "market.#"))
+
+	own.Close()
+	own.Close()
+	if _, ok := <-own.Trades(); ok || own.Err() != nil {
+		t.Errorf("expected a closed listener without error, got %v", own.Err())
+	}
+
+	b.Close()
+	if _, ok := <-other.Trades(); ok || !errors.Is(other.Err(), ErrBroadcastClosed) {
+		t.Errorf("expected ErrBroadcastClosed, got %v", other.Err())
+	}
+	late := b.Listen(pattern(t, "market.#"))
+	if _, ok := <-late.Trades(); ok || !errors.Is(late.Err(), ErrBroadcastClosed) {
+		t.Errorf("expected a listener after Close to end at once, got %v", late.Err())
+	}
+}
@@ -0,0 +1,280 @@
+package usecase
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// DefaultCandleIntervals are the bar sizes built unless WithIntervals is given.
+var DefaultCandleIntervals = []time.Duration{time.Second, time.Minute, 5 * time.Minute}
+
+// defaultAllowedLateness is how long a bar stays open after its end to
+// absorb trades that arrive out of order.
+const defaultAllowedLateness = 2 * time.Second
+
+// CandleAggregator builds OHLCV candles per symbol and target currency from
+// observed trades and publishes each bar once it is closed.
+//
+// Bars are assigned by trade timestamp, not arrival time. A bar closes when
+// the watermark passes its end; the watermark trails the newest trade
+// timestamp seen by the allowed lateness and keeps moving with the wall
+// clock while no trades arrive. Trades for a bar that was already closed
+// are dropped.
+type CandleAggregator struct {
+	pub       domain.CandlePublisher
+	intervals []time.Duration
+	lateness  time.Duration
+	now       func() time.Time
+
+	mu        sync.Mutex
+	bars      map[barKey]*bar
+	closed    []domain.Candle
+	watermark time.Time // bars ending at or before it are closed
+	newest    time.Time // newest trade timestamp observed
+	arrival   time.Time // wall-clock time newest was observed
+	ready     chan struct{}
+}
+
+// AggregatorOption configures a CandleAggregator.
+type AggregatorOption func(*CandleAggregator)
+
+// WithIntervals sets the bar sizes to build.
+func WithIntervals(intervals ...time.Duration) AggregatorOption {
+	return func(a *CandleAggregator) {
+		a.intervals = intervals
+	}
+}
+
+// WithAllowedLateness sets how long after its end a bar still accepts
+// out-of-order trades.
+func WithAllowedLateness(d time.Duration) AggregatorOption {
+	return func(a *CandleAggregator) {
+		a.lateness = d
+	}
+}
+
+// NewCandleAggregator creates a new CandleAggregator.
+func NewCandleAggregator(pub domain.CandlePublisher, opts ...AggregatorOption) *CandleAggregator {
+	a := &CandleAggregator{
+		pub:       pub,
+		intervals: DefaultCandleIntervals,
+		lateness:  defaultAllowedLateness,
+		now:       time.Now,
+		bars:      make(map[barKey]*bar),
+		ready:     make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+type barKey struct {
+	symbol   string
+	target   string
+	interval time.Duration
+	start    int64 // unix nanoseconds
+}
+
+// bar is a candle under construction. first and last are the timestamps of
+// the trades that set Open and Close, so that out-of-order trades land in
+// the right place.
+type bar struct {
+	candle      domain.Candle
+	first, last time.Time
+}
+
+// Observe adds a trade to its bars. It is meant to be used as a
+// TradeObserver handler and never fails: late trades are logged and dropped
+// rather than redelivered.
+func (a *CandleAggregator) Observe(trade domain.Trade) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ts := trade.Timestamp
+	if ts.IsZero() {
+		ts = a.now()
+	}
+
+	for _, interval := range a.intervals {
+		start := ts.Truncate(interval)
+		end := start.Add(interval)
+		if !end.After(a.watermark) {
+			log.Printf("Dropping late trade %s for %s %s bar at %s", trade.ID, trade.Symbol, domain.IntervalName(interval), start.UTC().Format(time.RFC3339))
+			continue
+		}
+
+		key := barKey{symbol: trade.Symbol, target: trade.TargetCurrency, interval: interval, start: start.UnixNano()}
+		b, ok := a.bars[key]
+		if !ok {
+			b = &bar{
+				candle: domain.Candle{
+					Symbol:         trade.Symbol,
+					TargetCurrency: trade.TargetCurrency,
+					Interval:       domain.IntervalName(interval),
+					Start:          start.UTC(),
+					End:            end.UTC(),
+					Open:           trade.Price,
+					High:           trade.Price,
+					Low:            trade.Price,
+					Close:          trade.Price,
+				},
+				first: ts,
+				last:  ts,
+			}
+			a.bars[key] = b
+		}
+		b.add(trade.Price, trade.Amount, ts)
+	}
+
+	if ts.After(a.newest) {
+		a.newest = ts
+		a.arrival = a.now()
+		a.advance(ts.Add(-a.lateness))
+	}
+	return nil
+}
+
+func (b *bar) add(price, amount float64, ts time.Time) {
+	c := &b.candle
+	if price > c.High {
+		c.High = price
+	}
+	if price < c.Low {
+		c.Low = price
+	}
+	if ts.Before(b.first) {
+		b.first = ts
+		c.Open = price
+	}
+	if !ts.Before(b.last) {
+		b.last = ts
+		c.Close = price
+	}
+	c.Volume += amount
+	c.Trades++
+}
+
+// advance moves the watermark forward and closes the bars it passed.
+// Callers must hold a.mu.
+func (a *CandleAggregator) advance(watermark time.Time) {
+	if !watermark.After(a.watermark) {
+		return
+	}
+	a.watermark = watermark
+
+	n := len(a.closed)
+	for key, b := range a.bars {
+		if !b.candle.End.After(watermark) {
+			a.closed = append(a.closed, b.candle)
+			delete(a.bars, key)
+		}
+	}
+	if len(a.closed) == n {
+		return
+	}
+	sortCandles(a.closed[n:])
+	select {
+	case a.ready <- struct{}{}:
+	default:
+	}
+}
+
+// tick advances the watermark by the wall-clock time elapsed since the
+// newest trade arrived, so bars close even when the market is quiet.
+func (a *CandleAggregator) tick() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.arrival.IsZero() {
+		return
+	}
+	idle := a.now().Sub(a.arrival)
+	a.advance(a.newest.Add(idle - a.lateness))
+}
+
+// Run publishes closed candles until ctx is done or publishing fails.
+func (a *CandleAggregator) Run(ctx context.Context) error {
+	ticker := time.NewTicker(a.tickInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			a.tick()
+		case <-a.ready:
+		}
+		if err := a.publishClosed(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// Flush closes every open bar and publishes it. Call it on shutdown, after
+// the trade subscription has stopped.
+func (a *CandleAggregator) Flush(ctx context.Context) error {
+	a.mu.Lock()
+	var last time.Time
+	for _, b := range a.bars {
+		if b.candle.End.After(last) {
+			last = b.candle.End
+		}
+	}
+	a.advance(last)
+	a.mu.Unlock()
+
+	return a.publishClosed(ctx)
+}
+
+// publishClosed publishes the closed candles in order. Candles that could
+// not be published are kept for the next attempt.
+func (a *CandleAggregator) publishClosed(ctx context.Context) error {
+	a.mu.Lock()
+	candles := a.closed
+	a.closed = nil
+	a.mu.Unlock()
+
+	for i, c := range candles {
+		if err := a.pub.PublishCandle(ctx, c); err != nil {
+			a.mu.Lock()
+			a.closed = append(candles[i:], a.closed...)
+			a.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// tickInterval is how often Run checks for bars to close on a quiet market.
+func (a *CandleAggregator) tickInterval() time.Duration {
+	d := time.Second
+	for _, interval := range a.intervals {
+		if interval < d {
+			d = interval
+		}
+	}
+	return d / 4
+}
+
+// sortCandles orders candles by end time, then by market and interval.
+func sortCandles(candles []domain.Candle) {
+	sort.Slice(candles, func(i, j int) bool {
+		a, b := candles[i], candles[j]
+		if !a.End.Equal(b.End) {
+			return a.End.Before(b.End)
+		}
+		if a.Symbol != b.Symbol {
+			return a.Symbol < b.Symbol
+		}
+		if a.TargetCurrency != b.TargetCurrency {
+			return a.TargetCurrency < b.TargetCurrency
+		}
+		return a.Start.After(b.Start) // shorter interval first
+	})
+}
@@ -0,0 +1,211 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+type candleRecorder struct {
+	mu      sync.Mutex
+	candles []domain.Candle
+	err     error
+}
+
+func (r *candleRecorder) PublishCandle(ctx context.Context, c domain.Candle) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.candles = append(r.candles, c)
+	return nil
+}
+
+func (r *candleRecorder) published() []domain.Candle {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]domain.Candle(nil), r.candles...)
+}
+
+var epoch = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func tradeAt(sec, price, amount float64) domain.Trade {
+	return domain.Trade{
+		ID:             "t",
+		Symbol:         "BTC",
+		TargetCurrency: "USD",
+		Price:          price,
+		Amount:         amount,
+		Timestamp:      epoch.Add(time.Duration(sec * float64(time.Second))),
+	}
+}
+
+func TestCandleAggregator_BuildsOHLCVFromOutOfOrderTrades(t *testing.T) {
+	rec := &candleRecorder{}
+	agg := NewCandleAggregator(rec, WithIntervals(time.Minute), WithAllowedLateness(5*time.Second))
+	agg.now = func() time.Time { return epoch }
+
+	// Arrival order differs from timestamp order.
+	for _, tr := range []domain.Trade{
+		tradeAt(10, 101, 1),
+		tradeAt(2, 100, 2), // earliest, so it opens the bar
+		tradeAt(30, 105, 1),
+		tradeAt(50, 99, 1),
+		tradeAt(40, 102, 3), // not the latest, so it does not close the bar
+	} {
+		agg.Observe(tr)
+	}
+	// A trade in the next bar moves the watermark past the first one.
+	agg.Observe(tradeAt(66, 110, 1))
+	if err := agg.publishClosed(context.Background()); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	got := rec.published()
+	if len(got) != 1 {
+		t.Fatalf("expected 1 closed candle, got %d: %+v", len(got), got)
+	}
+	want := domain.Candle{
+		Symbol:         "BTC",
+		TargetCurrency: "USD",
+		Interval:       "1m",
+		Start:          epoch,
+		End:            epoch.Add(time.Minute),
+		Open:           100,
+		High:           105,
+		Low:            99,
+		Close:          99,
+		Volume:         8,
+		Trades:         5,
+	}
+	if got[0] != want {
+		t.Errorf("expected %+v, got %+v", want, got[0])
+	}
+}
+
+func TestCandleAggregator_AcceptsLateTradesWithinLateness(t *testing.T) {
+	rec := &candleRecorder{}
+	agg := NewCandleAggregator(rec, WithIntervals(time.Second), WithAllowedLateness(500*time.Millisecond))
+	agg.now = func() time.Time { return epoch }
+
+	agg.Observe(tradeAt(0.5, 100, 1))
+	agg.Observe(tradeAt(1.2, 101, 1)) // watermark at 0.7s, bar [0,1) still open
+	agg.Observe(tradeAt(0.9, 90, 1))  // late but within lateness
+	agg.Observe(tradeAt(1.6, 102, 1)) // watermark at 1.1s, bar [0,1) closes
+	agg.Observe(tradeAt(0.95, 80, 1)) // too late, dropped
+	agg.publishClosed(context.Background())
+
+	got := rec.published()
+	if len(got) != 1 {
+		t.Fatalf("expected 1 closed candle, got %d", len(got))
+	}
+	if got[0].Trades != 2 || got[0].Low != 90 || got[0].Close != 90 {
+		t.Errorf("expected the late trade to be merged and the dropped one ignored, got %+v", got[0])
+	}
+}
+
+func TestCandleAggregator_BuildsEveryInterval(t *testing.T) {
+	rec := &candleRecorder{}
+	agg := NewCandleAggregator(rec, WithAllowedLateness(0))
+	agg.now = func() time.Time { return epoch }
+
+	agg.Observe(tradeAt(0, 100, 1))
+	agg.Observe(domain.Trade{Symbol: "ETH", TargetCurrency: "JPY", Price: 5, Amount: 1, Timestamp: epoch})
+	if err := agg.Flush(context.Background()); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+
+	var keys []string
+	for _, c := range rec.published() {
+		key, err := domain.CandleRoutingKey(c)
+		if err != nil {
+			t.Fatalf("invalid candle: %v", err)
+		}
+		keys = append(keys, key.String())
+	}
+	want := []string{
+		"candles.btc.usd.1s", "candles.eth.jpy.1s",
+		"candles.btc.usd.1m", "candles.eth.jpy.1m",
+		"candles.btc.usd.5m", "candles.eth.jpy.5m",
+	}
+	if len(keys) != len(want) {
+		t.Fatalf("expected %v, got %v", want, keys)
+	}
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, keys)
+		}
+	}
+}
+
+func TestCandleAggregator_ClosesBarsOnQuietMarket(t *testing.T) {
+	rec := &candleRecorder{}
+	agg := NewCandleAggregator(rec, WithIntervals(time.Second), WithAllowedLateness(time.Second))
+	now := epoch
+	agg.now = func() time.Time { return now }
+
+	agg.Observe(tradeAt(0.1, 100, 1))
+	agg.tick()
+	agg.publishClosed(context.Background())
+	if got := len(rec.published()); got != 0 {
+		t.Fatalf("expected the bar to stay open, got %d candles", got)
+	}
+
+	now = epoch.Add(2 * time.Second)
+	agg.tick()
+	agg.publishClosed(context.Background())
+	if got := len(rec.published()); got != 1 {
+		t.Fatalf("expected the bar to close without new trades, got %d candles", got)
+	}
+}
+
+func TestCandleAggregator_KeepsCandlesWhenPublishFails(t *testing.T) {
+	rec := &candleRecorder{err: errors.New("broker down")}
+	agg := NewCandleAggregator(rec, WithIntervals(time.Second))
+	agg.now = func() time.Time { return epoch }
+
+	agg.Observe(tradeAt(0, 100, 1))
+	if err := agg.Flush(context.Background()); err == nil {
+		t.Fatal("expected publish error")
+	}
+
+	rec.mu.Lock()
+	rec.err = nil
+	rec.mu.Unlock()
+	if err := agg.publishClosed(context.Background()); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	if got := len(rec.published()); got != 1 {
+		t.Errorf("expected the candle to be retried, got %d", got)
+	}
+}
+
+func TestCandleAggregator_RunPublishesClosedCandles(t *testing.T) {
+	rec := &candleRecorder{}
+	agg := NewCandleAggregator(rec, WithIntervals(20*time.Millisecond), WithAllowedLateness(0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- agg.Run(ctx) }()
+
+	agg.Observe(domain.Trade{Symbol: "BTC", TargetCurrency: "USD", Price: 1, Amount: 1, Timestamp: time.Now()})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(rec.published()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no candle published")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
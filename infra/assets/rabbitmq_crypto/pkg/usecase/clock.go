@@ -0,0 +1,18 @@
+package usecase
+
+import "time"
+
+// Clock tells the time and waits for it to pass. Simulations and replays
+// take one so that tests can run them without sleeping.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SystemClock is the wall clock.
+var SystemClock Clock = systemClock{}
@@ -0,0 +1,153 @@
+package usecase
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// MarketModel produces the trades of a simulated market.
+type MarketModel interface {
+	// Next advances the market by elapsed and returns the next trade. The
+	// simulator fills in its ID and Timestamp.
+	Next(rng *rand.Rand, elapsed time.Duration) domain.Trade
+}
+
+// Asset describes a simulated crypto asset. Prices follow a geometric
+// Brownian motion in USD; trade sizes are log-normally distributed.
+type Asset struct {
+	Symbol string
+	// Price is the initial price in USD.
+	Price float64
+	// Drift and Volatility are annualized, e.g. 0.6 for 60% volatility.
+	Drift      float64
+	Volatility float64
+	// MedianSize is the median trade amount; SizeSigma is the standard
+	// deviation of its logarithm.
+	MedianSize float64
+	SizeSigma  float64
+}
+
+// Currency describes a quote currency by its exchange rate to USD, which
+// follows a geometric Brownian motion with the given annualized volatility.
+type Currency struct {
+	Code       string
+	PerUSD     float64
+	Volatility float64
+}
+
+var (
+	// DefaultAssets are the assets traded by NewGBMMarket unless others are given.
+	DefaultAssets = []Asset{
+		{Symbol: "BTC", Price: 60000, Drift: 0.05, Volatility: 0.6, MedianSize: 0.05, SizeSigma: 1.5},
+		{Symbol: "ETH", Price: 3000, Drift: 0.05, Volatility: 0.75, MedianSize: 0.8, SizeSigma: 1.3},
+		{Symbol: "SOL", Price: 150, Drift: 0.05, Volatility: 0.9, MedianSize: 10, SizeSigma: 1.2},
+		{Symbol: "ADA", Price: 0.45, Drift: 0, Volatility: 0.8, MedianSize: 1500, SizeSigma: 1.2},
+	}
+	// DefaultCurrencies are the quote currencies used by NewGBMMarket unless
+	// others are given.
+	DefaultCurrencies = []Currency{
+		{Code: "USD", PerUSD: 1},
+		{Code: "JPY", PerUSD: 150, Volatility: 0.1},
+		{Code: "EUR", PerUSD: 0.92, Volatility: 0.08},
+	}
+)
+
+// secondsPerYear converts annualized drift and volatility to a time step.
+const secondsPerYear = 365 * 24 * 60 * 60
+
+// GBMMarket simulates each asset's USD price and each currency's USD rate
+// as independent geometric Brownian motions. Quotes in other currencies are
+// derived from them, so cross rates are always consistent: the BTC/JPY price
+// divided by the BTC/USD price is the USD/JPY rate.
+//
+// A GBMMarket is not safe for concurrent use.
+type GBMMarket struct {
+	assets     []Asset
+	currencies []Currency
+	up         []bool // whether each asset's last move was upwards
+}
+
+// NewGBMMarket creates a market from the given assets and currencies,
+// falling back to DefaultAssets and DefaultCurrencies when nil.
+func NewGBMMarket(assets []Asset, currencies []Currency) *GBMMarket {
+	if assets == nil {
+		assets = DefaultAssets
+	}
+	if currencies == nil {
+		currencies = DefaultCurrencies
+	}
+	return &GBMMarket{
+		assets:     append([]Asset(nil), assets...),
+		currencies: append([]Currency(nil), currencies...),
+		up:         make([]bool, len(assets)),
+	}
+}
+
+// Next advances every price and rate by elapsed and returns a trade in a
+// random asset and currency at the current quote. Buys follow upward moves
+// and sells downward ones.
+func (m *GBMMarket) Next(rng *rand.Rand, elapsed time.Duration) domain.Trade {
+	dt := elapsed.Seconds() / secondsPerYear
+	for i := range m.assets {
+		a := &m.assets[i]
+		next := gbmStep(rng, a.Price, a.Drift, a.Volatility, dt)
+		m.up[i] = next >= a.Price
+		a.Price = next
+	}
+	for i := range m.currencies {
+		c := &m.currencies[i]
+		c.PerUSD = gbmStep(rng, c.PerUSD, 0, c.Volatility, dt)
+	}
+
+	i := rng.Intn(len(m.assets))
+	a := m.assets[i]
+	c := m.currencies[rng.Intn(len(m.currencies))]
+	side := domain.SideSell
+	if m.up[i] {
+		side = domain.SideBuy
+	}
+	return domain.Trade{
+		Symbol:         a.Symbol,
+		TargetCurrency: c.Code,
+		Price:          a.Price * c.PerUSD,
+		Amount:         a.MedianSize * math.Exp(a.SizeSigma*rng.NormFloat64()),
+		Side:           side,
+	}
+}
+
+// Quote returns the current price of symbol in currency.
+func (m *GBMMarket) Quote(symbol, currency string) (float64, bool) {
+	var usd, rate float64
+	for _, a := range m.assets {
+		if a.Symbol == symbol {
+			usd = a.Price
+		}
+	}
+	for _, c := range m.currencies {
+		if c.Code == currency {
+			rate = c.PerUSD
+		}
+	}
+	if usd == 0 || rate == 0 {
+		return 0, false
+	}
+	return usd * rate, true
+}
+
+// gbmStep advances price by dt years of a geometric Brownian motion.
+func gbmStep(rng *rand.Rand, price, drift, volatility, dt float64) float64 {
+	if dt <= 0 {
+		return price
+	}
+	z := rng.NormFloat64()
+	return price * math.Exp((drift-volatility*volatility/2)*dt+volatility*math.Sqrt(dt)*z)
+}
+
+// poissonWait returns an exponentially distributed delay with the given
+// mean, i.e. the gap between arrivals of a Poisson process.
+func poissonWait(rng *rand.Rand, mean time.Duration) time.Duration {
+	return time.Duration(rng.ExpFloat64() * float64(mean))
+}
@@ -0,0 +1,141 @@
+package usecase
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+func TestGBMMarket_CrossRatesAreConsistent(t *testing.T) {
+	m := NewGBMMarket(nil, nil)
+	rng := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 1000; i++ {
+		trade := m.Next(rng, time.Hour)
+
+		usd, _ := m.Quote(trade.Symbol, "USD")
+		jpy, _ := m.Quote(trade.Symbol, "JPY")
+		eur, _ := m.Quote(trade.Symbol, "EUR")
+		btcjpy, _ := m.Quote("BTC", "JPY")
+		btcusd, _ := m.Quote("BTC", "USD")
+		if got, want := jpy/usd, btcjpy/btcusd; math.Abs(got-want) > 1e-9*want {
+			t.Fatalf("%s/JPY implies USD/JPY %v, BTC implies %v", trade.Symbol, got, want)
+		}
+		quote, _ := m.Quote(trade.Symbol, trade.TargetCurrency)
+		if trade.Price != quote {
+			t.Fatalf("trade price %v differs from quote %v", trade.Price, quote)
+		}
+		if trade.Price <= 0 || eur <= 0 || trade.Amount <= 0 {
+			t.Fatalf("invalid trade %+v", trade)
+		}
+	}
+}
+
+func TestGBMMarket_PricesAreDistinctAndMoveSmoothly(t *testing.T) {
+	m := NewGBMMarket(nil, nil)
+	rng := rand.New(rand.NewSource(2))
+
+	prev := map[string]float64{}
+	for i := 0; i < 1000; i++ {
+		trade := m.Next(rng, 500*time.Millisecond)
+		if trade.TargetCurrency != "USD" {
+			continue
+		}
+		if p, ok := prev[trade.Symbol]; ok {
+			if change := math.Abs(trade.Price/p - 1); change > 0.01 {
+				t.Fatalf("%s jumped %.2f%% between trades", trade.Symbol, change*100)
+			}
+		}
+		prev[trade.Symbol] = trade.Price
+	}
+
+	btc, _ := m.Quote("BTC", "USD")
+	ada, _ := m.Quote("ADA", "USD")
+	if btc < 1000*ada {
+		t.Errorf("expected BTC (%v) to trade far above ADA (%v)", btc, ada)
+	}
+}
+
+func TestGBMMarket_FollowsDrift(t *testing.T) {
+	m := NewGBMMarket([]Asset{{Symbol: "X", Price: 100, Drift: 0.1, MedianSize: 1}}, []Currency{{Code: "USD", PerUSD: 1}})
+	rng := rand.New(rand.NewSource(3))
+
+	// Without volatility the price grows exactly with the drift.
+	for i := 0; i < 12; i++ {
+		m.Next(rng, secondsPerYear*time.Second/12)
+	}
+	got, _ := m.Quote("X", "USD")
+	if want := 100 * math.Exp(0.1); math.Abs(got-want) > 1e-6 {
+		t.Errorf("expected %v after one year, got %v", want, got)
+	}
+}
+
+func TestGBMMarket_TradeSizesAreLogNormal(t *testing.T) {
+	m := NewGBMMarket([]Asset{{Symbol: "X", Price: 1, MedianSize: 2, SizeSigma: 1}}, []Currency{{Code: "USD", PerUSD: 1}})
+	rng := rand.New(rand.NewSource(4))
+
+	const n = 20000
+	sizes := make([]float64, n)
+	var sumLog, sumSq float64
+	for i := range sizes {
+		sizes[i] = m.Next(rng, time.Second).Amount
+		l := math.Log(sizes[i])
+		sumLog += l
+		sumSq += l * l
+	}
+	sort.Float64s(sizes)
+
+	if median := sizes[n/2]; math.Abs(median-2) > 0.1 {
+		t.Errorf("expected median size near 2, got %v", median)
+	}
+	mean := sumLog / n
+	if sigma := math.Sqrt(sumSq/n - mean*mean); math.Abs(sigma-1) > 0.05 {
+		t.Errorf("expected log-size sigma near 1, got %v", sigma)
+	}
+}
+
+func TestPoissonWait_MeanMatchesInterval(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+
+	const n = 20000
+	var total time.Duration
+	for i := 0; i < n; i++ {
+		total += poissonWait(rng, 100*time.Millisecond)
+	}
+	if mean := total / n; mean < 95*time.Millisecond || mean > 105*time.Millisecond {
+		t.Errorf("expected mean wait near 100ms, got %v", mean)
+	}
+}
+
+type fixedModel struct {
+	calls int
+}
+
+func (f *fixedModel) Next(rng *rand.Rand, elapsed time.Duration) domain.Trade {
+	f.calls++
+	return domain.Trade{Symbol: "XRP", TargetCurrency: "USD", Price: 0.5, Amount: 10, Side: domain.SideBuy}
+}
+
+func TestMarketSimulator_UsesMarketModel(t *testing.T) {
+	mock := &mockPublisher{}
+	model := &fixedModel{}
+	sim := NewMarketSimulator(mock, WithMarketModel(model), WithPoissonArrivals())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_ = sim.Run(ctx, 5*time.Millisecond)
+
+	if len(mock.trades) == 0 || len(mock.trades) != model.calls {
+		t.Fatalf("expected one trade per model call, got %d trades and %d calls", len(mock.trades), model.calls)
+	}
+	for _, tr := range mock.trades {
+		if tr.Symbol != "XRP" || tr.ID == "" || tr.Timestamp.IsZero() {
+			t.Errorf("unexpected trade %+v", tr)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// MatchingEngine keeps an OrderBook per symbol and target currency and
+// publishes a trade for every fill, so that the trades downstream services
+// see come from matched orders rather than from a simulation.
+type MatchingEngine struct {
+	pub     domain.TradePublisher
+	clock   Clock
+	ids     IDGenerator
+	metrics domain.TradeMetrics
+	report  DeliveryReport
+
+	mu    sync.Mutex
+	books map[string]*lockedBook
+}
+
+// lockedBook serializes the orders of one pair, from matching to
+// publishing their trades, so that trades leave in the order they matched.
+type lockedBook struct {
+	mu   sync.Mutex
+	book *OrderBook
+}
+
+// EngineOption configures a MatchingEngine.
+type EngineOption func(*MatchingEngine)
+
+// WithEngineClock sets the clock trades are timestamped with. Defaults to
+// SystemClock.
+func WithEngineClock(c Clock) EngineOption {
+	return func(e *MatchingEngine) {
+		e.clock = c
+	}
+}
+
+// WithEngineIDGenerator sets how trade IDs are generated. Defaults to
+// random UUIDs.
+func WithEngineIDGenerator(ids IDGenerator) EngineOption {
+	return func(e *MatchingEngine) {
+		e.ids = ids
+	}
+}
+
+// WithEngineMetrics records the delivery outcome of every trade in m.
+func WithEngineMetrics(m domain.TradeMetrics) EngineOption {
+	return func(e *MatchingEngine) {
+		e.metrics = m
+	}
+}
+
+// WithEngineDeliveryReport registers fn to receive the delivery outcome of
+// each trade.
+func WithEngineDeliveryReport(fn DeliveryReport) EngineOption {
+	return func(e *MatchingEngine) {
+		e.report = fn
+	}
+}
+
+// NewMatchingEngine creates a MatchingEngine publishing trades to pub.
+func NewMatchingEngine(pub domain.TradePublisher, opts ...EngineOption) *MatchingEngine {
+	e := &MatchingEngine{
+		pub:   pub,
+		clock: SystemClock,
+		ids:   uuid.NewString,
+		books: make(map[string]*lockedBook),
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// Start sends the orders matching routingKey, e.g. orders.*.*, to their
+// books. The trades of an order are published before the next order of
+// the same symbol is handled.
+//
+// An order is matched once it is handled, even if publishing its trades
+// fails, so redelivering it would match it again: consume orders without
+// domain.WithManualAck.
+func (e *MatchingEngine) Start(ctx context.Context, sub domain.OrderSubscriber, routingKey string, opts ...domain.SubscribeOption) (domain.Subscription, error) {
+	// Orders still in flight when ctx ends are drained by Stop, so their
+	// trades must still go out.
+	publishCtx := context.WithoutCancel(ctx)
+	return sub.SubscribeOrders(ctx, routingKey, func(order domain.Order) error {
+		return e.Submit(publishCtx, order)
+	}, opts...)
+}
+
+// Submit matches order against the book of its pair and publishes a trade
+// for every fill, taking the maker's price and the taker's side. Like a
+// MarketSimulator it only reports trades the broker rejects or cannot
+// route; it returns an error for an order the book rejects and for any
+// other publish error.
+func (e *MatchingEngine) Submit(ctx context.Context, order domain.Order) error {
+	if err := order.Validate(); err != nil {
+		return err
+	}
+	lb := e.book(order.Symbol, order.TargetCurrency)
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	fills, err := lb.book.Submit(order)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, f := range fills {
+		trade := domain.Trade{
+			ID:             e.ids(),
+			Symbol:         lb.book.Symbol(),
+			TargetCurrency: lb.book.TargetCurrency(),
+			Price:          f.Price,
+			Amount:         f.Amount,
+			Timestamp:      e.clock.Now(),
+			Side:           f.Side,
+		}
+		err := e.pub.Publish(ctx, trade)
+		if e.metrics != nil {
+			e.metrics.Published(trade, err)
+		}
+		if e.report != nil {
+			e.report(trade, err)
+		}
+		if err != nil && !errors.Is(err, domain.ErrTradeUnroutable) && !errors.Is(err, domain.ErrTradeNotConfirmed) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Depth returns up to n price levels of each side of the book of symbol in
+// target, best first.
+func (e *MatchingEngine) Depth(symbol, target string, n int) (bids, asks []domain.PriceLevel) {
+	lb := e.book(symbol, target)
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.book.Depth(n)
+}
+
+// book returns the book of symbol in target, creating it on first use.
+func (e *MatchingEngine) book(symbol, target string) *lockedBook {
+	key := strings.ToUpper(symbol) + "/" + strings.ToUpper(target)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	lb, ok := e.books[key]
+	if !ok {
+		lb = &lockedBook{book: NewOrderBook(symbol, target)}
+		e.books[key] = lb
+	}
+	return lb
+}
@@ -0,0 +1,139 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// counterIDs returns t1, t2, ...
+func counterIDs() IDGenerator {
+	n := 0
+	return func() string {
+		n++
+		return fmt.Sprintf("t%d", n)
+	}
+}
+
+func TestMatchingEngine_PublishesTrades(t *testing.T) {
+	pub := &mockPublisher{}
+	m := &recordingMetrics{}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	e := NewMatchingEngine(pub, WithEngineClock(&stepClock{now: start}), WithEngineIDGenerator(counterIDs()), WithEngineMetrics(m))
+
+	ctx := context.Background()
+	eth := limit("e1", domain.SideSell, 3000, 1)
+	eth.Symbol = "eth"
+	for _, o := range []domain.Order{
+		limit("a1", domain.SideSell, 100, 1),
+		limit("a2", domain.SideSell, 101, 1),
+		eth,
+		market("m1", domain.SideBuy, 1.5),
+	} {
+		if err := e.Submit(ctx, o); err != nil {
+			t.Fatalf("failed to submit %s: %v", o.ID, err)
+		}
+	}
+
+	want := []domain.Trade{
+		{ID: "t1", Symbol: "BTC", TargetCurrency: "USD", Price: 100, Amount: 1, Timestamp: start, Side: domain.SideBuy},
+		{ID: "t2", Symbol: "BTC", TargetCurrency: "USD", Price: 101, Amount: 0.5, Timestamp: start, Side: domain.SideBuy},
+	}
+	if len(pub.trades) != len(want) {
+		t.Fatalf("expected %d trades, got %+v", len(want), pub.trades)
+	}
+	for i := range want {
+		if pub.trades[i] != want[i] {
+			t.Errorf("trade %d: expected %+v, got %+v", i, want[i], pub.trades[i])
+		}
+	}
+	if len(m.published) != 2 {
+		t.Errorf("expected both trades to be recorded, got %v", m.published)
+	}
+
+	bids, asks := e.Depth("ETH", "USD", 5)
+	if len(bids) != 0 || len(asks) != 1 || asks[0].Price != 3000 {
+		t.Errorf("expected the ETH book to keep its ask, got bids %+v asks %+v", bids, asks)
+	}
+}
+
+func TestMatchingEngine_ReportsFailures(t *testing.T) {
+	pub := &failingPublisher{err: domain.ErrTradeUnroutable}
+	var reported []error
+	e := NewMatchingEngine(pub, WithEngineDeliveryReport(func(_ domain.Trade, err error) {
+		reported = append(reported, err)
+	}))
+	ctx := context.Background()
+
+	if err := e.Submit(ctx, market("m1", "", 1)); !errors.Is(err, domain.ErrInvalidOrder) {
+		t.Errorf("expected ErrInvalidOrder, got %v", err)
+	}
+	submitAll := func(orders ...domain.Order) error {
+		for _, o := range orders {
+			if err := e.Submit(ctx, o); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// An unroutable trade is only reported.
+	if err := submitAll(limit("a1", domain.SideSell, 100, 1), market("m1", domain.SideBuy, 1)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(reported) != 1 || !errors.Is(reported[0], domain.ErrTradeUnroutable) {
+		t.Errorf("expected the unroutable trade to be reported, got %v", reported)
+	}
+
+	// Any other failure is returned, though the order matched all the same.
+	boom := errors.New("boom")
+	pub.err = boom
+	if err := submitAll(limit("a2", domain.SideSell, 100, 1), market("m2", domain.SideBuy, 1)); !errors.Is(err, boom) {
+		t.Errorf("expected the publish error, got %v", err)
+	}
+	if _, asks := e.Depth("BTC", "USD", 0); len(asks) != 0 {
+		t.Errorf("expected the asks to be taken, got %+v", asks)
+	}
+}
+
+// mockOrderSubscriber keeps the handler of the last subscription.
+type mockOrderSubscriber struct {
+	routingKey string
+	handler    func(domain.Order) error
+}
+
+func (m *mockOrderSubscriber) SubscribeOrders(ctx context.Context, routingKey string, handler func(domain.Order) error, opts ...domain.SubscribeOption) (domain.Subscription, error) {
+	m.routingKey = routingKey
+	m.handler = handler
+	return &mockSubscription{}, nil
+}
+
+func TestMatchingEngine_Start(t *testing.T) {
+	pub := &mockPublisher{}
+	e := NewMatchingEngine(pub)
+	sub := &mockOrderSubscriber{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := e.Start(ctx, sub, "orders.*.*"); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	if sub.routingKey != "orders.*.*" {
+		t.Errorf("expected orders.*.*, got %s", sub.routingKey)
+	}
+
+	if err := sub.handler(limit("a1", domain.SideSell, 100, 1)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Orders drained after the context ends still publish their trades.
+	cancel()
+	if err := sub.handler(market("m1", domain.SideBuy, 1)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pub.trades) != 1 {
+		t.Errorf("expected one trade, got %+v", pub.trades)
+	}
+}
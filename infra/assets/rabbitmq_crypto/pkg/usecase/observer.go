@@ -8,15 +8,55 @@ import (
 
 // TradeObserver monitors trade events from a subscriber.
 type TradeObserver struct {
-	sub domain.TradeSubscriber
+	sub     domain.TradeSubscriber
+	metrics domain.TradeMetrics
+	clock   Clock
+}
+
+// ObserverOption configures a TradeObserver.
+type ObserverOption func(*TradeObserver)
+
+// WithObserverMetrics records every handled trade in m, with how long the
+// handler took and how far behind the market it started.
+func WithObserverMetrics(m domain.TradeMetrics) ObserverOption {
+	return func(o *TradeObserver) {
+		o.metrics = m
+	}
+}
+
+// WithObserverClock sets the clock handlers are timed with. Defaults to
+// SystemClock.
+func WithObserverClock(c Clock) ObserverOption {
+	return func(o *TradeObserver) {
+		o.clock = c
+	}
 }
 
 // NewTradeObserver creates a new TradeObserver.
-func NewTradeObserver(sub domain.TradeSubscriber) *TradeObserver {
-	return &TradeObserver{sub: sub}
+func NewTradeObserver(sub domain.TradeSubscriber, opts ...ObserverOption) *TradeObserver {
+	o := &TradeObserver{sub: sub, clock: SystemClock}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
 }
 
 // Start begins observing trades with the given routing key and handler.
-func (o *TradeObserver) Start(ctx context.Context, routingKey string, handler func(domain.Trade) error) error {
-	return o.sub.Subscribe(ctx, routingKey, handler)
+// Options such as domain.WithManualAck control delivery guarantees. Use the
+// returned Subscription to shut down without losing in-flight trades.
+func (o *TradeObserver) Start(ctx context.Context, routingKey string, handler func(domain.Trade) error, opts ...domain.SubscribeOption) (domain.Subscription, error) {
+	if o.metrics != nil {
+		handler = o.measure(handler)
+	}
+	return o.sub.Subscribe(ctx, routingKey, handler, opts...)
+}
+
+// measure wraps handler to record every trade it handles.
+func (o *TradeObserver) measure(handler func(domain.Trade) error) func(domain.Trade) error {
+	return func(trade domain.Trade) error {
+		start := o.clock.Now()
+		err := handler(trade)
+		o.metrics.Consumed(trade, start.Sub(trade.Timestamp), o.clock.Now().Sub(start), err)
+		return err
+	}
 }
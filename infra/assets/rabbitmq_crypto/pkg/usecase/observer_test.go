@@ -2,7 +2,10 @@ package usecase
 
 import (
 	"context"
+	"errors"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
 )
@@ -10,11 +13,28 @@ import (
 type mockSubscriber struct {
 	routingKey string
 	handler    func(domain.Trade) error
+	opts       domain.SubscribeOptions
+	sub        *mockSubscription
 }
 
-func (m *mockSubscriber) Subscribe(ctx context.Context, routingKey string, handler func(domain.Trade) error) error {
+func (m *mockSubscriber) Subscribe(ctx context.Context, routingKey string, handler func(domain.Trade) error, opts ...domain.SubscribeOption) (domain.Subscription, error) {
 	m.routingKey = routingKey
 	m.handler = handler
+	m.opts = domain.NewSubscribeOptions(opts...)
+	m.sub = &mockSubscription{}
+	return m.sub, nil
+}
+
+type mockSubscription struct {
+	stopped bool
+}
+
+func (m *mockSubscription) Stop(ctx context.Context) error {
+	m.stopped = true
+	return nil
+}
+
+func (m *mockSubscription) Wait() error {
 	return nil
 }
 
@@ -24,8 +44,8 @@ func TestTradeObserver_Start(t *testing.T) {
 
 	ctx := context.Background()
 	key := "market.btc.#"
-	
-	err := obs.Start(ctx, key, func(t domain.Trade) error { return nil })
+
+	sub, err := obs.Start(ctx, key, func(t domain.Trade) error { return nil })
 	if err != nil {
 		t.Fatalf("failed to start observer: %v", err)
 	}
@@ -37,4 +57,97 @@ func TestTradeObserver_Start(t *testing.T) {
 	if mock.handler == nil {
 		t.Error("expected handler to be set")
 	}
+
+	if mock.opts.ManualAck {
+		t.Error("expected auto-ack by default")
+	}
+
+	if err := sub.Stop(ctx); err != nil {
+		t.Fatalf("failed to stop observer: %v", err)
+	}
+	if !mock.sub.stopped {
+		t.Error("expected Stop to reach the subscription")
+	}
+}
+
+func TestTradeObserver_StartWithOptions(t *testing.T) {
+	mock := &mockSubscriber{}
+	obs := NewTradeObserver(mock)
+
+	_, err := obs.Start(context.Background(), "market.btc.#", func(t domain.Trade) error { return nil },
+		domain.WithManualAck(3), domain.WithDeadLetter("dlx"), domain.WithWorkers(4), domain.WithPrefetch(32))
+	if err != nil {
+		t.Fatalf("failed to start observer: %v", err)
+	}
+
+	want := domain.SubscribeOptions{ManualAck: true, MaxRetries: 3, DeadLetterExchange: "dlx", Workers: 4, Prefetch: 32}
+	if mock.opts != want {
+		t.Errorf("expected options %+v, got %+v", want, mock.opts)
+	}
+}
+
+// recordingMetrics keeps what it is told.
+type recordingMetrics struct {
+	mu        sync.Mutex
+	published map[string]error
+	consumed  []consumed
+}
+
+type consumed struct {
+	trade     domain.Trade
+	lag, took time.Duration
+	err       error
+}
+
+func (m *recordingMetrics) Published(trade domain.Trade, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.published == nil {
+		m.published = make(map[string]error)
+	}
+	m.published[trade.ID] = err
+}
+
+func (m *recordingMetrics) Consumed(trade domain.Trade, lag, took time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.consumed = append(m.consumed, consumed{trade, lag, took, err})
+}
+
+// tickClock advances by a second whenever it is read.
+type tickClock struct {
+	now time.Time
+}
+
+func (c *tickClock) Now() time.Time {
+	c.now = c.now.Add(time.Second)
+	return c.now
+}
+
+func (c *tickClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func TestTradeObserver_RecordsMetrics(t *testing.T) {
+	mock := &mockSubscriber{}
+	m := &recordingMetrics{}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	obs := NewTradeObserver(mock, WithObserverMetrics(m), WithObserverClock(&tickClock{now: start}))
+
+	boom := errors.New("boom")
+	if _, err := obs.Start(context.Background(), "market.#", func(domain.Trade) error { return boom }); err != nil {
+		t.Fatalf("failed to start observer: %v", err)
+	}
+	trade := domain.Trade{ID: "t1", Symbol: "BTC", TargetCurrency: "USD", Timestamp: start.Add(-2 * time.Second)}
+	if err := mock.handler(trade); !errors.Is(err, boom) {
+		t.Fatalf("expected the handler error, got %v", err)
+	}
+
+	if len(m.consumed) != 1 {
+		t.Fatalf("expected 1 consumed trade, got %d", len(m.consumed))
+	}
+	got := m.consumed[0]
+	if got.trade.ID != "t1" || got.lag != 3*time.Second || got.took != time.Second || !errors.Is(got.err, boom) {
+		t.Errorf("unexpected record %+v", got)
+	}
 }
@@ -0,0 +1,203 @@
+package usecase
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// dust is the amount below which an order counts as filled, so that
+// rounding errors do not leave tiny remainders in the book.
+const dust = 1e-9
+
+// Fill is one match between an incoming order, the taker, and an order
+// resting in the book, the maker. It trades at the maker's price.
+type Fill struct {
+	TakerID string
+	MakerID string
+	// Side is the taker's side: buy if the taker lifted an ask.
+	Side   string
+	Price  float64
+	Amount float64
+}
+
+// OrderBook is the limit order book of one symbol and target currency. It
+// matches by price-time priority: an incoming order fills against the best
+// price on the other side first and, within a price, against the order that
+// has rested longest. Orders may fill partially; a limit order rests with
+// whatever it could not fill at its price or better, while a market order
+// drops it.
+//
+// An OrderBook is not safe for concurrent use.
+type OrderBook struct {
+	symbol string
+	target string
+	bids   []*priceLevel // best (highest) first
+	asks   []*priceLevel // best (lowest) first
+	orders map[string]*restingOrder
+}
+
+type priceLevel struct {
+	price  float64
+	orders []*restingOrder // oldest first
+}
+
+type restingOrder struct {
+	id        string
+	side      string
+	price     float64
+	remaining float64
+}
+
+// NewOrderBook creates an empty book for symbol in target.
+func NewOrderBook(symbol, target string) *OrderBook {
+	return &OrderBook{
+		symbol: strings.ToUpper(symbol),
+		target: strings.ToUpper(target),
+		orders: make(map[string]*restingOrder),
+	}
+}
+
+// Symbol returns the symbol traded in the book.
+func (b *OrderBook) Symbol() string { return b.symbol }
+
+// TargetCurrency returns the currency prices are quoted in.
+func (b *OrderBook) TargetCurrency() string { return b.target }
+
+// Submit applies order to the book and returns the fills it caused, in
+// the order they happened. A cancel returns no fills; cancelling an order
+// that is not resting, e.g. because it filled in the meantime, does
+// nothing.
+func (b *OrderBook) Submit(order domain.Order) ([]Fill, error) {
+	if err := order.Validate(); err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(order.Symbol, b.symbol) || !strings.EqualFold(order.TargetCurrency, b.target) {
+		return nil, fmt.Errorf("%w %q: %s/%s sent to the %s/%s book", domain.ErrInvalidOrder, order.ID, order.Symbol, order.TargetCurrency, b.symbol, b.target)
+	}
+
+	switch order.Type {
+	case domain.OrderCancel:
+		b.cancel(order.ID)
+		return nil, nil
+	case domain.OrderMarket:
+		fills, _ := b.match(order, math.NaN())
+		return fills, nil
+	}
+
+	if _, ok := b.orders[order.ID]; ok {
+		return nil, fmt.Errorf("%w: %q", domain.ErrDuplicateOrder, order.ID)
+	}
+	fills, remaining := b.match(order, order.Price)
+	if remaining > dust {
+		b.rest(&restingOrder{id: order.ID, side: order.Side, price: order.Price, remaining: remaining})
+	}
+	return fills, nil
+}
+
+// Depth returns up to n price levels of each side, best first. n <= 0
+// returns every level.
+func (b *OrderBook) Depth(n int) (bids, asks []domain.PriceLevel) {
+	return depth(b.bids, n), depth(b.asks, n)
+}
+
+func depth(levels []*priceLevel, n int) []domain.PriceLevel {
+	if n <= 0 || n > len(levels) {
+		n = len(levels)
+	}
+	out := make([]domain.PriceLevel, n)
+	for i, l := range levels[:n] {
+		out[i] = domain.PriceLevel{Price: l.price, Orders: len(l.orders)}
+		for _, o := range l.orders {
+			out[i].Amount += o.remaining
+		}
+	}
+	return out
+}
+
+// match fills order against the other side of the book while its price is
+// within limit, NaN meaning any price, and returns the fills and the
+// amount left over.
+func (b *OrderBook) match(order domain.Order, limit float64) ([]Fill, float64) {
+	opposite := &b.asks
+	crosses := func(price float64) bool { return price <= limit }
+	if order.Side == domain.SideSell {
+		opposite = &b.bids
+		crosses = func(price float64) bool { return price >= limit }
+	}
+
+	var fills []Fill
+	remaining := order.Amount
+	for remaining > dust && len(*opposite) > 0 {
+		best := (*opposite)[0]
+		if !math.IsNaN(limit) && !crosses(best.price) {
+			break
+		}
+		for remaining > dust && len(best.orders) > 0 {
+			maker := best.orders[0]
+			amount := min(remaining, maker.remaining)
+			fills = append(fills, Fill{
+				TakerID: order.ID,
+				MakerID: maker.id,
+				Side:    order.Side,
+				Price:   best.price,
+				Amount:  amount,
+			})
+			remaining -= amount
+			maker.remaining -= amount
+			if maker.remaining <= dust {
+				best.orders = best.orders[1:]
+				delete(b.orders, maker.id)
+			}
+		}
+		if len(best.orders) == 0 {
+			*opposite = (*opposite)[1:]
+		}
+	}
+	return fills, remaining
+}
+
+// rest adds o behind the orders already at its price.
+func (b *OrderBook) rest(o *restingOrder) {
+	levels := &b.asks
+	better := func(price float64) bool { return price < o.price }
+	if o.side == domain.SideBuy {
+		levels = &b.bids
+		better = func(price float64) bool { return price > o.price }
+	}
+
+	i := sort.Search(len(*levels), func(i int) bool { return !better((*levels)[i].price) })
+	if i == len(*levels) || (*levels)[i].price != o.price {
+		*levels = slices.Insert(*levels, i, &priceLevel{price: o.price})
+	}
+	(*levels)[i].orders = append((*levels)[i].orders, o)
+	b.orders[o.id] = o
+}
+
+// cancel removes the resting order with the given ID, if any.
+func (b *OrderBook) cancel(id string) {
+	o, ok := b.orders[id]
+	if !ok {
+		return
+	}
+	delete(b.orders, id)
+
+	levels := &b.asks
+	if o.side == domain.SideBuy {
+		levels = &b.bids
+	}
+	for i, l := range *levels {
+		if l.price != o.price {
+			continue
+		}
+		l.orders = slices.DeleteFunc(l.orders, func(r *restingOrder) bool { return r == o })
+		if len(l.orders) == 0 {
+			*levels = slices.Delete(*levels, i, i+1)
+		}
+		return
+	}
+}
@@ -0,0 +1,146 @@
+package usecase
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+func limit(id, side string, price, amount float64) domain.Order {
+	return domain.Order{ID: id, Symbol: "BTC", TargetCurrency: "USD", Type: domain.OrderLimit, Side: side, Price: price, Amount: amount}
+}
+
+func market(id, side string, amount float64) domain.Order {
+	return domain.Order{ID: id, Symbol: "BTC", TargetCurrency: "USD", Type: domain.OrderMarket, Side: side, Amount: amount}
+}
+
+func cancel(id string) domain.Order {
+	return domain.Order{ID: id, Symbol: "BTC", TargetCurrency: "USD", Type: domain.OrderCancel}
+}
+
+// submit applies orders to b, failing on any error, and returns the fills
+// of the last one.
+func submit(t *testing.T, b *OrderBook, orders ...domain.Order) []Fill {
+	t.Helper()
+	var fills []Fill
+	for _, o := range orders {
+		var err error
+		if fills, err = b.Submit(o); err != nil {
+			t.Fatalf("failed to submit %s: %v", o.ID, err)
+		}
+	}
+	return fills
+}
+
+func TestOrderBook_PriceTimePriority(t *testing.T) {
+	b := NewOrderBook("btc", "usd")
+	submit(t, b,
+		limit("a1", domain.SideSell, 101, 1),
+		limit("a2", domain.SideSell, 100, 1),
+		limit("a3", domain.SideSell, 100, 1),
+		limit("b1", domain.SideBuy, 99, 1),
+	)
+
+	// The best price goes first and, within it, the oldest order.
+	fills := submit(t, b, limit("t1", domain.SideBuy, 101, 2.5))
+	want := []Fill{
+		{TakerID: "t1", MakerID: "a2", Side: domain.SideBuy, Price: 100, Amount: 1},
+		{TakerID: "t1", MakerID: "a3", Side: domain.SideBuy, Price: 100, Amount: 1},
+		{TakerID: "t1", MakerID: "a1", Side: domain.SideBuy, Price: 101, Amount: 0.5},
+	}
+	if !reflect.DeepEqual(fills, want) {
+		t.Errorf("expected %+v, got %+v", want, fills)
+	}
+
+	bids, asks := b.Depth(0)
+	if want := []domain.PriceLevel{{Price: 99, Amount: 1, Orders: 1}}; !reflect.DeepEqual(bids, want) {
+		t.Errorf("expected bids %+v, got %+v", want, bids)
+	}
+	if want := []domain.PriceLevel{{Price: 101, Amount: 0.5, Orders: 1}}; !reflect.DeepEqual(asks, want) {
+		t.Errorf("expected asks %+v, got %+v", want, asks)
+	}
+}
+
+func TestOrderBook_LimitRestsRemainder(t *testing.T) {
+	b := NewOrderBook("BTC", "USD")
+	submit(t, b, limit("a1", domain.SideSell, 100, 1))
+
+	// Only the part within the limit fills; the rest rests as a bid.
+	fills := submit(t, b, limit("t1", domain.SideBuy, 100, 3))
+	if len(fills) != 1 || fills[0].Amount != 1 {
+		t.Fatalf("expected one fill of 1, got %+v", fills)
+	}
+	bids, asks := b.Depth(0)
+	if len(asks) != 0 || len(bids) != 1 || bids[0] != (domain.PriceLevel{Price: 100, Amount: 2, Orders: 1}) {
+		t.Errorf("expected the remainder to rest, got bids %+v asks %+v", bids, asks)
+	}
+
+	// A sell below the best bid fills at the bid's price.
+	fills = submit(t, b, limit("t2", domain.SideSell, 95, 0.5))
+	if want := (Fill{TakerID: "t2", MakerID: "t1", Side: domain.SideSell, Price: 100, Amount: 0.5}); len(fills) != 1 || fills[0] != want {
+		t.Errorf("expected %+v, got %+v", want, fills)
+	}
+}
+
+func TestOrderBook_MarketDropsRemainder(t *testing.T) {
+	b := NewOrderBook("BTC", "USD")
+	submit(t, b,
+		limit("b1", domain.SideBuy, 100, 1),
+		limit("b2", domain.SideBuy, 90, 1),
+	)
+
+	fills := submit(t, b, market("m1", domain.SideSell, 5))
+	if len(fills) != 2 || fills[0].Price != 100 || fills[1].Price != 90 {
+		t.Errorf("expected the market order to sweep both bids, got %+v", fills)
+	}
+	if bids, asks := b.Depth(0); len(bids) != 0 || len(asks) != 0 {
+		t.Errorf("expected an empty book, got bids %+v asks %+v", bids, asks)
+	}
+	if fills := submit(t, b, market("m2", domain.SideBuy, 1)); len(fills) != 0 {
+		t.Errorf("expected no fills against an empty book, got %+v", fills)
+	}
+}
+
+func TestOrderBook_Cancel(t *testing.T) {
+	b := NewOrderBook("BTC", "USD")
+	submit(t, b,
+		limit("a1", domain.SideSell, 100, 1),
+		limit("a2", domain.SideSell, 100, 1),
+		cancel("a1"),
+		cancel("a1"),
+		cancel("unknown"),
+	)
+
+	fills := submit(t, b, market("m1", domain.SideBuy, 2))
+	if len(fills) != 1 || fills[0].MakerID != "a2" {
+		t.Errorf("expected only a2 to be left, got %+v", fills)
+	}
+
+	// A filled order can no longer be cancelled, nor does it block its ID.
+	submit(t, b, cancel("a2"), limit("a2", domain.SideSell, 105, 1))
+	if _, asks := b.Depth(1); len(asks) != 1 || asks[0].Price != 105 {
+		t.Errorf("expected a2 to rest again at 105, got %+v", asks)
+	}
+}
+
+func TestOrderBook_RejectsOrders(t *testing.T) {
+	b := NewOrderBook("BTC", "USD")
+	submit(t, b, limit("a1", domain.SideSell, 100, 1))
+
+	if _, err := b.Submit(limit("a1", domain.SideSell, 101, 1)); !errors.Is(err, domain.ErrDuplicateOrder) {
+		t.Errorf("expected ErrDuplicateOrder, got %v", err)
+	}
+	other := limit("e1", domain.SideBuy, 100, 1)
+	other.Symbol = "ETH"
+	if _, err := b.Submit(other); !errors.Is(err, domain.ErrInvalidOrder) {
+		t.Errorf("expected an order of another pair to be rejected, got %v", err)
+	}
+	if _, err := b.Submit(market("m1", domain.SideBuy, 0)); !errors.Is(err, domain.ErrInvalidOrder) {
+		t.Errorf("expected ErrInvalidOrder, got %v", err)
+	}
+	if _, asks := b.Depth(0); len(asks) != 1 || asks[0].Amount != 1 {
+		t.Errorf("expected rejected orders to leave the book alone, got %+v", asks)
+	}
+}
@@ -0,0 +1,136 @@
+package usecase
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// defaultRecentTrades is how many trades a PriceBook keeps unless
+// WithRecentTrades is given.
+const defaultRecentTrades = 1000
+
+// PriceBook keeps the last price of every symbol and target currency and
+// the most recent trades, for serving queries from memory. It is safe for
+// concurrent use.
+//
+// The last price is that of the trade with the latest timestamp, so a
+// trade arriving out of order does not overwrite a newer price. Recent
+// trades are kept in arrival order in a ring buffer.
+type PriceBook struct {
+	mu     sync.RWMutex
+	prices map[pairKey]domain.LastPrice
+	recent []domain.Trade // ring buffer
+	next   int            // index the next trade is written to
+	full   bool
+}
+
+var _ domain.MarketView = (*PriceBook)(nil)
+
+type pairKey struct {
+	symbol string
+	target string
+}
+
+func newPairKey(symbol, target string) pairKey {
+	return pairKey{strings.ToUpper(symbol), strings.ToUpper(target)}
+}
+
+// PriceBookOption configures a PriceBook.
+type PriceBookOption func(*PriceBook)
+
+// WithRecentTrades sets how many recent trades are kept.
+func WithRecentTrades(n int) PriceBookOption {
+	return func(b *PriceBook) {
+		if n > 0 {
+			b.recent = make([]domain.Trade, n)
+		}
+	}
+}
+
+// NewPriceBook creates an empty PriceBook.
+func NewPriceBook(opts ...PriceBookOption) *PriceBook {
+	b := &PriceBook{
+		prices: make(map[pairKey]domain.LastPrice),
+		recent: make([]domain.Trade, defaultRecentTrades),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// Observe records trade. It never fails, so it can be used as a handler.
+func (b *PriceBook) Observe(trade domain.Trade) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := newPairKey(trade.Symbol, trade.TargetCurrency)
+	if last, ok := b.prices[key]; !ok || !trade.Timestamp.Before(last.Timestamp) {
+		b.prices[key] = domain.LastPrice{
+			Symbol:         trade.Symbol,
+			TargetCurrency: trade.TargetCurrency,
+			Price:          trade.Price,
+			Amount:         trade.Amount,
+			Side:           trade.Side,
+			TradeID:        trade.ID,
+			Timestamp:      trade.Timestamp,
+		}
+	}
+
+	b.recent[b.next] = trade
+	b.next = (b.next + 1) % len(b.recent)
+	if b.next == 0 {
+		b.full = true
+	}
+	return nil
+}
+
+// Prices returns the last price of every pair, ordered by symbol and
+// target currency.
+func (b *PriceBook) Prices() []domain.LastPrice {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	prices := make([]domain.LastPrice, 0, len(b.prices))
+	for _, p := range b.prices {
+		prices = append(prices, p)
+	}
+	sort.Slice(prices, func(i, j int) bool {
+		if prices[i].Symbol != prices[j].Symbol {
+			return prices[i].Symbol < prices[j].Symbol
+		}
+		return prices[i].TargetCurrency < prices[j].TargetCurrency
+	})
+	return prices
+}
+
+// Price returns the last price of symbol in target, ignoring case.
+func (b *PriceBook) Price(symbol, target string) (domain.LastPrice, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	p, ok := b.prices[newPairKey(symbol, target)]
+	return p, ok
+}
+
+// Trades returns the kept trades of symbol (any if empty, ignoring case)
+// with a timestamp after since (any if zero), oldest arrival first.
+func (b *PriceBook) Trades(symbol string, since time.Time) []domain.Trade {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	start, n := 0, b.next
+	if b.full {
+		start, n = b.next, len(b.recent)
+	}
+	trades := []domain.Trade{}
+	for i := 0; i < n; i++ {
+		t := b.recent[(start+i)%len(b.recent)]
+		if (symbol == "" || strings.EqualFold(t.Symbol, symbol)) && (since.IsZero() || t.Timestamp.After(since)) {
+			trades = append(trades, t)
+		}
+	}
+	return trades
+}
@@ -0,0 +1,83 @@
+package usecase
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+func bookTrade(id, symbol, target string, sec int, price float64) domain.Trade {
+	return domain.Trade{
+		ID:             id,
+		Symbol:         symbol,
+		TargetCurrency: target,
+		Price:          price,
+		Amount:         1,
+		Timestamp:      time.Date(2024, 1, 1, 0, 0, sec, 0, time.UTC),
+	}
+}
+
+func TestPriceBook_KeepsLatestPricePerPair(t *testing.T) {
+	b := NewPriceBook()
+	for _, tr := range []domain.Trade{
+		bookTrade("1", "BTC", "USD", 1, 100),
+		bookTrade("2", "BTC", "JPY", 1, 15000),
+		bookTrade("3", "BTC", "USD", 3, 103),
+		bookTrade("4", "BTC", "USD", 2, 102), // late
+		bookTrade("5", "ETH", "USD", 2, 10),
+	} {
+		b.Observe(tr)
+	}
+
+	p, ok := b.Price("btc", "usd")
+	if !ok || p.Price != 103 || p.TradeID != "3" {
+		t.Errorf("expected BTC/USD at 103 from trade 3, got %+v (%v)", p, ok)
+	}
+	if _, ok := b.Price("SOL", "USD"); ok {
+		t.Error("expected no price for an unseen pair")
+	}
+
+	var pairs []string
+	for _, p := range b.Prices() {
+		pairs = append(pairs, fmt.Sprintf("%s/%s=%g", p.Symbol, p.TargetCurrency, p.Price))
+	}
+	if got := fmt.Sprint(pairs); got != "[BTC/JPY=15000 BTC/USD=103 ETH/USD=10]" {
+		t.Errorf("unexpected prices %s", got)
+	}
+}
+
+func TestPriceBook_RecentTradesRingBuffer(t *testing.T) {
+	b := NewPriceBook(WithRecentTrades(3))
+	ids := func(trades []domain.Trade) string {
+		s := []string{}
+		for _, t := range trades {
+			s = append(s, t.ID)
+		}
+		return fmt.Sprint(s)
+	}
+
+	b.Observe(bookTrade("1", "BTC", "USD", 1, 100))
+	b.Observe(bookTrade("2", "ETH", "USD", 2, 10))
+	if got := ids(b.Trades("", time.Time{})); got != "[1 2]" {
+		t.Errorf("expected [1 2] before the buffer fills, got %s", got)
+	}
+
+	b.Observe(bookTrade("3", "BTC", "USD", 3, 101))
+	b.Observe(bookTrade("4", "BTC", "JPY", 4, 15000))
+	for _, tc := range []struct {
+		symbol string
+		since  time.Time
+		want   string
+	}{
+		{"", time.Time{}, "[2 3 4]"},
+		{"btc", time.Time{}, "[3 4]"},
+		{"", time.Date(2024, 1, 1, 0, 0, 3, 0, time.UTC), "[4]"},
+		{"SOL", time.Time{}, "[]"},
+	} {
+		if got := ids(b.Trades(tc.symbol, tc.since)); got != tc.want {
+			t.Errorf("Trades(%q, %v): expected %s, got %s", tc.symbol, tc.since, tc.want, got)
+		}
+	}
+}
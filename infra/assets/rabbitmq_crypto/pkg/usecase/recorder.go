@@ -0,0 +1,98 @@
+package usecase
+
+import (
+	"context"
+	"sync"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// defaultMaxBatch is the most trades a TradeRecorder saves at once unless
+// WithMaxBatch is given.
+const defaultMaxBatch = 500
+
+// TradeRecorder saves observed trades to a TradeRepository in batches.
+//
+// Record returns only once its trade is stored, so a handler calling it
+// acknowledges nothing that could still be lost. Saves run one at a time:
+// the first trade is written immediately, and trades recorded while a save
+// is in progress are collected and written together by the next one. The
+// busier the handlers, the larger the batches, without delaying a lone
+// trade.
+type TradeRecorder struct {
+	repo     domain.TradeRepository
+	maxBatch int
+
+	mu      sync.Mutex
+	waiting []*recordBatch
+	saving  bool
+}
+
+type recordBatch struct {
+	trades []domain.Trade
+	done   chan struct{}
+	err    error
+}
+
+// RecorderOption configures a TradeRecorder.
+type RecorderOption func(*TradeRecorder)
+
+// WithMaxBatch limits how many trades are saved at once.
+func WithMaxBatch(n int) RecorderOption {
+	return func(r *TradeRecorder) {
+		if n > 0 {
+			r.maxBatch = n
+		}
+	}
+}
+
+// NewTradeRecorder creates a new TradeRecorder.
+func NewTradeRecorder(repo domain.TradeRepository, opts ...RecorderOption) *TradeRecorder {
+	r := &TradeRecorder{repo: repo, maxBatch: defaultMaxBatch}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Record stores trade and returns the error of the batch it was saved in.
+// Saving a trade twice is harmless, so a failed trade can be redelivered.
+func (r *TradeRecorder) Record(trade domain.Trade) error {
+	r.mu.Lock()
+	var b *recordBatch
+	if n := len(r.waiting); n > 0 && len(r.waiting[n-1].trades) < r.maxBatch {
+		b = r.waiting[n-1]
+	} else {
+		b = &recordBatch{done: make(chan struct{})}
+		r.waiting = append(r.waiting, b)
+	}
+	b.trades = append(b.trades, trade)
+	if !r.saving {
+		r.saving = true
+		go r.drain()
+	}
+	r.mu.Unlock()
+
+	<-b.done
+	return b.err
+}
+
+// drain saves the waiting batches in order until none are left.
+func (r *TradeRecorder) drain() {
+	for {
+		r.mu.Lock()
+		if len(r.waiting) == 0 {
+			r.saving = false
+			r.mu.Unlock()
+			return
+		}
+		b := r.waiting[0]
+		r.waiting = r.waiting[1:]
+		r.mu.Unlock()
+
+		// Not tied to the subscription's context, so that trades being
+		// drained at shutdown are still stored.
+		b.err = r.repo.Save(context.Background(), b.trades...)
+		close(b.done)
+	}
+}
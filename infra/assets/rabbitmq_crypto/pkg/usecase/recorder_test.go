@@ -0,0 +1,123 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// mockRepository records the batches it is asked to save. While gate is
+// non-nil, each save waits for a value from it.
+type mockRepository struct {
+	mu      sync.Mutex
+	batches [][]domain.Trade
+	gate    chan error
+	started chan struct{}
+}
+
+func (m *mockRepository) Save(ctx context.Context, trades ...domain.Trade) error {
+	m.mu.Lock()
+	m.batches = append(m.batches, trades)
+	m.mu.Unlock()
+	if m.gate == nil {
+		return nil
+	}
+	m.started <- struct{}{}
+	return <-m.gate
+}
+
+func (m *mockRepository) Find(ctx context.Context, q domain.TradeQuery) ([]domain.Trade, error) {
+	return nil, nil
+}
+
+func (m *mockRepository) sizes() []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sizes := make([]int, len(m.batches))
+	for i, b := range m.batches {
+		sizes[i] = len(b)
+	}
+	return sizes
+}
+
+func TestTradeRecorder_SavesAloneTradeImmediately(t *testing.T) {
+	repo := &mockRepository{}
+	r := NewTradeRecorder(repo)
+	if err := r.Record(domain.Trade{ID: "t1"}); err != nil {
+		t.Fatalf("failed to record: %v", err)
+	}
+	if got := fmt.Sprint(repo.sizes()); got != "[1]" {
+		t.Errorf("expected one batch of one trade, got %s", got)
+	}
+}
+
+func TestTradeRecorder_BatchesTradesRecordedDuringASave(t *testing.T) {
+	repo := &mockRepository{gate: make(chan error), started: make(chan struct{})}
+	r := NewTradeRecorder(repo, WithMaxBatch(3))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 6)
+	record := func(id string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- r.Record(domain.Trade{ID: id})
+		}()
+	}
+
+	// The first trade is saved on its own and holds up the others.
+	record("t0")
+	<-repo.started
+	for i := 1; i < 6; i++ {
+		record(fmt.Sprintf("t%d", i))
+	}
+	waitFor(t, func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		n := 0
+		for _, b := range r.waiting {
+			n += len(b.trades)
+		}
+		return n == 5
+	})
+
+	failed := errors.New("disk full")
+	repo.gate <- nil
+	<-repo.started
+	repo.gate <- failed
+	<-repo.started
+	repo.gate <- nil
+	wg.Wait()
+	close(errs)
+
+	if got := fmt.Sprint(repo.sizes()); got != "[1 3 2]" {
+		t.Errorf("expected batches of [1 3 2], got %s", got)
+	}
+	var nFailed int
+	for err := range errs {
+		if errors.Is(err, failed) {
+			nFailed++
+		} else if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if nFailed != 3 {
+		t.Errorf("expected the 3 trades of the failed batch to get its error, got %d", nFailed)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,83 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+// Replayer publishes recorded trades again, keeping their IDs and
+// timestamps and, unless it runs at maximum speed, the gaps between them.
+type Replayer struct {
+	src   domain.TradeReader
+	pub   domain.TradePublisher
+	speed float64
+	clock Clock
+}
+
+// ReplayOption configures a Replayer.
+type ReplayOption func(*Replayer)
+
+// WithSpeed sets the replay speed relative to the original run: 1 replays
+// in real time, 10 ten times faster, and 0 publishes without waiting.
+func WithSpeed(speed float64) ReplayOption {
+	return func(r *Replayer) {
+		r.speed = speed
+	}
+}
+
+// WithReplayClock sets the clock used to wait between trades. Defaults to
+// SystemClock.
+func WithReplayClock(c Clock) ReplayOption {
+	return func(r *Replayer) {
+		r.clock = c
+	}
+}
+
+// NewReplayer creates a Replayer that reads trades from src and publishes
+// them to pub at the original speed.
+func NewReplayer(src domain.TradeReader, pub domain.TradePublisher, opts ...ReplayOption) *Replayer {
+	r := &Replayer{src: src, pub: pub, speed: 1, clock: SystemClock}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Run replays trades until the recording ends, ctx is done or publishing
+// fails, and returns the number of trades published.
+func (r *Replayer) Run(ctx context.Context) (int, error) {
+	var n int
+	var prev time.Time
+	for {
+		trade, err := r.src.Read()
+		if errors.Is(err, io.EOF) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+
+		if r.speed > 0 && !prev.IsZero() {
+			if gap := trade.Timestamp.Sub(prev); gap > 0 {
+				select {
+				case <-ctx.Done():
+					return n, ctx.Err()
+				case <-r.clock.After(time.Duration(float64(gap) / r.speed)):
+				}
+			}
+		}
+		prev = trade.Timestamp
+
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		if err := r.pub.Publish(ctx, trade); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
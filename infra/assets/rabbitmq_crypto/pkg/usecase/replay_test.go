@@ -0,0 +1,87 @@
+package usecase
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
+)
+
+type sliceReader struct {
+	trades []domain.Trade
+}
+
+func (s *sliceReader) Read() (domain.Trade, error) {
+	if len(s.trades) == 0 {
+		return domain.Trade{}, io.EOF
+	}
+	trade := s.trades[0]
+	s.trades = s.trades[1:]
+	return trade, nil
+}
+
+func recording() []domain.Trade {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	return []domain.Trade{
+		{ID: "a", Timestamp: start},
+		{ID: "b", Timestamp: start.Add(2 * time.Second)},
+		{ID: "c", Timestamp: start.Add(2 * time.Second)},
+		{ID: "d", Timestamp: start.Add(3 * time.Second)},
+	}
+}
+
+func TestReplayer_Speeds(t *testing.T) {
+	cases := map[string]struct {
+		speed float64
+		waits []time.Duration
+	}{
+		"original":    {speed: 1, waits: []time.Duration{2 * time.Second, time.Second}},
+		"accelerated": {speed: 4, waits: []time.Duration{500 * time.Millisecond, 250 * time.Millisecond}},
+		"max":         {speed: 0, waits: nil},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			clock := &stepClock{now: time.Unix(0, 0)}
+			pub := &mockPublisher{}
+			r := NewReplayer(&sliceReader{trades: recording()}, pub, WithSpeed(tc.speed), WithReplayClock(clock))
+
+			n, err := r.Run(context.Background())
+			if err != nil {
+				t.Fatalf("replay failed: %v", err)
+			}
+			if n != 4 || len(pub.trades) != 4 {
+				t.Fatalf("expected 4 trades, got %d (%d published)", n, len(pub.trades))
+			}
+			for i, want := range recording() {
+				if pub.trades[i] != want {
+					t.Errorf("expected trade %+v unchanged, got %+v", want, pub.trades[i])
+				}
+			}
+			if len(clock.waits) != len(tc.waits) {
+				t.Fatalf("expected waits %v, got %v", tc.waits, clock.waits)
+			}
+			for i := range tc.waits {
+				if clock.waits[i] != tc.waits[i] {
+					t.Fatalf("expected waits %v, got %v", tc.waits, clock.waits)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayer_StopsOnCancel(t *testing.T) {
+	pub := &mockPublisher{}
+	r := NewReplayer(&sliceReader{trades: recording()}, pub)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	n, err := r.Run(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected only the first trade before the 2s gap, got %d", n)
+	}
+}
@@ -2,6 +2,8 @@ package usecase
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"math/rand"
 	"time"
 
@@ -9,43 +11,228 @@ import (
 	"github.com/sokoide/workshop/infra/assets/rabbitmq_crypto/pkg/domain"
 )
 
-// MarketSimulator generates random crypto trade events.
+// drainTimeout bounds how long Run waits for outstanding delivery reports
+// after the simulation stops.
+const drainTimeout = 5 * time.Second
+
+// DeliveryReport is called with the delivery outcome of every published
+// trade; err is nil once the broker confirmed it.
+type DeliveryReport func(trade domain.Trade, err error)
+
+// IDGenerator returns a new unique trade ID.
+type IDGenerator func() string
+
+// MarketSimulator generates crypto trade events from a MarketModel.
 type MarketSimulator struct {
-	pub domain.TradePublisher
+	pub      domain.TradePublisher
+	report   DeliveryReport
+	model    MarketModel
+	poisson  bool
+	rng      *rand.Rand
+	seeded   bool
+	clock    Clock
+	ids      IDGenerator
+	recorder domain.TradePublisher
+	metrics  domain.TradeMetrics
+}
+
+// SimulatorOption configures a MarketSimulator.
+type SimulatorOption func(*MarketSimulator)
+
+// WithDeliveryReport registers fn to receive the delivery outcome of each
+// trade. If the publisher supports asynchronous confirms, fn is called from
+// a separate goroutine in publish order.
+func WithDeliveryReport(fn DeliveryReport) SimulatorOption {
+	return func(s *MarketSimulator) {
+		s.report = fn
+	}
+}
+
+// WithMarketModel sets the model trades are drawn from. Defaults to a
+// GBMMarket with the default assets and currencies.
+func WithMarketModel(m MarketModel) SimulatorOption {
+	return func(s *MarketSimulator) {
+		s.model = m
+	}
+}
+
+// WithPoissonArrivals makes trades arrive as a Poisson process, so the
+// interval passed to Run is the mean time between trades rather than a
+// fixed period.
+func WithPoissonArrivals() SimulatorOption {
+	return func(s *MarketSimulator) {
+		s.poisson = true
+	}
+}
+
+// WithSeed makes the simulation reproducible: with the same seed, clock and
+// market model, a run generates the same trades, including their IDs unless
+// WithIDGenerator is given.
+func WithSeed(seed int64) SimulatorOption {
+	return func(s *MarketSimulator) {
+		s.rng = rand.New(rand.NewSource(seed))
+		s.seeded = true
+	}
+}
+
+// WithClock sets the clock used for trade timestamps and arrival times.
+// Defaults to SystemClock.
+func WithClock(c Clock) SimulatorOption {
+	return func(s *MarketSimulator) {
+		s.clock = c
+	}
+}
+
+// WithIDGenerator sets how trade IDs are generated. Defaults to random
+// UUIDs, drawn from the seeded source if WithSeed is given.
+func WithIDGenerator(ids IDGenerator) SimulatorOption {
+	return func(s *MarketSimulator) {
+		s.ids = ids
+	}
+}
+
+// WithRecorder writes every generated trade to rec before it is published,
+// e.g. to record a run for later replay.
+func WithRecorder(rec domain.TradePublisher) SimulatorOption {
+	return func(s *MarketSimulator) {
+		s.recorder = rec
+	}
+}
+
+// WithMetrics records the delivery outcome of every trade in m.
+func WithMetrics(m domain.TradeMetrics) SimulatorOption {
+	return func(s *MarketSimulator) {
+		s.metrics = m
+	}
 }
 
 // NewMarketSimulator creates a new MarketSimulator.
-func NewMarketSimulator(pub domain.TradePublisher) *MarketSimulator {
-	return &MarketSimulator{pub: pub}
+func NewMarketSimulator(pub domain.TradePublisher, opts ...SimulatorOption) *MarketSimulator {
+	s := &MarketSimulator{
+		pub:   pub,
+		model: NewGBMMarket(nil, nil),
+		rng:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		clock: SystemClock,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.ids == nil {
+		s.ids = uuid.NewString
+		if s.seeded {
+			s.ids = func() string {
+				return uuid.Must(uuid.NewRandomFromReader(s.rng)).String()
+			}
+		}
+	}
+	return s
 }
 
-var (
-	symbols = []string{"BTC", "ETH", "SOL", "ADA"}
-	targets = []string{"USD", "JPY", "EUR"}
-)
+type pendingTrade struct {
+	trade   domain.Trade
+	receipt domain.PublishReceipt
+}
 
-// Run starts the simulation loop.
+// Run starts the simulation loop. Trades the broker rejects or cannot route
+// are reported but do not stop the simulation; any other publish error does.
 func (s *MarketSimulator) Run(ctx context.Context, interval time.Duration) error {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+	last := s.clock.Now()
+	next := s.clock.After(s.wait(interval))
+
+	// With an asynchronous publisher, outcomes are collected in the
+	// background so that waiting for confirms does not slow down the ticks.
+	var pending chan pendingTrade
+	async, _ := s.pub.(domain.AsyncTradePublisher)
+	if async != nil && (s.report != nil || s.metrics != nil) {
+		pending = make(chan pendingTrade, 1024)
+		drained := make(chan struct{})
+		waitCtx, cancelWait := context.WithCancel(context.Background())
+		go s.awaitReceipts(waitCtx, pending, drained)
+		defer func() {
+			close(pending)
+			timer := time.AfterFunc(drainTimeout, cancelWait)
+			<-drained
+			timer.Stop()
+			cancelWait()
+		}()
+	} else {
+		async = nil
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case <-ticker.C:
-			trade := domain.Trade{
-				ID:             uuid.New().String(),
-				Symbol:         symbols[rand.Intn(len(symbols))],
-				TargetCurrency: targets[rand.Intn(len(targets))],
-				Price:          rand.Float64()*50000 + 10,
-				Amount:         rand.Float64() * 5,
-				Timestamp:      time.Now(),
+		case <-next:
+			now := s.clock.Now()
+			next = s.clock.After(s.wait(interval))
+			trade := s.model.Next(s.rng, now.Sub(last))
+			last = now
+			trade.ID = s.ids()
+			trade.Timestamp = now
+
+			if s.recorder != nil {
+				if err := s.recorder.Publish(ctx, trade); err != nil {
+					return fmt.Errorf("could not record trade: %w", err)
+				}
 			}
 
-			if err := s.pub.Publish(ctx, trade); err != nil {
-				return err
+			if async == nil {
+				if err := s.deliver(trade, s.pub.Publish(ctx, trade)); err != nil {
+					return err
+				}
+				continue
+			}
+
+			receipt, err := async.PublishAsync(ctx, trade)
+			if err != nil {
+				if err := s.deliver(trade, err); err != nil {
+					return err
+				}
+				continue
+			}
+			select {
+			case pending <- pendingTrade{trade: trade, receipt: receipt}:
+			case <-ctx.Done():
+				return ctx.Err()
 			}
 		}
 	}
 }
+
+// wait returns the delay until the next trade.
+func (s *MarketSimulator) wait(interval time.Duration) time.Duration {
+	if s.poisson {
+		return poissonWait(s.rng, interval)
+	}
+	return interval
+}
+
+// deliver reports the outcome of a trade and returns err if it should stop
+// the simulation.
+func (s *MarketSimulator) deliver(trade domain.Trade, err error) error {
+	s.settle(trade, err)
+	if errors.Is(err, domain.ErrTradeUnroutable) || errors.Is(err, domain.ErrTradeNotConfirmed) {
+		return nil
+	}
+	return err
+}
+
+// awaitReceipts reports asynchronous outcomes in publish order until
+// pending is closed and drained.
+func (s *MarketSimulator) awaitReceipts(ctx context.Context, pending <-chan pendingTrade, drained chan<- struct{}) {
+	defer close(drained)
+	for p := range pending {
+		s.settle(p.trade, p.receipt.Wait(ctx))
+	}
+}
+
+// settle reports the delivery outcome of a trade.
+func (s *MarketSimulator) settle(trade domain.Trade, err error) {
+	if s.metrics != nil {
+		s.metrics.Published(trade, err)
+	}
+	if s.report != nil {
+		s.report(trade, err)
+	}
+}
@@ -2,6 +2,9 @@ package usecase
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -33,8 +36,221 @@ func TestMarketSimulator_Run(t *testing.T) {
 	}
 
 	for _, tr := range mock.trades {
-		if tr.ID == "" || tr.Symbol == "" || tr.TargetCurrency == "" {
+		if tr.ID == "" || tr.Symbol == "" || tr.TargetCurrency == "" || tr.Side == "" {
 			t.Errorf("invalid trade generated: %+v", tr)
 		}
 	}
 }
+
+// stepClock is a Clock whose waits return immediately after advancing it.
+type stepClock struct {
+	now   time.Time
+	waits []time.Duration
+}
+
+func (c *stepClock) Now() time.Time { return c.now }
+
+func (c *stepClock) After(d time.Duration) <-chan time.Time {
+	c.waits = append(c.waits, d)
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+// stopAfter keeps the first n trades and then cancels the run. The run may
+// still publish a few more before it notices.
+type stopAfter struct {
+	n      int
+	cancel context.CancelFunc
+	trades []domain.Trade
+}
+
+func (s *stopAfter) Publish(ctx context.Context, trade domain.Trade) error {
+	if len(s.trades) == s.n {
+		return nil
+	}
+	s.trades = append(s.trades, trade)
+	if len(s.trades) == s.n {
+		s.cancel()
+	}
+	return nil
+}
+
+func TestMarketSimulator_SeedIsReproducible(t *testing.T) {
+	run := func(seed int64) []domain.Trade {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		pub := &stopAfter{n: 50, cancel: cancel}
+		clock := &stepClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+		sim := NewMarketSimulator(pub, WithSeed(seed), WithClock(clock), WithPoissonArrivals())
+		_ = sim.Run(ctx, time.Second)
+		return pub.trades
+	}
+
+	first, second, other := run(42), run(42), run(43)
+	if len(first) != 50 || len(second) != 50 {
+		t.Fatalf("expected 50 trades per run, got %d and %d", len(first), len(second))
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("trade %d differs between runs with the same seed: %+v vs %+v", i, first[i], second[i])
+		}
+	}
+	if first[0] == other[0] {
+		t.Error("expected a different seed to produce different trades")
+	}
+}
+
+func TestMarketSimulator_IDGeneratorAndRecorder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pub := &stopAfter{n: 3, cancel: cancel}
+	rec := &mockPublisher{}
+	var next int
+	sim := NewMarketSimulator(pub,
+		WithClock(&stepClock{now: time.Unix(0, 0)}),
+		WithIDGenerator(func() string { next++; return fmt.Sprintf("trade-%d", next) }),
+		WithRecorder(rec))
+	_ = sim.Run(ctx, time.Second)
+
+	if len(rec.trades) < len(pub.trades) {
+		t.Fatalf("expected %d recorded trades, got %d", len(pub.trades), len(rec.trades))
+	}
+	for i, trade := range pub.trades {
+		if want := fmt.Sprintf("trade-%d", i+1); trade.ID != want {
+			t.Errorf("expected ID %s, got %s", want, trade.ID)
+		}
+		if want := time.Unix(int64(i+1), 0); !trade.Timestamp.Equal(want) {
+			t.Errorf("expected timestamp %v from the clock, got %v", want, trade.Timestamp)
+		}
+		if rec.trades[i] != trade {
+			t.Errorf("recorded %+v, published %+v", rec.trades[i], trade)
+		}
+	}
+}
+
+type failingPublisher struct {
+	err error
+}
+
+func (f *failingPublisher) Publish(ctx context.Context, trade domain.Trade) error {
+	return f.err
+}
+
+type receipt struct {
+	err error
+}
+
+func (r receipt) Wait(ctx context.Context) error {
+	return r.err
+}
+
+type asyncPublisher struct {
+	mu     sync.Mutex
+	trades []domain.Trade
+}
+
+func (a *asyncPublisher) Publish(ctx context.Context, trade domain.Trade) error {
+	return errors.New("sync publish not expected")
+}
+
+func (a *asyncPublisher) PublishAsync(ctx context.Context, trade domain.Trade) (domain.PublishReceipt, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.trades = append(a.trades, trade)
+	if len(a.trades)%2 == 0 {
+		return receipt{err: domain.ErrTradeUnroutable}, nil
+	}
+	return receipt{}, nil
+}
+
+func TestMarketSimulator_ReportsUnroutableAndContinues(t *testing.T) {
+	pub := &failingPublisher{err: domain.ErrTradeUnroutable}
+	var reported []error
+	sim := NewMarketSimulator(pub, WithDeliveryReport(func(trade domain.Trade, err error) {
+		reported = append(reported, err)
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err := sim.Run(ctx, 20*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected run to continue until the deadline, got %v", err)
+	}
+	if len(reported) < 2 {
+		t.Fatalf("expected several reports, got %d", len(reported))
+	}
+	for _, e := range reported {
+		if !errors.Is(e, domain.ErrTradeUnroutable) {
+			t.Errorf("expected ErrTradeUnroutable, got %v", e)
+		}
+	}
+}
+
+func TestMarketSimulator_StopsOnPublishError(t *testing.T) {
+	boom := errors.New("boom")
+	sim := NewMarketSimulator(&failingPublisher{err: boom})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := sim.Run(ctx, 10*time.Millisecond); !errors.Is(err, boom) {
+		t.Fatalf("expected boom, got %v", err)
+	}
+}
+
+func TestMarketSimulator_ReportsAsyncOutcomes(t *testing.T) {
+	pub := &asyncPublisher{}
+	var mu sync.Mutex
+	outcomes := make(map[string]error)
+	sim := NewMarketSimulator(pub, WithDeliveryReport(func(trade domain.Trade, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		outcomes[trade.ID] = err
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_ = sim.Run(ctx, 20*time.Millisecond)
+
+	// Run drains every outstanding receipt before returning.
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(outcomes) != len(pub.trades) {
+		t.Fatalf("expected %d outcomes, got %d", len(pub.trades), len(outcomes))
+	}
+	for i, tr := range pub.trades {
+		err := outcomes[tr.ID]
+		if (i%2 == 1) != errors.Is(err, domain.ErrTradeUnroutable) {
+			t.Errorf("unexpected outcome for trade %d: %v", i, err)
+		}
+	}
+}
+
+func TestMarketSimulator_RecordsMetrics(t *testing.T) {
+	pub := &asyncPublisher{}
+	m := &recordingMetrics{}
+	sim := NewMarketSimulator(pub, WithMetrics(m))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_ = sim.Run(ctx, 20*time.Millisecond)
+
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.published) != len(pub.trades) {
+		t.Fatalf("expected %d outcomes, got %d", len(pub.trades), len(m.published))
+	}
+	for i, tr := range pub.trades {
+		if err := m.published[tr.ID]; (i%2 == 1) != errors.Is(err, domain.ErrTradeUnroutable) {
+			t.Errorf("unexpected outcome for trade %d: %v", i, err)
+		}
+	}
+}